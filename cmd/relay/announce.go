@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/pkg/relayclient"
+)
+
+// runAnnounce prints the DNS SRV record that lets bots discover this relay with
+// relayclient.Discover. It returns the process exit code.
+func runAnnounce(args []string) int {
+	fs := flag.NewFlagSet("announce", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON")
+	domain := fs.String("domain", "", "Domain bots look up (default: the relay_host domain)")
+	ttl := fs.Int("ttl", 3600, "Record TTL in seconds")
+	priority := fs.Int("priority", 10, "SRV priority (lower is preferred)")
+	weight := fs.Int("weight", 10, "SRV weight among records of the same priority")
+	fs.Parse(args)
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "announce: load config: %v\n", err)
+		return 1
+	}
+	if cfg.RelayHost == "" || net.ParseIP(cfg.RelayHost) != nil {
+		fmt.Fprintln(os.Stderr, "announce: relay_host must be a DNS name (SRV targets cannot be IP addresses)")
+		return 1
+	}
+	_, port, err := net.SplitHostPort(cfg.TURNListen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "announce: turn_listen: %v\n", err)
+		return 1
+	}
+	if *domain == "" {
+		*domain = cfg.RelayHost
+		if i := strings.IndexByte(cfg.RelayHost, '.'); i >= 0 && strings.Contains(cfg.RelayHost[i+1:], ".") {
+			*domain = cfg.RelayHost[i+1:]
+		}
+	}
+	fmt.Printf("; Publish in the %s zone so bots can find this relay with relayclient.Discover(%q):\n", *domain, *domain)
+	fmt.Printf("_%s._%s.%s. %d IN SRV %d %d %s %s.\n",
+		relayclient.SRVService, relayclient.SRVProto, strings.TrimSuffix(*domain, "."), *ttl, *priority, *weight, port, strings.TrimSuffix(cfg.RelayHost, "."))
+	return 0
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/keystore"
+)
+
+const certUsage = `usage: relay cert new [-config path] [-host name,...] [-days 365] [-csr] [-cert path] [-key path] [-force]
+       relay cert fingerprint [-config path] [-addr host:port] [cert.pem]`
+
+// runCert handles "relay cert new" and "relay cert fingerprint". It returns the process
+// exit code.
+func runCert(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, certUsage)
+		return 2
+	}
+	switch args[0] {
+	case "new":
+		return runCertNew(args[1:])
+	case "fingerprint":
+		return runCertFingerprint(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, certUsage)
+		return 2
+	}
+}
+
+// runCertNew writes an ECDSA P-256 key and either a self-signed certificate or a CSR for
+// the relay's names, by default to tls_cert_file and tls_key_file from the config.
+func runCertNew(args []string) int {
+	fs := flag.NewFlagSet("cert new", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON (for relay_host, dcc_sni_domain and file paths)")
+	hosts := fs.String("host", "", "Comma-separated DNS names or IPs; default relay_host plus *.dcc_sni_domain")
+	days := fs.Int("days", 365, "Validity of the self-signed certificate in days")
+	csr := fs.Bool("csr", false, "Write a certificate signing request to <cert>.csr instead of a self-signed certificate")
+	certFile := fs.String("cert", "", "Certificate output path; default tls_cert_file")
+	keyFile := fs.String("key", "", "Key output path; default tls_key_file")
+	force := fs.Bool("force", false, "Overwrite existing files")
+	fs.Parse(args)
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		if *hosts == "" || *certFile == "" || *keyFile == "" {
+			fmt.Fprintf(os.Stderr, "cert: load config: %v (pass -host, -cert and -key to run without one)\n", err)
+			return 1
+		}
+		cfg = &config.RelayConfig{}
+	}
+	if *certFile == "" {
+		*certFile = cfg.TLSCertFile
+	}
+	if *keyFile == "" {
+		*keyFile = cfg.TLSKeyFile
+	}
+	if *certFile == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "cert: no output paths: set tls_cert_file and tls_key_file or pass -cert and -key")
+		return 1
+	}
+	names := certNames(*hosts, cfg)
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "cert: no host names: set relay_host or pass -host")
+		return 1
+	}
+	out := *certFile
+	if *csr {
+		out += ".csr"
+	}
+	if !*force {
+		for _, p := range []string{out, *keyFile} {
+			if _, err := os.Stat(p); err == nil {
+				fmt.Fprintf(os.Stderr, "cert: %s exists (use -force to overwrite)\n", p)
+				return 1
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+		return 1
+	}
+	var dns []string
+	var ips []net.IP
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dns = append(dns, n)
+		}
+	}
+	subject := pkix.Name{CommonName: names[0]}
+	var block *pem.Block
+	if *csr {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject, DNSNames: dns, IPAddresses: ips}, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+			return 1
+		}
+		block = &pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}
+	} else {
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+			return 1
+		}
+		now := time.Now()
+		tmpl := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      subject,
+			DNSNames:     dns,
+			IPAddresses:  ips,
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.AddDate(0, 0, *days),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+			return 1
+		}
+		block = &pem.Block{Type: "CERTIFICATE", Bytes: der}
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+		return 1
+	}
+	for _, f := range []struct {
+		path string
+		data []byte
+		mode os.FileMode
+	}{
+		{*keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600},
+		{out, pem.EncodeToMemory(block), 0o644},
+	} {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(f.path, f.data, f.mode); err != nil {
+			fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Printf("key:  %s\n", *keyFile)
+	if *csr {
+		fmt.Printf("csr:  %s (names %s); have it signed and save the certificate as %s\n", out, strings.Join(names, ", "), *certFile)
+		return 0
+	}
+	fmt.Printf("cert: %s (names %s, valid until %s)\n", out, strings.Join(names, ", "), time.Now().AddDate(0, 0, *days).UTC().Format(time.DateOnly))
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		printFingerprints(cert)
+	}
+	return 0
+}
+
+// certNames returns the names for a new certificate: the -host list, or relay_host and
+// *.dcc_sni_domain from the config.
+func certNames(hosts string, cfg *config.RelayConfig) []string {
+	var names []string
+	if hosts != "" {
+		for _, h := range strings.Split(hosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				names = append(names, h)
+			}
+		}
+		return names
+	}
+	if cfg.RelayHost != "" {
+		names = append(names, cfg.RelayHost)
+	}
+	if cfg.DCCSNIDomain != "" {
+		names = append(names, "*."+cfg.DCCSNIDomain)
+	}
+	return names
+}
+
+// runCertFingerprint prints the fingerprints bots can pin: of the certificate file given,
+// of the one a running relay presents at -addr, or of tls_cert_file.
+func runCertFingerprint(args []string) int {
+	fs := flag.NewFlagSet("cert fingerprint", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON (for tls_cert_file)")
+	addr := fs.String("addr", "", "Fetch the certificate from a running relay at host:port instead of a file")
+	fs.Parse(args)
+
+	var cert *x509.Certificate
+	var err error
+	switch {
+	case *addr != "":
+		cert, err = fetchCert(*addr)
+	case fs.NArg() > 0:
+		cert, err = readCert(fs.Arg(0))
+	default:
+		cert, err = configCert(*confPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cert: %v\n", err)
+		return 1
+	}
+	fmt.Printf("subject:    %s\n", cert.Subject.CommonName)
+	fmt.Printf("expires:    %s\n", cert.NotAfter.UTC().Format(time.RFC3339))
+	printFingerprints(cert)
+	return 0
+}
+
+// printFingerprints prints the SHA-256 of the certificate (as openssl x509 -fingerprint
+// shows it) and the SHA-256 of its public key, which survives renewals with the same key.
+func printFingerprints(cert *x509.Certificate) {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	fmt.Printf("sha256:     %s\n", strings.Join(hex, ":"))
+	fmt.Printf("pin-sha256: %s\n", base64.StdEncoding.EncodeToString(spki[:]))
+}
+
+// configCert loads the relay's certificate as configured, decrypting a PKCS#12 bundle or
+// an encrypted key as the relay would.
+func configCert(confPath string) (*x509.Certificate, error) {
+	cfg, err := config.LoadRelayConfig(confPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLSCertFile == "" {
+		return nil, errors.New("tls_cert_file is not set in the config")
+	}
+	pass, err := keystore.Passphrase(cfg.TLSKeyPassEnv, cfg.TLSKeyPassFile, cfg.TLSKeyPassPrompt)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := keystore.LoadPair(cfg.TLSCertFile, cfg.TLSKeyFile, pass)
+	if err != nil {
+		return nil, err
+	}
+	return pair.Leaf, nil
+}
+
+// readCert reads the first certificate in a PEM file.
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return nil, fmt.Errorf("%s: no PEM certificate", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// fetchCert returns the leaf certificate presented at addr, without verifying it.
+func fetchCert(addr string) (*x509.Certificate, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/keystore"
+)
+
+const configUsage = `usage: relay config encrypt [-in path] [-out path] [-force]
+       relay config decrypt [-in path] [-out path] [-force]
+The key is read from ` + config.KeyEnv + `, ` + config.KeyFileEnv + ` or ` + config.KeyCommandEnv + `.`
+
+// runConfig handles "relay config encrypt" and "relay config decrypt". It returns the
+// process exit code.
+func runConfig(args []string) int {
+	if len(args) == 0 || (args[0] != "encrypt" && args[0] != "decrypt") {
+		fmt.Fprintln(os.Stderr, configUsage)
+		return 2
+	}
+	encrypt := args[0] == "encrypt"
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	in := fs.String("in", "config/relay.json", "Config file to read")
+	out := fs.String("out", "", "File to write; default <in>.enc when encrypting, stdout when decrypting")
+	force := fs.Bool("force", false, "Overwrite an existing output file")
+	fs.Parse(args[1:])
+
+	key, err := config.Key()
+	if err == nil && len(key) == 0 {
+		err = fmt.Errorf("no key: set %s, %s or %s", config.KeyEnv, config.KeyFileEnv, config.KeyCommandEnv)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	if encrypt {
+		if keystore.IsSealed(data) {
+			fmt.Fprintf(os.Stderr, "config: %s is already encrypted\n", *in)
+			return 1
+		}
+		// Refuse to lock away a config the relay could not load anyway.
+		var c config.RelayConfig
+		if err := json.Unmarshal(data, &c); err != nil {
+			fmt.Fprintf(os.Stderr, "config: %s: %v\n", *in, err)
+			return 1
+		}
+		data, err = keystore.Seal(data, key)
+		if *out == "" {
+			*out = *in + ".enc"
+		}
+	} else {
+		data, err = keystore.Open(data, key)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s: %v\n", *in, err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !*force {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(*out, flags, 0o600)
+	if err == nil {
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "config: wrote %s\n", *out)
+	return 0
+}
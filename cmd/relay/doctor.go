@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/keystore"
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// certExpiryWarn is how close to expiry the doctor starts warning about the certificate.
+const certExpiryWarn = 14 * 24 * time.Hour
+
+// doctor collects findings and prints them as they are made.
+type doctor struct {
+	failures int
+}
+
+func (d *doctor) ok(check, format string, args ...any) {
+	fmt.Printf("[ OK ] %s: %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(check, fix, format string, args ...any) {
+	fmt.Printf("[WARN] %s: %s\n", check, fmt.Sprintf(format, args...))
+	if fix != "" {
+		fmt.Printf("       -> %s\n", fix)
+	}
+}
+
+func (d *doctor) fail(check, fix, format string, args ...any) {
+	d.failures++
+	fmt.Printf("[FAIL] %s: %s\n", check, fmt.Sprintf(format, args...))
+	if fix != "" {
+		fmt.Printf("       -> %s\n", fix)
+	}
+}
+
+// runDoctor checks a relay configuration against the host it runs on: certificate,
+// listener and DCC port availability, the advertised address and, with -reflector, whether
+// the ports are reachable from outside. It returns the process exit code: 1 if any check
+// failed.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON")
+	method := fs.String("public-ip", "stun", "How to detect the public IP: stun or https")
+	reflector := fs.String("reflector", "", "URL of a reachability reflector: GET <url>?addr=host:port must answer 2xx if it can connect")
+	timeout := fs.Duration("timeout", 10*time.Second, "Deadline for each network check")
+	fs.Parse(args)
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: load config: %v\n", err)
+		return 1
+	}
+	d := &doctor{}
+	d.checkCert(cfg)
+	turnFree := d.checkListener(cfg)
+	if cfg.SinglePort {
+		d.ok("dcc ports", "single_port mode, users connect to turn_listen")
+	} else {
+		d.checkPortRange(cfg)
+	}
+	d.showFirewall(cfg)
+	publicIP := d.checkPublicAddr(cfg, *method, *timeout)
+	if *reflector == "" {
+		d.warn("reachability", "pass -reflector to test the ports from outside", "not tested")
+	} else if publicIP != nil {
+		d.checkReachable(cfg, *reflector, publicIP, turnFree, *timeout)
+	}
+	if d.failures > 0 {
+		fmt.Printf("\n%d check(s) failed\n", d.failures)
+		return 1
+	}
+	return 0
+}
+
+// loadCert loads the relay's certificate and key as the relay would. A PKCS#11 key is
+// also asked for a test signature.
+func (d *doctor) loadCert(cfg *config.RelayConfig) (tls.Certificate, bool) {
+	const check = "certificate"
+	if cfg.TLSPKCS11 != nil {
+		signer, err := openTLSToken(cfg)
+		if err != nil {
+			d.fail(check, "check tls_pkcs11 (module, token and key labels, PIN)", "%v", err)
+			return tls.Certificate{}, false
+		}
+		pair, err := keystore.LoadChain(cfg.TLSCertFile, signer)
+		if err != nil {
+			d.fail(check, "set tls_cert_file to the PEM chain of the token's key", "%v", err)
+			return tls.Certificate{}, false
+		}
+		digest := sha256.Sum256([]byte("huzaa-relay doctor"))
+		if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+			d.fail("pkcs11 key", "check the key's CKA_SIGN attribute and the token's mechanisms", "test signature: %v", err)
+			return tls.Certificate{}, false
+		}
+		d.ok("pkcs11 key", "test signature made with %s", cfg.TLSPKCS11.Module)
+		return pair, true
+	}
+	pass, err := keystore.Passphrase(cfg.TLSKeyPassEnv, cfg.TLSKeyPassFile, cfg.TLSKeyPassPrompt)
+	if err != nil {
+		d.fail(check, "check tls_key_passphrase_env / tls_key_passphrase_file", "passphrase: %v", err)
+		return tls.Certificate{}, false
+	}
+	pair, err := keystore.LoadPair(cfg.TLSCertFile, cfg.TLSKeyFile, pass)
+	if err != nil {
+		d.fail(check, "set tls_cert_file and tls_key_file to a matching PEM certificate and key, or tls_cert_file to a PKCS#12 bundle", "%v", err)
+		return tls.Certificate{}, false
+	}
+	return pair, true
+}
+
+// checkCert loads the certificate and verifies its validity period and chain.
+func (d *doctor) checkCert(cfg *config.RelayConfig) {
+	const check = "certificate"
+	pair, ok := d.loadCert(cfg)
+	if !ok {
+		return
+	}
+	leaf := pair.Leaf
+	now := time.Now()
+	switch left := leaf.NotAfter.Sub(now); {
+	case now.Before(leaf.NotBefore):
+		d.fail(check, "check the system clock", "not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	case left <= 0:
+		d.fail(check, "renew the certificate; the relay picks up the new files without a restart", "expired %s", leaf.NotAfter.Format(time.RFC3339))
+	case left < certExpiryWarn:
+		d.warn(check, "renew the certificate soon", "expires in %s (%s)", left.Round(time.Hour), leaf.NotAfter.Format(time.RFC3339))
+	default:
+		d.ok(check, "%s, valid until %s", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02"))
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+	verify := func(name string) error {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Intermediates: intermediates})
+		return err
+	}
+	if err := verify(cfg.RelayHost); err != nil {
+		d.warn("certificate chain", "bots must trust this certificate explicitly (relayclient Config.TLSConfig RootCAs); include intermediates in tls_cert_file if it is CA-issued", "not verifiable for %q: %v", cfg.RelayHost, err)
+	} else {
+		d.ok("certificate chain", "verifies for %q", cfg.RelayHost)
+	}
+	if cfg.DCCSNIDomain != "" {
+		if err := leaf.VerifyHostname("session." + cfg.DCCSNIDomain); err != nil {
+			d.fail("certificate SNI", "use a certificate with a *."+cfg.DCCSNIDomain+" name", "does not cover session names under %s", cfg.DCCSNIDomain)
+		} else {
+			d.ok("certificate SNI", "covers *.%s", cfg.DCCSNIDomain)
+		}
+	}
+}
+
+// showFirewall lists the inbound ports the relay needs and the rules that open them here.
+func (d *doctor) showFirewall(cfg *config.RelayConfig) {
+	ports := firewallPorts(cfg)
+	var need []string
+	for _, p := range ports {
+		need = append(need, p.String())
+	}
+	hints := firewallHints(runtime.GOOS, ports)
+	if len(hints) == 0 {
+		d.ok("firewall", "inbound TCP %s must be open", strings.Join(need, ", "))
+		return
+	}
+	d.ok("firewall", "inbound TCP %s must be open; rules for this host:", strings.Join(need, ", "))
+	for _, line := range hints {
+		fmt.Printf("       %s\n", line)
+	}
+	if firewallCommands(runtime.GOOS, ports) != nil {
+		fmt.Println("       (relay -configure-firewall applies them)")
+	}
+}
+
+// checkListener checks that turn_listen can be bound. It reports whether the port is free
+// (false if the relay is presumably already running on it).
+func (d *doctor) checkListener(cfg *config.RelayConfig) bool {
+	const check = "bot listener"
+	ln, err := net.Listen("tcp", cfg.TURNListen)
+	if err == nil {
+		ln.Close()
+		d.ok(check, "%s can be bound", cfg.TURNListen)
+		return true
+	}
+	if errors.Is(err, syscall.EADDRINUSE) {
+		d.warn(check, "fine if the relay is running; otherwise find the process holding the port", "%s is in use", cfg.TURNListen)
+		return false
+	}
+	fix := ""
+	if errors.Is(err, syscall.EACCES) {
+		fix = "ports below 1024 need root or CAP_NET_BIND_SERVICE"
+	}
+	d.fail(check, fix, "%v", err)
+	return false
+}
+
+// checkPortRange tries to bind every port of the DCC range and compares it with the OS
+// ephemeral port range.
+func (d *doctor) checkPortRange(cfg *config.RelayConfig) {
+	const check = "dcc ports"
+	lo, hi := cfg.DCCPortMin, cfg.DCCPortMax
+	if lo == 0 {
+		lo, hi = 50000, 50100
+	}
+	if lo <= 0 || hi > 65535 || lo > hi {
+		d.fail(check, "set dcc_port_min <= dcc_port_max within 1-65535", "invalid range %d-%d", lo, hi)
+		return
+	}
+	for _, l := range []struct{ name, addr string }{{"turn_listen", cfg.TURNListen}, {"dcc_sni_listen", cfg.DCCSNIListen}, {"metrics_listen", cfg.MetricsListen}, {"status_listen", cfg.StatusListen}, {"admin_listen", cfg.AdminListen}} {
+		_, p, err := net.SplitHostPort(l.addr)
+		if port, _ := strconv.Atoi(p); err == nil && port >= lo && port <= hi {
+			d.fail(check, "move "+l.name+" or the DCC range so they do not overlap", "%d-%d includes the %s port %d; the relay refuses to start", lo, hi, l.name, port)
+			return
+		}
+	}
+	var busy []string
+	for p := lo; p <= hi; p++ {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(p))
+		if err != nil {
+			busy = append(busy, strconv.Itoa(p))
+			continue
+		}
+		ln.Close()
+	}
+	total := hi - lo + 1
+	switch {
+	case len(busy) == total:
+		d.fail(check, "choose a free range or stop what holds it", "none of %d-%d can be bound", lo, hi)
+	case len(busy) > 0:
+		d.warn(check, "fine if the relay is running; otherwise these ports are unavailable to it", "%d of %d ports in use: %s", len(busy), total, abbreviate(busy, 10))
+	default:
+		d.ok(check, "all %d ports in %d-%d can be bound", total, lo, hi)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return
+	}
+	f := strings.Fields(string(data))
+	if len(f) != 2 {
+		return
+	}
+	elo, _ := strconv.Atoi(f[0])
+	ehi, _ := strconv.Atoi(f[1])
+	if lo <= ehi && elo <= hi {
+		d.warn("ephemeral ports", "move the DCC range outside the OS range, or reserve it in net.ipv4.ip_local_reserved_ports", "%d-%d overlaps the OS ephemeral range %d-%d; outgoing connections can take DCC ports", lo, hi, elo, ehi)
+	}
+}
+
+// checkPublicAddr detects the public IP and compares it with what relay_host advertises.
+func (d *doctor) checkPublicAddr(cfg *config.RelayConfig, method string, timeout time.Duration) net.IP {
+	const check = "public address"
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ip, err := turnrelay.DetectPublicIP(ctx, method, cfg.PublicIPSTUNServer, cfg.PublicIPEchoURL)
+	if err != nil {
+		d.warn(check, "try -public-ip https, or check outbound UDP to the STUN server", "cannot detect public IP: %v", err)
+		return nil
+	}
+	if cfg.RelayHost == "" {
+		if cfg.PublicIPDetect == "" {
+			d.fail(check, "set relay_host, or public_ip_detect to advertise the detected address", "relay_host is empty; users get no address to connect to")
+		} else {
+			d.ok(check, "%s (advertised via public_ip_detect)", ip)
+		}
+		return ip
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, cfg.RelayHost)
+	if err != nil {
+		d.fail(check, "publish a DNS record for relay_host (see ddns) or use an IP address", "relay_host %q does not resolve: %v", cfg.RelayHost, err)
+		return ip
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(ip) {
+			d.ok(check, "relay_host %s resolves to this host's public IP %s", cfg.RelayHost, ip)
+			return ip
+		}
+	}
+	d.warn(check, "point relay_host at the public IP (see ddns), or confirm the listed address forwards to this host", "relay_host %s resolves to %v, but this host is seen as %s", cfg.RelayHost, addrs, ip)
+	return ip
+}
+
+// checkReachable asks the reflector to connect to the bot listener and to one DCC port.
+// Ports nobody listens on are held open by the doctor for the duration of the test.
+func (d *doctor) checkReachable(cfg *config.RelayConfig, reflector string, ip net.IP, turnFree bool, timeout time.Duration) {
+	_, turnPort, _ := net.SplitHostPort(cfg.TURNListen)
+	targets := []struct{ name, port string }{{"bot listener reachability", turnPort}}
+	if !cfg.SinglePort {
+		if p := freeDCCPort(cfg); p != "" {
+			targets = append(targets, struct{ name, port string }{"dcc port reachability", p})
+		} else {
+			d.warn("dcc port reachability", "", "no free port in the DCC range to test with")
+		}
+	}
+	for i, t := range targets {
+		if i > 0 || turnFree {
+			ln, err := net.Listen("tcp", ":"+t.port)
+			if err != nil {
+				d.warn(t.name, "", "cannot listen on %s for the test: %v", t.port, err)
+				continue
+			}
+			go acceptAndClose(ln)
+			defer ln.Close()
+		}
+		addr := net.JoinHostPort(ip.String(), t.port)
+		if err := askReflector(reflector, addr, timeout); err != nil {
+			d.fail(t.name, "open TCP "+t.port+" in the firewall / security group and forward it if behind NAT", "%s: %v", addr, err)
+		} else {
+			d.ok(t.name, "%s is reachable from outside", addr)
+		}
+	}
+}
+
+// askReflector asks the reflector at base to open a TCP connection to addr.
+func askReflector(base, addr string, timeout time.Duration) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("addr", addr)
+	u.RawQuery = q.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("reflector says %s %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// freeDCCPort returns a port of the DCC range that can be bound, or "".
+func freeDCCPort(cfg *config.RelayConfig) string {
+	lo, hi := cfg.DCCPortMin, cfg.DCCPortMax
+	if lo == 0 {
+		lo, hi = 50000, 50100
+	}
+	for p := lo; p <= hi; p++ {
+		if ln, err := net.Listen("tcp", ":"+strconv.Itoa(p)); err == nil {
+			ln.Close()
+			return strconv.Itoa(p)
+		}
+	}
+	return ""
+}
+
+func acceptAndClose(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c.Close()
+	}
+}
+
+// abbreviate joins the first n items and says how many more there are.
+func abbreviate(items []string, n int) string {
+	if len(items) <= n {
+		return strings.Join(items, ", ")
+	}
+	return strings.Join(items[:n], ", ") + fmt.Sprintf(" and %d more", len(items)-n)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+)
+
+// firewallPort is an inbound TCP port, or range of ports, the relay needs open.
+type firewallPort struct {
+	name   string // what the port is for; also names the firewall rule
+	lo, hi int
+}
+
+func (p firewallPort) String() string {
+	if p.lo == p.hi {
+		return strconv.Itoa(p.lo)
+	}
+	return fmt.Sprintf("%d-%d", p.lo, p.hi)
+}
+
+// firewallPorts returns the ports users and bots connect to under cfg. The metrics and
+// admin listeners are left out: they are not meant to be reachable from outside.
+func firewallPorts(cfg *config.RelayConfig) []firewallPort {
+	var ports []firewallPort
+	add := func(name, addr string) {
+		if _, p, err := net.SplitHostPort(addr); err == nil {
+			if port, err := net.LookupPort("tcp", p); err == nil && port > 0 {
+				ports = append(ports, firewallPort{name, port, port})
+			}
+		}
+	}
+	add("bots", cfg.TURNListen)
+	if !cfg.SinglePort {
+		lo, hi := cfg.DCCPortMin, cfg.DCCPortMax
+		if lo == 0 {
+			lo, hi = 50000, 50100
+		}
+		ports = append(ports, firewallPort{"dcc", lo, hi})
+	}
+	add("dcc-sni", cfg.DCCSNIListen)
+	add("status", cfg.StatusListen)
+	return ports
+}
+
+// firewallCommands returns the commands that open ports on goos: ufw on Linux, netsh on
+// Windows. It returns nil where the relay cannot apply rules itself.
+func firewallCommands(goos string, ports []firewallPort) [][]string {
+	var cmds [][]string
+	for _, p := range ports {
+		name := "huzaa-relay " + p.name
+		switch goos {
+		case "linux":
+			cmds = append(cmds, []string{"ufw", "allow", strings.ReplaceAll(p.String(), "-", ":") + "/tcp", "comment", name})
+		case "windows":
+			cmds = append(cmds, []string{"netsh", "advfirewall", "firewall", "add", "rule", "name=" + name, "dir=in", "action=allow", "protocol=TCP", "localport=" + p.String()})
+		}
+	}
+	return cmds
+}
+
+// firewallHints returns the rules for goos as lines to show an operator: commands for
+// Linux and Windows, pf.conf rules for macOS and the BSDs.
+func firewallHints(goos string, ports []firewallPort) []string {
+	var lines []string
+	switch goos {
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		lines = append(lines, "# add to /etc/pf.conf, then run: pfctl -f /etc/pf.conf")
+		for _, p := range ports {
+			lines = append(lines, fmt.Sprintf("pass in proto tcp from any to any port %s # huzaa-relay %s", strings.ReplaceAll(p.String(), "-", ":"), p.name))
+		}
+	case "windows":
+		for _, argv := range firewallCommands(goos, ports) {
+			line := strings.Join(argv, " ")
+			for _, p := range ports {
+				// cmd.exe quoting for the rule name.
+				line = strings.Replace(line, "name=huzaa-relay "+p.name+" ", `name="huzaa-relay `+p.name+`" `, 1)
+			}
+			lines = append(lines, line)
+		}
+	default:
+		for _, argv := range firewallCommands(goos, ports) {
+			lines = append(lines, shellJoin(argv))
+		}
+	}
+	return lines
+}
+
+// shellJoin quotes argv for display in a shell.
+func shellJoin(argv []string) string {
+	out := make([]string, len(argv))
+	for i, a := range argv {
+		if strings.ContainsAny(a, " \t'\"") {
+			a = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		out[i] = a
+	}
+	return strings.Join(out, " ")
+}
+
+// logFirewallHints logs the inbound ports the relay needs and the rules that open them on
+// this platform.
+func logFirewallHints(cfg *config.RelayConfig) {
+	ports := firewallPorts(cfg)
+	var need []string
+	for _, p := range ports {
+		need = append(need, p.String()+" ("+p.name+")")
+	}
+	log.Printf("relay: firewall: inbound TCP needed on %s", strings.Join(need, ", "))
+	for _, line := range firewallHints(runtime.GOOS, ports) {
+		log.Printf("relay: firewall:   %s", line)
+	}
+}
+
+// configureFirewall applies the rules of firewallCommands for this platform. On Windows an
+// existing rule of the same name is replaced, so running it again does not pile up rules;
+// ufw skips rules it already has.
+func configureFirewall(cfg *config.RelayConfig) error {
+	cmds := firewallCommands(runtime.GOOS, firewallPorts(cfg))
+	if cmds == nil {
+		return fmt.Errorf("not supported on %s; add the rules logged above by hand", runtime.GOOS)
+	}
+	if _, err := exec.LookPath(cmds[0][0]); err != nil {
+		return fmt.Errorf("%s not found: %w", cmds[0][0], err)
+	}
+	for _, argv := range cmds {
+		if runtime.GOOS == "windows" {
+			// argv[5] is name=<rule name>.
+			exec.Command("netsh", "advfirewall", "firewall", "delete", "rule", argv[5]).Run()
+		}
+		if out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %v: %s", shellJoin(argv), err, strings.TrimSpace(string(out)))
+		}
+		log.Printf("relay: firewall: applied %s", shellJoin(argv))
+	}
+	return nil
+}
@@ -1,38 +1,256 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"log"
+	"net/netip"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/awgh/huzaa-relay/internal/buildinfo"
 	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/keystore"
+	"github.com/awgh/huzaa-relay/internal/logrotate"
 	"github.com/awgh/huzaa-relay/internal/turnrelay"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		case "announce":
+			os.Exit(runAnnounce(os.Args[2:]))
+		case "stats":
+			os.Exit(runStats(os.Args[2:]))
+		case "usage":
+			os.Exit(runUsage(os.Args[2:]))
+		case "doctor":
+			os.Exit(runDoctor(os.Args[2:]))
+		case "cert":
+			os.Exit(runCert(os.Args[2:]))
+		case "version":
+			os.Exit(runVersion())
+		case "soak":
+			os.Exit(runSoak(os.Args[2:]))
+		case "sessions":
+			os.Exit(runSessions(os.Args[2:]))
+		case "config":
+			os.Exit(runConfig(os.Args[2:]))
+		}
+	}
 	confPath := flag.String("config", "config/relay.json", "Path to relay config JSON")
+	configureFw := flag.Bool("configure-firewall", false, "Add firewall rules for the relay's ports before starting (ufw on Linux, netsh on Windows; needs root/administrator)")
+	shutdownGrace := flag.Duration("shutdown-grace", 30*time.Second, "On SIGINT/SIGTERM, how long transfers in progress may take to finish before they are cut off")
 	flag.Parse()
 
 	cfg, err := config.LoadRelayConfig(*confPath)
 	if err != nil {
 		log.Fatalf("load config: %v", err)
 	}
+	keyPass, err := keystore.Passphrase(cfg.TLSKeyPassEnv, cfg.TLSKeyPassFile, cfg.TLSKeyPassPrompt)
+	if err != nil {
+		log.Fatalf("tls key passphrase: %v", err)
+	}
+	signer, err := openTLSToken(cfg)
+	if err != nil {
+		log.Fatalf("tls_pkcs11: %v", err)
+	}
 
 	turnUsers := make([]turnrelay.TurnUserCred, 0, len(cfg.TurnUsers))
 	for _, u := range cfg.TurnUsers {
-		turnUsers = append(turnUsers, turnrelay.TurnUserCred{Username: u.Username, Secret: u.Secret})
+		turnUsers = append(turnUsers, turnrelay.TurnUserCred{
+			Username:            u.Username,
+			Secret:              u.Secret,
+			MaxLeaseSec:         u.MaxLeaseSec,
+			MaxRateBps:          u.MaxRateBps,
+			Schedules:           scheduleRules(u.Schedules),
+			ChainPeer:           u.ChainPeer,
+			MaxSessionsPerDay:   u.MaxSessionsPerDay,
+			MaxBytesPerDay:      u.MaxBytesPerDay,
+			MaxSessionsPerMonth: u.MaxSessionsPerMonth,
+			MaxBytesPerMonth:    u.MaxBytesPerMonth,
+		})
 	}
 	relayCfg := &turnrelay.RelayConfig{
-		TURNListen:  cfg.TURNListen,
-		TURNSecret:  cfg.TURNSecret,
-		TurnUsers:   turnUsers,
-		DCCPortMin:  cfg.DCCPortMin,
-		DCCPortMax:  cfg.DCCPortMax,
-		RelayHost:   cfg.RelayHost,
-		TLSCertFile: cfg.TLSCertFile,
-		TLSKeyFile:  cfg.TLSKeyFile,
-		MaxSessions: cfg.MaxSessions,
+		TURNListen:            cfg.TURNListen,
+		TURNSecret:            cfg.TURNSecret,
+		TurnUsers:             turnUsers,
+		DCCPortMin:            cfg.DCCPortMin,
+		DCCPortMax:            cfg.DCCPortMax,
+		RelayHost:             cfg.RelayHost,
+		TLSCertFile:           cfg.TLSCertFile,
+		TLSKeyFile:            cfg.TLSKeyFile,
+		TLSKeyPassphrase:      keyPass,
+		TLSSigner:             signer,
+		MaxSessions:           cfg.MaxSessions,
+		MaxBandwidthBps:       cfg.MaxBandwidthBps,
+		MaxFileSize:           cfg.MaxFileSize,
+		ReadOnly:              cfg.ReadOnly,
+		CrashDumpDir:          cfg.CrashDumpDir,
+		Debug:                 cfg.Debug,
+		DebugEvery:            cfg.DebugEvery,
+		DebugPerSec:           cfg.DebugPerSec,
+		IdempotencyWindowSec:  cfg.IdempotencyWindowSec,
+		ResumeWindowSec:       cfg.ResumeWindowSec,
+		InterruptedFile:       cfg.InterruptedFile,
+		DCCLeaseSec:           cfg.DCCLeaseSec,
+		MaxLeaseSec:           cfg.MaxLeaseSec,
+		MetricsListen:         cfg.MetricsListen,
+		StatusListen:          cfg.StatusListen,
+		AdminListen:           cfg.AdminListen,
+		SlowConsumerPolicy:    cfg.SlowConsumerPolicy,
+		SlowConsumerThreshold: cfg.SlowConsumerThreshold,
+		SlowConsumerGraceSec:  cfg.SlowConsumerGraceSec,
+		SessionIdleTimeoutSec: cfg.SessionIdleTimeoutSec,
+		SessionMaxDurationSec: cfg.SessionMaxDurationSec,
+		MaxFanout:             cfg.MaxFanout,
+		FanoutWaitSec:         cfg.FanoutWaitSec,
+		RelayHostTTLSec:       cfg.RelayHostTTLSec,
+		PublicIPDetect:        cfg.PublicIPDetect,
+		PublicIPSTUNServer:    cfg.PublicIPSTUNServer,
+		PublicIPEchoURL:       cfg.PublicIPEchoURL,
+		BotAcceptLimit:        cfg.BotAcceptLimit,
+		StatsFile:             cfg.StatsFile,
+		StatsRetentionDays:    cfg.StatsRetentionDays,
+		QuotaFile:             cfg.QuotaFile,
+		DCCSNIListen:          cfg.DCCSNIListen,
+		DCCSNIDomain:          cfg.DCCSNIDomain,
+		SinglePort:            cfg.SinglePort,
+		Banner:                cfg.Banner,
+		BannerFile:            cfg.BannerFile,
+		Schedules:             scheduleRules(cfg.Schedules),
+		StatsRedactPeer:       cfg.StatsRedactPeer,
+		PreflightStrict:       cfg.PreflightStrict,
+		UserKeepAliveSec:      cfg.UserKeepAliveSec,
+		UserTCPTimeoutSec:     cfg.UserTCPTimeoutSec,
+		UserWriteTimeoutSec:   cfg.UserWriteTimeoutSec,
+		BotKeepAliveSec:       cfg.BotKeepAliveSec,
+		RegRatePerConn:        cfg.RegRatePerConn,
+		RegRatePerUser:        cfg.RegRatePerUser,
+		RegBurst:              cfg.RegBurst,
+		IntegritySampleEvery:  cfg.IntegritySampleEvery,
+		PortCooldownSec:       cfg.PortCooldownSec,
+		MaxChainHops:          cfg.MaxChainHops,
+	}
+	for _, h := range cfg.PostHooks {
+		if len(h.Command) == 0 && h.URL == "" {
+			log.Fatalf("post_hooks: hook %q has neither command nor url", h.Name)
+		}
+		relayCfg.PostHooks = append(relayCfg.PostHooks, turnrelay.PostHook{
+			Name:       h.Name,
+			Command:    h.Command,
+			URL:        h.URL,
+			Kinds:      h.Kinds,
+			TimeoutSec: h.TimeoutSec,
+			Retries:    h.Retries,
+		})
+	}
+	for _, n := range cfg.Notifiers {
+		if n.URL == "" {
+			log.Fatalf("notifiers: notifier %q has no url", n.Name)
+		}
+		if n.Format != "" && n.Format != turnrelay.NotifyJSON && n.Format != turnrelay.NotifyText {
+			log.Fatalf("notifiers: notifier %q: unknown format %q", n.Name, n.Format)
+		}
+		relayCfg.Notifiers = append(relayCfg.Notifiers, turnrelay.Notifier{
+			Name:       n.Name,
+			URL:        n.URL,
+			Format:     n.Format,
+			Events:     n.Events,
+			TimeoutSec: n.TimeoutSec,
+			Retries:    n.Retries,
+		})
+	}
+	for _, c := range cfg.ChainRelays {
+		if c.Name == "" || c.Addr == "" {
+			log.Fatal("chain_relays: name and addr are required")
+		}
+		relayCfg.ChainRelays = append(relayCfg.ChainRelays, turnrelay.ChainRelay{
+			Name:     c.Name,
+			Addr:     c.Addr,
+			Username: c.Username,
+			Secret:   c.Secret,
+			CAFile:   c.CAFile,
+		})
+	}
+	for _, u := range cfg.AdminUsers {
+		relayCfg.AdminUsers = append(relayCfg.AdminUsers, turnrelay.AdminUser{Username: u.Username, Secret: u.Secret})
+	}
+	if h := cfg.PreRegister; h != nil {
+		if h.URL == "" {
+			log.Fatal("pre_register_hook: url is required")
+		}
+		relayCfg.PreRegister = &turnrelay.PreHook{URL: h.URL, TimeoutSec: h.TimeoutSec, FailOpen: h.FailOpen}
+	}
+	for _, s := range cfg.NAT64Prefixes {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Fatalf("nat64_prefixes: %v", err)
+		}
+		relayCfg.NAT64Prefixes = append(relayCfg.NAT64Prefixes, p)
+	}
+	for _, s := range cfg.RateLimitExempt {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Fatalf("rate_limit_exempt: %v", err)
+		}
+		relayCfg.RateLimitExempt = append(relayCfg.RateLimitExempt, p.Masked())
+	}
+	if cfg.ScheduleTimezone != "" {
+		loc, err := time.LoadLocation(cfg.ScheduleTimezone)
+		if err != nil {
+			log.Fatalf("schedule_timezone: %v", err)
+		}
+		relayCfg.ScheduleLocation = loc
+	}
+	if d := cfg.DDNS; d != nil {
+		relayCfg.DDNS = &turnrelay.DDNSConfig{
+			Provider:   d.Provider,
+			Hostname:   d.Hostname,
+			CheckSec:   d.CheckSec,
+			IPEchoURL:  d.IPEchoURL,
+			TTL:        d.TTL,
+			Token:      d.Token,
+			ZoneID:     d.ZoneID,
+			Server:     d.Server,
+			Zone:       d.Zone,
+			TSIGKey:    d.TSIGKey,
+			TSIGAlgo:   d.TSIGAlgo,
+			TSIGSecret: d.TSIGSecret,
+		}
+	}
+	var logSinks []*logrotate.Writer
+	if cfg.LogFile != nil {
+		w, err := openLogSink(cfg.LogFile)
+		if err != nil {
+			log.Fatalf("open log file: %v", err)
+		}
+		log.SetOutput(w)
+		logSinks = append(logSinks, w)
+	}
+	log.Printf("relay: huzaa-relay %s", buildinfo.Get())
+	logFirewallHints(cfg)
+	if *configureFw {
+		if err := configureFirewall(cfg); err != nil {
+			log.Fatalf("configure firewall: %v", err)
+		}
+	}
+	if cfg.AuditLog != nil {
+		w, err := openLogSink(cfg.AuditLog)
+		if err != nil {
+			log.Fatalf("open audit log: %v", err)
+		}
+		relayCfg.AuditLog = w
+		logSinks = append(logSinks, w)
 	}
+	rotateOnHangup(logSinks)
 	if relayCfg.DCCPortMin == 0 {
 		relayCfg.DCCPortMin = 50000
 		relayCfg.DCCPortMax = 50100
@@ -42,9 +260,88 @@ func main() {
 	if err != nil {
 		log.Fatalf("new relay: %v", err)
 	}
-	if err := relay.Run(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second signal kills the process without waiting for the drain.
+		stop()
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+		defer cancel()
+		relay.Shutdown(ctx) // logs the sessions it had to cut off
+	}()
+	// RunContext returns once Shutdown is done, or with the error of a listener that failed.
+	if err := relay.RunContext(context.Background()); err != nil {
 		log.Fatalf("run relay: %v", err)
 	}
-	select {}
-	os.Exit(0)
+}
+
+// scheduleRules converts configured schedules, exiting on an invalid one.
+func scheduleRules(in []config.Schedule) []turnrelay.ScheduleRule {
+	var out []turnrelay.ScheduleRule
+	for _, s := range in {
+		rule, err := turnrelay.ParseScheduleRule(s.Days, s.Start, s.End, s.MaxRateBps, s.Deny)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		out = append(out, rule)
+	}
+	return out
+}
+
+// openTLSToken opens the PKCS#11 key configured in tls_pkcs11, or returns nil if none is.
+func openTLSToken(cfg *config.RelayConfig) (crypto.Signer, error) {
+	p := cfg.TLSPKCS11
+	if p == nil {
+		return nil, nil
+	}
+	id, err := hex.DecodeString(p.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("key_id: %w", err)
+	}
+	pin, err := keystore.Passphrase(p.PINEnv, p.PINFile, p.PINPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("pin: %w", err)
+	}
+	chain, err := keystore.LoadChain(cfg.TLSCertFile, nil)
+	if err != nil {
+		return nil, err
+	}
+	return keystore.OpenPKCS11(keystore.PKCS11Config{
+		Module:     p.Module,
+		Slot:       p.Slot,
+		TokenLabel: p.TokenLabel,
+		KeyLabel:   p.KeyLabel,
+		KeyID:      id,
+		PIN:        pin,
+	}, chain.Leaf.PublicKey)
+}
+
+// rotateOnHangup rotates the log sinks whenever the process gets SIGHUP, so an operator
+// can start new files on demand.
+func rotateOnHangup(sinks []*logrotate.Writer) {
+	if len(sinks) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for _, w := range sinks {
+				if err := w.Rotate(); err != nil {
+					log.Printf("relay: rotate log: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// openLogSink opens a rotating file writer for one configured log sink.
+func openLogSink(s *config.LogSink) (*logrotate.Writer, error) {
+	return logrotate.Open(s.Path, logrotate.Options{
+		MaxSize:    int64(s.MaxSizeMB) << 20,
+		Interval:   time.Duration(s.RotateHours) * time.Hour,
+		MaxBackups: s.MaxBackups,
+		MaxAge:     time.Duration(s.MaxAgeDays) * 24 * time.Hour,
+		Compress:   s.Compress,
+	})
 }
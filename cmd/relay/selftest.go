@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+const (
+	selftestChunk    = 32 * 1024 // MsgData payload size used by the selftest bot
+	selftestCooldown = 2         // PortCooldownSec of the in-process relay
+)
+
+// runSelftest starts an in-process relay on localhost with a throwaway config and
+// certificate, runs one download and one upload through it (or -parallel of each at once)
+// and verifies the bytes. Afterwards it checks that no session, port or goroutine leaked.
+// It returns the process exit code.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	size := fs.Int("size", 8<<20, "Bytes to transfer in each direction")
+	timeout := fs.Duration("timeout", 60*time.Second, "Overall deadline for the self-test")
+	parallel := fs.Int("parallel", 1, "Concurrent downloads and uploads to run")
+	fs.Parse(args)
+
+	done := make(chan error, 1)
+	go func() { done <- selftest(*size, max(*parallel, 1)) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "selftest: FAIL: %v\n", err)
+			return 1
+		}
+		fmt.Println("selftest: OK")
+		return 0
+	case <-time.After(*timeout):
+		fmt.Fprintf(os.Stderr, "selftest: FAIL: timed out after %s\n", *timeout)
+		return 1
+	}
+}
+
+func selftest(size, parallel int) error {
+	dir, err := os.MkdirTemp("", "relay-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	relay, turnAddr, cred, err := startLocalRelay(dir, 20+2*parallel)
+	if err != nil {
+		return err
+	}
+	baseline := relay.Metrics()
+	goroutines := runtime.NumGoroutine()
+
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	want := sha256.Sum256(data)
+	fmt.Printf("selftest: relay on %s, %d bytes, sha256 %x\n", turnAddr, size, want)
+
+	if parallel == 1 {
+		start := time.Now()
+		if err := selftestDownload(turnAddr, cred, data); err != nil {
+			return fmt.Errorf("download: %w", err)
+		}
+		reportTiming("download", size, time.Since(start))
+
+		start = time.Now()
+		if err := selftestUpload(turnAddr, cred, data); err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+		reportTiming("upload", size, time.Since(start))
+	} else {
+		start := time.Now()
+		errs := make(chan error, 2*parallel)
+		for i := 0; i < parallel; i++ {
+			go func() {
+				if err := selftestDownload(turnAddr, cred, data); err != nil {
+					err = fmt.Errorf("download: %w", err)
+				}
+				errs <- err
+			}()
+			go func() {
+				if err := selftestUpload(turnAddr, cred, data); err != nil {
+					err = fmt.Errorf("upload: %w", err)
+				}
+				errs <- err
+			}()
+		}
+		for i := 0; i < 2*parallel; i++ {
+			if err := <-errs; err != nil {
+				return err
+			}
+		}
+		reportTiming(fmt.Sprintf("%d downloads + %d uploads", parallel, parallel), 2*parallel*size, time.Since(start))
+	}
+	return selftestLeaks(relay, baseline, goroutines)
+}
+
+// startLocalRelay runs an in-process relay on 127.0.0.1 with a self-signed certificate in
+// dir, one random bot credential and about ports DCC ports.
+func startLocalRelay(dir string, ports int) (*turnrelay.Relay, string, turnrelay.TurnUserCred, error) {
+	var cred turnrelay.TurnUserCred
+	certFile, keyFile, err := writeSelfSignedCert(dir, "localhost")
+	if err != nil {
+		return nil, "", cred, fmt.Errorf("generate cert: %w", err)
+	}
+	turnAddr, err := freeLocalAddr()
+	if err != nil {
+		return nil, "", cred, err
+	}
+	dccMin, err := freeLocalPort()
+	if err != nil {
+		return nil, "", cred, err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", cred, err
+	}
+	cred = turnrelay.TurnUserCred{Username: "selftest", Secret: hex.EncodeToString(secret)}
+	relay, err := turnrelay.NewRelay(&turnrelay.RelayConfig{
+		TURNListen:  turnAddr,
+		TurnUsers:   []turnrelay.TurnUserCred{cred},
+		DCCPortMin:  dccMin,
+		DCCPortMax:  dccMin + ports,
+		RelayHost:   "127.0.0.1",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+
+		PortCooldownSec: selftestCooldown,
+	})
+	if err != nil {
+		return nil, "", cred, fmt.Errorf("new relay: %w", err)
+	}
+	if err := relay.Run(); err != nil {
+		return nil, "", cred, fmt.Errorf("run relay: %w", err)
+	}
+	return relay, turnAddr, cred, nil
+}
+
+// selftestLeaks waits briefly for teardown and then checks that every session was removed,
+// every DCC port returned and no goroutine left behind.
+func selftestLeaks(relay *turnrelay.Relay, baseline turnrelay.Metrics, goroutines int) error {
+	var m turnrelay.Metrics
+	var g int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		m, g = relay.Metrics(), runtime.NumGoroutine()
+		// Ports in their reuse cooldown have been released.
+		if m.Sessions == baseline.Sessions && m.FreePorts+m.CoolingPorts == baseline.FreePorts && g <= goroutines {
+			return nil
+		}
+	}
+	return fmt.Errorf("leak after transfers: sessions %d (want %d), free or cooling ports %d (want %d), goroutines %d (want <= %d)",
+		m.Sessions, baseline.Sessions, m.FreePorts+m.CoolingPorts, baseline.FreePorts, g, goroutines)
+}
+
+func reportTiming(what string, size int, d time.Duration) {
+	rate := float64(size) / d.Seconds() / (1 << 20)
+	fmt.Printf("selftest: %s ok in %s (%.1f MiB/s)\n", what, d.Round(time.Millisecond), rate)
+}
+
+// selftestDownload plays the bot sending data and the user receiving it over DCC.
+func selftestDownload(turnAddr string, cred turnrelay.TurnUserCred, data []byte) error {
+	bot, port, err := selftestRegister(turnAddr, cred, turnrelay.MsgRegisterDownload, "selftest-download.bin")
+	if err != nil {
+		return err
+	}
+	defer bot.Close()
+	sendErr := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(data); off += selftestChunk {
+			end := off + selftestChunk
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := turnrelay.WriteFrame(bot, turnrelay.MsgData, data[off:end]); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- turnrelay.WriteFrame(bot, turnrelay.MsgEOF, nil)
+	}()
+	user, err := dialDCC(port)
+	if err != nil {
+		return err
+	}
+	defer user.Close()
+	got, err := io.ReadAll(user)
+	if err != nil {
+		return fmt.Errorf("user read: %w", err)
+	}
+	if err := <-sendErr; err != nil {
+		return fmt.Errorf("bot send: %w", err)
+	}
+	return compareData(data, got)
+}
+
+// selftestUpload plays the user sending data over DCC and the bot receiving it.
+func selftestUpload(turnAddr string, cred turnrelay.TurnUserCred, data []byte) error {
+	bot, port, err := selftestRegister(turnAddr, cred, turnrelay.MsgRegisterUpload, "selftest-upload.bin")
+	if err != nil {
+		return err
+	}
+	defer bot.Close()
+	user, err := dialDCC(port)
+	if err != nil {
+		return err
+	}
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := user.Write(data)
+		user.Close()
+		sendErr <- err
+	}()
+	var got bytes.Buffer
+	for {
+		msgType, payload, err := turnrelay.ReadFrame(bot)
+		if err != nil {
+			return fmt.Errorf("bot read: %w", err)
+		}
+		if msgType == turnrelay.MsgEOF {
+			break
+		}
+		if msgType != turnrelay.MsgData {
+			return fmt.Errorf("unexpected frame type %d: %s", msgType, payload)
+		}
+		got.Write(payload)
+	}
+	if err := <-sendErr; err != nil {
+		return fmt.Errorf("user send: %w", err)
+	}
+	return compareData(data, got.Bytes())
+}
+
+// selftestRegister connects and authenticates as a bot, registers a session and returns
+// the bot connection and the allocated DCC port.
+func selftestRegister(turnAddr string, cred turnrelay.TurnUserCred, msgType byte, filename string) (*tls.Conn, int, error) {
+	conn, err := tls.Dial("tcp", turnAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, 0, err
+	}
+	auth := make([]byte, 4, 4+len(cred.Username)+len(cred.Secret))
+	binary.BigEndian.PutUint32(auth, uint32(len(cred.Username)))
+	auth = append(append(auth, cred.Username...), cred.Secret...)
+	if err := turnrelay.WriteFrame(conn, turnrelay.MsgAuth, auth); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if t, p, err := turnrelay.ReadFrame(conn); err != nil || t != turnrelay.MsgAuthOk {
+		conn.Close()
+		return nil, 0, fmt.Errorf("auth: type=%d err=%v %s", t, err, p)
+	}
+	sessionID := make([]byte, 18)
+	if _, err := rand.Read(sessionID); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	reg := append([]byte(hex.EncodeToString(sessionID)), filename...)
+	if err := turnrelay.WriteFrame(conn, msgType, reg); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	t, p, err := turnrelay.ReadFrame(conn)
+	if err != nil || t != turnrelay.MsgPortAlloc || len(p) < 4 {
+		conn.Close()
+		return nil, 0, fmt.Errorf("register: type=%d err=%v %s", t, err, p)
+	}
+	return conn, int(binary.BigEndian.Uint32(p[:4])), nil
+}
+
+func dialDCC(port int) (*tls.Conn, error) {
+	return tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+}
+
+func compareData(want, got []byte) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("length mismatch: got %d bytes, want %d", len(got), len(want))
+	}
+	if sha256.Sum256(got) != sha256.Sum256(want) {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+// freeLocalAddr returns a currently unused 127.0.0.1:port.
+func freeLocalAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// writeSelfSignedCert writes a short-lived self-signed ECDSA certificate and key for host
+// into dir and returns their paths.
+func writeSelfSignedCert(dir, host string) (certFile, keyFile string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, "relay.crt")
+	keyFile = filepath.Join(dir, "relay.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// runSessions handles "relay sessions interrupted": the sessions the last shutdown ended
+// before they finished, from interrupted_file. It returns the process exit code.
+func runSessions(args []string) int {
+	if len(args) == 0 || args[0] != "interrupted" {
+		fmt.Fprintln(os.Stderr, "usage: relay sessions interrupted [-config path] [-json]")
+		return 2
+	}
+	fs := flag.NewFlagSet("sessions interrupted", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON")
+	asJSON := fs.Bool("json", false, "Print the sessions as JSON")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sessions: load config: %v\n", err)
+		return 1
+	}
+	if cfg.InterruptedFile == "" {
+		fmt.Fprintln(os.Stderr, "sessions: interrupted_file is not set in the config")
+		return 1
+	}
+	written, sessions, err := turnrelay.ReadInterrupted(cfg.InterruptedFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sessions: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if sessions == nil {
+			sessions = []turnrelay.InterruptedSession{}
+		}
+		enc.Encode(sessions)
+		return 0
+	}
+	if written.IsZero() {
+		fmt.Println("No shutdown has been recorded yet.")
+		return 0
+	}
+	fmt.Printf("Sessions interrupted by the shutdown at %s: %d\n\n", written.Format("2006-01-02 15:04:05 MST"), len(sessions))
+	if len(sessions) == 0 {
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tKIND\tOWNER\tOFFSET\tREASON\tRESUMABLE\tFILENAME")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%t\t%s\n", s.ID, s.Kind, s.Owner, s.Offset, s.Reason, s.Resumable, s.Filename)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// runSoak is the hidden "relay soak" subcommand: it runs an in-process relay like
+// selftest and keeps creating loopback downloads and uploads at -rate per second, with
+// sizes spread log-uniformly between -min-size and -max-size, for -duration (or until
+// interrupted). Every -report it prints heap and goroutine counts so growth shows up
+// over hours; at the end it fails if a transfer failed, something leaked or the heap
+// grew by more than -max-heap-growth. It is meant for validating leak fixes before a
+// release, not for production hosts.
+func runSoak(args []string) int {
+	fs := flag.NewFlagSet("soak", flag.ExitOnError)
+	rate := fs.Float64("rate", 5, "Sessions started per second")
+	duration := fs.Duration("duration", time.Hour, "How long to run; 0 = until interrupted")
+	minSize := fs.Int("min-size", 1<<10, "Smallest transfer in bytes")
+	maxSize := fs.Int("max-size", 4<<20, "Largest transfer in bytes")
+	parallel := fs.Int("parallel", 32, "Sessions in flight at most; ticks beyond it are skipped")
+	report := fs.Duration("report", time.Minute, "Interval between progress lines")
+	maxGrowth := fs.Int64("max-heap-growth", 64<<20, "Heap growth in bytes (after GC) that fails the run")
+	fs.Parse(args)
+	if *rate <= 0 || *minSize < 1 || *maxSize < *minSize || *parallel < 1 || *report <= 0 {
+		fmt.Fprintln(os.Stderr, "soak: need -rate > 0, 1 <= -min-size <= -max-size, -parallel >= 1 and -report > 0")
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	if err := soak(ctx, soakConfig{
+		rate:      *rate,
+		minSize:   *minSize,
+		maxSize:   *maxSize,
+		parallel:  *parallel,
+		report:    *report,
+		maxGrowth: *maxGrowth,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "soak: FAIL: %v\n", err)
+		return 1
+	}
+	fmt.Println("soak: OK")
+	return 0
+}
+
+type soakConfig struct {
+	rate             float64
+	minSize, maxSize int
+	parallel         int
+	report           time.Duration
+	maxGrowth        int64
+}
+
+// soakCounters are the running totals printed by soakReport.
+type soakCounters struct {
+	ok, failed, skipped atomic.Int64
+	bytes               atomic.Int64
+	inFlight            atomic.Int64
+}
+
+func soak(ctx context.Context, cfg soakConfig) error {
+	dir, err := os.MkdirTemp("", "relay-soak-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// Released ports rest for selftestCooldown seconds before reuse.
+	relay, turnAddr, cred, err := startLocalRelay(dir, 20+cfg.parallel+int(math.Ceil(cfg.rate*selftestCooldown)))
+	if err != nil {
+		return err
+	}
+	baseline := relay.Metrics()
+	goroutines := runtime.NumGoroutine()
+	heap := heapInUse()
+
+	data := make([]byte, cfg.maxSize)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	fmt.Printf("soak: relay on %s, %.1f sessions/s of %d..%d bytes, heap %s, %d goroutines\n",
+		turnAddr, cfg.rate, cfg.minSize, cfg.maxSize, mib(heap), goroutines)
+
+	var c soakCounters
+	var wg sync.WaitGroup
+	start := time.Now()
+	tick := time.NewTicker(time.Duration(float64(time.Second) / cfg.rate))
+	defer tick.Stop()
+	reportTick := time.NewTicker(cfg.report)
+	defer reportTick.Stop()
+	var firstErr error
+	var firstOnce sync.Once
+loop:
+	for n := 0; ; {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-reportTick.C:
+			soakReport(relay, &c, start)
+		case <-tick.C:
+			if c.inFlight.Load() >= int64(cfg.parallel) {
+				c.skipped.Add(1)
+				continue
+			}
+			size := soakSize(cfg.minSize, cfg.maxSize)
+			upload := n%2 == 1
+			n++
+			c.inFlight.Add(1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.inFlight.Add(-1)
+				var err error
+				if upload {
+					err = selftestUpload(turnAddr, cred, data[:size])
+				} else {
+					err = selftestDownload(turnAddr, cred, data[:size])
+				}
+				if err != nil {
+					c.failed.Add(1)
+					firstOnce.Do(func() { firstErr = err })
+					fmt.Fprintf(os.Stderr, "soak: session failed: %v\n", err)
+					return
+				}
+				c.ok.Add(1)
+				c.bytes.Add(int64(size))
+			}()
+		}
+	}
+	fmt.Println("soak: stopping, waiting for sessions in flight")
+	wg.Wait()
+	soakReport(relay, &c, start)
+
+	if err := selftestLeaks(relay, baseline, goroutines); err != nil {
+		return err
+	}
+	if n := c.failed.Load(); n > 0 {
+		return fmt.Errorf("%d of %d sessions failed, first: %v", n, n+c.ok.Load(), firstErr)
+	}
+	if grown := int64(heapInUse()) - int64(heap); grown > cfg.maxGrowth {
+		return fmt.Errorf("heap grew by %s (limit %s)", mib(uint64(grown)), mib(uint64(cfg.maxGrowth)))
+	}
+	return nil
+}
+
+// soakSize picks a transfer size log-uniformly in [min, max], so small and large
+// transfers are both common.
+func soakSize(lo, hi int) int {
+	if lo == hi {
+		return lo
+	}
+	f := math.Exp(math.Log(float64(lo)) + mrand.Float64()*(math.Log(float64(hi))-math.Log(float64(lo))))
+	return max(lo, min(hi, int(f)))
+}
+
+func soakReport(relay *turnrelay.Relay, c *soakCounters, start time.Time) {
+	m := relay.Metrics()
+	fmt.Printf("soak: %s ok=%d failed=%d skipped=%d moved=%s in_flight=%d sessions=%d free_ports=%d cooling_ports=%d heap=%s goroutines=%d\n",
+		time.Since(start).Round(time.Second), c.ok.Load(), c.failed.Load(), c.skipped.Load(), mib(uint64(c.bytes.Load())),
+		c.inFlight.Load(), m.Sessions, m.FreePorts, m.CoolingPorts, mib(heapInUse()), runtime.NumGoroutine())
+}
+
+// heapInUse returns the live heap after a collection, so that successive readings
+// compare retained memory rather than garbage.
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+func mib(n uint64) string { return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20)) }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/stats"
+)
+
+// runStats prints the per-user totals kept in stats_file. It returns the process exit code.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON")
+	since := fs.String("since", "7d", "How far back to report: Nd (days) or a Go duration such as 36h")
+	fs.Parse(args)
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stats: load config: %v\n", err)
+		return 1
+	}
+	if cfg.StatsFile == "" {
+		fmt.Fprintln(os.Stderr, "stats: stats_file is not set in the config")
+		return 1
+	}
+	d, err := parseSince(*since)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stats: -since: %v\n", err)
+		return 1
+	}
+	store, err := stats.Open(cfg.StatsFile, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "stats: %v\n", err)
+		return 1
+	}
+	now := time.Now()
+	from := now.Add(-d)
+	fmt.Printf("Transfers %s .. %s (UTC days)\n\n", from.UTC().Format("2006-01-02"), now.UTC().Format("2006-01-02"))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "USER\tSESSIONS\tBYTES\tFAILURES\t")
+	for _, row := range store.Query(from, now) {
+		user := row.User
+		if user == "" {
+			user = "(total)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", user, row.Sessions, row.Bytes, row.Failures)
+	}
+	tw.Flush()
+	return 0
+}
+
+// parseSince accepts "7d" style day counts as well as time.ParseDuration strings.
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad day count %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/stats"
+)
+
+// runUsage handles "relay usage export": per-user sessions and bytes for one month from
+// stats_file, for chargeback. It returns the process exit code.
+func runUsage(args []string) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintln(os.Stderr, "usage: relay usage export [-config path] [-month YYYY-MM] [-format csv|json]")
+		return 2
+	}
+	fs := flag.NewFlagSet("usage export", flag.ExitOnError)
+	confPath := fs.String("config", "config/relay.json", "Path to relay config JSON")
+	month := fs.String("month", time.Now().UTC().Format("2006-01"), "Month to export (YYYY-MM, UTC)")
+	format := fs.String("format", stats.FormatCSV, "Output format: csv or json")
+	fs.Parse(args[1:])
+
+	cfg, err := config.LoadRelayConfig(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: load config: %v\n", err)
+		return 1
+	}
+	if cfg.StatsFile == "" {
+		fmt.Fprintln(os.Stderr, "usage: stats_file is not set in the config")
+		return 1
+	}
+	since, until, err := stats.MonthRange(*month)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: -month: %v\n", err)
+		return 1
+	}
+	store, err := stats.Open(cfg.StatsFile, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage: %v\n", err)
+		return 1
+	}
+	if err := stats.WriteUsage(os.Stdout, *format, *month, store.Query(since, until)); err != nil {
+		fmt.Fprintf(os.Stderr, "usage: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/awgh/huzaa-relay/internal/buildinfo"
+)
+
+// runVersion prints the build information of this binary. It returns the process exit code.
+func runVersion() int {
+	bi := buildinfo.Get()
+	fmt.Printf("huzaa-relay %s\n", bi.Version)
+	if bi.Commit != "" {
+		fmt.Printf("commit:  %s\n", bi.Commit)
+	}
+	if bi.Date != "" {
+		fmt.Printf("built:   %s\n", bi.Date)
+	}
+	fmt.Printf("go:      %s\n", bi.GoVersion)
+	return 0
+}
@@ -0,0 +1,496 @@
+// Command relayctl operates a running relay through its admin API (admin_listen): list,
+// kill, boost and trace sessions, change limits, the DCC port range and the banner, reload
+// the TLS certificate, show per-user statistics, switch read-only mode and drain the relay.
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/config"
+	"github.com/awgh/huzaa-relay/internal/keystore"
+	"github.com/awgh/huzaa-relay/internal/stats"
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+const usage = `usage: relayctl [flags] <command>
+
+commands:
+  sessions                list the registered sessions
+  kill <session-id>       end a session
+  boost <session-id> <n>  set one session's rate limit to n bytes/s (0 = unlimited)
+  stats [-since 7d]       per-user transfers (needs stats_file)
+  trace [-format text|mermaid] <session-id> [on|off]
+                          start or stop tracing a session, or print its trace
+  limits [-max-sessions n [-shed]] [-max-bandwidth n]
+                          show or change the runtime limits
+  user-rate <user> <n>    set a bot user's max_rate_bps (0 = unlimited)
+  ports [<min> <max>]     show or change the DCC port range
+  banner [<text>]         show or replace the banner sent to bots ("" = none)
+  tls-reload              reload tls_cert_file and tls_key_file now
+  read-only [on|off]      show or switch read-only mode (downloads only)
+  drain [-grace 30s]      stop accepting, let transfers finish, then stop the relay
+
+flags:
+`
+
+func main() {
+	confPath := flag.String("config", "config/relay.json", "Relay config JSON; admin_listen, admin_users and tls_cert_file are taken from it")
+	addr := flag.String("addr", "", "Admin API address (default: admin_listen from -config)")
+	user := flag.String("user", "", "Admin user (default: the first of admin_users); the secret is read from $RELAYCTL_SECRET, else from -config")
+	insecure := flag.Bool("insecure", false, "Do not verify the relay's certificate")
+	asJSON := flag.Bool("json", false, "Print the admin API's JSON reply instead of a table")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, err := newClient(*confPath, *addr, *user, *insecure)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "relayctl: %v\n", err)
+		os.Exit(1)
+	}
+	c.json = *asJSON
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "sessions":
+		err = c.sessions()
+	case "kill":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: relayctl kill <session-id>")
+			os.Exit(2)
+		}
+		err = c.kill(args[0])
+	case "boost":
+		var bps int64
+		if len(args) == 2 {
+			bps, err = strconv.ParseInt(args[1], 10, 64)
+		}
+		if len(args) != 2 || err != nil {
+			fmt.Fprintln(os.Stderr, "usage: relayctl boost <session-id> <bytes-per-second>")
+			os.Exit(2)
+		}
+		err = c.boost(args[0], bps)
+	case "stats":
+		fs := flag.NewFlagSet("stats", flag.ExitOnError)
+		since := fs.String("since", "7d", "How far back to report: Nd (days) or a Go duration such as 36h")
+		fs.Parse(args)
+		err = c.stats(*since)
+	case "trace":
+		fs := flag.NewFlagSet("trace", flag.ExitOnError)
+		format := fs.String("format", "text", "Trace format: text or mermaid (a sequenceDiagram)")
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "on" && args[1] != "off") {
+			fmt.Fprintln(os.Stderr, "usage: relayctl trace [-format text|mermaid] <session-id> [on|off]")
+			os.Exit(2)
+		}
+		err = c.trace(args, *format)
+	case "limits":
+		fs := flag.NewFlagSet("limits", flag.ExitOnError)
+		maxSessions := fs.Int("max-sessions", 0, "Max concurrent bot connections")
+		shed := fs.Bool("shed", false, "With -max-sessions, close the sessions beyond the new limit")
+		maxBandwidth := fs.Int64("max-bandwidth", 0, "Relay-wide transfer rate cap in bytes/s (0 = unlimited)")
+		fs.Parse(args)
+		body := map[string]interface{}{}
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "max-sessions":
+				body["max_sessions"], body["shed"] = *maxSessions, *shed
+			case "max-bandwidth":
+				body["max_bandwidth_bps"] = *maxBandwidth
+			}
+		})
+		err = c.limits(body)
+	case "user-rate":
+		var bps int64
+		if len(args) == 2 {
+			bps, err = strconv.ParseInt(args[1], 10, 64)
+		}
+		if len(args) != 2 || err != nil {
+			fmt.Fprintln(os.Stderr, "usage: relayctl user-rate <user> <bytes-per-second>")
+			os.Exit(2)
+		}
+		err = c.userRate(args[0], bps)
+	case "ports":
+		var lo, hi int
+		if len(args) == 2 {
+			if lo, err = strconv.Atoi(args[0]); err == nil {
+				hi, err = strconv.Atoi(args[1])
+			}
+		}
+		if (len(args) != 0 && len(args) != 2) || err != nil {
+			fmt.Fprintln(os.Stderr, "usage: relayctl ports [<min> <max>]")
+			os.Exit(2)
+		}
+		err = c.ports(args, lo, hi)
+	case "banner":
+		if len(args) > 1 {
+			fmt.Fprintln(os.Stderr, "usage: relayctl banner [<text>]")
+			os.Exit(2)
+		}
+		err = c.banner(args)
+	case "tls-reload":
+		err = c.tlsReload()
+	case "read-only":
+		if len(args) > 1 || (len(args) == 1 && args[0] != "on" && args[0] != "off") {
+			fmt.Fprintln(os.Stderr, "usage: relayctl read-only [on|off]")
+			os.Exit(2)
+		}
+		err = c.readOnly(args)
+	case "drain":
+		fs := flag.NewFlagSet("drain", flag.ExitOnError)
+		grace := fs.Duration("grace", 30*time.Second, "How long transfers in progress may take to finish")
+		fs.Parse(args)
+		err = c.drain(*grace)
+	default:
+		fmt.Fprintf(os.Stderr, "relayctl: unknown command %q\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "relayctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// client calls the admin API.
+type client struct {
+	base         string // https://host:port
+	user, secret string
+	http         *http.Client
+	json         bool
+}
+
+// newClient sets up the admin API connection from the relay config at confPath, overridden
+// by addr and user. The config is optional when addr is given.
+func newClient(confPath, addr, user string, insecure bool) (*client, error) {
+	cfg, cfgErr := config.LoadRelayConfig(confPath)
+	if cfgErr != nil {
+		if addr == "" {
+			return nil, fmt.Errorf("load config: %w (or pass -addr)", cfgErr)
+		}
+		cfg = &config.RelayConfig{}
+	}
+	if addr == "" {
+		if addr = cfg.AdminListen; addr == "" {
+			return nil, errors.New("admin_listen is not set in the config")
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	secret := os.Getenv("RELAYCTL_SECRET")
+	for _, u := range cfg.AdminUsers {
+		if user == "" {
+			user = u.Username
+		}
+		if u.Username == user && secret == "" {
+			secret = u.Secret
+		}
+	}
+	if user == "" || secret == "" {
+		return nil, errors.New("no admin credential: set -user and $RELAYCTL_SECRET, or admin_users in the config")
+	}
+	tlsCfg := &tls.Config{ServerName: host, InsecureSkipVerify: insecure}
+	// The relay's own certificate file, when readable, pins the certificate; this also works
+	// with self-signed certificates and addresses the certificate does not name.
+	if !insecure && cfg.TLSCertFile != "" {
+		if pin, err := keystore.LoadChain(cfg.TLSCertFile, nil); err == nil {
+			tlsCfg.InsecureSkipVerify = true
+			tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 || !bytes.Equal(cs.PeerCertificates[0].Raw, pin.Certificate[0]) {
+					return fmt.Errorf("relay certificate does not match %s", cfg.TLSCertFile)
+				}
+				return nil
+			}
+		}
+	}
+	return &client{
+		base:   "https://" + net.JoinHostPort(host, port),
+		user:   user,
+		secret: secret,
+		http:   &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsCfg}},
+	}, nil
+}
+
+// call sends a request with an optional JSON body and decodes the JSON reply into out
+// (skipped if nil). With -json the reply is printed instead.
+func (c *client) call(method, path string, body, out interface{}) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.secret)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if c.json {
+		os.Stdout.Write(data)
+		return nil
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *client) sessions() error {
+	var list []struct {
+		turnrelay.SessionInfo
+		AgeSec int64 `json:"age_sec"`
+	}
+	if err := c.call(http.MethodGet, "/sessions", nil, &list); err != nil || c.json {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tSTATE\tUSER\tPEER\tPORT\tBYTES\tAGE\tFILE")
+	for _, s := range list {
+		peer := s.Peer
+		if peer == "" {
+			peer = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", s.ID, s.Kind, s.State, s.Owner, peer, s.Port, s.Bytes,
+			time.Duration(s.AgeSec)*time.Second, s.Filename)
+	}
+	return tw.Flush()
+}
+
+func (c *client) kill(id string) error {
+	if err := c.call(http.MethodDelete, "/sessions/"+url.PathEscape(id), nil, nil); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("killed %s\n", id)
+	return nil
+}
+
+func (c *client) boost(id string, bps int64) error {
+	body := map[string]int64{"rate_bps": bps}
+	if err := c.call(http.MethodPut, "/sessions/"+url.PathEscape(id)+"/rate", body, nil); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("%s rate limit: %s\n", id, rateString(bps))
+	return nil
+}
+
+func (c *client) stats(since string) error {
+	d, err := parseSince(since)
+	if err != nil {
+		return fmt.Errorf("-since: %w", err)
+	}
+	now := time.Now().UTC()
+	from := now.Add(-d)
+	q := url.Values{"since": {from.Format(time.DateOnly)}, "until": {now.Format(time.DateOnly)}}
+	var rows []stats.Row
+	if err := c.call(http.MethodGet, "/stats?"+q.Encode(), nil, &rows); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("Transfers %s .. %s (UTC days)\n\n", from.Format(time.DateOnly), now.Format(time.DateOnly))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "USER\tSESSIONS\tBYTES\tFAILURES\t")
+	for _, row := range rows {
+		user := row.User
+		if user == "" {
+			user = "(total)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", user, row.Sessions, row.Bytes, row.Failures)
+	}
+	return tw.Flush()
+}
+
+// trace prints the trace of session args[0], or starts or stops it if args[1] is "on" or
+// "off".
+func (c *client) trace(args []string, format string) error {
+	path := "/sessions/" + url.PathEscape(args[0]) + "/trace"
+	if len(args) == 2 {
+		on := args[1] == "on"
+		if err := c.call(http.MethodPut, path, map[string]bool{"enabled": on}, nil); err != nil || c.json {
+			return err
+		}
+		if on {
+			fmt.Printf("tracing %s; \"relayctl trace %s\" prints it\n", args[0], args[0])
+		} else {
+			fmt.Printf("stopped tracing %s\n", args[0])
+		}
+		return nil
+	}
+	var reply struct {
+		Trace string `json:"trace"`
+	}
+	if err := c.call(http.MethodGet, path+"?"+url.Values{"format": {format}}.Encode(), nil, &reply); err != nil || c.json {
+		return err
+	}
+	fmt.Print(reply.Trace)
+	return nil
+}
+
+// limits shows the runtime limits after applying the changes in body, if any.
+func (c *client) limits(body map[string]interface{}) error {
+	method := http.MethodGet
+	if len(body) > 0 {
+		method = http.MethodPut
+	}
+	var l turnrelay.Limits
+	if err := c.call(method, "/limits", body, &l); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("max sessions:  %d\nmax bandwidth: %s\n", l.MaxSessions, rateString(l.MaxBandwidthBps))
+	return nil
+}
+
+func (c *client) userRate(user string, bps int64) error {
+	body := map[string]int64{"rate_bps": bps}
+	if err := c.call(http.MethodPut, "/users/"+url.PathEscape(user)+"/rate", body, nil); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("%s rate limit: %s\n", user, rateString(bps))
+	return nil
+}
+
+// ports shows the DCC port pool, or moves its range to lo-hi if args are given.
+func (c *client) ports(args []string, lo, hi int) error {
+	method, body := http.MethodGet, interface{}(nil)
+	if len(args) == 2 {
+		method, body = http.MethodPut, map[string]int{"min": lo, "max": hi}
+	}
+	var pool turnrelay.PortPoolInfo
+	if err := c.call(method, "/ports", body, &pool); err != nil || c.json {
+		return err
+	}
+	if pool.Min == 0 {
+		fmt.Println("single-port mode: no DCC port range")
+		return nil
+	}
+	fmt.Printf("DCC ports %d-%d: %d free, %d cooling, %d in use\n", pool.Min, pool.Max, pool.Free, pool.Cooling, len(pool.InUse))
+	if len(pool.InUse) == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nPORT\tSESSION")
+	for _, u := range pool.InUse {
+		fmt.Fprintf(tw, "%d\t%s\n", u.Port, u.Session)
+	}
+	return tw.Flush()
+}
+
+// banner shows the banner, or replaces it with args[0].
+func (c *client) banner(args []string) error {
+	method, body := http.MethodGet, interface{}(nil)
+	if len(args) == 1 {
+		method, body = http.MethodPut, map[string]string{"text": args[0]}
+	}
+	var reply struct {
+		Text string `json:"text"`
+	}
+	if err := c.call(method, "/banner", body, &reply); err != nil || c.json {
+		return err
+	}
+	if reply.Text == "" {
+		fmt.Println("no banner")
+	} else {
+		fmt.Println(reply.Text)
+	}
+	return nil
+}
+
+func (c *client) tlsReload() error {
+	if err := c.call(http.MethodPost, "/tls/reload", nil, nil); err != nil || c.json {
+		return err
+	}
+	fmt.Println("reloaded the TLS certificate")
+	return nil
+}
+
+// readOnly shows read-only mode, or switches it if args is ["on"] or ["off"].
+func (c *client) readOnly(args []string) error {
+	method, body := http.MethodGet, interface{}(nil)
+	if len(args) == 1 {
+		method, body = http.MethodPut, map[string]bool{"enabled": args[0] == "on"}
+	}
+	var reply struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.call(method, "/read_only", body, &reply); err != nil || c.json {
+		return err
+	}
+	if reply.Enabled {
+		fmt.Println("read-only: on; uploads and forward sessions are refused")
+	} else {
+		fmt.Println("read-only: off")
+	}
+	return nil
+}
+
+func (c *client) drain(grace time.Duration) error {
+	body := map[string]int{"grace_sec": int((grace + time.Second - 1) / time.Second)}
+	if err := c.call(http.MethodPost, "/drain", body, nil); err != nil || c.json {
+		return err
+	}
+	fmt.Printf("draining; transfers in progress get %s to finish\n", grace)
+	return nil
+}
+
+// rateString formats a rate limit in bytes per second.
+func rateString(bps int64) string {
+	if bps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", bps)
+}
+
+// parseSince accepts "7d" style day counts as well as time.ParseDuration strings, like
+// "relay stats".
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad day count %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,77 @@
+// Package buildinfo reports which build of the relay is running. Version, Commit and Date
+// are set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/awgh/huzaa-relay/internal/buildinfo.Version=v1.2.0 \
+//	  -X github.com/awgh/huzaa-relay/internal/buildinfo.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/awgh/huzaa-relay/internal/buildinfo.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./cmd/relay
+//
+// Without them, Commit and Date fall back to the VCS stamp the go command embeds when it
+// builds from a git checkout.
+package buildinfo
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X.
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build.
+type Info struct {
+	Version   string
+	Commit    string // "" = unknown; "-dirty" suffix = built from a modified checkout
+	Date      string // build or commit time, RFC 3339; "" = unknown
+	GoVersion string
+}
+
+// Get returns the build information of the running binary.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if info.Commit != "" && info.Date != "" {
+		return info
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	var rev, at string
+	dirty := false
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.time":
+			at = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if info.Commit == "" && rev != "" {
+		info.Commit = rev[:min(len(rev), 12)]
+		if dirty {
+			info.Commit += "-dirty"
+		}
+	}
+	if info.Date == "" {
+		info.Date = at
+	}
+	return info
+}
+
+// String formats the info for logs, e.g. "v1.2.0 (commit 1a2b3c4, built 2024-05-01T10:00:00Z, go1.22.3)".
+func (i Info) String() string {
+	s := i.Version + " ("
+	if i.Commit != "" {
+		s += "commit " + i.Commit + ", "
+	}
+	if i.Date != "" {
+		s += "built " + i.Date + ", "
+	}
+	return fmt.Sprintf("%s%s)", s, i.GoVersion)
+}
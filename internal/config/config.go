@@ -2,34 +2,208 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+
+	"github.com/awgh/huzaa-relay/internal/keystore"
 )
 
 // TurnUser is one allowed bot credential (username + secret).
 type TurnUser struct {
+	Username    string     `json:"username"`
+	Secret      string     `json:"secret"`
+	MaxLeaseSec int        `json:"max_lease_sec,omitempty"`
+	MaxRateBps  int64      `json:"max_rate_bps,omitempty"`
+	Schedules   []Schedule `json:"schedules,omitempty"`
+	ChainPeer   bool       `json:"chain_peer,omitempty"`
+
+	MaxSessionsPerDay   int64 `json:"max_sessions_per_day,omitempty"`
+	MaxBytesPerDay      int64 `json:"max_bytes_per_day,omitempty"`
+	MaxSessionsPerMonth int64 `json:"max_sessions_per_month,omitempty"`
+	MaxBytesPerMonth    int64 `json:"max_bytes_per_month,omitempty"`
+}
+
+// Schedule is a recurring time window with limits: days "mon".."sun" (empty = every day),
+// start and end "HH:MM" (end before start crosses midnight).
+type Schedule struct {
+	Days       []string `json:"days,omitempty"`
+	Start      string   `json:"start"`
+	End        string   `json:"end"`
+	MaxRateBps int64    `json:"max_rate_bps,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+}
+
+// LogSink is a file log destination with optional built-in rotation. Zero limits are off.
+type LogSink struct {
+	Path        string `json:"path"`
+	MaxSizeMB   int    `json:"max_size_mb,omitempty"`
+	RotateHours int    `json:"rotate_hours,omitempty"`
+	MaxBackups  int    `json:"max_backups,omitempty"`
+	MaxAgeDays  int    `json:"max_age_days,omitempty"`
+	Compress    bool   `json:"compress,omitempty"`
+}
+
+// DDNS configures built-in dynamic DNS updates.
+type DDNS struct {
+	Provider   string `json:"provider"`
+	Hostname   string `json:"hostname,omitempty"`
+	CheckSec   int    `json:"check_sec,omitempty"`
+	IPEchoURL  string `json:"ip_echo_url,omitempty"`
+	TTL        int    `json:"ttl,omitempty"`
+	Token      string `json:"token,omitempty"`
+	ZoneID     string `json:"zone_id,omitempty"`
+	Server     string `json:"server,omitempty"`
+	Zone       string `json:"zone,omitempty"`
+	TSIGKey    string `json:"tsig_key,omitempty"`
+	TSIGAlgo   string `json:"tsig_algorithm,omitempty"`
+	TSIGSecret string `json:"tsig_secret,omitempty"`
+}
+
+// PostHook is a command or URL run after each completed transfer.
+type PostHook struct {
+	Name       string   `json:"name,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	URL        string   `json:"url,omitempty"`
+	Kinds      []string `json:"kinds,omitempty"`
+	TimeoutSec int      `json:"timeout_sec,omitempty"`
+	Retries    int      `json:"retries,omitempty"`
+}
+
+// PreHook is a URL asked to approve each registration before a port is allocated.
+type PreHook struct {
+	URL        string `json:"url"`
+	TimeoutSec int    `json:"timeout_sec,omitempty"`
+	FailOpen   bool   `json:"fail_open,omitempty"`
+}
+
+// Notifier is a webhook paged about critical events.
+type Notifier struct {
+	Name       string   `json:"name,omitempty"`
+	URL        string   `json:"url"`
+	Format     string   `json:"format,omitempty"`
+	Events     []string `json:"events,omitempty"`
+	TimeoutSec int      `json:"timeout_sec,omitempty"`
+	Retries    int      `json:"retries,omitempty"`
+}
+
+// ChainRelay is a relay that sessions can be chained through; this relay logs in there
+// with one of its turn_users.
+type ChainRelay struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
 	Username string `json:"username"`
 	Secret   string `json:"secret"`
+	CAFile   string `json:"ca_file,omitempty"`
+}
+
+// AdminUser is a basic-auth credential for the admin API.
+type AdminUser struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+}
+
+// PKCS11 selects the TLS private key on a PKCS#11 token (HSM, YubiKey).
+type PKCS11 struct {
+	Module     string `json:"module"`
+	Slot       *uint  `json:"slot,omitempty"`
+	TokenLabel string `json:"token_label,omitempty"`
+	KeyLabel   string `json:"key_label,omitempty"`
+	KeyID      string `json:"key_id,omitempty"` // hex
+	PINEnv     string `json:"pin_env,omitempty"`
+	PINFile    string `json:"pin_file,omitempty"`
+	PINPrompt  bool   `json:"pin_prompt,omitempty"`
 }
 
 // RelayConfig is the configuration for the relay bot (runs on IRC server).
 type RelayConfig struct {
-	TURNListen  string     `json:"turn_listen"`
-	TURNSecret  string     `json:"turn_secret,omitempty"`
-	TurnUsers   []TurnUser `json:"turn_users,omitempty"`
-	DCCPortMin  int        `json:"dcc_port_min"`
-	DCCPortMax  int        `json:"dcc_port_max"`
-	RelayHost   string     `json:"relay_host"`
-	TLSCertFile string     `json:"tls_cert_file"`
-	TLSKeyFile  string     `json:"tls_key_file"`
-	MaxSessions int        `json:"max_sessions,omitempty"`
-}
-
-// LoadRelayConfig loads a single relay config from a JSON file.
+	TURNListen            string     `json:"turn_listen"`
+	TURNSecret            string     `json:"turn_secret,omitempty"`
+	TurnUsers             []TurnUser `json:"turn_users,omitempty"`
+	DCCPortMin            int        `json:"dcc_port_min"`
+	DCCPortMax            int        `json:"dcc_port_max"`
+	RelayHost             string     `json:"relay_host"`
+	TLSCertFile           string     `json:"tls_cert_file"`
+	TLSKeyFile            string     `json:"tls_key_file"`
+	TLSKeyPassEnv         string     `json:"tls_key_passphrase_env,omitempty"`
+	TLSKeyPassFile        string     `json:"tls_key_passphrase_file,omitempty"`
+	TLSKeyPassPrompt      bool       `json:"tls_key_passphrase_prompt,omitempty"`
+	TLSPKCS11             *PKCS11    `json:"tls_pkcs11,omitempty"`
+	MaxSessions           int        `json:"max_sessions,omitempty"`
+	MaxBandwidthBps       int64      `json:"max_bandwidth_bps,omitempty"`
+	MaxFileSize           int64      `json:"max_file_size,omitempty"`
+	ReadOnly              bool       `json:"read_only,omitempty"`
+	CrashDumpDir          string     `json:"crash_dump_dir,omitempty"`
+	Debug                 bool       `json:"debug,omitempty"`
+	DebugEvery            int        `json:"debug_sample_every,omitempty"`
+	DebugPerSec           int        `json:"debug_max_per_sec,omitempty"`
+	LogFile               *LogSink   `json:"log_file,omitempty"`
+	AuditLog              *LogSink   `json:"audit_log,omitempty"`
+	IdempotencyWindowSec  int        `json:"idempotency_window_sec,omitempty"`
+	ResumeWindowSec       int        `json:"resume_window_sec,omitempty"`
+	InterruptedFile       string     `json:"interrupted_file,omitempty"`
+	DCCLeaseSec           int        `json:"dcc_lease_sec,omitempty"`
+	MaxLeaseSec           int        `json:"max_lease_sec,omitempty"`
+	MetricsListen         string     `json:"metrics_listen,omitempty"`
+	StatusListen          string     `json:"status_listen,omitempty"`
+	AdminListen           string     `json:"admin_listen,omitempty"`
+	SlowConsumerPolicy    string     `json:"slow_consumer_policy,omitempty"`
+	SlowConsumerThreshold int        `json:"slow_consumer_threshold_pct,omitempty"`
+	SlowConsumerGraceSec  int        `json:"slow_consumer_grace_sec,omitempty"`
+	SessionIdleTimeoutSec int        `json:"session_idle_timeout_sec,omitempty"`
+	SessionMaxDurationSec int        `json:"session_max_duration_sec,omitempty"`
+	MaxFanout             int        `json:"max_fanout,omitempty"`
+	FanoutWaitSec         int        `json:"fanout_wait_sec,omitempty"`
+	RelayHostTTLSec       int        `json:"relay_host_ttl_sec,omitempty"`
+	DDNS                  *DDNS      `json:"ddns,omitempty"`
+	PublicIPDetect        string     `json:"public_ip_detect,omitempty"`
+	PublicIPSTUNServer    string     `json:"public_ip_stun_server,omitempty"`
+	PublicIPEchoURL       string     `json:"public_ip_echo_url,omitempty"`
+	BotAcceptLimit        int        `json:"bot_accept_limit,omitempty"`
+	StatsFile             string     `json:"stats_file,omitempty"`
+	StatsRetentionDays    int        `json:"stats_retention_days,omitempty"`
+	QuotaFile             string     `json:"quota_file,omitempty"`
+	DCCSNIListen          string     `json:"dcc_sni_listen,omitempty"`
+	DCCSNIDomain          string     `json:"dcc_sni_domain,omitempty"`
+	SinglePort            bool       `json:"single_port,omitempty"`
+	Banner                string     `json:"banner,omitempty"`
+	BannerFile            string     `json:"banner_file,omitempty"`
+	Schedules             []Schedule `json:"schedules,omitempty"`
+	ScheduleTimezone      string     `json:"schedule_timezone,omitempty"`
+	NAT64Prefixes         []string   `json:"nat64_prefixes,omitempty"`
+	StatsRedactPeer       bool       `json:"stats_redact_peer,omitempty"`
+	PostHooks             []PostHook `json:"post_hooks,omitempty"`
+	PreRegister           *PreHook   `json:"pre_register_hook,omitempty"`
+	Notifiers             []Notifier `json:"notifiers,omitempty"`
+	PreflightStrict       bool       `json:"preflight_strict,omitempty"`
+	UserKeepAliveSec      int        `json:"user_keepalive_sec,omitempty"`
+	UserTCPTimeoutSec     int        `json:"user_tcp_timeout_sec,omitempty"`
+	UserWriteTimeoutSec   int        `json:"user_write_timeout_sec,omitempty"`
+	BotKeepAliveSec       int        `json:"bot_keepalive_sec,omitempty"`
+	RegRatePerConn        float64    `json:"reg_rate_per_conn,omitempty"`
+	RegRatePerUser        float64    `json:"reg_rate_per_user,omitempty"`
+	RegBurst              int        `json:"reg_burst,omitempty"`
+	RateLimitExempt       []string   `json:"rate_limit_exempt,omitempty"`
+	IntegritySampleEvery  int        `json:"integrity_sample_every,omitempty"`
+	PortCooldownSec       int        `json:"port_cooldown_sec,omitempty"`
+
+	ChainRelays  []ChainRelay `json:"chain_relays,omitempty"`
+	MaxChainHops int          `json:"max_chain_hops,omitempty"`
+
+	AdminUsers []AdminUser `json:"admin_users,omitempty"`
+}
+
+// LoadRelayConfig loads a single relay config from a JSON file. A file encrypted with
+// "relay config encrypt" (keystore.Seal) is decrypted first with the key from Key.
 func LoadRelayConfig(path string) (*RelayConfig, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	if keystore.IsSealed(data) {
+		if data, err = decrypt(data); err != nil {
+			return nil, fmt.Errorf("decrypt %s: %w", path, err)
+		}
+	}
 	var c RelayConfig
 	if err := json.Unmarshal(data, &c); err != nil {
 		return nil, err
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/awgh/huzaa-relay/internal/keystore"
+)
+
+// Environment variables that provide the key of an encrypted config, checked in this order.
+const (
+	KeyEnv        = "RELAY_CONFIG_KEY"         // the key itself
+	KeyFileEnv    = "RELAY_CONFIG_KEY_FILE"    // a file whose first line is the key
+	KeyCommandEnv = "RELAY_CONFIG_KEY_COMMAND" // a command (e.g. a KMS or vault CLI) that prints the key
+)
+
+// Key returns the config encryption key from KeyEnv, KeyFileEnv or KeyCommandEnv, or nil if
+// none of them is set.
+func Key() ([]byte, error) {
+	if _, ok := os.LookupEnv(KeyEnv); ok {
+		return keystore.Passphrase(KeyEnv, "", false)
+	}
+	if path := os.Getenv(KeyFileEnv); path != "" {
+		return keystore.Passphrase("", path, false)
+	}
+	if command := strings.Fields(os.Getenv(KeyCommandEnv)); len(command) > 0 {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", KeyCommandEnv, err)
+		}
+		return bytes.TrimRight(out, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// decrypt returns the plaintext of a config encrypted with keystore.Seal, using Key.
+func decrypt(data []byte) ([]byte, error) {
+	key, err := Key()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, errors.New("config is encrypted; set " + KeyEnv + ", " + KeyFileEnv + " or " + KeyCommandEnv)
+	}
+	return keystore.Open(data, key)
+}
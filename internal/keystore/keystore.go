@@ -0,0 +1,132 @@
+// Package keystore loads the relay's TLS identity from PEM files, passphrase-protected PEM
+// keys or PKCS#12 bundles, using only the standard library.
+package keystore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrPassphrase is returned when a key or bundle does not decrypt with the passphrase.
+	ErrPassphrase = errors.New("wrong passphrase or corrupt key")
+	// ErrNeedPassphrase is returned for an encrypted key or bundle when no passphrase is set.
+	ErrNeedPassphrase = errors.New("key is encrypted and no passphrase is configured")
+)
+
+// IsPKCS12 reports whether data looks like a DER PKCS#12 bundle rather than PEM.
+func IsPKCS12(data []byte) bool {
+	return len(data) > 0 && data[0] == 0x30 && !bytes.Contains(data, []byte("-----BEGIN"))
+}
+
+// LoadPair loads a TLS certificate and key. If certFile is a PKCS#12 bundle (.p12/.pfx),
+// the key and chain come from it and keyFile is ignored. Otherwise both are PEM; the key
+// may be encrypted, either as "ENCRYPTED PRIVATE KEY" (PKCS#8) or with the legacy
+// Proc-Type/DEK-Info headers. passphrase decrypts either form and may be nil for
+// unencrypted keys. The returned certificate has Leaf set.
+func LoadPair(certFile, keyFile string, passphrase []byte) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if IsPKCS12(certPEM) {
+		pair, err := DecodePKCS12(certPEM, passphrase)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("%s: %w", certFile, err)
+		}
+		return pair, nil
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if keyPEM, err = decryptPEMKey(keyPEM, passphrase); err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return pair, nil
+}
+
+// LoadChain loads the PEM certificate chain in certFile and pairs it with key, which is
+// held elsewhere (see OpenPKCS11). With a nil key only the chain is returned. The leaf
+// must match key's public half.
+func LoadChain(certFile string, key crypto.Signer) (tls.Certificate, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var out tls.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			out.Certificate = append(out.Certificate, block.Bytes)
+		}
+	}
+	if len(out.Certificate) == 0 {
+		return tls.Certificate{}, fmt.Errorf("%s: no PEM certificate", certFile)
+	}
+	if out.Leaf, err = x509.ParseCertificate(out.Certificate[0]); err != nil {
+		return tls.Certificate{}, fmt.Errorf("%s: %w", certFile, err)
+	}
+	if key != nil {
+		if !samePublicKey(out.Leaf.PublicKey, key.Public()) {
+			return tls.Certificate{}, fmt.Errorf("%s: certificate does not match the private key", certFile)
+		}
+		out.PrivateKey = key
+	}
+	return out, nil
+}
+
+// decryptPEMKey returns keyPEM with its private key block decrypted; unencrypted keys are
+// returned as they are.
+func decryptPEMKey(keyPEM, passphrase []byte) ([]byte, error) {
+	rest := keyPEM
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			return keyPEM, nil
+		}
+		// Legacy OpenSSL PEM encryption is deprecated in crypto/x509 but still what many CAs
+		// and "openssl rsa -aes256" hand out.
+		legacy := x509.IsEncryptedPEMBlock(block)
+		if block.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+			if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+				return keyPEM, nil
+			}
+			continue
+		}
+		if len(passphrase) == 0 {
+			return nil, ErrNeedPassphrase
+		}
+		if legacy {
+			der, err := x509.DecryptPEMBlock(block, passphrase)
+			if err != nil {
+				return nil, ErrPassphrase
+			}
+			return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+		}
+		der, err := decryptPKCS8(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
@@ -0,0 +1,53 @@
+package keystore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Passphrase returns the key passphrase from the first configured source: the environment
+// variable env, the file path (first line), or, if prompt is set, the controlling
+// terminal. It returns nil if no source is configured.
+func Passphrase(env, path string, prompt bool) ([]byte, error) {
+	switch {
+	case env != "":
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", env)
+		}
+		return []byte(v), nil
+	case path != "":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		line, _, _ := bytes.Cut(data, []byte("\n"))
+		return bytes.TrimSuffix(line, []byte("\r")), nil
+	case prompt:
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return nil, fmt.Errorf("prompt for passphrase: %w", err)
+		}
+		defer tty.Close()
+		fmt.Fprint(tty, "TLS key passphrase: ")
+		pass, err := readNoEcho(tty)
+		fmt.Fprintln(tty)
+		if err != nil {
+			return nil, fmt.Errorf("prompt for passphrase: %w", err)
+		}
+		return pass, nil
+	}
+	return nil, nil
+}
+
+// readLine reads one line from tty without its line ending.
+func readLine(tty *os.File) ([]byte, error) {
+	line, err := bufio.NewReader(tty).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, errors.New("no passphrase entered")
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,24 @@
+package keystore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// readNoEcho reads a line from tty with echo turned off.
+func readNoEcho(tty *os.File) ([]byte, error) {
+	fd := tty.Fd()
+	var old syscall.Termios
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old))); e != 0 {
+		return nil, e
+	}
+	t := old
+	t.Lflag &^= syscall.ECHO
+	t.Lflag |= syscall.ICANON
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+		return nil, e
+	}
+	defer syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+	return readLine(tty)
+}
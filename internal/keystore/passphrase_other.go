@@ -0,0 +1,14 @@
+//go:build !linux
+
+package keystore
+
+import (
+	"errors"
+	"os"
+)
+
+// readNoEcho is only implemented on Linux; elsewhere the passphrase must come from the
+// environment or a file.
+func readNoEcho(tty *os.File) ([]byte, error) {
+	return nil, errors.New("not supported on this platform; use an environment variable or file")
+}
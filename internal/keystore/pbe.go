@@ -0,0 +1,279 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+)
+
+// Password-based encryption algorithms (PKCS#5 PBES2 and the PKCS#12 legacy schemes).
+var (
+	oidPBES2               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidPBEWithSHAAnd3DES   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidPBEWithSHAAnd128RC2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 5}
+	oidPBEWithSHAAnd40RC2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 6}
+	oidHMACWithSHA1        = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC          = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// maxIterations bounds KDF work so a hostile file cannot pin the CPU.
+const maxIterations = 10_000_000
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pbes2Params struct {
+	KDF              pkix.AlgorithmIdentifier
+	EncryptionScheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts a DER EncryptedPrivateKeyInfo and returns the PKCS#8 key.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("encrypted private key: %w", err)
+	}
+	return decrypt(info.Algorithm, info.Data, passphrase)
+}
+
+// decrypt decrypts data encrypted with a PBES2 or PKCS#12 password-based scheme.
+// PBES2 keys are derived from the passphrase as bytes, the PKCS#12 schemes from its
+// BMPString form, as OpenSSL does.
+func decrypt(alg pkix.AlgorithmIdentifier, data, passphrase []byte) ([]byte, error) {
+	var block cipher.Block
+	var iv []byte
+	switch {
+	case alg.Algorithm.Equal(oidPBES2):
+		var err error
+		if block, iv, err = pbes2Cipher(alg.Parameters.FullBytes, passphrase); err != nil {
+			return nil, err
+		}
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3DES), alg.Algorithm.Equal(oidPBEWithSHAAnd128RC2), alg.Algorithm.Equal(oidPBEWithSHAAnd40RC2):
+		var p pbeParams
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &p); err != nil {
+			return nil, fmt.Errorf("pbe parameters: %w", err)
+		}
+		if p.Iterations < 1 || p.Iterations > maxIterations {
+			return nil, fmt.Errorf("pbe iteration count %d out of range", p.Iterations)
+		}
+		pass := bmpString(passphrase)
+		iv = pkcs12KDF(sha1.New, 2, pass, p.Salt, p.Iterations, 8)
+		var err error
+		switch {
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd3DES):
+			block, err = des.NewTripleDESCipher(pkcs12KDF(sha1.New, 1, pass, p.Salt, p.Iterations, 24))
+		case alg.Algorithm.Equal(oidPBEWithSHAAnd128RC2):
+			block, err = newRC2(pkcs12KDF(sha1.New, 1, pass, p.Salt, p.Iterations, 16), 128)
+		default:
+			block, err = newRC2(pkcs12KDF(sha1.New, 1, pass, p.Salt, p.Iterations, 5), 40)
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %v", alg.Algorithm)
+	}
+	if len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, ErrPassphrase
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	return unpad(out, block.BlockSize())
+}
+
+// pbes2Cipher returns the block cipher and IV for PBES2 parameters (PBKDF2 with AES-CBC
+// or 3DES-CBC).
+func pbes2Cipher(params, passphrase []byte) (cipher.Block, []byte, error) {
+	var p pbes2Params
+	if _, err := asn1.Unmarshal(params, &p); err != nil {
+		return nil, nil, fmt.Errorf("pbes2 parameters: %w", err)
+	}
+	if !p.KDF.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported key derivation %v", p.KDF.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(p.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("pbkdf2 parameters: %w", err)
+	}
+	if kdf.Iterations < 1 || kdf.Iterations > maxIterations {
+		return nil, nil, fmt.Errorf("pbkdf2 iteration count %d out of range", kdf.Iterations)
+	}
+	prf := sha1.New
+	switch alg := kdf.PRF.Algorithm; {
+	case len(alg) == 0 || alg.Equal(oidHMACWithSHA1):
+	case alg.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case alg.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case alg.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported pbkdf2 prf %v", alg)
+	}
+	var keyLen int
+	var newCipher func([]byte) (cipher.Block, error)
+	switch alg := p.EncryptionScheme.Algorithm; {
+	case alg.Equal(oidAES128CBC):
+		keyLen, newCipher = 16, aes.NewCipher
+	case alg.Equal(oidAES192CBC):
+		keyLen, newCipher = 24, aes.NewCipher
+	case alg.Equal(oidAES256CBC):
+		keyLen, newCipher = 32, aes.NewCipher
+	case alg.Equal(oidDESEDE3CBC):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("unsupported cipher %v", alg)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(p.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("cipher iv: %w", err)
+	}
+	block, err := newCipher(pbkdf2(prf, passphrase, kdf.Salt, kdf.Iterations, keyLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, nil, fmt.Errorf("cipher iv is %d bytes", len(iv))
+	}
+	return block, iv, nil
+}
+
+// unpad strips PKCS#7 padding. Bad padding almost always means a wrong passphrase.
+func unpad(b []byte, size int) ([]byte, error) {
+	n := int(b[len(b)-1])
+	if n == 0 || n > size || n > len(b) {
+		return nil, ErrPassphrase
+	}
+	for _, c := range b[len(b)-n:] {
+		if int(c) != n {
+			return nil, ErrPassphrase
+		}
+	}
+	return b[:len(b)-n], nil
+}
+
+// pbkdf2 is PBKDF2 from RFC 8018.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// pkcs12KDF is the PKCS#12 key derivation from RFC 7292 appendix B.2. id is 1 for keys,
+// 2 for IVs and 3 for MAC keys; pass is the BMPString password.
+func pkcs12KDF(h func() hash.Hash, id byte, pass, salt []byte, iter, n int) []byte {
+	d := h()
+	u, v := d.Size(), d.BlockSize()
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(pass)...)
+	var out []byte
+	for len(out) < n {
+		d.Reset()
+		d.Write(D)
+		d.Write(I)
+		A := d.Sum(nil)
+		for i := 1; i < iter; i++ {
+			d.Reset()
+			d.Write(A)
+			A = d.Sum(A[:0])
+		}
+		out = append(out, A...)
+		// I_j = (I_j + B + 1) mod 2^(8v) for every v-byte block of I, B = A repeated.
+		for j := 0; j < len(I); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				carry += int(I[j+k]) + int(A[k%u])
+				I[j+k] = byte(carry)
+				carry >>= 8
+			}
+		}
+	}
+	return out[:n]
+}
+
+// bmpString encodes a password as a NUL-terminated big-endian UTF-16 string, as the
+// PKCS#12 KDF expects.
+func bmpString(s []byte) []byte {
+	u := utf16.Encode([]rune(string(s)))
+	out := make([]byte, 0, 2*len(u)+2)
+	for _, c := range u {
+		out = append(out, byte(c>>8), byte(c))
+	}
+	return append(out, 0, 0)
+}
+
+// hashFor returns the hash for a MAC digest algorithm.
+func hashFor(alg asn1.ObjectIdentifier) (func() hash.Hash, error) {
+	switch {
+	case alg.Equal(oidSHA1):
+		return sha1.New, nil
+	case alg.Equal(oidSHA256):
+		return sha256.New, nil
+	case alg.Equal(oidSHA384):
+		return sha512.New384, nil
+	case alg.Equal(oidSHA512):
+		return sha512.New, nil
+	}
+	return nil, fmt.Errorf("unsupported mac digest %v", alg)
+}
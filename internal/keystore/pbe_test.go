@@ -0,0 +1,133 @@
+package keystore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"path/filepath"
+	"testing"
+)
+
+// testPassphrase encrypts the fixtures in testdata (see testdata/gen.sh).
+const testPassphrase = "keystore-test"
+
+// TestPBKDF2 checks the RFC 6070 PBKDF2-HMAC-SHA1 test vectors.
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iter, keyLen   int
+		want           string
+	}{
+		{"password", "salt", 1, 20, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, 20, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, 20, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, 25, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, 16, "56fa6aa75548099dcc37d7f03425e0c3"},
+	}
+	for _, tt := range tests {
+		got := pbkdf2(sha1.New, []byte(tt.password), []byte(tt.salt), tt.iter, tt.keyLen)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %s", tt.password, tt.salt, tt.iter, got, tt.want)
+		}
+	}
+}
+
+// TestPKCS12KDF checks the RFC 7292 appendix B key derivation. The "smeg"/"queeg" key and
+// IV vectors are the widely used ones; the rest were computed with "openssl kdf PKCS12KDF"
+// and cover MAC keys, empty passwords, SHA-256 and passwords longer than one hash block.
+func TestPKCS12KDF(t *testing.T) {
+	long := make([]byte, 40)
+	for i := range long {
+		long[i] = 'a'
+	}
+	tests := []struct {
+		h       func() hash.Hash
+		id      byte
+		pass    []byte
+		salt    string
+		iter, n int
+		want    string
+	}{
+		{sha1.New, 1, []byte("smeg"), "0a58cf64530d823f", 1, 24, "8aaae6297b6cb04642ab5b077851284eb7128f1a2a7fbca3"},
+		{sha1.New, 2, []byte("smeg"), "0a58cf64530d823f", 1, 8, "79993dfe048d3b76"},
+		{sha1.New, 1, []byte("queeg"), "1682c0fc5b3f7ec5", 1000, 24, "483dd6e919d7de2e8e648ba8f862f3fbfbdc2bcb2c02957f"},
+		{sha1.New, 2, []byte("queeg"), "1682c0fc5b3f7ec5", 1000, 8, "9d461d1b00355c50"},
+		{sha1.New, 3, []byte("queeg"), "1682c0fc5b3f7ec5", 1000, 20, "022db40d747da404972b3144296ba4b80a96b1f3"},
+		{sha1.New, 3, nil, "1682c0fc5b3f7ec5", 1000, 20, "86d63674d162ae894033173cd4388dc67f544aa5"},
+		{sha256.New, 3, long, "0102030405060708", 2048, 32, "db7a33899af546b4b9d9945a2ec17e7dd3aee790533bfc7815b4154c073196dc"},
+		{sha1.New, 1, long, "0102030405060708", 3, 70, "0fb4307ded05e7ebdd618cd895ed33539ad1eaea5249232b516be860948c9a35c2b783b589505674c827cf694e14f810165bb3888cb3a6e14a2bb298f644f09116b1937610bb"},
+	}
+	for _, tt := range tests {
+		salt, _ := hex.DecodeString(tt.salt)
+		got := pkcs12KDF(tt.h, tt.id, bmpString(tt.pass), salt, tt.iter, tt.n)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("pkcs12KDF(id %d, %q, %s, %d) = %x, want %s", tt.id, tt.pass, tt.salt, tt.iter, got, tt.want)
+		}
+	}
+}
+
+func TestBMPString(t *testing.T) {
+	tests := map[string]string{
+		"":           "0000",
+		"Beavis":     "004200650061007600690073" + "0000",
+		"pä€":        "007000e420ac" + "0000",
+		"\U0001F511": "d83ddd11" + "0000", // outside the BMP: a surrogate pair
+	}
+	for in, want := range tests {
+		if got := hex.EncodeToString(bmpString([]byte(in))); got != want {
+			t.Errorf("bmpString(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" = ErrPassphrase
+	}{
+		{"4142434445460202", "414243444546"},
+		{"0808080808080808", "-"},
+		{"4142434445464701", "41424344454647"},
+		{"4142434445464700", ""},
+		{"4142434445464709", ""},
+		{"4142434445460302", ""},
+	}
+	for _, tt := range tests {
+		in, _ := hex.DecodeString(tt.in)
+		got, err := unpad(in, 8)
+		switch {
+		case tt.want == "":
+			if !errors.Is(err, ErrPassphrase) {
+				t.Errorf("unpad(%s) = %x, %v; want ErrPassphrase", tt.in, got, err)
+			}
+		case err != nil:
+			t.Errorf("unpad(%s): %v", tt.in, err)
+		case tt.want == "-" && len(got) != 0, tt.want != "-" && hex.EncodeToString(got) != tt.want:
+			t.Errorf("unpad(%s) = %x, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestEncryptedPEMKey loads the OpenSSL-encrypted copies of testdata/key.pem.
+func TestEncryptedPEMKey(t *testing.T) {
+	want := loadTestPair(t)
+	for _, name := range []string{"key-pkcs8-aes256.pem", "key-pkcs8-3des.pem", "key-legacy-aes256.pem"} {
+		keyFile := filepath.Join("testdata", name)
+		pair, err := LoadPair(filepath.Join("testdata", "cert.pem"), keyFile, []byte(testPassphrase))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !samePrivateKey(pair.PrivateKey, want.PrivateKey) {
+			t.Errorf("%s: decrypted key differs from key.pem", name)
+		}
+		if _, err := LoadPair(filepath.Join("testdata", "cert.pem"), keyFile, []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("%s with a wrong passphrase: %v, want ErrPassphrase", name, err)
+		}
+		if _, err := LoadPair(filepath.Join("testdata", "cert.pem"), keyFile, nil); !errors.Is(err, ErrNeedPassphrase) {
+			t.Errorf("%s without a passphrase: %v, want ErrNeedPassphrase", name, err)
+		}
+	}
+}
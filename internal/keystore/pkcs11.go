@@ -0,0 +1,135 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// PKCS11Config selects a private key on a PKCS#11 token (HSM, YubiKey, SoftHSM). The
+// token is the first one matching Slot or TokenLabel; the key is the private key object
+// matching KeyLabel and/or KeyID.
+type PKCS11Config struct {
+	Module     string // path of the PKCS#11 module (.so)
+	Slot       *uint  // slot ID; nil = pick the token by TokenLabel, or the first token
+	TokenLabel string
+	KeyLabel   string // CKA_LABEL of the private key
+	KeyID      []byte // CKA_ID of the private key
+	PIN        []byte // user PIN; nil = no login
+}
+
+// PKCS#11 mechanisms, hashes and MGFs used for signing.
+const (
+	ckmRSAPKCS    = 0x0001
+	ckmRSAPKCSPSS = 0x000d
+	ckmECDSA      = 0x1041
+	ckmSHA1       = 0x0220
+	ckmSHA256     = 0x0250
+	ckmSHA384     = 0x0260
+	ckmSHA512     = 0x0270
+	ckgMGF1SHA1   = 1
+	ckgMGF1SHA256 = 2
+	ckgMGF1SHA384 = 3
+	ckgMGF1SHA512 = 4
+)
+
+// p11Mechanism is a signing mechanism; hash, mgf and saltLen are only set for RSA-PSS.
+type p11Mechanism struct {
+	mech, hash, mgf, saltLen uint
+}
+
+// p11Key signs with a private key object on an open token session.
+type p11Key interface {
+	sign(m p11Mechanism, data []byte) ([]byte, error)
+}
+
+// digestInfoPrefix is the DER DigestInfo header that PKCS#1 v1.5 signatures wrap around
+// the digest; the token's CKM_RSA_PKCS only pads.
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA1:    {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256:  {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384:  {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512:  {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+	crypto.MD5SHA1: {},
+}
+
+var pssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {ckmSHA1, ckgMGF1SHA1},
+	crypto.SHA256: {ckmSHA256, ckgMGF1SHA256},
+	crypto.SHA384: {ckmSHA384, ckgMGF1SHA384},
+	crypto.SHA512: {ckmSHA512, ckgMGF1SHA512},
+}
+
+// tokenSigner is a crypto.Signer backed by a PKCS#11 private key. Calls are serialized:
+// a PKCS#11 session runs one operation at a time.
+type tokenSigner struct {
+	pub crypto.PublicKey
+	mu  sync.Mutex
+	key p11Key
+}
+
+// OpenPKCS11 logs in to the token described by cfg and returns a signer for its private
+// key. pub is the key's public half, usually taken from the certificate (see LoadChain);
+// it selects the signing mechanism. RSA and ECDSA keys are supported. PKCS#11 needs a
+// build with cgo and the pkcs11 tag.
+func OpenPKCS11(cfg PKCS11Config, pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("pkcs11: unsupported public key type %T", pub)
+	}
+	if cfg.Module == "" {
+		return nil, errors.New("pkcs11: no module configured")
+	}
+	if cfg.KeyLabel == "" && len(cfg.KeyID) == 0 {
+		return nil, errors.New("pkcs11: set a key label or key id")
+	}
+	key, err := openPKCS11Key(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenSigner{pub: pub, key: key}, nil
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *tokenSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.pub.(type) {
+	case *ecdsa.PublicKey:
+		raw, err := s.key.sign(p11Mechanism{mech: ckmECDSA}, digest)
+		if err != nil {
+			return nil, err
+		}
+		if len(raw)%2 != 0 {
+			return nil, fmt.Errorf("pkcs11: ecdsa signature is %d bytes", len(raw))
+		}
+		n := len(raw) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(raw[:n]), new(big.Int).SetBytes(raw[n:])})
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			h, ok := pssHashes[pss.Hash]
+			if !ok {
+				return nil, fmt.Errorf("pkcs11: unsupported pss hash %v", pss.Hash)
+			}
+			saltLen := pss.SaltLength
+			if saltLen == rsa.PSSSaltLengthEqualsHash || saltLen == rsa.PSSSaltLengthAuto {
+				saltLen = pss.Hash.Size()
+			}
+			return s.key.sign(p11Mechanism{mech: ckmRSAPKCSPSS, hash: h[0], mgf: h[1], saltLen: uint(saltLen)}, digest)
+		}
+		prefix, ok := digestInfoPrefix[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("pkcs11: unsupported hash %v", opts.HashFunc())
+		}
+		return s.key.sign(p11Mechanism{mech: ckmRSAPKCS}, append(append([]byte(nil), prefix...), digest...))
+	}
+	return nil, errors.New("pkcs11: unsupported key type")
+}
@@ -0,0 +1,233 @@
+//go:build pkcs11 && cgo && unix
+
+package keystore
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The subset of the PKCS#11 v2.40 API the relay needs, so no pkcs11.h is required. The
+// function list is declared up to C_Sign; the rest is never touched.
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef unsigned char CK_BYTE;
+
+typedef struct { CK_BYTE major, minor; } CK_VERSION;
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+typedef struct { CK_ULONG hashAlg; CK_ULONG mgf; CK_ULONG sLen; } CK_RSA_PKCS_PSS_PARAMS;
+typedef struct {
+	void *CreateMutex, *DestroyMutex, *LockMutex, *UnlockMutex;
+	CK_ULONG flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo;
+	void *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(CK_BYTE, CK_ULONG *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_ULONG, void *);
+	void *C_GetMechanismList, *C_GetMechanismInfo, *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	void *C_CloseSession, *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState, *C_SetOperationState;
+	CK_RV (*C_Login)(CK_ULONG, CK_ULONG, CK_BYTE *, CK_ULONG);
+	void *C_Logout, *C_CreateObject, *C_CopyObject, *C_DestroyObject, *C_GetObjectSize, *C_GetAttributeValue, *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_ULONG, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_ULONG);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal;
+	void *C_DecryptInit, *C_Decrypt, *C_DecryptUpdate, *C_DecryptFinal;
+	void *C_DigestInit, *C_Digest, *C_DigestUpdate, *C_DigestKey, *C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_ULONG, CK_MECHANISM *, CK_ULONG);
+	CK_RV (*C_Sign)(CK_ULONG, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+typedef CK_RV (*get_function_list_fn)(CK_FUNCTION_LIST **);
+
+static CK_RV p11_load(const char *path, CK_FUNCTION_LIST **fl) {
+	void *h = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (h == NULL) return (CK_RV)-1;
+	get_function_list_fn get = (get_function_list_fn)dlsym(h, "C_GetFunctionList");
+	if (get == NULL) return (CK_RV)-2;
+	return get(fl);
+}
+
+static CK_RV p11_initialize(CK_FUNCTION_LIST *fl) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof args);
+	args.flags = 0x2; // CKF_OS_LOCKING_OK
+	return fl->C_Initialize(&args);
+}
+
+static CK_RV p11_slots(CK_FUNCTION_LIST *fl, CK_ULONG *slots, CK_ULONG *n) {
+	return fl->C_GetSlotList(1, slots, n);
+}
+
+static CK_RV p11_token_label(CK_FUNCTION_LIST *fl, CK_ULONG slot, char *label) {
+	CK_BYTE info[512]; // CK_TOKEN_INFO starts with the 32-byte blank-padded label
+	CK_RV rv = fl->C_GetTokenInfo(slot, info);
+	if (rv == 0) memcpy(label, info, 32);
+	return rv;
+}
+
+static CK_RV p11_open(CK_FUNCTION_LIST *fl, CK_ULONG slot, CK_ULONG *session) {
+	return fl->C_OpenSession(slot, 0x4, NULL, NULL, session); // CKF_SERIAL_SESSION
+}
+
+static CK_RV p11_login(CK_FUNCTION_LIST *fl, CK_ULONG session, CK_BYTE *pin, CK_ULONG n) {
+	return fl->C_Login(session, 1, pin, n); // CKU_USER
+}
+
+static CK_RV p11_find_key(CK_FUNCTION_LIST *fl, CK_ULONG session, void *label, CK_ULONG labelLen, void *id, CK_ULONG idLen, CK_ULONG *key, CK_ULONG *found) {
+	CK_ULONG class = 3; // CKO_PRIVATE_KEY
+	CK_ATTRIBUTE tmpl[3] = {{0x0, &class, sizeof class}}; // CKA_CLASS
+	CK_ULONG n = 1;
+	if (labelLen > 0) { tmpl[n].type = 0x3; tmpl[n].pValue = label; tmpl[n].ulValueLen = labelLen; n++; } // CKA_LABEL
+	if (idLen > 0) { tmpl[n].type = 0x102; tmpl[n].pValue = id; tmpl[n].ulValueLen = idLen; n++; } // CKA_ID
+	CK_RV rv = fl->C_FindObjectsInit(session, tmpl, n);
+	if (rv != 0) return rv;
+	rv = fl->C_FindObjects(session, key, 1, found);
+	fl->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV p11_sign(CK_FUNCTION_LIST *fl, CK_ULONG session, CK_ULONG key, CK_ULONG mech, CK_ULONG hash, CK_ULONG mgf, CK_ULONG saltLen,
+		CK_BYTE *data, CK_ULONG dataLen, CK_BYTE *sig, CK_ULONG *sigLen) {
+	CK_RSA_PKCS_PSS_PARAMS pss = {hash, mgf, saltLen};
+	CK_MECHANISM m = {mech, NULL, 0};
+	if (hash != 0) { m.pParameter = &pss; m.ulParameterLen = sizeof pss; }
+	CK_RV rv = fl->C_SignInit(session, &m, key);
+	if (rv != 0) return rv;
+	return fl->C_Sign(session, data, dataLen, sig, sigLen);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"unsafe"
+)
+
+// PKCS#11 return values the relay tells apart.
+const (
+	ckrOK                         = 0x000
+	ckrPINIncorrect               = 0x0a0
+	ckrUserAlreadyLoggedIn        = 0x100
+	ckrCryptokiAlreadyInitialized = 0x191
+)
+
+// cgoKey is a private key object on an open, logged-in session.
+type cgoKey struct {
+	fl      *C.CK_FUNCTION_LIST
+	session C.CK_ULONG
+	handle  C.CK_ULONG
+}
+
+func p11Error(op string, rv C.CK_RV) error {
+	if rv == ckrPINIncorrect {
+		return fmt.Errorf("pkcs11: %s: incorrect PIN", op)
+	}
+	return fmt.Errorf("pkcs11: %s: CKR 0x%x", op, uint64(rv))
+}
+
+func openPKCS11Key(cfg PKCS11Config) (p11Key, error) {
+	path := C.CString(cfg.Module)
+	defer C.free(unsafe.Pointer(path))
+	var fl *C.CK_FUNCTION_LIST
+	switch rv := C.p11_load(path, &fl); {
+	case rv == C.CK_RV(^uint64(0)):
+		return nil, fmt.Errorf("pkcs11: load %s: %s", cfg.Module, C.GoString(C.dlerror()))
+	case rv == C.CK_RV(^uint64(1)):
+		return nil, fmt.Errorf("pkcs11: %s has no C_GetFunctionList", cfg.Module)
+	case rv != ckrOK:
+		return nil, p11Error("C_GetFunctionList", rv)
+	}
+	if rv := C.p11_initialize(fl); rv != ckrOK && rv != ckrCryptokiAlreadyInitialized {
+		return nil, p11Error("C_Initialize", rv)
+	}
+	slot, err := findSlot(fl, cfg)
+	if err != nil {
+		return nil, err
+	}
+	k := &cgoKey{fl: fl}
+	if rv := C.p11_open(fl, slot, &k.session); rv != ckrOK {
+		return nil, p11Error("C_OpenSession", rv)
+	}
+	if cfg.PIN != nil {
+		pin := C.CBytes(cfg.PIN)
+		rv := C.p11_login(fl, k.session, (*C.CK_BYTE)(pin), C.CK_ULONG(len(cfg.PIN)))
+		C.free(pin)
+		if rv != ckrOK && rv != ckrUserAlreadyLoggedIn {
+			return nil, p11Error("C_Login", rv)
+		}
+	}
+	var label, id unsafe.Pointer
+	if cfg.KeyLabel != "" {
+		label = C.CBytes([]byte(cfg.KeyLabel))
+		defer C.free(label)
+	}
+	if len(cfg.KeyID) > 0 {
+		id = C.CBytes(cfg.KeyID)
+		defer C.free(id)
+	}
+	var found C.CK_ULONG
+	if rv := C.p11_find_key(fl, k.session, label, C.CK_ULONG(len(cfg.KeyLabel)), id, C.CK_ULONG(len(cfg.KeyID)), &k.handle, &found); rv != ckrOK {
+		return nil, p11Error("C_FindObjects", rv)
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("pkcs11: no private key with label %q id %x", cfg.KeyLabel, cfg.KeyID)
+	}
+	return k, nil
+}
+
+// findSlot returns cfg.Slot, or the first slot with a token whose label is
+// cfg.TokenLabel (any token if empty).
+func findSlot(fl *C.CK_FUNCTION_LIST, cfg PKCS11Config) (C.CK_ULONG, error) {
+	if cfg.Slot != nil {
+		return C.CK_ULONG(*cfg.Slot), nil
+	}
+	var n C.CK_ULONG
+	if rv := C.p11_slots(fl, nil, &n); rv != ckrOK {
+		return 0, p11Error("C_GetSlotList", rv)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("pkcs11: %s has no token present", cfg.Module)
+	}
+	slots := make([]C.CK_ULONG, n)
+	if rv := C.p11_slots(fl, &slots[0], &n); rv != ckrOK {
+		return 0, p11Error("C_GetSlotList", rv)
+	}
+	for _, s := range slots[:n] {
+		if cfg.TokenLabel == "" {
+			return s, nil
+		}
+		var label [32]C.char
+		if C.p11_token_label(fl, s, &label[0]) != ckrOK {
+			continue
+		}
+		if string(bytes.TrimRight(C.GoBytes(unsafe.Pointer(&label[0]), 32), " ")) == cfg.TokenLabel {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("pkcs11: no token labeled %q", cfg.TokenLabel)
+}
+
+func (k *cgoKey) sign(m p11Mechanism, data []byte) ([]byte, error) {
+	in := C.CBytes(data)
+	defer C.free(in)
+	sig := make([]byte, 1024) // enough for RSA-8192 and any ECDSA curve
+	sigLen := C.CK_ULONG(len(sig))
+	rv := C.p11_sign(k.fl, k.session, k.handle, C.CK_ULONG(m.mech), C.CK_ULONG(m.hash), C.CK_ULONG(m.mgf), C.CK_ULONG(m.saltLen),
+		(*C.CK_BYTE)(in), C.CK_ULONG(len(data)), (*C.CK_BYTE)(unsafe.Pointer(&sig[0])), &sigLen)
+	if rv != ckrOK {
+		return nil, p11Error("C_Sign", rv)
+	}
+	return sig[:sigLen], nil
+}
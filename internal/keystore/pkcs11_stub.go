@@ -0,0 +1,9 @@
+//go:build !pkcs11 || !cgo || !unix
+
+package keystore
+
+import "errors"
+
+func openPKCS11Key(cfg PKCS11Config) (p11Key, error) {
+	return nil, errors.New("pkcs11: this relay was built without PKCS#11 support; rebuild with cgo and -tags pkcs11")
+}
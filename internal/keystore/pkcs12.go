@@ -0,0 +1,223 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// PKCS#7 content types and PKCS#12 bag types.
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidKeyBag                   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// DecodePKCS12 decodes a DER PKCS#12 bundle holding one private key and its certificate
+// chain. The leaf is the certificate matching the key; the other certificates follow it
+// in the returned chain. Bundles protected with PBES2 (AES, OpenSSL 3 default) and with
+// the legacy 3DES and RC2 schemes are supported.
+func DecodePKCS12(der, passphrase []byte) (tls.Certificate, error) {
+	var pfx pfxPdu
+	if rest, err := asn1.Unmarshal(der, &pfx); err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+	} else if len(rest) != 0 {
+		return tls.Certificate{}, errors.New("pkcs12: trailing data")
+	}
+	if pfx.Version != 3 {
+		return tls.Certificate{}, fmt.Errorf("pkcs12: version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return tls.Certificate{}, errors.New("pkcs12: only password-integrity bundles are supported")
+	}
+	var authSafe []byte
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+	}
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) > 0 {
+		if err := verifyMAC(&pfx.MacData, authSafe, passphrase); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	var contents []contentInfo
+	if _, err := asn1.Unmarshal(authSafe, &contents); err != nil {
+		return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+	}
+
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+	for _, ci := range contents {
+		var data []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &data); err != nil {
+				return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+			}
+			var err error
+			if data, err = decrypt(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, ed.EncryptedContentInfo.EncryptedContent, passphrase); err != nil {
+				return tls.Certificate{}, err
+			}
+		default:
+			return tls.Certificate{}, fmt.Errorf("pkcs12: unsupported content type %v", ci.ContentType)
+		}
+		var bags []safeBag
+		if _, err := asn1.Unmarshal(data, &bags); err != nil {
+			return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidShroudedKeyBag):
+				if key != nil {
+					return tls.Certificate{}, errors.New("pkcs12: more than one private key")
+				}
+				pkcs8 := bag.Value.Bytes
+				if bag.ID.Equal(oidShroudedKeyBag) {
+					var err error
+					if pkcs8, err = decryptPKCS8(bag.Value.Bytes, passphrase); err != nil {
+						return tls.Certificate{}, err
+					}
+				}
+				var err error
+				if key, err = x509.ParsePKCS8PrivateKey(pkcs8); err != nil {
+					return tls.Certificate{}, fmt.Errorf("pkcs12: private key: %w", err)
+				}
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if _, err := asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return tls.Certificate{}, fmt.Errorf("pkcs12: %w", err)
+				}
+				if !cb.ID.Equal(oidX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return tls.Certificate{}, fmt.Errorf("pkcs12: certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	if key == nil {
+		return tls.Certificate{}, errors.New("pkcs12: no private key")
+	}
+	return chainFor(key, certs)
+}
+
+// verifyMAC checks the bundle's integrity MAC, which is also the cheapest way to detect a
+// wrong passphrase.
+func verifyMAC(md *macData, content, passphrase []byte) error {
+	h, err := hashFor(md.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return fmt.Errorf("pkcs12: %w", err)
+	}
+	if md.Iterations < 1 || md.Iterations > maxIterations {
+		return fmt.Errorf("pkcs12: mac iteration count %d out of range", md.Iterations)
+	}
+	key := pkcs12KDF(h, 3, bmpString(passphrase), md.MacSalt, md.Iterations, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(content)
+	if !hmac.Equal(mac.Sum(nil), md.Mac.Digest) {
+		if len(passphrase) == 0 {
+			return ErrNeedPassphrase
+		}
+		return ErrPassphrase
+	}
+	return nil
+}
+
+// chainFor builds a tls.Certificate from key and the certificate whose public key matches
+// it, followed by the remaining certificates.
+func chainFor(key crypto.PrivateKey, certs []*x509.Certificate) (tls.Certificate, error) {
+	pub, ok := key.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return tls.Certificate{}, errors.New("pkcs12: unsupported private key type")
+	}
+	out := tls.Certificate{PrivateKey: key}
+	for i, c := range certs {
+		if samePublicKey(c.PublicKey, pub.Public()) {
+			out.Leaf = c
+			out.Certificate = append(out.Certificate, c.Raw)
+			certs = append(certs[:i:i], certs[i+1:]...)
+			break
+		}
+	}
+	if out.Leaf == nil {
+		return tls.Certificate{}, errors.New("pkcs12: no certificate matches the private key")
+	}
+	for _, c := range certs {
+		out.Certificate = append(out.Certificate, c.Raw)
+	}
+	return out, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		return a.Equal(b)
+	case *ecdsa.PublicKey:
+		return a.Equal(b)
+	case ed25519.PublicKey:
+		return a.Equal(b)
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package keystore
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestPair loads the unencrypted testdata/cert.pem and key.pem the bundles were made from.
+func loadTestPair(t *testing.T) tls.Certificate {
+	t.Helper()
+	pair, err := LoadPair(filepath.Join("testdata", "cert.pem"), filepath.Join("testdata", "key.pem"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func samePrivateKey(a, b crypto.PrivateKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PrivateKey) bool })
+	return ok && k.Equal(b)
+}
+
+// TestDecodePKCS12 loads bundles made by OpenSSL with each supported encryption scheme.
+func TestDecodePKCS12(t *testing.T) {
+	want := loadTestPair(t)
+	ca, err := LoadChain(filepath.Join("testdata", "ca.pem"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file, passphrase string
+	}{
+		{"aes256.p12", testPassphrase},  // PBES2 AES-256-CBC, SHA-256 MAC
+		{"3des.p12", testPassphrase},    // pbeWithSHAAnd3-KeyTripleDES-CBC
+		{"rc2-40.p12", testPassphrase},  // pbeWithSHAAnd40BitRC2-CBC certificates
+		{"rc2-128.p12", testPassphrase}, // pbeWithSHAAnd128BitRC2-CBC
+		{"utf8-pass.p12", "pässwörd €"},
+	}
+	for _, tt := range tests {
+		der, err := os.ReadFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsPKCS12(der) {
+			t.Errorf("%s: IsPKCS12 = false", tt.file)
+		}
+		pair, err := DecodePKCS12(der, []byte(tt.passphrase))
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+			continue
+		}
+		if !pair.Leaf.Equal(want.Leaf) {
+			t.Errorf("%s: leaf is %s, not the one in cert.pem", tt.file, pair.Leaf.Subject)
+		}
+		if len(pair.Certificate) != 2 || string(pair.Certificate[1]) != string(ca.Certificate[0]) {
+			t.Errorf("%s: chain has %d certificates, want the leaf and ca.pem", tt.file, len(pair.Certificate))
+		}
+		if !samePrivateKey(pair.PrivateKey, want.PrivateKey) {
+			t.Errorf("%s: private key differs from key.pem", tt.file)
+		}
+
+		if _, err := DecodePKCS12(der, []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("%s with a wrong passphrase: %v, want ErrPassphrase", tt.file, err)
+		}
+		if _, err := DecodePKCS12(der, nil); !errors.Is(err, ErrNeedPassphrase) {
+			t.Errorf("%s without a passphrase: %v, want ErrNeedPassphrase", tt.file, err)
+		}
+		corrupt := append([]byte(nil), der...)
+		corrupt[len(corrupt)/2] ^= 0xff
+		if _, err := DecodePKCS12(corrupt, []byte(tt.passphrase)); err == nil {
+			t.Errorf("%s: corrupted bundle decoded", tt.file)
+		}
+	}
+}
+
+// TestLoadPairPKCS12 loads a bundle through LoadPair, which ignores keyFile for PKCS#12.
+func TestLoadPairPKCS12(t *testing.T) {
+	pair, err := LoadPair(filepath.Join("testdata", "rc2-40.p12"), "", []byte(testPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePrivateKey(pair.PrivateKey, loadTestPair(t).PrivateKey) {
+		t.Error("private key differs from key.pem")
+	}
+	if _, err := LoadPair(filepath.Join("testdata", "rc2-40.p12"), "", []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: %v, want ErrPassphrase", err)
+	}
+}
+
+func TestIsPKCS12(t *testing.T) {
+	pem, err := os.ReadFile(filepath.Join("testdata", "cert.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsPKCS12(pem) || IsPKCS12(nil) {
+		t.Error("IsPKCS12 accepted PEM or empty data")
+	}
+}
@@ -0,0 +1,55 @@
+package keystore
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestRC2 checks decryption against the RFC 2268 section 5 test vectors.
+func TestRC2(t *testing.T) {
+	tests := []struct {
+		key        string
+		effective  int
+		plain, enc string
+	}{
+		{"0000000000000000", 63, "0000000000000000", "ebb773f993278eff"},
+		{"ffffffffffffffff", 64, "ffffffffffffffff", "278b27e42e2f0d49"},
+		{"3000000000000000", 64, "1000000000000001", "30649edf9be7d2c2"},
+		{"88", 64, "0000000000000000", "61a8a244adacccf0"},
+		{"88bca90e90875a", 64, "0000000000000000", "6ccf4308974c267f"},
+		{"88bca90e90875a7f0f79c384627bafb2", 64, "0000000000000000", "1a807d272bbe5db1"},
+		{"88bca90e90875a7f0f79c384627bafb2", 128, "0000000000000000", "2269552ab0f85ca6"},
+		{"88bca90e90875a7f0f79c384627bafb216f80a6f85920584c42fceb0be255daf1e", 129, "0000000000000000", "5b78d3a43dfff1f1"},
+	}
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		enc, _ := hex.DecodeString(tt.enc)
+		c, err := newRC2(key, tt.effective)
+		if err != nil {
+			t.Fatalf("newRC2(%s, %d): %v", tt.key, tt.effective, err)
+		}
+		got := make([]byte, c.BlockSize())
+		c.Decrypt(got, enc)
+		if hex.EncodeToString(got) != tt.plain {
+			t.Errorf("key %s/%d bits: decrypt %s = %x, want %s", tt.key, tt.effective, tt.enc, got, tt.plain)
+		}
+	}
+}
+
+func TestRC2KeyLength(t *testing.T) {
+	for _, n := range []int{0, 129} {
+		if _, err := newRC2(make([]byte, n), 64); err == nil {
+			t.Errorf("newRC2 accepted a %d-byte key", n)
+		}
+	}
+}
+
+func TestRC2PiTable(t *testing.T) {
+	var seen [256]bool
+	for _, b := range rc2PiTable {
+		if seen[b] {
+			t.Fatalf("rc2PiTable repeats %#02x", b)
+		}
+		seen[b] = true
+	}
+}
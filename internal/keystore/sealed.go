@@ -0,0 +1,100 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// sealedType is the PEM block type of a file encrypted with Seal.
+const sealedType = "HUZAA ENCRYPTED CONFIG"
+
+// sealIterations is the PBKDF2-SHA256 work factor of Seal.
+const sealIterations = 600_000
+
+// IsSealed reports whether data was written by Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN "+sealedType+"-----"))
+}
+
+// Seal encrypts plaintext with AES-256-GCM under a key derived from passphrase with
+// PBKDF2-SHA256, and returns it as a PEM block whose headers carry the parameters.
+func Seal(plaintext, passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty key")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := sealCipher(passphrase, salt, sealIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: sealedType,
+		Headers: map[string]string{
+			"Cipher":     "AES-256-GCM",
+			"KDF":        "PBKDF2-SHA256",
+			"Iterations": strconv.Itoa(sealIterations),
+			"Salt":       hex.EncodeToString(salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, plaintext, nil),
+	}), nil
+}
+
+// Open decrypts data written by Seal.
+func Open(data, passphrase []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != sealedType {
+		return nil, errors.New("not an encrypted config")
+	}
+	h := block.Headers
+	if h["Cipher"] != "AES-256-GCM" || h["KDF"] != "PBKDF2-SHA256" {
+		return nil, fmt.Errorf("unsupported encryption %s with %s", h["Cipher"], h["KDF"])
+	}
+	iter, err := strconv.Atoi(h["Iterations"])
+	if err != nil || iter <= 0 || iter > maxIterations {
+		return nil, fmt.Errorf("bad iteration count %q", h["Iterations"])
+	}
+	salt, err := hex.DecodeString(h["Salt"])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("bad salt")
+	}
+	nonce, err := hex.DecodeString(h["Nonce"])
+	if err != nil {
+		return nil, errors.New("bad nonce")
+	}
+	aead, err := sealCipher(passphrase, salt, iter)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("bad nonce")
+	}
+	plaintext, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("wrong key or corrupted file")
+	}
+	return plaintext, nil
+}
+
+func sealCipher(passphrase, salt []byte, iter int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(sha256.New, passphrase, salt, iter, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
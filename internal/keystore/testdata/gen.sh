@@ -0,0 +1,30 @@
+#!/bin/sh
+# Regenerates the keystore test fixtures with OpenSSL 3 (RC2 needs its legacy provider).
+# The tests only need the files; rerun this after changing the list below.
+set -e
+cd "$(dirname "$0")"
+pass=keystore-test
+
+# A CA and a leaf it issued; the bundles carry both.
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -days 36500 \
+	-subj /CN=keystore-test-ca -keyout ca.key -out ca.pem
+openssl req -new -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes \
+	-subj /CN=keystore-test -keyout key.pem -out leaf.csr
+openssl x509 -req -in leaf.csr -CA ca.pem -CAkey ca.key -CAcreateserial -days 36500 -out cert.pem
+rm ca.key ca.srl leaf.csr
+
+# PKCS#8 PBES2 (PBKDF2-HMAC-SHA256, AES-256-CBC) and legacy Proc-Type/DEK-Info PEM keys.
+openssl pkcs8 -topk8 -v2 aes-256-cbc -v2prf hmacWithSHA256 -in key.pem -passout pass:$pass -out key-pkcs8-aes256.pem
+openssl pkcs8 -topk8 -v1 PBE-SHA1-3DES -in key.pem -passout pass:$pass -out key-pkcs8-3des.pem
+openssl ec -aes256 -in key.pem -passout pass:$pass -out key-legacy-aes256.pem
+
+p12() {
+	out=$1
+	shift
+	openssl pkcs12 -export -in cert.pem -inkey key.pem -certfile ca.pem -name keystore-test -passout pass:$pass -out "$out" "$@"
+}
+p12 aes256.p12 # OpenSSL 3 default: PBES2 AES-256-CBC, SHA-256 MAC
+p12 3des.p12 -certpbe PBE-SHA1-3DES -keypbe PBE-SHA1-3DES -macalg sha1
+p12 rc2-40.p12 -legacy -certpbe PBE-SHA1-RC2-40 -keypbe PBE-SHA1-3DES -macalg sha1
+p12 rc2-128.p12 -legacy -certpbe PBE-SHA1-RC2-128 -keypbe PBE-SHA1-RC2-128 -macalg sha1
+p12 utf8-pass.p12 -certpbe PBE-SHA1-3DES -keypbe PBE-SHA1-3DES -macalg sha1 -passout 'pass:pässwörd €'
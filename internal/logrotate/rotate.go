@@ -0,0 +1,233 @@
+// Package logrotate provides a size- and time-based rotating file writer for the relay's
+// application and audit logs, for deployments without logrotate.
+package logrotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp inserted into rotated file names (name-<ts>.ext). A
+// second rotation within the same millisecond adds a sequence number (name-<ts>-<n>.ext).
+const backupTimeFormat = "20060102T150405.000"
+
+// Options controls when a Writer rotates and which backups it keeps. Zero values disable
+// the corresponding limit.
+type Options struct {
+	MaxSize    int64         // rotate once the file would exceed this many bytes
+	Interval   time.Duration // rotate when the file is older than this
+	MaxBackups int           // keep at most this many rotated files
+	MaxAge     time.Duration // delete rotated files older than this
+	Compress   bool          // gzip rotated files
+}
+
+// Writer is an io.WriteCloser that appends to a file and rotates it per Options. It is safe
+// for concurrent use.
+type Writer struct {
+	path     string
+	opts     Options
+	now      func() time.Time // the clock; tests replace it
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	opened   time.Time
+	pending  sync.WaitGroup // compressing and pruning after rotations
+	finishMu sync.Mutex     // one finish at a time, so prune never sees a half-written .gz
+}
+
+// Open opens (or creates) path for appending.
+func Open(path string, opts Options) (*Writer, error) {
+	w := &Writer{path: path, opts: opts, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = st.Size()
+	w.opened = st.ModTime()
+	if w.size == 0 {
+		w.opened = w.now()
+	}
+	return nil
+}
+
+// Write appends p, rotating first if p would push the file past MaxSize or the file is
+// older than Interval.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size > 0 && ((w.opts.MaxSize > 0 && w.size+int64(len(p)) > w.opts.MaxSize) ||
+		(w.opts.Interval > 0 && w.now().Sub(w.opened) >= w.opts.Interval)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate forces a rotation (cmd/relay calls it on SIGHUP).
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+// Close closes the current file and waits until rotated files are compressed and pruned.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.f != nil {
+		err = w.f.Close()
+		w.f = nil
+	}
+	w.mu.Unlock()
+	w.pending.Wait()
+	return err
+}
+
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	backup := w.backupName(w.now())
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	// Compression and pruning happen off the write path.
+	w.pending.Add(1)
+	go w.finish(backup)
+	return nil
+}
+
+// backupName returns a name for the file rotated at t that no backup has yet, compressed
+// or not.
+func (w *Writer) backupName(t time.Time) string {
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	name := fmt.Sprintf("%s-%s%s", base, t.Format(backupTimeFormat), ext)
+	for seq := 1; exists(name) || exists(name+".gz"); seq++ {
+		name = fmt.Sprintf("%s-%s-%d%s", base, t.Format(backupTimeFormat), seq, ext)
+	}
+	return name
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func (w *Writer) finish(backup string) {
+	defer w.pending.Done()
+	w.finishMu.Lock()
+	defer w.finishMu.Unlock()
+	if w.opts.Compress {
+		if err := gzipFile(backup); err == nil {
+			os.Remove(backup)
+		}
+	}
+	w.prune()
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	return out.Close()
+}
+
+// prune removes backups beyond MaxBackups and older than MaxAge.
+func (w *Writer) prune() {
+	if w.opts.MaxBackups <= 0 && w.opts.MaxAge <= 0 {
+		return
+	}
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		t    time.Time
+		seq  int
+	}
+	var backups []backup
+	for _, m := range matches {
+		ts := strings.TrimPrefix(m, base+"-")
+		ts = strings.TrimSuffix(strings.TrimSuffix(ts, ".gz"), ext)
+		ts, seqText, _ := strings.Cut(ts, "-")
+		t, err := time.ParseInLocation(backupTimeFormat, ts, time.Local)
+		if err != nil {
+			continue
+		}
+		seq := 0
+		if seqText != "" {
+			if seq, err = strconv.Atoi(seqText); err != nil {
+				continue
+			}
+		}
+		backups = append(backups, backup{m, t, seq})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].t.Equal(backups[j].t) {
+			return backups[i].t.After(backups[j].t)
+		}
+		return backups[i].seq > backups[j].seq
+	})
+	now := w.now()
+	for i, b := range backups {
+		if (w.opts.MaxBackups > 0 && i >= w.opts.MaxBackups) ||
+			(w.opts.MaxAge > 0 && now.Sub(b.t) > w.opts.MaxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
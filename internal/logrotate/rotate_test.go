@@ -0,0 +1,285 @@
+package logrotate
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+
+// testClock is a settable clock for Writer.now.
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// openTestWriter opens dir/app.log with opts on clock.
+func openTestWriter(t *testing.T, dir string, opts Options, clock *testClock) *Writer {
+	t.Helper()
+	w := &Writer{path: filepath.Join(dir, "app.log"), opts: opts, now: clock.now}
+	if err := w.open(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// backupName is the name of the first backup of dir/app.log rotated at t.
+func backupName(dir string, t time.Time) string {
+	return filepath.Join(dir, "app-"+t.Format(backupTimeFormat)+".log")
+}
+
+// readBackups returns the contents of the backups in dir, oldest first, decompressing them.
+func readBackups(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "app-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var out []string
+	for _, name := range names {
+		out = append(out, readFile(t, name))
+	}
+	return out
+}
+
+// readFile returns the content of path, decompressed if it ends in .gz.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if filepath.Ext(path) == ".gz" {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(b)
+}
+
+func TestRotateTriggers(t *testing.T) {
+	type step struct {
+		after time.Duration // clock advance before the write
+		write string
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		initial string // content of the log before Open
+		steps   []step
+		backups []string
+		current string
+	}{
+		{"off", Options{}, "", []step{{0, "aaaa"}, {24 * time.Hour, "bbbb"}}, nil, "aaaabbbb"},
+		{"size fits", Options{MaxSize: 8}, "", []step{{time.Second, "aaaa"}, {time.Second, "bbbb"}}, nil, "aaaabbbb"},
+		{"size exceeded", Options{MaxSize: 8}, "", []step{{time.Second, "aaaa"}, {time.Second, "bbbb"}, {time.Second, "c"}}, []string{"aaaabbbb"}, "c"},
+		{"size twice", Options{MaxSize: 4}, "", []step{{time.Second, "aaa"}, {time.Second, "bbb"}, {time.Second, "ccc"}}, []string{"aaa", "bbb"}, "ccc"},
+		{"oversized write to empty file", Options{MaxSize: 4}, "", []step{{time.Second, "aaaaaa"}, {time.Second, "b"}}, []string{"aaaaaa"}, "b"},
+		{"size counts existing content", Options{MaxSize: 8}, "0123456", []step{{time.Second, "ab"}}, []string{"0123456"}, "ab"},
+		{"interval not reached", Options{Interval: time.Hour}, "", []step{{0, "a"}, {59 * time.Minute, "b"}}, nil, "ab"},
+		{"interval reached", Options{Interval: time.Hour}, "", []step{{0, "a"}, {59 * time.Minute, "b"}, {time.Minute, "c"}}, []string{"ab"}, "c"},
+		{"interval restarts", Options{Interval: time.Hour}, "", []step{{0, "a"}, {time.Hour, "b"}, {59 * time.Minute, "c"}, {time.Minute, "d"}}, []string{"a", "bc"}, "d"},
+		{"interval on empty file", Options{Interval: time.Hour}, "", []step{{2 * time.Hour, "a"}}, nil, "a"},
+		{"size before interval", Options{MaxSize: 4, Interval: time.Hour}, "", []step{{0, "aaa"}, {time.Second, "bb"}, {time.Hour, "c"}}, []string{"aaa", "bb"}, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.initial != "" {
+				if err := os.WriteFile(filepath.Join(dir, "app.log"), []byte(tt.initial), 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock := &testClock{testStart}
+			w := openTestWriter(t, dir, tt.opts, clock)
+			for _, s := range tt.steps {
+				clock.advance(s.after)
+				if n, err := w.Write([]byte(s.write)); err != nil || n != len(s.write) {
+					t.Fatalf("Write(%q) = %d, %v", s.write, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := readBackups(t, dir); !slices.Equal(got, tt.backups) {
+				t.Errorf("backups %q, want %q", got, tt.backups)
+			}
+			if got := readFile(t, filepath.Join(dir, "app.log")); got != tt.current {
+				t.Errorf("current log %q, want %q", got, tt.current)
+			}
+		})
+	}
+}
+
+// TestRotateSameMillisecond rotates several times without the clock moving: no backup may
+// overwrite another, plain or compressed.
+func TestRotateSameMillisecond(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		clock := &testClock{testStart}
+		w := openTestWriter(t, dir, Options{Compress: compress}, clock)
+		want := []string{"first", "second", "third"}
+		for _, s := range want {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+			// Let the previous backup be compressed before the next name is picked.
+			w.pending.Wait()
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		base := backupName(dir, testStart)
+		ext := ""
+		if compress {
+			ext = ".gz"
+		}
+		names := []string{base, base[:len(base)-len(".log")] + "-1.log", base[:len(base)-len(".log")] + "-2.log"}
+		for i, name := range names {
+			if got := readFile(t, name+ext); got != want[i] {
+				t.Errorf("compress=%v: %s holds %q, want %q", compress, filepath.Base(name+ext), got, want[i])
+			}
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	clock := &testClock{testStart}
+	w := openTestWriter(t, dir, Options{MaxSize: 8, Compress: true}, clock)
+	for _, s := range []string{"hello", " world"} {
+		clock.advance(time.Second)
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backup := backupName(dir, testStart.Add(2*time.Second))
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("uncompressed backup left behind: %v", err)
+	}
+	if got := readFile(t, backup+".gz"); got != "hello" {
+		t.Errorf("compressed backup holds %q, want %q", got, "hello")
+	}
+}
+
+// TestPrune rotates once into a directory that already holds backups and checks which of
+// them are kept. Backups are named by their age relative to the rotation.
+func TestPrune(t *testing.T) {
+	type backup struct {
+		age time.Duration
+		seq string // "" or "-<n>"
+		gz  bool
+	}
+	tests := []struct {
+		name     string
+		opts     Options
+		existing []backup
+		kept     []backup // besides the new backup (age 0) and unrelated files
+	}{
+		{"no limits", Options{},
+			[]backup{{time.Hour, "", false}, {48 * time.Hour, "", false}},
+			[]backup{{time.Hour, "", false}, {48 * time.Hour, "", false}}},
+		{"max backups", Options{MaxBackups: 2},
+			[]backup{{time.Hour, "", false}, {2 * time.Hour, "", false}, {3 * time.Hour, "", false}},
+			[]backup{{time.Hour, "", false}}},
+		{"max backups counts compressed", Options{MaxBackups: 3},
+			[]backup{{time.Hour, "", true}, {2 * time.Hour, "", true}, {3 * time.Hour, "", true}},
+			[]backup{{time.Hour, "", true}, {2 * time.Hour, "", true}}},
+		{"max backups orders by sequence", Options{MaxBackups: 3},
+			[]backup{{time.Hour, "", false}, {time.Hour, "-1", false}, {time.Hour, "-2", false}},
+			[]backup{{time.Hour, "-1", false}, {time.Hour, "-2", false}}},
+		{"max age", Options{MaxAge: 90 * time.Minute},
+			[]backup{{time.Hour, "", false}, {2 * time.Hour, "", true}, {3 * time.Hour, "-1", false}},
+			[]backup{{time.Hour, "", false}}},
+		{"both", Options{MaxBackups: 2, MaxAge: 3 * time.Hour},
+			[]backup{{time.Hour, "", false}, {2 * time.Hour, "", false}, {4 * time.Hour, "", false}},
+			[]backup{{time.Hour, "", false}}},
+	}
+	unrelated := []string{"app-latest.log", "app-20260101T000000.000-x.log", "other-20200101T000000.000.log", "app.txt"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			now := testStart
+			name := func(b backup) string {
+				n := "app-" + now.Add(-b.age).Format(backupTimeFormat) + b.seq + ".log"
+				if b.gz {
+					n += ".gz"
+				}
+				return n
+			}
+			for _, f := range unrelated {
+				if err := os.WriteFile(filepath.Join(dir, f), nil, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, b := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name(b)), nil, 0o640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock := &testClock{now}
+			w := openTestWriter(t, dir, tt.opts, clock)
+			if _, err := w.Write([]byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := append([]string{"app.log", name(backup{})}, unrelated...)
+			for _, b := range tt.kept {
+				want = append(want, name(b))
+			}
+			sort.Strings(want)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("files\n%q\nwant\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	w := openTestWriter(t, t.TempDir(), Options{}, &testClock{testStart})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close: %v, want %v", err, os.ErrClosed)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
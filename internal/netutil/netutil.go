@@ -0,0 +1,65 @@
+// Package netutil normalizes peer addresses, so that policy, limits and logs written for
+// IPv4 also match dual-stack and NAT64 clients.
+package netutil
+
+import (
+	"net"
+	"net/netip"
+)
+
+// WellKnownNAT64 is the RFC 6052 well-known NAT64 prefix.
+var WellKnownNAT64 = netip.MustParsePrefix("64:ff9b::/96")
+
+// NormalizeIP returns the IPv4 address behind ip if it is IPv4-mapped (::ffff:a.b.c.d) or
+// inside one of the NAT64 prefixes; otherwise ip itself. Only /96 NAT64 prefixes embed the
+// IPv4 address in the last four bytes; other prefix lengths are ignored. The zone is dropped,
+// since prefixes never contain zoned addresses.
+func NormalizeIP(ip netip.Addr, nat64 []netip.Prefix) netip.Addr {
+	ip = ip.Unmap().WithZone("")
+	if !ip.Is6() {
+		return ip
+	}
+	for _, p := range nat64 {
+		if p.Bits() == 96 && p.Addr().Is6() && p.Contains(ip) {
+			b := ip.As16()
+			return netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+		}
+	}
+	return ip
+}
+
+// AddrIP returns the normalized IP of a TCP or UDP address, or the zero Addr for others.
+func AddrIP(a net.Addr, nat64 []netip.Prefix) netip.Addr {
+	var ap netip.AddrPort
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		ap = t.AddrPort()
+	case *net.UDPAddr:
+		ap = t.AddrPort()
+	default:
+		return netip.Addr{}
+	}
+	return NormalizeIP(ap.Addr(), nat64)
+}
+
+// AddrString formats a for logs with its IP normalized ("1.2.3.4:5678" rather than
+// "[::ffff:1.2.3.4]:5678"). Addresses that are not TCP or UDP, or have no valid IP, are
+// formatted as is.
+func AddrString(a net.Addr, nat64 []netip.Prefix) string {
+	var ap netip.AddrPort
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		ap = t.AddrPort()
+	case *net.UDPAddr:
+		ap = t.AddrPort()
+	default:
+		if a == nil {
+			return ""
+		}
+		return a.String()
+	}
+	if !ap.Addr().IsValid() {
+		return a.String()
+	}
+	return netip.AddrPortFrom(NormalizeIP(ap.Addr(), nat64), ap.Port()).String()
+}
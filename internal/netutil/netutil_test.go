@@ -0,0 +1,97 @@
+package netutil
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+var testNAT64 = []netip.Prefix{
+	WellKnownNAT64,
+	netip.MustParsePrefix("2001:db8:64::/96"),
+	netip.MustParsePrefix("2001:db8:ff::/64"), // not /96: ignored
+	netip.MustParsePrefix("10.0.0.0/8"),       // not IPv6: ignored
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+		nat64          []netip.Prefix
+	}{
+		{"native v4", "192.0.2.1", "192.0.2.1", testNAT64},
+		{"native v6", "2001:db8::1", "2001:db8::1", testNAT64},
+		{"v4-mapped", "::ffff:192.0.2.1", "192.0.2.1", testNAT64},
+		{"v4-mapped without prefixes", "::ffff:192.0.2.1", "192.0.2.1", nil},
+		{"well-known NAT64", "64:ff9b::c000:201", "192.0.2.1", testNAT64},
+		{"network-specific NAT64", "2001:db8:64::c000:201", "192.0.2.1", testNAT64},
+		{"NAT64 not configured", "64:ff9b::c000:201", "64:ff9b::c000:201", nil},
+		{"non-/96 prefix", "2001:db8:ff::c000:201", "2001:db8:ff::c000:201", testNAT64},
+		{"outside NAT64 /96", "64:ff9b::1:c000:201", "64:ff9b::1:c000:201", testNAT64},
+		{"zoned v6", "fe80::1%eth0", "fe80::1", testNAT64},
+		{"zoned NAT64", "64:ff9b::c000:201%eth0", "192.0.2.1", testNAT64},
+		{"loopback v6", "::1", "::1", testNAT64},
+	}
+	for _, tt := range tests {
+		got := NormalizeIP(netip.MustParseAddr(tt.in), tt.nat64)
+		if got.String() != tt.want {
+			t.Errorf("%s: NormalizeIP(%s) = %s, want %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+	if got := NormalizeIP(netip.Addr{}, testNAT64); got.IsValid() {
+		t.Errorf("NormalizeIP(zero Addr) = %s, want the zero Addr", got)
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	tests := []struct {
+		name string
+		in   net.Addr
+		want string // "" = zero Addr
+	}{
+		{"tcp v4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}, "192.0.2.1"},
+		{"tcp v4-mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 80}, "192.0.2.1"},
+		{"tcp NAT64", &net.TCPAddr{IP: net.ParseIP("64:ff9b::c000:201"), Port: 80}, "192.0.2.1"},
+		{"udp v6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "2001:db8::1"},
+		{"udp zoned", &net.UDPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 53}, "fe80::1"},
+		{"tcp without IP", &net.TCPAddr{Port: 80}, ""},
+		{"tcp bad IP length", &net.TCPAddr{IP: net.IP{1, 2, 3}, Port: 80}, ""},
+		{"unix", &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, ""},
+		{"nil", nil, ""},
+	}
+	for _, tt := range tests {
+		got := AddrIP(tt.in, testNAT64)
+		if tt.want == "" {
+			if got.IsValid() {
+				t.Errorf("%s: AddrIP = %s, want the zero Addr", tt.name, got)
+			}
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: AddrIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddrString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   net.Addr
+		want string
+	}{
+		{"tcp v4", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5678}, "192.0.2.1:5678"},
+		{"tcp v4-mapped", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5678}, "192.0.2.1:5678"},
+		{"tcp NAT64", &net.TCPAddr{IP: net.ParseIP("64:ff9b::c000:201"), Port: 5678}, "192.0.2.1:5678"},
+		{"tcp non-/96 prefix", &net.TCPAddr{IP: net.ParseIP("2001:db8:ff::c000:201"), Port: 5678}, "[2001:db8:ff::c000:201]:5678"},
+		{"udp v6", &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "[2001:db8::1]:53"},
+		{"tcp zoned", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth0", Port: 22}, "[fe80::1]:22"},
+		{"tcp without IP", &net.TCPAddr{Port: 80}, ":80"},
+		{"tcp bad IP length", &net.TCPAddr{IP: net.IP{1, 2, 3}, Port: 80}, (&net.TCPAddr{IP: net.IP{1, 2, 3}, Port: 80}).String()},
+		{"unix", &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, "/tmp/sock"},
+		{"nil", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := AddrString(tt.in, testNAT64); got != tt.want {
+			t.Errorf("%s: AddrString = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package stats keeps per-user transfer statistics as daily rollups in a small JSON file,
+// so usage survives restarts and can be reported per day or month.
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dayLayout keys the rollups (UTC days).
+const dayLayout = "2006-01-02"
+
+// Counts is one rollup bucket.
+type Counts struct {
+	Sessions int64 `json:"sessions"`
+	Bytes    int64 `json:"bytes"`
+	Failures int64 `json:"failures"`
+}
+
+func (c *Counts) add(o Counts) {
+	c.Sessions += o.Sessions
+	c.Bytes += o.Bytes
+	c.Failures += o.Failures
+}
+
+// Row is the total of one user (or "" for all users) over a query range.
+type Row struct {
+	User string `json:"user"`
+	Counts
+}
+
+// Store holds rollups by day and user. It is safe for concurrent use.
+type Store struct {
+	path      string
+	retention time.Duration
+
+	mu    sync.Mutex
+	days  map[string]map[string]*Counts // day -> user -> counts
+	dirty bool
+}
+
+// Open loads the store at path, or starts an empty one if the file does not exist yet.
+// Days older than retention (0 = keep forever) are dropped on Flush.
+func Open(path string, retention time.Duration) (*Store, error) {
+	s := &Store{path: path, retention: retention, days: make(map[string]map[string]*Counts)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.days); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Record adds one finished session of user, ended at t, that moved bytes.
+func (s *Store) Record(user string, t time.Time, bytes int64, ok bool) {
+	c := Counts{Sessions: 1, Bytes: bytes}
+	if !ok {
+		c.Failures = 1
+	}
+	day := t.UTC().Format(dayLayout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := s.days[day]
+	if users == nil {
+		users = make(map[string]*Counts)
+		s.days[day] = users
+	}
+	if users[user] == nil {
+		users[user] = &Counts{}
+	}
+	users[user].add(c)
+	s.dirty = true
+}
+
+// Query returns per-user totals for the days from since through until (inclusive, UTC),
+// sorted by user, followed by the overall total with User "".
+func (s *Store) Query(since, until time.Time) []Row {
+	from, to := since.UTC().Format(dayLayout), until.UTC().Format(dayLayout)
+	totals := make(map[string]*Counts)
+	var all Counts
+	s.mu.Lock()
+	for day, users := range s.days {
+		if day < from || day > to {
+			continue
+		}
+		for user, c := range users {
+			if totals[user] == nil {
+				totals[user] = &Counts{}
+			}
+			totals[user].add(*c)
+			all.add(*c)
+		}
+	}
+	s.mu.Unlock()
+	rows := make([]Row, 0, len(totals)+1)
+	for user, c := range totals {
+		rows = append(rows, Row{User: user, Counts: *c})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].User < rows[j].User })
+	return append(rows, Row{Counts: all})
+}
+
+// Flush writes the store to disk if it changed, dropping days past the retention. The
+// file is replaced atomically.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	if s.retention > 0 {
+		cutoff := time.Now().Add(-s.retention).UTC().Format(dayLayout)
+		for day := range s.days {
+			if day < cutoff {
+				delete(s.days, day)
+				s.dirty = true
+			}
+		}
+	}
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.days)
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(s.path, data)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true // retry on the next Flush
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
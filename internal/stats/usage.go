@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Usage export formats.
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// MonthRange returns the first and last UTC day of month ("2006-01"), for Query.
+func MonthRange(month string) (since, until time.Time, err error) {
+	since, err = time.Parse("2006-01", month)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("bad month %q (want YYYY-MM)", month)
+	}
+	return since, since.AddDate(0, 1, -1), nil
+}
+
+type usageJSON struct {
+	Month string      `json:"month"`
+	Users []usageUser `json:"users"`
+	Total Counts      `json:"total"`
+}
+
+type usageUser struct {
+	User string `json:"user"`
+	Counts
+}
+
+// WriteUsage writes the rows of a Query over month as a chargeback report in format
+// (FormatCSV or FormatJSON). The CSV has one line per user; JSON adds the total.
+func WriteUsage(w io.Writer, format, month string, rows []Row) error {
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"month", "user", "sessions", "bytes", "failures"})
+		for _, row := range rows {
+			if row.User == "" {
+				continue
+			}
+			cw.Write([]string{month, row.User,
+				strconv.FormatInt(row.Sessions, 10),
+				strconv.FormatInt(row.Bytes, 10),
+				strconv.FormatInt(row.Failures, 10)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case FormatJSON:
+		out := usageJSON{Month: month, Users: []usageUser{}}
+		for _, row := range rows {
+			if row.User == "" {
+				out.Total = row.Counts
+				continue
+			}
+			out.Users = append(out.Users, usageUser{User: row.User, Counts: row.Counts})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	}
+	return fmt.Errorf("unknown usage format %q (want %s or %s)", format, FormatCSV, FormatJSON)
+}
@@ -0,0 +1,493 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/stats"
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+)
+
+// AdminUser is a credential for the admin API (AdminListen).
+type AdminUser struct {
+	Username string
+	Secret   string
+}
+
+// adminSession is a session as listed by the admin API.
+type adminSession struct {
+	SessionInfo
+	AgeSec int64 `json:"age_sec"`
+}
+
+// serveAdmin serves the admin API on AdminListen over HTTPS with the relay's certificate.
+// Every request needs HTTP basic auth with one of AdminUsers; the username is the actor of
+// the admin actions it takes. Replies are JSON:
+//
+//	GET    /sessions             registered sessions, oldest first
+//	DELETE /sessions/<id>        end a session (close reason admin_kill)
+//	PUT    /sessions/<id>/debug  {"enabled": bool}: debug logging for one session
+//	PUT    /sessions/<id>/rate   {"rate_bps": n}: BoostSession (0 = unlimited)
+//	PUT    /sessions/<id>/trace  {"enabled": bool}: TraceSession
+//	GET    /sessions/<id>/trace?format=text|mermaid  {"trace": "..."}: SessionTrace
+//	GET    /ports                DCC port pool state
+//	PUT    /ports                {"min", "max"}: SetPortRange
+//	GET    /limits               runtime limits
+//	PUT    /limits               {"max_sessions", "shed", "max_bandwidth_bps"}, each optional
+//	PUT    /users/<name>/rate    {"rate_bps": n}: SetUserRate (0 = unlimited)
+//	GET    /debug                debug logging settings
+//	PUT    /debug                {"enabled", "sample_every", "max_per_sec"}, each optional
+//	GET    /read_only            {"enabled": bool}: whether only downloads are accepted
+//	PUT    /read_only            {"enabled": bool}: SetReadOnly
+//	GET    /actions?limit=<n>    recent admin actions
+//	GET    /stats?since=&until=  per-user totals for UTC days YYYY-MM-DD (default: the last 7)
+//	GET    /usage?month=&format= monthly usage export, csv (default) or json; month YYYY-MM (default: this one)
+//	GET    /banner               {"text": "..."}: the MsgBanner text ("" = none)
+//	PUT    /banner               {"text": "..."}: SetBanner
+//	POST   /tls/reload           ReloadTLS
+//	POST   /drain                {"grace_sec"}: Shutdown, giving transfers grace_sec (default 30)
+func (r *Relay) serveAdmin() error {
+	users := make(auth.Credentials)
+	for _, u := range r.config.AdminUsers {
+		if u.Username != "" && u.Secret != "" {
+			users[u.Username] = u.Secret
+		}
+	}
+	if len(users) == 0 {
+		return errors.New("admin_listen needs admin_users")
+	}
+	ln, err := tls.Listen("tcp", r.config.AdminListen, r.dccTLS)
+	if err != nil {
+		return fmt.Errorf("admin listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", r.adminSessions)
+	mux.HandleFunc("/sessions/", r.adminSession)
+	mux.HandleFunc("/ports", r.adminPorts)
+	mux.HandleFunc("/limits", r.adminLimits)
+	mux.HandleFunc("/users/", r.adminUser)
+	mux.HandleFunc("/debug", r.adminDebug)
+	mux.HandleFunc("/read_only", r.adminReadOnly)
+	mux.HandleFunc("/actions", func(w http.ResponseWriter, req *http.Request) {
+		if !adminMethod(w, req, http.MethodGet) {
+			return
+		}
+		limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+		adminReply(w, r.AdminActions(limit))
+	})
+	mux.HandleFunc("/stats", r.adminStats)
+	mux.HandleFunc("/usage", r.adminUsage)
+	mux.HandleFunc("/banner", r.adminBanner)
+	mux.HandleFunc("/tls/reload", func(w http.ResponseWriter, req *http.Request) {
+		if adminMethod(w, req, http.MethodPost) {
+			actor, _, _ := req.BasicAuth()
+			adminResult(w, r.ReloadTLS(actor))
+		}
+	})
+	mux.HandleFunc("/drain", r.adminDrain)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			user, secret, ok := req.BasicAuth()
+			if !ok || !users.Verify(user, []byte(secret)) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="huzaa relay admin"`)
+				adminFail(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+			mux.ServeHTTP(w, req)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	context.AfterFunc(r.ctx, func() { ln.Close() })
+	r.spawn(func() {
+		h := r.health.register("admin server", 0)
+		err := srv.Serve(ln)
+		if r.ctx.Err() != nil {
+			h.stop()
+			return
+		}
+		log.Printf("relay: admin server: %v", err)
+		h.exit(err)
+	})
+	log.Printf("relay: admin API listening on %s", r.config.AdminListen)
+	return nil
+}
+
+// adminSessions handles /sessions.
+func (r *Relay) adminSessions(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet) {
+		return
+	}
+	now := time.Now()
+	out := []adminSession{}
+	for _, s := range r.Sessions() {
+		out = append(out, adminSession{SessionInfo: s, AgeSec: int64(now.Sub(s.CreatedAt) / time.Second)})
+	}
+	adminReply(w, out)
+}
+
+// adminSession handles /sessions/<id> and its subresources.
+func (r *Relay) adminSession(w http.ResponseWriter, req *http.Request) {
+	actor, _, _ := req.BasicAuth()
+	id, sub, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/sessions/"), "/")
+	switch sub {
+	case "":
+		if adminMethod(w, req, http.MethodDelete) {
+			adminResult(w, r.KillSession(actor, id))
+		}
+	case "debug":
+		if !adminMethod(w, req, http.MethodPut) {
+			return
+		}
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+			adminFail(w, http.StatusBadRequest, errors.New(`need {"enabled": true|false}`))
+			return
+		}
+		adminResult(w, r.SetSessionDebug(actor, id, *body.Enabled))
+	case "rate":
+		if !adminMethod(w, req, http.MethodPut) {
+			return
+		}
+		bps, ok := adminRate(w, req)
+		if ok {
+			adminResult(w, r.BoostSession(actor, id, bps))
+		}
+	case "trace":
+		if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if req.Method == http.MethodGet {
+			text, err := r.SessionTrace(id, req.URL.Query().Get("format"))
+			if err != nil {
+				adminResult(w, err)
+				return
+			}
+			adminReply(w, map[string]string{"trace": text})
+			return
+		}
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+			adminFail(w, http.StatusBadRequest, errors.New(`need {"enabled": true|false}`))
+			return
+		}
+		adminResult(w, r.TraceSession(actor, id, *body.Enabled))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// adminPorts handles /ports.
+func (r *Relay) adminPorts(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		actor, _, _ := req.BasicAuth()
+		var body struct {
+			Min *int `json:"min"`
+			Max *int `json:"max"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Min == nil || body.Max == nil {
+			adminFail(w, http.StatusBadRequest, errors.New(`need {"min": port, "max": port}`))
+			return
+		}
+		if err := r.SetPortRange(actor, *body.Min, *body.Max); err != nil {
+			adminFail(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	adminReply(w, r.PortPool())
+}
+
+// adminLimits handles /limits.
+func (r *Relay) adminLimits(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		actor, _, _ := req.BasicAuth()
+		var body struct {
+			MaxSessions     *int   `json:"max_sessions"`
+			Shed            bool   `json:"shed"`
+			MaxBandwidthBps *int64 `json:"max_bandwidth_bps"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			adminFail(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.MaxSessions != nil {
+			if err := r.SetMaxSessions(actor, *body.MaxSessions, body.Shed); err != nil {
+				adminFail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if body.MaxBandwidthBps != nil {
+			if err := r.SetMaxBandwidth(actor, *body.MaxBandwidthBps); err != nil {
+				adminFail(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+	adminReply(w, r.Limits())
+}
+
+// adminUser handles /users/<name>/rate.
+func (r *Relay) adminUser(w http.ResponseWriter, req *http.Request) {
+	name, sub, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/users/"), "/")
+	if sub != "rate" {
+		http.NotFound(w, req)
+		return
+	}
+	if !adminMethod(w, req, http.MethodPut) {
+		return
+	}
+	actor, _, _ := req.BasicAuth()
+	if bps, ok := adminRate(w, req); ok {
+		adminResult(w, r.SetUserRate(actor, name, bps))
+	}
+}
+
+// adminBanner handles /banner.
+func (r *Relay) adminBanner(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	var body struct {
+		Text *string `json:"text"`
+	}
+	if req.Method == http.MethodPut {
+		actor, _, _ := req.BasicAuth()
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Text == nil {
+			adminFail(w, http.StatusBadRequest, errors.New(`need {"text": "..."}`))
+			return
+		}
+		if len(*body.Text) > maxBannerLen {
+			adminFail(w, http.StatusBadRequest, fmt.Errorf("banner is longer than %d bytes", maxBannerLen))
+			return
+		}
+		r.SetBanner(actor, *body.Text)
+	}
+	text := r.Banner()
+	body.Text = &text
+	adminReply(w, body)
+}
+
+// adminDebug handles /debug.
+func (r *Relay) adminDebug(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		actor, _, _ := req.BasicAuth()
+		var body struct {
+			Enabled     *bool `json:"enabled"`
+			SampleEvery *int  `json:"sample_every"`
+			MaxPerSec   *int  `json:"max_per_sec"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			adminFail(w, http.StatusBadRequest, err)
+			return
+		}
+		if body.Enabled != nil {
+			r.SetDebug(actor, *body.Enabled)
+		}
+		if body.SampleEvery != nil || body.MaxPerSec != nil {
+			cur := r.Debug()
+			if body.SampleEvery != nil {
+				cur.SampleEvery = *body.SampleEvery
+			}
+			if body.MaxPerSec != nil {
+				cur.MaxPerSec = *body.MaxPerSec
+			}
+			r.SetDebugSampling(actor, cur.SampleEvery, cur.MaxPerSec)
+		}
+	}
+	adminReply(w, r.Debug())
+}
+
+// adminReadOnly handles /read_only.
+func (r *Relay) adminReadOnly(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if req.Method == http.MethodPut {
+		actor, _, _ := req.BasicAuth()
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+			adminFail(w, http.StatusBadRequest, errors.New(`need {"enabled": true|false}`))
+			return
+		}
+		r.SetReadOnly(actor, *body.Enabled)
+	}
+	enabled := r.ReadOnly()
+	body.Enabled = &enabled
+	adminReply(w, body)
+}
+
+// adminStats handles /stats.
+func (r *Relay) adminStats(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet) {
+		return
+	}
+	if r.stats == nil {
+		adminFail(w, http.StatusNotFound, errors.New("stats_file is not set"))
+		return
+	}
+	until := time.Now().UTC()
+	since := until.AddDate(0, 0, -7)
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if v := req.URL.Query().Get(p.name); v != "" {
+			t, err := time.Parse(time.DateOnly, v)
+			if err != nil {
+				adminFail(w, http.StatusBadRequest, fmt.Errorf("bad %s %q (want YYYY-MM-DD)", p.name, v))
+				return
+			}
+			*p.t = t
+		}
+	}
+	adminReply(w, r.Stats(since, until))
+}
+
+// adminUsage handles /usage: the monthly per-user usage export, as CSV or JSON.
+func (r *Relay) adminUsage(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodGet) {
+		return
+	}
+	if r.stats == nil {
+		adminFail(w, http.StatusNotFound, errors.New("stats_file is not set"))
+		return
+	}
+	q := req.URL.Query()
+	month := q.Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("2006-01")
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = stats.FormatCSV
+	}
+	since, until, err := stats.MonthRange(month)
+	if err != nil {
+		adminFail(w, http.StatusBadRequest, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := stats.WriteUsage(&buf, format, month, r.Stats(since, until)); err != nil {
+		adminFail(w, http.StatusBadRequest, err)
+		return
+	}
+	if format == stats.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// defaultDrainGrace is how long transfers may run on after POST /drain without grace_sec.
+const defaultDrainGrace = 30 * time.Second
+
+// adminDrain handles /drain: it starts Shutdown and answers 202 right away. The admin API
+// keeps serving while sessions drain.
+func (r *Relay) adminDrain(w http.ResponseWriter, req *http.Request) {
+	if !adminMethod(w, req, http.MethodPost) {
+		return
+	}
+	actor, _, _ := req.BasicAuth()
+	var body struct {
+		GraceSec *int `json:"grace_sec"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil && err != io.EOF {
+		adminFail(w, http.StatusBadRequest, err)
+		return
+	}
+	grace := defaultDrainGrace
+	if body.GraceSec != nil {
+		grace = time.Duration(max(*body.GraceSec, 0)) * time.Second
+	}
+	params := map[string]string{"grace": grace.String()}
+	if r.draining() {
+		err := errors.New("already draining")
+		r.recordAdminAction(actor, "drain", params, err)
+		adminFail(w, http.StatusConflict, err)
+		return
+	}
+	r.recordAdminAction(actor, "drain", params, nil)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		r.Shutdown(ctx)
+	}()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "{}\n")
+}
+
+// adminRate decodes a {"rate_bps": n} request body, answering 400 if it has none.
+func adminRate(w http.ResponseWriter, req *http.Request) (int64, bool) {
+	var body struct {
+		RateBps *int64 `json:"rate_bps"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.RateBps == nil {
+		adminFail(w, http.StatusBadRequest, errors.New(`need {"rate_bps": n}`))
+		return 0, false
+	}
+	return *body.RateBps, true
+}
+
+// adminMethod reports whether req uses one of methods, and answers 405 if not.
+func adminMethod(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	adminFail(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", strings.Join(methods, " or ")))
+	return false
+}
+
+// adminResult answers {} for a successful action, or the error: 404 for an unknown
+// session, 400 otherwise.
+func adminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		adminReply(w, struct{}{})
+	case errors.Is(err, ErrSessionNotFound):
+		adminFail(w, http.StatusNotFound, err)
+	default:
+		adminFail(w, http.StatusBadRequest, err)
+	}
+}
+
+func adminReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminFail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
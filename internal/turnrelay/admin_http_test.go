@@ -0,0 +1,365 @@
+package turnrelay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+)
+
+// adminTestUser and adminTestSecret are the admin API credential of startAdminRelay.
+const (
+	adminTestUser   = "ops"
+	adminTestSecret = "ops-secret"
+)
+
+// startAdminRelay runs a relay with config c and the admin API enabled, and returns it with
+// the admin API's base URL.
+func startAdminRelay(t testing.TB, c *RelayConfig) (*Relay, string, string) {
+	t.Helper()
+	c.AdminListen = fmt.Sprintf("127.0.0.1:%d", freePortRange(t, 1))
+	c.AdminUsers = []AdminUser{{Username: adminTestUser, Secret: adminTestSecret}}
+	r, addr := startTestRelay(t, c)
+	return r, addr, "https://" + c.AdminListen
+}
+
+// adminCall sends an admin API request as adminTestUser (no auth if user is "") and returns
+// the status and body. body, if not nil, is sent as JSON.
+func adminCall(t testing.TB, user, method, url string, body interface{}) (int, []byte) {
+	t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "" {
+		req.SetBasicAuth(user, adminTestSecret)
+	}
+	req.Close = true // no idle connections left to skew goroutine counts (TestStress)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// The usage export is per-user billing data: it is served on the admin API behind basic
+// auth, not on the unauthenticated metrics listener.
+func TestAdminUsage(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.StatsFile = filepath.Join(t.TempDir(), "stats.json")
+	c.MetricsListen = fmt.Sprintf("127.0.0.1:%d", freePortRange(t, 1))
+	_, _, admin := startAdminRelay(t, c)
+
+	if status, _ := adminCall(t, "", http.MethodGet, admin+"/usage", nil); status != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated /usage: %d, want 401", status)
+	}
+	status, body := adminCall(t, adminTestUser, http.MethodGet, admin+"/usage?month=2025-06", nil)
+	if status != http.StatusOK || !strings.HasPrefix(string(body), "month,user,sessions,bytes,failures") {
+		t.Fatalf("/usage: %d %q", status, body)
+	}
+	if status, _ := adminCall(t, adminTestUser, http.MethodGet, admin+"/usage?month=June", nil); status != http.StatusBadRequest {
+		t.Fatalf("/usage with a bad month: %d, want 400", status)
+	}
+
+	resp, err := http.Get("http://" + c.MetricsListen + "/usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("metrics listener /usage: %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAdminBoostSession(t *testing.T) {
+	r, addr, admin := startAdminRelay(t, newTestConfig(t, 4))
+	registerTestSession(t, dialTestBot(t, addr), "upload", testSessionID(1))
+	sess, err := r.lookupSession(testSessionID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := admin + "/sessions/" + testSessionID(1) + "/rate"
+	if status, body := adminCall(t, adminTestUser, http.MethodPut, url, map[string]int64{"rate_bps": 4096}); status != http.StatusOK {
+		t.Fatalf("PUT rate: %d %s", status, body)
+	}
+	if rate, boosted := sess.limiter.currentRate(); rate != 4096 || !boosted {
+		t.Errorf("limiter = %d boosted=%v, want 4096 boosted", rate, boosted)
+	}
+	if a := r.AdminActions(1); len(a) != 1 || a[0].Action != "boost_session" || a[0].Actor != adminTestUser {
+		t.Errorf("admin actions = %+v, want boost_session by %s", a, adminTestUser)
+	}
+
+	for _, tt := range []struct {
+		url  string
+		body interface{}
+		want int
+	}{
+		{url, map[string]int64{"rate_bps": -1}, http.StatusBadRequest},
+		{url, map[string]string{}, http.StatusBadRequest},
+		{admin + "/sessions/" + testSessionID(2) + "/rate", map[string]int64{"rate_bps": 1}, http.StatusNotFound},
+	} {
+		if status, body := adminCall(t, adminTestUser, http.MethodPut, tt.url, tt.body); status != tt.want {
+			t.Errorf("PUT %s %v: %d %s, want %d", tt.url, tt.body, status, body, tt.want)
+		}
+	}
+	if status, _ := adminCall(t, adminTestUser, http.MethodGet, url, nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET rate: %d, want 405", status)
+	}
+	if rate, _ := sess.limiter.currentRate(); rate != 4096 {
+		t.Errorf("rejected requests changed the rate to %d", rate)
+	}
+}
+
+// adminJSON is adminCall for requests that must succeed; it decodes the reply into out.
+func adminJSON(t testing.TB, method, url string, body, out interface{}) {
+	t.Helper()
+	status, data := adminCall(t, adminTestUser, method, url, body)
+	if status != http.StatusOK {
+		t.Fatalf("%s %s: %d %s", method, url, status, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+}
+
+func TestAdminLimits(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.MaxSessions = 10
+	r, addr, admin := startAdminRelay(t, c)
+	var limits Limits
+	adminJSON(t, http.MethodGet, admin+"/limits", nil, &limits)
+	if limits.MaxSessions != 10 {
+		t.Errorf("GET /limits: max_sessions %d, want 10", limits.MaxSessions)
+	}
+
+	registerTestSession(t, dialTestBot(t, addr), "upload", testSessionID(1))
+	registerTestSession(t, dialTestBot(t, addr), "upload", testSessionID(2))
+	adminJSON(t, http.MethodPut, admin+"/limits", map[string]interface{}{"max_sessions": 1, "shed": true}, &limits)
+	if limits.MaxSessions != 1 || r.Limits().MaxSessions != 1 {
+		t.Errorf("PUT /limits: max_sessions %d (relay %d), want 1", limits.MaxSessions, r.Limits().MaxSessions)
+	}
+	waitFor(t, 5*time.Second, "a session to be shed", func() bool { return sessionCount(r) == 1 })
+	if _, err := r.lookupSession(testSessionID(1)); err != nil {
+		t.Errorf("the older session was shed: %v", err)
+	}
+
+	if status, _ := adminCall(t, adminTestUser, http.MethodPut, admin+"/limits", map[string]int{"max_sessions": 0}); status != http.StatusBadRequest {
+		t.Errorf("PUT /limits max_sessions 0: %d, want 400", status)
+	}
+	if r.Limits().MaxSessions != 1 {
+		t.Errorf("rejected PUT changed max_sessions to %d", r.Limits().MaxSessions)
+	}
+}
+
+func TestAdminUserRate(t *testing.T) {
+	r, addr, admin := startAdminRelay(t, newTestConfig(t, 4))
+	registerTestSession(t, dialTestBot(t, addr), "upload", testSessionID(1))
+	sess, err := r.lookupSession(testSessionID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminJSON(t, http.MethodPut, admin+"/users/"+testUser+"/rate", map[string]int64{"rate_bps": 2048}, nil)
+	if got := r.policy(testUser).MaxRateBps; got != 2048 {
+		t.Errorf("policy rate = %d, want 2048", got)
+	}
+	if rate, boosted := sess.limiter.currentRate(); rate != 2048 || boosted {
+		t.Errorf("running session limiter = %d boosted=%v, want 2048 from the policy", rate, boosted)
+	}
+	for _, tt := range []struct {
+		method, path string
+		body         interface{}
+		want         int
+	}{
+		{http.MethodPut, "/users/nobody/rate", map[string]int64{"rate_bps": 1}, http.StatusBadRequest},
+		{http.MethodPut, "/users/" + testUser + "/rate", map[string]int64{"rate_bps": -1}, http.StatusBadRequest},
+		{http.MethodPut, "/users/" + testUser + "/rate", nil, http.StatusBadRequest},
+		{http.MethodGet, "/users/" + testUser + "/rate", nil, http.StatusMethodNotAllowed},
+		{http.MethodPut, "/users/" + testUser, map[string]int64{"rate_bps": 1}, http.StatusNotFound},
+	} {
+		if status, body := adminCall(t, adminTestUser, tt.method, admin+tt.path, tt.body); status != tt.want {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, status, body, tt.want)
+		}
+	}
+}
+
+func TestAdminPortRange(t *testing.T) {
+	r, _, admin := startAdminRelay(t, newTestConfig(t, 4))
+	base := freePortRange(t, 6)
+	var pool PortPoolInfo
+	adminJSON(t, http.MethodPut, admin+"/ports", map[string]int{"min": base, "max": base + 5}, &pool)
+	if pool.Min != base || pool.Max != base+5 || pool.Free != 6 {
+		t.Errorf("PUT /ports: %+v, want %d-%d with 6 free", pool, base, base+5)
+	}
+	if lo, hi := r.portPool.Range(); lo != base || hi != base+5 {
+		t.Errorf("pool range %d-%d, want %d-%d", lo, hi, base, base+5)
+	}
+	for _, body := range []interface{}{
+		map[string]int{"min": base + 5, "max": base},
+		map[string]int{"min": base},
+		nil,
+	} {
+		if status, data := adminCall(t, adminTestUser, http.MethodPut, admin+"/ports", body); status != http.StatusBadRequest {
+			t.Errorf("PUT /ports %v: %d %s, want 400", body, status, data)
+		}
+	}
+	adminJSON(t, http.MethodGet, admin+"/ports", nil, &pool)
+	if pool.Min != base || pool.Max != base+5 {
+		t.Errorf("rejected PUTs changed the range to %d-%d", pool.Min, pool.Max)
+	}
+}
+
+func TestAdminTrace(t *testing.T) {
+	r, addr, admin := startAdminRelay(t, newTestConfig(t, 4))
+	bot := dialTestBot(t, addr)
+	registerTestSession(t, bot, "download", testSessionID(1))
+	url := admin + "/sessions/" + testSessionID(1) + "/trace"
+
+	if status, _ := adminCall(t, adminTestUser, http.MethodGet, url, nil); status != http.StatusNotFound {
+		t.Errorf("GET trace before tracing: %d, want 404", status)
+	}
+	adminJSON(t, http.MethodPut, url, map[string]bool{"enabled": true}, nil)
+	if err := WriteFrame(bot, MsgData, []byte("traced")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the data frame to be traced", func() bool {
+		text, _ := r.SessionTrace(testSessionID(1), "text")
+		return strings.Contains(text, " data")
+	})
+	adminJSON(t, http.MethodPut, url, map[string]bool{"enabled": false}, nil)
+
+	for format, want := range map[string]string{"": "trace of ", "text": "trace of ", "mermaid": "sequenceDiagram"} {
+		var reply struct {
+			Trace string `json:"trace"`
+		}
+		adminJSON(t, http.MethodGet, url+"?format="+format, nil, &reply)
+		if !strings.HasPrefix(reply.Trace, want) || !strings.Contains(reply.Trace, " data") {
+			t.Errorf("GET trace format %q: %q", format, reply.Trace)
+		}
+	}
+	for _, tt := range []struct {
+		method, url string
+		body        interface{}
+		want        int
+	}{
+		{http.MethodGet, url + "?format=svg", nil, http.StatusBadRequest},
+		{http.MethodPut, url, map[string]string{}, http.StatusBadRequest},
+		{http.MethodPut, admin + "/sessions/" + testSessionID(2) + "/trace", map[string]bool{"enabled": true}, http.StatusNotFound},
+		{http.MethodGet, admin + "/sessions/" + testSessionID(2) + "/trace", nil, http.StatusNotFound},
+		{http.MethodPost, url, nil, http.StatusMethodNotAllowed},
+	} {
+		if status, body := adminCall(t, adminTestUser, tt.method, tt.url, tt.body); status != tt.want {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.url, status, body, tt.want)
+		}
+	}
+}
+
+func TestAdminMaxBandwidth(t *testing.T) {
+	r, _, admin := startAdminRelay(t, newTestConfig(t, 4))
+	var limits Limits
+	adminJSON(t, http.MethodPut, admin+"/limits", map[string]int64{"max_bandwidth_bps": 1 << 20}, &limits)
+	if limits.MaxBandwidthBps != 1<<20 || r.bandwidth.currentRate() != 1<<20 {
+		t.Errorf("PUT /limits: max_bandwidth_bps %d (relay %d), want %d", limits.MaxBandwidthBps, r.bandwidth.currentRate(), 1<<20)
+	}
+	if status, _ := adminCall(t, adminTestUser, http.MethodPut, admin+"/limits", map[string]int64{"max_bandwidth_bps": -1}); status != http.StatusBadRequest {
+		t.Errorf("PUT /limits max_bandwidth_bps -1: %d, want 400", status)
+	}
+	adminJSON(t, http.MethodPut, admin+"/limits", map[string]int64{"max_bandwidth_bps": 0}, &limits)
+	if limits.MaxBandwidthBps != 0 || limits.MaxSessions == 0 {
+		t.Errorf("PUT /limits max_bandwidth_bps 0: %+v", limits)
+	}
+}
+
+func TestAdminBanner(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.Banner = "from the config"
+	_, addr, admin := startAdminRelay(t, c)
+	var reply struct {
+		Text string `json:"text"`
+	}
+	adminJSON(t, http.MethodGet, admin+"/banner", nil, &reply)
+	if reply.Text != "from the config" {
+		t.Errorf("GET /banner: %q", reply.Text)
+	}
+	adminJSON(t, http.MethodPut, admin+"/banner", map[string]string{"text": "maintenance at 02:00 UTC"}, &reply)
+	if reply.Text != "maintenance at 02:00 UTC" {
+		t.Errorf("PUT /banner: %q", reply.Text)
+	}
+
+	// New bots get the new text right after MsgAuthOk.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNFrames}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := WriteFrame(conn, MsgAuth, auth.MarshalRequest(testUser, testSecret)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []byte{MsgAuthOk, MsgBanner} {
+		msgType, payload, err := ReadFrame(conn)
+		if err != nil || msgType != want {
+			t.Fatalf("read %s: got %s, %v", MsgTypeName(want), MsgTypeName(msgType), err)
+		}
+		if want == MsgBanner && string(payload) != "maintenance at 02:00 UTC" {
+			t.Errorf("MsgBanner %q", payload)
+		}
+	}
+
+	if status, _ := adminCall(t, adminTestUser, http.MethodPut, admin+"/banner", map[string]string{"text": strings.Repeat("x", maxBannerLen+1)}); status != http.StatusBadRequest {
+		t.Errorf("PUT /banner too long: %d, want 400", status)
+	}
+	if status, _ := adminCall(t, adminTestUser, http.MethodPut, admin+"/banner", map[string]int{}); status != http.StatusBadRequest {
+		t.Errorf("PUT /banner without text: %d, want 400", status)
+	}
+	adminJSON(t, http.MethodPut, admin+"/banner", map[string]string{"text": ""}, &reply)
+	if reply.Text != "" {
+		t.Errorf("PUT /banner \"\": %q", reply.Text)
+	}
+}
+
+func TestAdminReloadTLS(t *testing.T) {
+	c := newTestConfig(t, 4)
+	r, _, admin := startAdminRelay(t, c)
+	rotated := rotateTestCert(t, c.TLSCertFile, c.TLSKeyFile, time.Now().Add(time.Minute))
+	adminJSON(t, http.MethodPost, admin+"/tls/reload", nil, nil)
+	if got := cachedCert(t, r.certs); !got.Equal(rotated) {
+		t.Error("POST /tls/reload did not load the rotated certificate")
+	}
+	if err := os.Remove(c.TLSKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := adminCall(t, adminTestUser, http.MethodPost, admin+"/tls/reload", nil); status != http.StatusBadRequest {
+		t.Errorf("POST /tls/reload without a key: %d %s, want 400", status, body)
+	}
+	if got := cachedCert(t, r.certs); !got.Equal(rotated) {
+		t.Error("failed reload replaced the certificate")
+	}
+	if status, _ := adminCall(t, adminTestUser, http.MethodGet, admin+"/tls/reload", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET /tls/reload: %d, want 405", status)
+	}
+}
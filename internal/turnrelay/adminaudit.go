@@ -0,0 +1,72 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// adminHistorySize is how many recent admin actions are kept in memory for AdminActions.
+const adminHistorySize = 500
+
+// AdminAction is one recorded admin/control action.
+type AdminAction struct {
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor"`  // who did it (admin API user, "control-socket", "signal", ...)
+	Action string            `json:"action"` // e.g. "set_debug", "kill_session"
+	Params map[string]string `json:"params,omitempty"`
+	Error  string            `json:"error,omitempty"` // set if the action failed
+}
+
+// adminHistory is a bounded in-memory ring of recent admin actions.
+type adminHistory struct {
+	mu      sync.Mutex
+	actions []AdminAction
+}
+
+func (h *adminHistory) add(a AdminAction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.actions = append(h.actions, a)
+	if len(h.actions) > adminHistorySize {
+		h.actions = h.actions[len(h.actions)-adminHistorySize:]
+	}
+}
+
+// recordAdminAction writes an admin action to the audit log and the in-memory history.
+// Every admin/control entry point calls it, successful or not.
+func (r *Relay) recordAdminAction(actor, action string, params map[string]string, err error) {
+	if actor == "" {
+		actor = "unknown"
+	}
+	a := AdminAction{Time: time.Now().UTC(), Actor: actor, Action: action, Params: params}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	r.adminHistory.add(a)
+	r.audit.record(AuditEvent{
+		Time:   a.Time,
+		Event:  "admin_action",
+		Actor:  a.Actor,
+		Action: a.Action,
+		Params: a.Params,
+		Error:  a.Error,
+	})
+	log.Printf("relay: admin: %s by %s %v", action, actor, params)
+}
+
+// AdminActions returns up to limit of the most recent admin actions, oldest first
+// (limit <= 0 = all that are kept).
+func (r *Relay) AdminActions(limit int) []AdminAction {
+	r.adminHistory.mu.Lock()
+	defer r.adminHistory.mu.Unlock()
+	actions := r.adminHistory.actions
+	if limit > 0 && len(actions) > limit {
+		actions = actions[len(actions)-limit:]
+	}
+	return append([]AdminAction(nil), actions...)
+}
+
+// itoa formats an int admin parameter.
+func itoa(n int) string { return fmt.Sprint(n) }
@@ -0,0 +1,180 @@
+package turnrelay
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHostTTL is how often a DNS RelayHost is re-resolved when RelayHostTTLSec is 0.
+const defaultHostTTL = 5 * time.Minute
+
+// hostResolver keeps the current addresses of RelayHost. An IP literal is used as is; a
+// DNS name is re-resolved every ttl, so a relay on a dynamic IP advertises its current
+// address in PortAlloc.
+type hostResolver struct {
+	host  string
+	ttl   time.Duration
+	mu    sync.RWMutex
+	addrs []string
+}
+
+func newHostResolver(host string, ttl time.Duration) *hostResolver {
+	if ttl <= 0 {
+		ttl = defaultHostTTL
+	}
+	h := &hostResolver{host: host, ttl: ttl}
+	if ip := net.ParseIP(host); ip != nil {
+		h.addrs = []string{ip.String()}
+	}
+	return h
+}
+
+// isName reports whether the host needs DNS resolution.
+func (h *hostResolver) isName() bool {
+	return h.host != "" && net.ParseIP(h.host) == nil
+}
+
+// current returns the addresses to advertise (nil if unknown).
+func (h *hostResolver) current() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.addrs
+}
+
+func (h *hostResolver) set(addrs []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs = addrs
+}
+
+// resolve looks the host up once and stores the result; on failure the previous addresses
+// are kept.
+func (h *hostResolver) resolve(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, h.host)
+	if err != nil || len(ips) == 0 {
+		log.Printf("relay: resolve relay_host %s: %v (keeping %v)", h.host, err, h.current())
+		return
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.IP.String())
+	}
+	if prev := h.current(); strings.Join(prev, ",") != strings.Join(addrs, ",") {
+		log.Printf("relay: relay_host %s now resolves to %v", h.host, addrs)
+	}
+	h.set(addrs)
+}
+
+// refreshLoop re-resolves the host every ttl until ctx ends.
+func (h *hostResolver) refreshLoop(ctx context.Context, health *healthEntry) {
+	t := time.NewTicker(h.ttl)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			health.stop()
+			return
+		case <-t.C:
+		}
+		h.resolve(ctx)
+		health.beat()
+	}
+}
+
+// reachWindow is how many recent user connections reachability remembers.
+const reachWindow = 64
+
+// reachability remembers the address family (IPv4 or IPv6) of the relay address recent
+// users connected to, so advertised addresses can be ordered by what users actually reach.
+type reachability struct {
+	mu     sync.Mutex
+	recent [reachWindow]byte // 4 or 6; 0 = empty slot
+	next   int
+}
+
+// ipFamily returns 4 or 6 for an IP address, 0 otherwise.
+func ipFamily(ip net.IP) int {
+	switch {
+	case ip == nil:
+		return 0
+	case ip.To4() != nil:
+		return 4
+	default:
+		return 6
+	}
+}
+
+// addrFamily returns the family of a TCP address, 0 if it is not one.
+func addrFamily(a net.Addr) int {
+	if t, ok := a.(*net.TCPAddr); ok {
+		return ipFamily(t.IP)
+	}
+	return 0
+}
+
+// observe records that a user reached the relay at local address a.
+func (re *reachability) observe(a net.Addr) {
+	f := addrFamily(a)
+	if f == 0 {
+		return
+	}
+	re.mu.Lock()
+	re.recent[re.next] = byte(f)
+	re.next = (re.next + 1) % reachWindow
+	re.mu.Unlock()
+}
+
+// counts returns how many remembered user connections used IPv4 and IPv6.
+func (re *reachability) counts() (v4, v6 int) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	for _, f := range re.recent {
+		switch f {
+		case 4:
+			v4++
+		case 6:
+			v6++
+		}
+	}
+	return v4, v6
+}
+
+// order returns addrs sorted most-likely-reachable first: host names (the client resolves
+// them and can race the families itself), then IP addresses of the family recent users
+// connected over most often. Without user history, the family the bot connected over
+// (botFamily) goes first, since it is evidence of at least one working path. The sort is
+// stable, so equal addresses keep the configured order.
+func (re *reachability) order(addrs []string, botFamily int) []string {
+	v4, v6 := re.counts()
+	score := map[int]int{0: 1 << 30, 4: 2 * v4, 6: 2 * v6}
+	if botFamily != 0 {
+		score[botFamily]++
+	}
+	out := append([]string(nil), addrs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return score[ipFamily(net.ParseIP(out[i]))] > score[ipFamily(net.ParseIP(out[j]))]
+	})
+	return out
+}
+
+// portAllocPayload builds the MsgPortAlloc payload for sess, requested by a bot connected
+// from botAddr: its port, the advertised addresses in preference order and, with SNI
+// routing, its server name. A bot-to-bot session has no port, so it gets port 0 and no
+// addresses; a chained session gets the next relay's allocation.
+func (r *Relay) portAllocPayload(sess *Session, botAddr net.Addr) []byte {
+	if sess.chainAlloc != nil {
+		return sess.chainAlloc.Marshal()
+	}
+	if sess.peerBot != "" {
+		return PortAlloc{Filename: sess.renamed, MaxBytes: sess.maxBytes}.Marshal()
+	}
+	addrs := r.reach.order(r.host.current(), addrFamily(botAddr))
+	return PortAlloc{Port: sess.Port, Addrs: addrs, SNIHost: r.sniHost(sess), Filename: sess.renamed, MaxBytes: sess.maxBytes}.Marshal()
+}
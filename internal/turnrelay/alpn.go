@@ -0,0 +1,59 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"time"
+)
+
+// ALPNFrames is the ALPN protocol ID of the binary frame protocol on TURNListen. Clients
+// that send no ALPN get the frame protocol too.
+const ALPNFrames = "huzaa-relay/1"
+
+// handshakeTimeout bounds TLS handshakes the relay completes itself before dispatching.
+const handshakeTimeout = 10 * time.Second
+
+// ProtocolHandler serves a TURNListen connection that negotiated its ALPN protocol. It owns
+// conn and must close it; ctx ends when the relay stops, and Shutdown waits for the handler
+// to return.
+type ProtocolHandler func(ctx context.Context, conn *tls.Conn)
+
+// botNextProtos lists the ALPN protocols offered on TURNListen: the frame protocol first,
+// then RelayConfig.Protocols in name order.
+func (r *Relay) botNextProtos() []string {
+	extra := make([]string, 0, len(r.config.Protocols))
+	for name := range r.config.Protocols {
+		if name != ALPNFrames {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	return append([]string{ALPNFrames}, extra...)
+}
+
+// dispatchBotConnection completes the handshake and hands conn to the handler of the
+// negotiated protocol.
+func (r *Relay) dispatchBotConnection(ctx context.Context, conn *tls.Conn) {
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	err := conn.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		r.debug.printf("relay: bot %s: handshake: %v", r.peerString(conn.RemoteAddr()), err)
+		conn.Close()
+		return
+	}
+	if r.config.SinglePort {
+		if _, under := r.sniToken(conn.ConnectionState().ServerName); under {
+			r.serveSNIUser(conn)
+			return
+		}
+	}
+	proto := conn.ConnectionState().NegotiatedProtocol
+	if h, ok := r.config.Protocols[proto]; ok && proto != ALPNFrames {
+		defer r.recoverPanic("protocol "+proto+" connection "+r.peerString(conn.RemoteAddr()), func() { conn.Close() })
+		h(ctx, conn)
+		return
+	}
+	r.handleBotConnection(ctx, conn)
+}
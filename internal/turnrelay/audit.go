@@ -0,0 +1,84 @@
+package turnrelay
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// AuditEvent is one line of the audit log (JSON, one object per line).
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Session   string    `json:"session,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Bytes     int64     `json:"bytes,omitempty"`
+	UserBytes int64     `json:"user_bytes,omitempty"`
+	State     string    `json:"state,omitempty"`
+	Peer      string    `json:"peer,omitempty"`     // user IP, IPv4-mapped and NAT64 addresses normalized to IPv4
+	Reason    string    `json:"reason,omitempty"`   // session_close: the CloseReason; session_resume: the offset
+	User      string    `json:"user,omitempty"`     // bot user that owns the session
+	BotAddr   string    `json:"bot_addr,omitempty"` // remote address of the bot connection
+	// Admin actions (event "admin_action").
+	Actor  string            `json:"actor,omitempty"`
+	Action string            `json:"action,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	// Post-transfer hooks (event "post_hook"; Action is the hook name).
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// auditLog writes AuditEvents to the configured writer; with no writer it is a no-op.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (a *auditLog) record(ev AuditEvent) {
+	if a == nil || a.w == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("relay: audit: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("relay: audit write: %v", err)
+	}
+}
+
+// sessionEvent builds an audit event describing sess.
+func sessionEvent(event string, sess *Session) AuditEvent {
+	return AuditEvent{
+		Event:     event,
+		Session:   sess.ID,
+		Kind:      sess.Kind,
+		Filename:  sess.Filename,
+		Port:      sess.Port,
+		Bytes:     sess.Bytes(),
+		UserBytes: sess.UserBytes(),
+		State:     sess.State().String(),
+		Peer:      peerText(sess.Peer()),
+		User:      sess.owner,
+		BotAddr:   sess.BotAddr(),
+	}
+}
+
+// peerText formats a peer IP for the audit log ("" if unknown).
+func peerText(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	return ip.String()
+}
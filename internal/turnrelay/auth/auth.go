@@ -0,0 +1,57 @@
+// Package auth checks bot credentials sent in MsgAuth.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// NonceLen is the length of the random nonce the relay sends in MsgAuthOk.
+const NonceLen = 16
+
+// maxUsernameLen bounds the username in a MsgAuth payload.
+const maxUsernameLen = 256
+
+// ErrMalformed is returned by ParseRequest for a payload that is not a valid MsgAuth.
+var ErrMalformed = errors.New("malformed auth request")
+
+// Credentials maps username -> secret.
+type Credentials map[string]string
+
+// ParseRequest splits a MsgAuth payload: 4-byte username length (big-endian), then
+// username, then secret.
+func ParseRequest(payload []byte) (username string, secret []byte, err error) {
+	if len(payload) < 4 {
+		return "", nil, ErrMalformed
+	}
+	unLen := binary.BigEndian.Uint32(payload[:4])
+	if unLen == 0 || uint32(len(payload)) < 4+unLen || unLen > maxUsernameLen {
+		return "", nil, ErrMalformed
+	}
+	return string(payload[4 : 4+unLen]), payload[4+unLen:], nil
+}
+
+// MarshalRequest builds a MsgAuth payload for username and secret; see ParseRequest.
+func MarshalRequest(username, secret string) []byte {
+	payload := make([]byte, 4, 4+len(username)+len(secret))
+	binary.BigEndian.PutUint32(payload, uint32(len(username)))
+	return append(append(payload, username...), secret...)
+}
+
+// Verify reports whether secret is the secret of username, in constant time with respect
+// to the secret.
+func (c Credentials) Verify(username string, secret []byte) bool {
+	expected, ok := c[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), secret) == 1
+}
+
+// NewNonce returns a fresh random nonce for one authenticated bot connection.
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
@@ -0,0 +1,129 @@
+package turnrelay
+
+import (
+	"sync"
+	"time"
+)
+
+// bandwidthQuantum is the most one session takes from the relay-wide bucket at a time;
+// larger chunks queue up again for the rest, so sessions sending big frames cannot crowd
+// out the others.
+const bandwidthQuantum = 16 * 1024
+
+// bandwidthShaper is the relay-wide token bucket over bytes (MaxBandwidthBps). Senders are
+// served in arrival order, one quantum each, so active sessions share the rate about
+// equally while an idle session leaves its share to the others. A rate of 0 means
+// unlimited.
+type bandwidthShaper struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second; 0 = unlimited
+	tokens float64
+	last   time.Time
+	queue  []chan struct{} // waiters in arrival order; the head's channel is closed
+}
+
+func (s *bandwidthShaper) setRate(bps int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = bps
+	s.tokens = 0
+	s.last = time.Now()
+}
+
+func (s *bandwidthShaper) currentRate() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+// wait blocks until n bytes may pass. It returns false if done is closed first.
+func (s *bandwidthShaper) wait(n int, done <-chan struct{}) bool {
+	for n > 0 {
+		q := min(n, bandwidthQuantum)
+		if !s.take(q, done) {
+			return false
+		}
+		n -= q
+	}
+	return true
+}
+
+// take queues for n <= bandwidthQuantum bytes and returns once they are granted, or false
+// if done is closed first.
+func (s *bandwidthShaper) take(n int, done <-chan struct{}) bool {
+	s.mu.Lock()
+	if s.rate <= 0 {
+		s.mu.Unlock()
+		return true
+	}
+	turn := make(chan struct{})
+	s.queue = append(s.queue, turn)
+	if len(s.queue) == 1 {
+		close(turn)
+	}
+	s.mu.Unlock()
+	select {
+	case <-turn:
+	case <-done:
+		s.leave(turn)
+		return false
+	}
+	for {
+		s.mu.Lock()
+		if s.rate <= 0 {
+			s.leaveLocked(turn)
+			s.mu.Unlock()
+			return true
+		}
+		now := time.Now()
+		s.tokens += now.Sub(s.last).Seconds() * float64(s.rate)
+		s.last = now
+		if burst := float64(max(s.rate, bandwidthQuantum)); s.tokens > burst {
+			s.tokens = burst
+		}
+		if s.tokens >= float64(n) {
+			s.tokens -= float64(n)
+			s.leaveLocked(turn)
+			s.mu.Unlock()
+			return true
+		}
+		delay := time.Duration((float64(n) - s.tokens) / float64(s.rate) * float64(time.Second))
+		s.mu.Unlock()
+		if delay > 100*time.Millisecond {
+			delay = 100 * time.Millisecond // re-check: the rate may be changed meanwhile
+		}
+		select {
+		case <-done:
+			s.leave(turn)
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *bandwidthShaper) leave(turn chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaveLocked(turn)
+}
+
+// leaveLocked removes turn from the queue and, if it was the head, hands the turn on.
+func (s *bandwidthShaper) leaveLocked(turn chan struct{}) {
+	for i, t := range s.queue {
+		if t != turn {
+			continue
+		}
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		if i == 0 && len(s.queue) > 0 {
+			close(s.queue[0])
+		}
+		return
+	}
+}
+
+// pace holds back n bytes sess is about to relay until the slow-consumer policy, the
+// session's own rate limit and the relay-wide bandwidth cap let them pass. It returns false
+// if the session closed meanwhile.
+func (r *Relay) pace(sess *Session, n int) bool {
+	return r.throttleFastSide(sess) && sess.limiter.wait(n, sess.Done) && r.bandwidth.wait(n, sess.Done)
+}
@@ -0,0 +1,82 @@
+package turnrelay
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBannerLen caps the MsgBanner text.
+const maxBannerLen = 4096
+
+// banner holds the operator text sent to bots as MsgBanner after auth. The text comes from
+// SetBanner if called, else BannerFile (re-read whenever it changes), else Banner.
+type banner struct {
+	text string
+	path string
+
+	mu       sync.Mutex
+	override *string
+	modTime  time.Time
+	fileText string
+}
+
+// current returns the banner text, "" for none.
+func (b *banner) current() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.override != nil {
+		return *b.override
+	}
+	if b.path == "" {
+		return b.text
+	}
+	fi, err := os.Stat(b.path)
+	if err != nil {
+		// A removed file clears the banner; a transient error keeps the last text.
+		if os.IsNotExist(err) {
+			b.fileText, b.modTime = "", time.Time{}
+		}
+		return b.fileText
+	}
+	if !fi.ModTime().Equal(b.modTime) {
+		data, err := os.ReadFile(b.path)
+		if err != nil {
+			log.Printf("relay: banner_file: %v", err)
+			return b.fileText
+		}
+		b.fileText, b.modTime = strings.TrimSpace(string(data)), fi.ModTime()
+	}
+	return b.fileText
+}
+
+func (b *banner) set(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.override = &text
+}
+
+// sendBanner writes MsgBanner to a freshly authenticated bot if a banner is configured.
+func (r *Relay) sendBanner(conn net.Conn) error {
+	text := r.banner.current()
+	if text == "" {
+		return nil
+	}
+	if len(text) > maxBannerLen {
+		text = text[:maxBannerLen]
+	}
+	return r.writeFrame(conn, MsgBanner, []byte(text))
+}
+
+// Banner returns the MsgBanner text sent to bots now, "" for none.
+func (r *Relay) Banner() string { return r.banner.current() }
+
+// SetBanner replaces the MsgBanner text at runtime ("" = no banner) until the relay
+// restarts; Banner and BannerFile no longer apply.
+func (r *Relay) SetBanner(actor, text string) {
+	r.banner.set(text)
+	r.recordAdminAction(actor, "set_banner", map[string]string{"text": text}, nil)
+}
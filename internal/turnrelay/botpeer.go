@@ -0,0 +1,264 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A bot-to-bot session is registered like any other, with the "peer" option naming the bot
+// user that takes the user's side. No DCC port is opened: that bot authenticates, sends
+// MsgAttach with the session ID and is then served by serveDCCUser like a DCC user, its
+// stream carried in MsgData/MsgEOF frames (peerConn). Leases, caps, rate limits, schedules
+// and MsgStats apply as for DCC sessions, and both bot users' quotas and statistics are
+// charged.
+
+// errUpstreamEnded is returned by a chained session's user side when the chain relay
+// reported the session over without the transfer completing.
+var errUpstreamEnded = errors.New("chain relay ended the session")
+
+// attachPeerBot hands the bot-to-bot session sessionID to the authenticated bot user username.
+func (r *Relay) attachPeerBot(username, sessionID string) (*Session, error) {
+	if r.draining() {
+		return nil, ErrShuttingDown
+	}
+	sess, err := r.lookupSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	// Sessions this bot user may not attach to look the same as unknown ones.
+	if sess.peerBot == "" || sess.peerBot != username {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	if err := r.checkSchedule(username, sess.Kind); err != nil {
+		return nil, err
+	}
+	if username != sess.owner {
+		if err := r.checkQuota(username); err != nil {
+			return nil, err
+		}
+	}
+	if !sess.claim() {
+		return nil, fmt.Errorf("%w: session %s already attached", ErrDuplicateSession, sessionID)
+	}
+	if username != sess.owner {
+		r.usage.addSession(username)
+	}
+	return sess, nil
+}
+
+// servePeerBot serves the user side of sess on the attached bot connection conn, then sends
+// that bot MsgStats once the session has ended.
+func (r *Relay) servePeerBot(ctx context.Context, conn *tls.Conn, sess *Session) {
+	if err := r.writeFrame(conn, MsgAttach, Attach{Kind: sess.Kind, Filename: sess.Filename}.Marshal()); err != nil {
+		sess.setCloseReason(CloseUserError)
+		r.removeSession(sess.ID)
+		return
+	}
+	pc := newPeerConn(r, conn, sess, false)
+	defer r.keepBotAlive(conn, sess, pc.writeFrame)()
+	r.serveDCCUser(pc, sess)
+	select {
+	case <-sess.Done:
+	case <-ctx.Done():
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	_ = pc.writeFrame(MsgStats, r.sessionStats(sess).Marshal())
+}
+
+// chargedPeer returns the bot user that attached to a bot-to-bot session when it is not the
+// owner and is therefore charged separately; otherwise "".
+func (s *Session) chargedPeer() string {
+	if s.peerBot == "" || s.peerBot == s.owner || !s.isClaimed() {
+		return ""
+	}
+	return s.peerBot
+}
+
+// peerConn is the user side of a bot-to-bot or chained session: reads return the MsgData
+// payloads of the attached bot or chain relay until its MsgEOF, and writes are sent to it
+// as MsgData frames.
+type peerConn struct {
+	net.Conn // the attached bot's or chain relay's connection
+	r        *Relay
+	sess     *Session
+	upstream bool          // a chain relay: it reports the session's end with MsgStats
+	ended    chan struct{} // upstream: closed once its MsgStats arrived
+	buf      []byte        // unread rest of the last MsgData payload
+	eof      atomic.Bool   // the peer sent MsgEOF, or finish sent it one
+	wmu      sync.Mutex
+	once     sync.Once
+}
+
+// newPeerConn wraps conn as the user side of sess. During a download the peer only
+// receives, so its frames (MsgCancel, MsgStats) are read in the background.
+func newPeerConn(r *Relay, conn net.Conn, sess *Session, upstream bool) *peerConn {
+	c := &peerConn{Conn: conn, r: r, sess: sess, upstream: upstream, ended: make(chan struct{})}
+	if sess.Kind == "download" {
+		go c.watch()
+	}
+	return c
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		msgType, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case msgType == MsgData:
+			c.buf = payload
+		case msgType == MsgEOF:
+			c.eof.Store(true)
+			if c.upstream {
+				// A chain relay follows its MsgEOF with MsgStats right away.
+				if msgType, payload, err := c.readFrame(); err == nil && msgType == MsgStats {
+					c.upstreamEnded(payload)
+				}
+			}
+			return 0, io.EOF
+		case msgType == MsgStats && c.upstream:
+			c.upstreamEnded(payload)
+			return 0, errUpstreamEnded
+		default:
+			c.unexpected(msgType)
+			return 0, fmt.Errorf("peer sent %s", MsgTypeName(msgType))
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *peerConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for n := 0; n < len(p); {
+		chunk := p[n:min(len(p), n+MaxPayload)]
+		if err := c.r.writeFrame(c.Conn, MsgData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return len(p), nil
+}
+
+// writeFrame writes one frame to the peer outside Write, e.g. a keepalive; wmu keeps it from
+// landing between the frames of a Write.
+func (c *peerConn) writeFrame(msgType byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.r.writeFrame(c.Conn, msgType, payload)
+}
+
+// CloseWrite ends the relay-to-peer direction of a forward session with MsgEOF.
+func (c *peerConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.r.writeFrame(c.Conn, MsgEOF, nil)
+}
+
+// finish is called by serveDCCUser once a download was copied out completely. It sends
+// MsgEOF; a chain relay's MsgStats is then awaited, so the download only completes once the
+// user at the end of the chain got everything.
+func (c *peerConn) finish() error {
+	c.wmu.Lock()
+	err := c.r.writeFrame(c.Conn, MsgEOF, nil)
+	c.eof.Store(err == nil)
+	c.wmu.Unlock()
+	if err != nil || !c.upstream {
+		return err
+	}
+	select {
+	case <-c.ended:
+	case <-c.sess.Done:
+	}
+	if st := c.sess.upstream.Load(); st == nil || st.Reason != string(CloseCompleted) {
+		return errUpstreamEnded
+	}
+	return nil
+}
+
+// Close ends the user side: pending reads and writes are unblocked. A chain relay is sent
+// MsgCancel if the transfer did not get to MsgEOF. The connection itself stays open, for
+// MsgStats to an attached bot.
+func (c *peerConn) Close() error {
+	c.once.Do(func() {
+		c.wmu.Lock()
+		if c.upstream && !c.eof.Load() {
+			c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_ = c.r.writeFrame(c.Conn, MsgCancel, nil)
+		}
+		c.wmu.Unlock()
+		c.Conn.SetDeadline(time.Unix(1, 0))
+	})
+	return nil
+}
+
+// watch reads the peer's frames during a download, where it only receives: MsgCancel or a
+// hangup ends the session, and a chain relay's MsgStats reports how it ended there.
+func (c *peerConn) watch() {
+	defer c.r.recoverPanic("peer of "+c.sess.ID, func() { c.r.removeSession(c.sess.ID) })
+	msgType, payload, err := c.readFrame()
+	switch {
+	case err != nil:
+	case msgType == MsgStats && c.upstream:
+		c.upstreamEnded(payload)
+	default:
+		c.unexpected(msgType)
+	}
+}
+
+// readFrame reads one frame from the peer. A failed read ends the session unless it already
+// ended (Close unblocks reads that way).
+func (c *peerConn) readFrame() (byte, []byte, error) {
+	msgType, payload, err := c.r.readFrameReplying(c.Conn, c.writeFrame)
+	if err != nil {
+		replyFrameError(err, c.writeFrame)
+		c.fail(CloseUserError)
+	}
+	return msgType, payload, err
+}
+
+// upstreamEnded records a chain relay's MsgStats, the end-to-end result of the session,
+// and ends the session for the same reason unless the user there got everything.
+func (c *peerConn) upstreamEnded(payload []byte) {
+	st, err := ParseSessionStats(payload)
+	if err != nil {
+		c.unexpected(MsgStats)
+		return
+	}
+	c.sess.upstream.Store(&st)
+	if reason := upstreamReason(st.Reason); reason != CloseCompleted {
+		c.fail(reason)
+	}
+	close(c.ended)
+}
+
+// unexpected ends the session on a frame the peer may not send now; MsgCancel cancels it.
+func (c *peerConn) unexpected(msgType byte) {
+	if msgType == MsgCancel {
+		c.fail(CloseCanceled)
+		return
+	}
+	c.r.metrics.malformed()
+	c.fail(CloseUserError)
+}
+
+// fail ends the session for reason, unless it has already ended.
+func (c *peerConn) fail(reason CloseReason) {
+	select {
+	case <-c.sess.Done:
+	default:
+		c.sess.setCloseReason(reason)
+		c.sess.Close()
+	}
+}
@@ -0,0 +1,85 @@
+// Package bridge moves data between a network connection and a session's buffered
+// channels of byte slices.
+package bridge
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrClosed is returned by ChanReader when the session is aborted mid-stream.
+var ErrClosed = errors.New("session closed")
+
+// ChanReader implements io.Reader by reading from a channel of byte slices. If Done is set,
+// a closed Done aborts a blocked Read with ErrClosed instead of waiting forever.
+type ChanReader struct {
+	Ch   <-chan []byte
+	Done <-chan struct{}
+	cur  []byte
+	done bool
+}
+
+func (c *ChanReader) Read(p []byte) (n int, err error) {
+	for len(c.cur) == 0 && !c.done {
+		select {
+		case data, ok := <-c.Ch:
+			if !ok {
+				c.done = true
+				return 0, io.EOF
+			}
+			c.cur = data
+		case <-c.Done:
+			return 0, ErrClosed
+		}
+	}
+	if len(c.cur) == 0 {
+		return 0, io.EOF
+	}
+	n = copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// CountWriter wraps an io.Writer and counts bytes written. OnProgress, if set, is called
+// each time the total crosses a multiple of ProgressEvery bytes.
+type CountWriter struct {
+	W             io.Writer
+	N             int64
+	ProgressEvery int64
+	OnProgress    func(total int64)
+}
+
+func (c *CountWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	if n > 0 {
+		c.N += int64(n)
+		if c.OnProgress != nil && c.ProgressEvery > 0 && c.N/c.ProgressEvery != (c.N-int64(n))/c.ProgressEvery {
+			c.OnProgress(c.N)
+		}
+	}
+	return n, err
+}
+
+// Pump reads r in chunks of chunkSize and sends each chunk on out until r fails or ends
+// (the error is returned, io.EOF included) or done is closed (ErrClosed). gate, if set, is
+// called with the chunk length before every send and may block (e.g. for throttling or
+// rate limiting); returning false aborts with ErrClosed. Every chunk is a fresh slice, so the receiver may keep it.
+func Pump(r io.Reader, out chan<- []byte, done <-chan struct{}, chunkSize int, gate func(n int) bool) error {
+	for {
+		buf := make([]byte, chunkSize)
+		n, err := r.Read(buf)
+		if n > 0 {
+			if gate != nil && !gate(n) {
+				return ErrClosed
+			}
+			select {
+			case out <- buf[:n:n]:
+			case <-done:
+				return ErrClosed
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
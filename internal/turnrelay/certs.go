@@ -0,0 +1,102 @@
+package turnrelay
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/keystore"
+)
+
+// certCheckInterval is the minimum time between checks of the certificate files for changes.
+const certCheckInterval = 10 * time.Second
+
+// certCache holds the TLS certificate loaded from TLSCertFile/TLSKeyFile (or a PKCS#12
+// TLSCertFile). It reloads the pair when either file changes; if the files are missing or
+// invalid at that moment the previous certificate stays in use, so rotation never breaks
+// running listeners.
+type certCache struct {
+	certFile, keyFile string
+	passphrase        []byte        // TLSKeyPassphrase
+	signer            crypto.Signer // TLSSigner
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // newer of the two files' mtimes at the last load
+	checked time.Time
+}
+
+// load reads the pair unconditionally.
+func (c *certCache) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.loadLocked()
+}
+
+func (c *certCache) loadLocked() error {
+	mod, err := c.filesModTime()
+	if err != nil {
+		return fmt.Errorf("load TLS: %w", err)
+	}
+	var cert tls.Certificate
+	if c.signer != nil {
+		cert, err = keystore.LoadChain(c.certFile, c.signer)
+	} else {
+		cert, err = keystore.LoadPair(c.certFile, c.keyFile, c.passphrase)
+	}
+	if err != nil {
+		return fmt.Errorf("load TLS: %w", err)
+	}
+	c.cert, c.modTime, c.checked = &cert, mod, time.Now()
+	return nil
+}
+
+func (c *certCache) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// get returns the current certificate, reloading it first if the files changed. It is
+// the GetCertificate hook of every relay listener.
+func (c *certCache) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if mod, err := c.filesModTime(); err == nil && !mod.Equal(c.modTime) {
+			if err := c.loadLocked(); err != nil {
+				log.Printf("relay: %v; keeping the previous certificate", err)
+			} else {
+				log.Printf("relay: reloaded TLS certificate from %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// ReloadTLS reloads TLSCertFile/TLSKeyFile now instead of on the next check. On error the
+// previous certificate stays in use.
+func (r *Relay) ReloadTLS(actor string) error {
+	err := r.certs.load()
+	if err == nil {
+		log.Printf("relay: reloaded TLS certificate from %s", r.config.TLSCertFile)
+	}
+	r.recordAdminAction(actor, "reload_tls", nil, err)
+	return err
+}
@@ -0,0 +1,142 @@
+package turnrelay
+
+import (
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+)
+
+// rotateTestCert replaces certFile and keyFile with a new pair and moves their mtimes
+// forward, so the change is seen even on filesystems with coarse timestamps.
+func rotateTestCert(t *testing.T, certFile, keyFile string, at time.Time) *x509.Certificate {
+	t.Helper()
+	dir := t.TempDir()
+	newCert, newKey, cert := writeTestCert(t, dir, "rotated")
+	for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dst, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cert
+}
+
+// cachedCert returns the certificate c serves now, forcing the change check.
+func cachedCert(t *testing.T, c *certCache) *x509.Certificate {
+	t.Helper()
+	c.mu.Lock()
+	c.checked = time.Time{}
+	c.mu.Unlock()
+	tc, err := c.get(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writeTestCert(t, dir, "relay")
+	c := &certCache{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedCert(t, c); !got.Equal(first) {
+		t.Fatal("not serving the loaded certificate")
+	}
+
+	second := rotateTestCert(t, certFile, keyFile, time.Now().Add(time.Minute))
+	if got := cachedCert(t, c); !got.Equal(second) {
+		t.Fatal("replaced files were not reloaded")
+	}
+
+	tests := []struct {
+		name       string
+		breakFiles func()
+	}{
+		{"key removed", func() { os.Remove(keyFile) }},
+		{"cert removed", func() { os.Remove(certFile) }},
+		{"cert garbage", func() { os.WriteFile(certFile, []byte("not a certificate"), 0o600) }},
+		{"key mismatched", func() {
+			_, otherKey, _ := writeTestCert(t, t.TempDir(), "other")
+			b, _ := os.ReadFile(otherKey)
+			os.WriteFile(keyFile, b, 0o600)
+		}},
+	}
+	for i, tt := range tests {
+		rotateTestCert(t, certFile, keyFile, time.Now().Add(time.Duration(2+2*i)*time.Minute))
+		good := cachedCert(t, c)
+		tt.breakFiles()
+		at := time.Now().Add(time.Duration(3+2*i) * time.Minute)
+		os.Chtimes(certFile, at, at)
+		os.Chtimes(keyFile, at, at)
+		if got := cachedCert(t, c); !got.Equal(good) {
+			t.Errorf("%s: not serving the last good certificate", tt.name)
+		}
+		if err := c.load(); err == nil {
+			t.Errorf("%s: load succeeded", tt.name)
+		}
+		if got := cachedCert(t, c); !got.Equal(good) {
+			t.Errorf("%s: failed load replaced the certificate", tt.name)
+		}
+	}
+}
+
+// TestCertRotationBetweenAllocations rotates and then breaks the relay's certificate files
+// between DCC allocations: new sessions get the rotated certificate, and once the files are
+// unusable ReloadTLS fails while sessions keep getting the last good one.
+func TestCertRotationBetweenAllocations(t *testing.T) {
+	c := newTestConfig(t, 8)
+	r, addr := startTestRelay(t, c)
+
+	userCert := func(n int) *x509.Certificate {
+		t.Helper()
+		bot := dialTestBot(t, addr)
+		user := dialTestUser(t, registerTestSession(t, bot, "upload", testSessionID(n)))
+		// Uploads read from the user first, so the handshake completes without bot data.
+		if err := user.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return user.ConnectionState().PeerCertificates[0]
+	}
+	first := userCert(1)
+
+	second := rotateTestCert(t, c.TLSCertFile, c.TLSKeyFile, time.Now().Add(time.Minute))
+	if err := r.ReloadTLS("test"); err != nil {
+		t.Fatalf("ReloadTLS: %v", err)
+	}
+	if got := userCert(2); !got.Equal(second) || got.Equal(first) {
+		t.Error("session after rotation did not get the new certificate")
+	}
+
+	if err := os.Remove(c.TLSKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReloadTLS("test"); err == nil {
+		t.Error("ReloadTLS succeeded without a key file")
+	}
+	if got := userCert(3); !got.Equal(second) {
+		t.Error("session after a failed reload did not get the last good certificate")
+	}
+
+	if err := os.WriteFile(c.TLSKeyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.ReloadTLS("test"); err == nil {
+		t.Error("ReloadTLS succeeded with a garbage key file")
+	}
+	if got := userCert(4); !got.Equal(second) {
+		t.Error("session after a failed reload did not get the last good certificate")
+	}
+}
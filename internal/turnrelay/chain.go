@@ -0,0 +1,201 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+)
+
+// A chained session reaches its user through further relays (relay A <-> relay B <-> user),
+// for users this relay cannot serve directly. The bot names the path in the registration's
+// "via" option. This relay connects to the first relay on it as an ordinary bot, registers
+// the session there (with the rest of the path and the hop count), and passes that relay's
+// PortAlloc on. The upstream connection then takes the DCC user's side of the session, like
+// an attached bot (peerConn), and the upstream's MsgStats decides how the session ended.
+
+// chainDialTimeout bounds connecting, authenticating and registering at a chain relay.
+const chainDialTimeout = 15 * time.Second
+
+// defaultMaxChainHops is the relay-to-relay link limit when MaxChainHops is 0.
+const defaultMaxChainHops = 2
+
+// ChainRelay is a relay that sessions can be chained through. This relay authenticates
+// there as a bot, so Username/Secret must be one of its turn_users.
+type ChainRelay struct {
+	Name     string // what bots put in the registration's "via" option
+	Addr     string // host:port of its turn_listen
+	Username string
+	Secret   string
+	CAFile   string // PEM certificates that verify it; empty = system roots
+}
+
+// maxChainHops returns how many relay-to-relay links a session may pass through.
+func (r *Relay) maxChainHops() int {
+	if r.config.MaxChainHops > 0 {
+		return r.config.MaxChainHops
+	}
+	return defaultMaxChainHops
+}
+
+// checkHops returns ErrHopLimit if reg passed through, or would go on through, more
+// relay-to-relay links than this relay allows.
+func (r *Relay) checkHops(reg Registration) error {
+	hops := reg.Hops
+	if reg.Via != "" {
+		hops++
+	}
+	if hops > r.maxChainHops() {
+		return fmt.Errorf("%w: %d relay hops (max %d)", ErrHopLimit, hops, r.maxChainHops())
+	}
+	return nil
+}
+
+// chain registers sess at the first relay of reg.Via and serves the session's user side on
+// that connection. sess has no DCC port of its own.
+func (r *Relay) chain(ctx context.Context, sess *Session, reg Registration) error {
+	var msgType byte
+	switch sess.Kind {
+	case "download":
+		msgType = MsgRegisterDownload
+	case "upload":
+		msgType = MsgRegisterUpload
+	default:
+		return fmt.Errorf("%s sessions cannot be chained", sess.Kind)
+	}
+	name, rest, _ := strings.Cut(reg.Via, ",")
+	cr, ok := r.chainRelay(name)
+	if !ok {
+		return fmt.Errorf("unknown chain relay %q", name)
+	}
+	dctx, cancel := context.WithTimeout(ctx, chainDialTimeout)
+	defer cancel()
+	conn, err := dialChain(dctx, cr)
+	if err != nil {
+		return fmt.Errorf("chain relay %s: %w", name, err)
+	}
+	next := Registration{SessionID: sess.ID, Filename: sess.Filename, Via: rest, Hops: reg.Hops + 1, Size: reg.Size}
+	alloc, err := registerChained(conn, msgType, next)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("chain relay %s: %w", name, err)
+	}
+	conn.SetDeadline(time.Time{})
+	if alloc.Filename == "" {
+		alloc.Filename = sess.renamed
+	}
+	if sess.maxBytes > 0 && (alloc.MaxBytes == 0 || sess.maxBytes < alloc.MaxBytes) {
+		alloc.MaxBytes = sess.maxBytes
+	}
+	sess.chainAlloc = &alloc
+	sess.claim()
+	log.Printf("relay: session %s (user %s) chained through %s (%s), hop %d", sess.ID, sess.owner, name, cr.Addr, next.Hops)
+	r.spawn(func() {
+		defer conn.Close()
+		defer r.recoverPanic("chained session "+sess.ID, func() { r.removeSession(sess.ID) })
+		r.serveDCCUser(newPeerConn(r, conn, sess, true), sess)
+	})
+	return nil
+}
+
+// chainRelay returns the ChainRelays entry called name.
+func (r *Relay) chainRelay(name string) (ChainRelay, bool) {
+	for _, cr := range r.config.ChainRelays {
+		if cr.Name == name {
+			return cr, true
+		}
+	}
+	return ChainRelay{}, false
+}
+
+// dialChain connects to cr and authenticates. The connection's deadline is ctx's.
+func dialChain(ctx context.Context, cr ChainRelay) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(cr.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{ServerName: host, NextProtos: []string{ALPNFrames}, MinVersion: tls.VersionTLS12}
+	if cr.CAFile != "" {
+		pem, err := os.ReadFile(cr.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cr.CAFile)
+		}
+	}
+	d := &tls.Dialer{Config: cfg}
+	nc, err := d.DialContext(ctx, "tcp", cr.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := nc.(*tls.Conn)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := WriteFrame(conn, MsgAuth, auth.MarshalRequest(cr.Username, cr.Secret)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := readChainReply(conn, MsgAuthOk); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	return conn, nil
+}
+
+// registerChained sends reg to the chain relay on conn and returns its PortAlloc.
+func registerChained(conn net.Conn, msgType byte, reg Registration) (PortAlloc, error) {
+	if err := WriteFrame(conn, msgType, reg.Marshal()); err != nil {
+		return PortAlloc{}, err
+	}
+	payload, err := readChainReply(conn, MsgPortAlloc)
+	if err != nil {
+		return PortAlloc{}, err
+	}
+	return ParsePortAlloc(payload)
+}
+
+// readChainReply reads the chain relay's want reply and returns its payload, skipping
+// MsgBanner and keepalives. MsgError and any other type are returned as errors.
+func readChainReply(conn net.Conn, want byte) ([]byte, error) {
+	for {
+		msgType, payload, err := ReadFrame(conn)
+		switch {
+		case err != nil:
+			return nil, err
+		case msgType == MsgBanner, msgType == MsgPong:
+			continue
+		case msgType == MsgPing:
+			if err := WriteFrame(conn, MsgPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case msgType == MsgError:
+			return nil, errors.New(string(payload))
+		case msgType != want:
+			return nil, fmt.Errorf("unexpected %s reply", MsgTypeName(msgType))
+		}
+		return payload, nil
+	}
+}
+
+// upstreamReason maps a chain relay's MsgStats close reason to ours; unknown ones count as
+// user errors, the upstream being this session's user side.
+func upstreamReason(reason string) CloseReason {
+	for _, r := range closeReasons {
+		if string(r) == reason {
+			return r
+		}
+	}
+	return CloseUserError
+}
@@ -0,0 +1,56 @@
+package turnrelay
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestParseRegistrationHops(t *testing.T) {
+	for _, tc := range []struct {
+		hops    string
+		want    int
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"2", 2, false},
+		{"-1", 0, true},
+		{"-1000", 0, true},
+		{"", 0, true},
+		{"two", 0, true},
+		{"9999999999999999999999", 0, true},
+	} {
+		payload := append([]byte(testSessionID(1)+"f"), "\x00via=B,A\x00hops="+tc.hops...)
+		reg, err := ParseRegistration(payload)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("hops=%q: no error, got %d", tc.hops, reg.Hops)
+			}
+			continue
+		}
+		if err != nil || reg.Hops != tc.want {
+			t.Errorf("hops=%q: got %d, %v; want %d", tc.hops, reg.Hops, err, tc.want)
+		}
+	}
+}
+
+// Only chain peers may say how many relays a registration already passed; an ordinary bot
+// cannot send a low (or high) count to game the hop limit.
+func TestHopsTrustedFromChainPeersOnly(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.TurnUsers = append(c.TurnUsers, TurnUserCred{Username: "relay-b", Secret: "s", ChainPeer: true})
+	c.MaxChainHops = 2
+	r, err := NewRelay(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := Registration{SessionID: testSessionID(1), Filename: "f", PeerBot: "peer", Hops: 5}
+	if _, err := r.registerSession(context.Background(), "relay-b", "download", reg); !errors.Is(err, ErrHopLimit) {
+		t.Fatalf("chain peer with hops=5: %v, want ErrHopLimit", err)
+	}
+	sess, err := r.registerSession(context.Background(), testUser, "download", reg)
+	if err != nil {
+		t.Fatalf("bot with hops=5: %v, want hops ignored", err)
+	}
+	r.removeSession(sess.ID)
+}
@@ -0,0 +1,151 @@
+package turnrelay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ChecksumSHA256 is the algorithm of end-of-transfer checksums (Registration.Checksum), and
+// currently the only one.
+const ChecksumSHA256 = "sha256"
+
+// Checksum is a MsgChecksum payload: <algorithm>\x00<hex digest>[\x00<hex tag>]. The digest
+// covers the MsgData payloads of the session on the bot's connection. The relay's checksum
+// carries Tag, SignChecksum of the digest under the session's MAC key, so the bot can tell
+// it came from the relay it registered with.
+type Checksum struct {
+	Algorithm string
+	Digest    []byte
+	Tag       []byte
+}
+
+// ParseChecksum parses a MsgChecksum payload.
+func ParseChecksum(payload []byte) (Checksum, error) {
+	fields := strings.Split(string(payload), "\x00")
+	if len(fields) < 2 || len(fields) > 3 {
+		return Checksum{}, errors.New("checksum needs algorithm and digest")
+	}
+	c := Checksum{Algorithm: fields[0]}
+	var err error
+	if c.Digest, err = hex.DecodeString(fields[1]); err != nil {
+		return Checksum{}, fmt.Errorf("checksum digest: %w", err)
+	}
+	if len(fields) == 3 {
+		if c.Tag, err = hex.DecodeString(fields[2]); err != nil {
+			return Checksum{}, fmt.Errorf("checksum tag: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Marshal encodes the checksum as a MsgChecksum payload.
+func (c Checksum) Marshal() []byte {
+	s := c.Algorithm + "\x00" + hex.EncodeToString(c.Digest)
+	if c.Tag != nil {
+		s += "\x00" + hex.EncodeToString(c.Tag)
+	}
+	return []byte(s)
+}
+
+// streamSum is a running hash of the data on a session's bot connection.
+type streamSum struct {
+	mu  sync.Mutex
+	alg string
+	h   hash.Hash
+}
+
+// newStreamSum returns a hash for alg, or nil for "" (no checksum).
+func newStreamSum(alg string) *streamSum {
+	if alg == "" {
+		return nil
+	}
+	return &streamSum{alg: alg, h: sha256.New()}
+}
+
+func (s *streamSum) write(p []byte) {
+	if s != nil {
+		s.mu.Lock()
+		s.h.Write(p)
+		s.mu.Unlock()
+	}
+}
+
+// algorithm is the hash's algorithm, or "" for a nil *streamSum.
+func (s *streamSum) algorithm() string {
+	if s == nil {
+		return ""
+	}
+	return s.alg
+}
+
+func (s *streamSum) digest() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.h.Sum(nil)
+}
+
+// checkChecksum validates a registration's checksum option. Forward sessions have no single
+// end to check at.
+func checkChecksum(kind string, reg Registration) error {
+	switch {
+	case reg.Checksum == "":
+		return nil
+	case reg.Checksum != ChecksumSHA256:
+		return fmt.Errorf("bad checksum: unsupported algorithm %q", reg.Checksum)
+	case kind == "forward":
+		return errors.New("bad checksum: forward sessions have none")
+	}
+	return nil
+}
+
+// relayChecksum is the relay's signed MsgChecksum for sess.
+func relayChecksum(sess *Session) []byte {
+	sess.mu.Lock()
+	key := sess.MACKey
+	sess.mu.Unlock()
+	digest := sess.sum.digest()
+	return Checksum{Algorithm: sess.sum.alg, Digest: digest, Tag: SignChecksum(key, digest)}.Marshal()
+}
+
+// verifyChecksum reads the bot's MsgChecksum that follows the MsgEOF of a download with a
+// checksum, compares it with what the relay received, and answers with the relay's own.
+// A mismatch is logged, audited and counted, but does not fail the session: the user
+// already has the data, and the bot learns of it from the reply. Once the data is complete
+// a failed read does not end the session either.
+func (r *Relay) verifyChecksum(botConn net.Conn, sess *Session) {
+	msgType, payload, err := r.readBotFrame(botConn, sess)
+	switch {
+	case err != nil:
+		r.debug.sessionf(sess, "relay download session=%s checksum read_err=%v", sess.ID, err)
+		return
+	case msgType == MsgCancel:
+		sess.setCloseReason(CloseCanceled)
+		r.removeSession(sess.ID)
+		return
+	case msgType != MsgChecksum:
+		r.metrics.malformed()
+		log.Printf("relay: %s: expected checksum after EOF, got %s", sess, MsgTypeName(msgType))
+		return
+	}
+	sum, err := ParseChecksum(payload)
+	if err != nil || sum.Algorithm != sess.sum.alg {
+		r.metrics.malformed()
+		log.Printf("relay: %s: bad checksum from bot (%s): %v", sess, sum.Algorithm, err)
+	} else if digest := sess.sum.digest(); !bytes.Equal(sum.Digest, digest) {
+		atomic.AddInt64(&r.metrics.checksumErrs, 1)
+		log.Printf("relay: %s: checksum mismatch after %d bytes: bot sent %x, relay received %x", sess, sess.Bytes(), sum.Digest, digest)
+		ev := sessionEvent("checksum_mismatch", sess)
+		ev.Reason = fmt.Sprintf("bot %x relay %x", sum.Digest, digest)
+		r.audit.record(ev)
+	}
+	_ = sess.writeBot(MsgChecksum, relayChecksum(sess))
+}
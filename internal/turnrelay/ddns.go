@@ -0,0 +1,203 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DDNSConfig enables built-in dynamic DNS updates: the relay periodically detects its
+// public IP and, when it changes, points Hostname at it through Provider.
+type DDNSConfig struct {
+	Provider   string // "cloudflare", "duckdns" or "rfc2136"
+	Hostname   string // record to update; defaults to RelayHost
+	CheckSec   int    // how often to check the public IP; default 300
+	IPEchoURL  string // HTTPS endpoint returning the caller's IP as text; default api.ipify.org
+	TTL        int    // record TTL for cloudflare/rfc2136; default 60
+	Token      string // cloudflare API token or duckdns token
+	ZoneID     string // cloudflare zone ID
+	Server     string // rfc2136: primary server host:port
+	Zone       string // rfc2136: zone containing Hostname
+	TSIGKey    string // rfc2136: TSIG key name
+	TSIGAlgo   string // rfc2136: "hmac-sha256" (default) or "hmac-sha512"
+	TSIGSecret string // rfc2136: base64 TSIG secret
+}
+
+// ddnsProvider points a hostname at an address.
+type ddnsProvider interface {
+	update(ctx context.Context, ip net.IP) error
+}
+
+func newDDNSProvider(c *DDNSConfig) (ddnsProvider, error) {
+	if c.Hostname == "" {
+		return nil, fmt.Errorf("ddns: no hostname")
+	}
+	switch c.Provider {
+	case "cloudflare":
+		if c.Token == "" || c.ZoneID == "" {
+			return nil, fmt.Errorf("ddns: cloudflare needs token and zone_id")
+		}
+		return &cloudflareDDNS{c: c}, nil
+	case "duckdns":
+		if c.Token == "" {
+			return nil, fmt.Errorf("ddns: duckdns needs token")
+		}
+		return &duckDNS{c: c}, nil
+	case "rfc2136":
+		if c.Server == "" || c.Zone == "" {
+			return nil, fmt.Errorf("ddns: rfc2136 needs server and zone")
+		}
+		return &rfc2136DDNS{c: c}, nil
+	default:
+		return nil, fmt.Errorf("ddns: unknown provider %q", c.Provider)
+	}
+}
+
+// runDDNS checks the public IP every CheckSec and updates the record when it changes.
+func (r *Relay) runDDNS(c *DDNSConfig, p ddnsProvider) {
+	interval := 5 * time.Minute
+	if c.CheckSec > 0 {
+		interval = time.Duration(c.CheckSec) * time.Second
+	}
+	h := r.health.register("ddns updater", 3*interval)
+	var last net.IP
+	for {
+		ctx, cancel := context.WithTimeout(r.ctx, 30*time.Second)
+		ip, err := lookupPublicIP(ctx, c.IPEchoURL)
+		if err != nil {
+			log.Printf("relay: ddns: detect public IP: %v", err)
+		} else if !ip.Equal(last) {
+			if err := p.update(ctx, ip); err != nil {
+				log.Printf("relay: ddns: update %s -> %s: %v", c.Hostname, ip, err)
+			} else {
+				log.Printf("relay: ddns: %s -> %s (%s)", c.Hostname, ip, c.Provider)
+				last = ip
+				if strings.EqualFold(c.Hostname, r.config.RelayHost) {
+					r.host.set([]string{ip.String()})
+				}
+			}
+		}
+		cancel()
+		h.beat()
+		select {
+		case <-r.ctx.Done():
+			h.stop()
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func ddnsRecordType(ip net.IP) string {
+	if ip.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+func ddnsTTL(c *DDNSConfig) int {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return 60
+}
+
+// cloudflareDDNS updates (or creates) the record through the Cloudflare v4 API.
+type cloudflareDDNS struct {
+	c *DDNSConfig
+}
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+func (d *cloudflareDDNS) call(ctx context.Context, method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var env struct {
+		Success bool              `json:"success"`
+		Errors  []json.RawMessage `json:"errors"`
+		Result  json.RawMessage   `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return fmt.Errorf("cloudflare %s: %w", resp.Status, err)
+	}
+	if !env.Success {
+		return fmt.Errorf("cloudflare %s: %s", resp.Status, env.Errors)
+	}
+	if out != nil {
+		return json.Unmarshal(env.Result, out)
+	}
+	return nil
+}
+
+func (d *cloudflareDDNS) update(ctx context.Context, ip net.IP) error {
+	typ := ddnsRecordType(ip)
+	base := "/zones/" + url.PathEscape(d.c.ZoneID) + "/dns_records"
+	var found []struct {
+		ID string `json:"id"`
+	}
+	q := url.Values{"type": {typ}, "name": {d.c.Hostname}}
+	if err := d.call(ctx, http.MethodGet, base+"?"+q.Encode(), nil, &found); err != nil {
+		return err
+	}
+	rec := map[string]any{"type": typ, "name": d.c.Hostname, "content": ip.String(), "ttl": ddnsTTL(d.c)}
+	if len(found) == 0 {
+		return d.call(ctx, http.MethodPost, base, rec, nil)
+	}
+	return d.call(ctx, http.MethodPut, base+"/"+url.PathEscape(found[0].ID), rec, nil)
+}
+
+// duckDNS updates a <name>.duckdns.org record.
+type duckDNS struct {
+	c *DDNSConfig
+}
+
+func (d *duckDNS) update(ctx context.Context, ip net.IP) error {
+	q := url.Values{
+		"domains": {strings.TrimSuffix(strings.TrimSuffix(d.c.Hostname, "."), ".duckdns.org")},
+		"token":   {d.c.Token},
+	}
+	if ip.To4() != nil {
+		q.Set("ip", ip.String())
+	} else {
+		q.Set("ipv6", ip.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.duckdns.org/update?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if strings.TrimSpace(string(body)) != "OK" {
+		return fmt.Errorf("duckdns: %s %q", resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+)
+
+// rfc2136DDNS sends a TSIG-signed DNS UPDATE (RFC 2136 / RFC 8945) to the zone's primary:
+// delete the existing A/AAAA RRset for Hostname, then add the new address.
+type rfc2136DDNS struct {
+	c *DDNSConfig
+}
+
+const (
+	dnsTypeSOA   = 6
+	dnsTypeA     = 1
+	dnsTypeAAAA  = 28
+	dnsTypeTSIG  = 250
+	dnsClassIN   = 1
+	dnsClassANY  = 255
+	dnsOpUpdate  = 5
+	tsigFudgeSec = 300
+)
+
+var dnsRcodeNames = map[int]string{1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED", 6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE"}
+
+// appendDNSName appends name in uncompressed wire format, lowercased (canonical form).
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("bad DNS name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte { return binary.BigEndian.AppendUint16(b, v) }
+
+func appendUint32(b []byte, v uint32) []byte { return binary.BigEndian.AppendUint32(b, v) }
+
+func (d *rfc2136DDNS) update(ctx context.Context, ip net.IP) error {
+	typ, rdata := uint16(dnsTypeA), ip.To4()
+	if rdata == nil {
+		typ, rdata = dnsTypeAAAA, ip.To16()
+	}
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+
+	msg := appendUint16(nil, id)
+	msg = appendUint16(msg, dnsOpUpdate<<11)
+	msg = appendUint16(msg, 1) // ZOCOUNT
+	msg = appendUint16(msg, 0) // PRCOUNT
+	msg = appendUint16(msg, 2) // UPCOUNT
+	msg = appendUint16(msg, 0) // ADCOUNT (TSIG added below)
+	var err error
+	if msg, err = appendDNSName(msg, d.c.Zone); err != nil {
+		return err
+	}
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+	// Delete the RRset of this type...
+	if msg, err = appendDNSName(msg, d.c.Hostname); err != nil {
+		return err
+	}
+	msg = appendUint16(msg, typ)
+	msg = appendUint16(msg, dnsClassANY)
+	msg = appendUint32(msg, 0)
+	msg = appendUint16(msg, 0)
+	// ...and add the new record.
+	msg, _ = appendDNSName(msg, d.c.Hostname)
+	msg = appendUint16(msg, typ)
+	msg = appendUint16(msg, dnsClassIN)
+	msg = appendUint32(msg, uint32(ddnsTTL(d.c)))
+	msg = appendUint16(msg, uint16(len(rdata)))
+	msg = append(msg, rdata...)
+
+	if d.c.TSIGKey != "" {
+		if msg, err = d.sign(msg, id); err != nil {
+			return err
+		}
+	}
+	return d.exchange(ctx, msg, id)
+}
+
+// sign appends a TSIG record to msg.
+func (d *rfc2136DDNS) sign(msg []byte, id uint16) ([]byte, error) {
+	algo := d.c.TSIGAlgo
+	if algo == "" {
+		algo = "hmac-sha256"
+	}
+	var newHash func() hash.Hash
+	switch algo {
+	case "hmac-sha256":
+		newHash = sha256.New
+	case "hmac-sha512":
+		newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("ddns: unsupported TSIG algorithm %q", algo)
+	}
+	secret, err := base64.StdEncoding.DecodeString(d.c.TSIGSecret)
+	if err != nil {
+		return nil, fmt.Errorf("ddns: tsig secret: %w", err)
+	}
+	keyName, err := appendDNSName(nil, d.c.TSIGKey)
+	if err != nil {
+		return nil, err
+	}
+	algoName, _ := appendDNSName(nil, algo)
+	now := uint64(time.Now().Unix())
+	timeSigned := []byte{byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now)}
+
+	// MAC over the message and the TSIG variables (RFC 8945 section 4.3.3).
+	mac := hmac.New(newHash, secret)
+	mac.Write(msg)
+	vars := append([]byte{}, keyName...)
+	vars = appendUint16(vars, dnsClassANY)
+	vars = appendUint32(vars, 0)
+	vars = append(vars, algoName...)
+	vars = append(vars, timeSigned...)
+	vars = appendUint16(vars, tsigFudgeSec)
+	vars = appendUint16(vars, 0) // error
+	vars = appendUint16(vars, 0) // other len
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rd := append([]byte{}, algoName...)
+	rd = append(rd, timeSigned...)
+	rd = appendUint16(rd, tsigFudgeSec)
+	rd = appendUint16(rd, uint16(len(sum)))
+	rd = append(rd, sum...)
+	rd = appendUint16(rd, id)
+	rd = appendUint16(rd, 0) // error
+	rd = appendUint16(rd, 0) // other len
+
+	msg = append(msg, keyName...)
+	msg = appendUint16(msg, dnsTypeTSIG)
+	msg = appendUint16(msg, dnsClassANY)
+	msg = appendUint32(msg, 0)
+	msg = appendUint16(msg, uint16(len(rd)))
+	msg = append(msg, rd...)
+	binary.BigEndian.PutUint16(msg[10:], 1) // ADCOUNT
+	return msg, nil
+}
+
+// exchange sends the update over UDP and checks the response code.
+func (d *rfc2136DDNS) exchange(ctx context.Context, msg []byte, id uint16) error {
+	server := d.c.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		if rcode := int(binary.BigEndian.Uint16(buf[2:]) & 0xF); rcode != 0 {
+			if name, ok := dnsRcodeNames[rcode]; ok {
+				return fmt.Errorf("ddns: update refused: %s", name)
+			}
+			return fmt.Errorf("ddns: update refused: rcode %d", rcode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,142 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// debugLog gates high-volume debug events (per-frame and per-10KB progress lines) and
+// samples them so busy relays do not flood their logs. All settings can be changed at
+// runtime; samplers pick up new values on their next event.
+type debugLog struct {
+	enabled int32 // atomic; non-zero = debug logging on
+	every   int64 // atomic; log every Nth sampled event per session (<= 1 = every event)
+	perSec  int64 // atomic; at most N sampled lines per second per session (0 = unlimited)
+}
+
+func newDebugLog(enabled bool, every, perSec int) *debugLog {
+	d := &debugLog{}
+	d.set(enabled)
+	d.setSampling(every, perSec)
+	return d
+}
+
+func (d *debugLog) on() bool { return atomic.LoadInt32(&d.enabled) != 0 }
+
+func (d *debugLog) set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&d.enabled, v)
+}
+
+func (d *debugLog) setSampling(every, perSec int) {
+	atomic.StoreInt64(&d.every, int64(every))
+	atomic.StoreInt64(&d.perSec, int64(perSec))
+}
+
+// printf logs a low-volume debug event (session start/end, errors); it is never sampled.
+func (d *debugLog) printf(format string, args ...interface{}) {
+	if d.on() {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+// sessionf is printf for an event of sess, which is also logged while debug is on for
+// just that session (SetSessionDebug).
+func (d *debugLog) sessionf(sess *Session, format string, args ...interface{}) {
+	if d.on() || sess.debug.Load() {
+		log.Printf("[debug] "+format, args...)
+	}
+}
+
+// sampler returns a sampler for one session's stream of high-volume events. A sampler is
+// owned by a single goroutine.
+func (d *debugLog) sampler(sess *Session) *debugSampler {
+	return &debugSampler{d: d, sess: sess}
+}
+
+// debugSampler applies the every-Nth and per-second limits to one session's event stream.
+type debugSampler struct {
+	d        *debugLog
+	sess     *Session
+	count    int64
+	window   time.Time
+	inWindow int64
+	dropped  int64
+}
+
+// printf logs a high-volume event if debug is on and the sampling limits allow it. Lines
+// carry sampled=N when earlier events were skipped.
+func (s *debugSampler) printf(format string, args ...interface{}) {
+	if !s.d.on() && !s.sess.debug.Load() {
+		return
+	}
+	s.count++
+	if every := atomic.LoadInt64(&s.d.every); every > 1 && s.count%every != 0 {
+		s.dropped++
+		return
+	}
+	if perSec := atomic.LoadInt64(&s.d.perSec); perSec > 0 {
+		now := time.Now()
+		if now.Sub(s.window) >= time.Second {
+			s.window = now
+			s.inWindow = 0
+		}
+		if s.inWindow >= perSec {
+			s.dropped++
+			return
+		}
+		s.inWindow++
+	}
+	if s.dropped > 0 {
+		args = append(args, s.dropped)
+		format += " sampled=%d"
+		s.dropped = 0
+	}
+	log.Printf("[debug] "+format, args...)
+}
+
+// SetDebug turns debug logging on or off at runtime. actor identifies who asked, for the
+// admin audit trail.
+func (r *Relay) SetDebug(actor string, enabled bool) {
+	r.debug.set(enabled)
+	r.recordAdminAction(actor, "set_debug", map[string]string{"enabled": fmt.Sprint(enabled)}, nil)
+}
+
+// SetSessionDebug turns debug logging on or off for one session, leaving the global
+// setting alone, so a single misbehaving transfer can be followed on a busy relay.
+func (r *Relay) SetSessionDebug(actor, sessionID string, enabled bool) error {
+	sess, err := r.lookupSession(sessionID)
+	if err == nil {
+		sess.debug.Store(enabled)
+	}
+	r.recordAdminAction(actor, "set_session_debug", map[string]string{"session": sessionID, "enabled": fmt.Sprint(enabled)}, err)
+	return err
+}
+
+// DebugSettings is the current debug logging configuration (see SetDebug, SetDebugSampling).
+type DebugSettings struct {
+	Enabled     bool `json:"enabled"`
+	SampleEvery int  `json:"sample_every"`
+	MaxPerSec   int  `json:"max_per_sec"`
+}
+
+// Debug returns the current debug logging configuration.
+func (r *Relay) Debug() DebugSettings {
+	return DebugSettings{
+		Enabled:     r.debug.on(),
+		SampleEvery: int(atomic.LoadInt64(&r.debug.every)),
+		MaxPerSec:   int(atomic.LoadInt64(&r.debug.perSec)),
+	}
+}
+
+// SetDebugSampling changes debug log sampling at runtime: log every Nth high-volume event
+// and at most perSec such lines per second per session (0 = no limit).
+func (r *Relay) SetDebugSampling(actor string, every, perSec int) {
+	r.debug.setSampling(every, perSec)
+	r.recordAdminAction(actor, "set_debug_sampling", map[string]string{"every": itoa(every), "per_sec": itoa(perSec)}, nil)
+}
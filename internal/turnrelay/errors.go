@@ -0,0 +1,49 @@
+package turnrelay
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/pool"
+)
+
+// Errors returned (possibly wrapped) by the relay; use errors.Is. Their text is also what
+// bots receive in MsgError, so the client library can map it back.
+var (
+	ErrPortPoolExhausted = pool.ErrExhausted                    // every DCC port is allocated
+	ErrSessionNotFound   = errors.New("session not found")      // no session with that ID
+	ErrAuthFailed        = errors.New("auth failed")            // unknown user or wrong secret
+	ErrRelayFull         = errors.New("relay full")             // max_sessions bot connections already open
+	ErrDuplicateSession  = errors.New("duplicate registration") // the session ID is in use, or an idempotent retry of a session that already moved data
+	ErrScheduleDenied    = errors.New("not allowed now")        // a schedule window refuses this kind of session
+	ErrQuotaExceeded     = errors.New("quota exceeded")         // the bot user used up a day or month quota
+	ErrFileTooLarge      = errors.New("file too large")         // the declared file size is over MaxFileSize
+	ErrReadOnly          = errors.New("read only")              // the relay accepts downloads only (ReadOnly, SetReadOnly)
+	ErrFrameTooLarge     = errors.New("frame too large")        // a frame payload exceeds MaxPayload; the connection is closed
+	ErrSlowDown          = errors.New("slow down")              // registration rate limit hit; the message ends in "retry after <n>ms"
+	ErrDenied            = errors.New("registration denied")    // the pre-registration hook refused it
+	ErrHopLimit          = errors.New("hop limit reached")      // a chained registration would pass through too many relays
+	ErrShuttingDown      = errors.New("shutting down")          // Shutdown was called; no new sessions are accepted
+	ErrLeaseExpired      = errors.New("lease expired")          // no user connected before the allocation's lease ran out
+	ErrResumeRejected    = errors.New("resume rejected")        // MsgResume names no interrupted download, or an offset past what its user received
+)
+
+// replyFrameError tells the bot why its connection is about to be closed when a frame read
+// failed because the frame was too large. write sends one frame on that connection (the
+// session's serialized writer once a session exists). Other read errors get no reply.
+func replyFrameError(err error, write func(msgType byte, payload []byte) error) {
+	if errors.Is(err, ErrFrameTooLarge) {
+		_ = write(MsgError, []byte(err.Error()))
+	}
+}
+
+// lookupSession returns the registered session with the given ID.
+func (r *Relay) lookupSession(sessionID string) (*Session, error) {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+	sess, ok := r.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSessionNotFound, sessionID)
+	}
+	return sess, nil
+}
@@ -0,0 +1,252 @@
+package turnrelay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/bridge"
+)
+
+// defaultFanoutWait is how long a fan-out session waits for its other users once the first
+// one connected, when FanoutWaitSec is not set.
+const defaultFanoutWait = 10 * time.Second
+
+// fanoutBuffer is how many chunks each fan-out user's buffer holds, like BotStream.
+const fanoutBuffer = 512
+
+// fanout shares the bot stream of a download session among several DCC users
+// (Registration.Fanout), so the bot sends the file once. Users join on the session's port
+// or server name until want of them connected or the wait after the first one ran out;
+// then the stream starts and later users are refused.
+type fanout struct {
+	want    int
+	mu      sync.Mutex
+	users   []*fanoutUser
+	closed  bool          // no more users: the stream started
+	full    chan struct{} // closed when want users joined
+	started chan struct{} // closed when the stream starts
+	writers sync.WaitGroup
+}
+
+// fanoutUser is one user of a fan-out session.
+type fanoutUser struct {
+	conn     net.Conn
+	ch       chan []byte   // chunks for this user; closed after the bot's EOF
+	exited   chan struct{} // closed when the user's writer returned
+	complete atomic.Bool   // the user received everything
+}
+
+func newFanout(want int) *fanout {
+	return &fanout{want: want, full: make(chan struct{}), started: make(chan struct{})}
+}
+
+// join adds a user on conn and reports whether it is the first. It returns nil once the
+// stream started.
+func (f *fanout) join(conn net.Conn) (u *fanoutUser, first bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, false
+	}
+	u = &fanoutUser{conn: conn, ch: make(chan []byte, fanoutBuffer), exited: make(chan struct{})}
+	f.users = append(f.users, u)
+	f.writers.Add(1)
+	if len(f.users) == f.want {
+		close(f.full)
+	}
+	return u, len(f.users) == 1
+}
+
+// joinable reports whether users can still join.
+func (f *fanout) joinable() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.closed
+}
+
+// start closes the fan-out to new users and returns the ones that joined.
+func (f *fanout) start() []*fanoutUser {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.started)
+	}
+	return f.users
+}
+
+func (r *Relay) maxFanout() int { return max(r.config.MaxFanout, 0) }
+
+func (r *Relay) fanoutWait() time.Duration {
+	if r.config.FanoutWaitSec > 0 {
+		return time.Duration(r.config.FanoutWaitSec) * time.Second
+	}
+	return defaultFanoutWait
+}
+
+// checkFanout validates a registration's fan-out option.
+func (r *Relay) checkFanout(kind string, reg Registration) error {
+	switch {
+	case reg.Fanout <= 1:
+		return nil
+	case kind != "download" || reg.PeerBot != "" || reg.Via != "":
+		return errors.New("bad fanout: only DCC downloads can fan out")
+	case reg.Fanout > r.maxFanout():
+		return fmt.Errorf("bad fanout: %d users (max %d)", reg.Fanout, r.maxFanout())
+	}
+	return nil
+}
+
+// acceptFanout takes users on a fan-out session's DCC port until the stream starts.
+func (r *Relay) acceptFanout(ln net.Listener, sess *Session) {
+	go func() {
+		select {
+		case <-sess.Done:
+		case <-sess.fan.started:
+		}
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !sess.isClaimed() {
+				r.removeSession(sess.ID)
+			}
+			return
+		}
+		r.spawn(func() { r.serveFanoutUser(conn, sess) })
+	}
+}
+
+// serveFanoutUser joins the user on conn to sess's fan-out and writes the stream to it. The
+// first user claims the session and starts distribute.
+func (r *Relay) serveFanoutUser(conn net.Conn, sess *Session) {
+	defer conn.Close()
+	u, first := sess.fan.join(conn)
+	if u == nil {
+		return
+	}
+	defer sess.fan.writers.Done()
+	defer close(u.exited)
+	r.reach.observe(conn.LocalAddr())
+	if first {
+		// The first user stands for the session in logs and statistics.
+		sess.setPeer(r.peerIP(conn.RemoteAddr()))
+		sess.claim()
+		r.spawn(func() { r.distribute(sess) })
+	}
+	conn = r.wrapUserConn(conn, sess)
+	go func() {
+		<-sess.Done
+		conn.Close()
+	}()
+	cw := r.userWriter(conn, sess)
+	var dst io.Writer = cw
+	var tw io.WriteCloser
+	if t := r.config.Transform; t != nil {
+		if tw = t.Wrap(TransformInfo{SessionID: sess.ID, Filename: sess.Filename}, cw); tw != nil {
+			dst = tw
+		}
+	}
+	_, err := io.Copy(dst, &bridge.ChanReader{Ch: u.ch, Done: sess.Done})
+	if tw != nil && err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		log.Printf("relay: %s: fan-out user %s failed after %d bytes: %v", sess, r.peerString(u.conn.RemoteAddr()), cw.N, err)
+		return
+	}
+	u.complete.Store(true)
+}
+
+// distribute waits for the fan-out's users, then copies BotStream to each of them. The
+// stream goes at the pace of the slowest user, except that a user whose buffer stays full
+// for the slow-consumer grace period is dropped. Once every user is done the session is
+// removed: completed if at least one user received everything, CloseUserError otherwise.
+func (r *Relay) distribute(sess *Session) {
+	f := sess.fan
+	defer r.recoverPanic("fan-out "+sess.ID, func() { r.removeSession(sess.ID) })
+	wait := time.NewTimer(r.fanoutWait())
+	select {
+	case <-f.full:
+	case <-wait.C:
+	case <-sess.Done:
+	}
+	wait.Stop()
+	users := f.start()
+	log.Printf("relay: %s: fan-out to %d of %d users", sess, len(users), f.want)
+	r.pump(sess, users)
+	f.writers.Wait()
+	completed := 0
+	for _, u := range users {
+		if u.complete.Load() {
+			completed++
+		}
+	}
+	if completed > 0 {
+		sess.completed.Store(true)
+	} else {
+		sess.setCloseReason(CloseUserError)
+	}
+	if completed < len(users) {
+		log.Printf("relay: %s: fan-out complete for %d of %d users", sess, completed, len(users))
+	}
+	r.removeSession(sess.ID)
+}
+
+// pump copies BotStream to users until the bot's EOF, which it passes on by closing each
+// remaining user's channel, or until the session ends.
+func (r *Relay) pump(sess *Session, users []*fanoutUser) {
+	grace := r.slowConsumerGrace()
+	live := append([]*fanoutUser(nil), users...)
+	for {
+		var chunk []byte
+		select {
+		case c, ok := <-sess.BotStream:
+			if !ok {
+				for _, u := range live {
+					close(u.ch)
+				}
+				return
+			}
+			chunk = c
+		case <-sess.Done:
+			return
+		}
+		next := live[:0]
+		for _, u := range live {
+			select {
+			case u.ch <- chunk:
+				next = append(next, u)
+				continue
+			case <-u.exited:
+				continue
+			default:
+			}
+			lag := time.NewTimer(grace)
+			select {
+			case u.ch <- chunk:
+				next = append(next, u)
+			case <-u.exited:
+			case <-lag.C:
+				atomic.AddInt64(&r.metrics.slowConsumers, 1)
+				log.Printf("relay: %s: fan-out user %s fell %s behind, dropping it", sess, r.peerString(u.conn.RemoteAddr()), grace)
+				u.conn.Close()
+			case <-sess.Done:
+				lag.Stop()
+				return
+			}
+			lag.Stop()
+		}
+		live = next
+		if len(live) == 0 {
+			return
+		}
+	}
+}
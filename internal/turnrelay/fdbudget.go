@@ -0,0 +1,51 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// fdBudget raises the open file soft limit towards what MaxSessions needs (at most to the
+// hard limit) and records how many sessions the resulting limit supports in r.fdSessions.
+// It returns that number, or 0 if the platform reports no limit.
+func (r *Relay) fdBudget() int32 {
+	need := uint64(atomic.LoadInt32(&r.maxSessions))*fdsPerSession + fdsReserved
+	if err := raiseOpenFileLimit(need); err != nil {
+		log.Printf("relay: raise open file limit to %d: %v", need, err)
+	}
+	soft, _, ok := openFileLimit()
+	if !ok {
+		return 0
+	}
+	atomic.StoreInt64(&r.fdLimit, int64(soft))
+	sessions := int64(1)
+	if soft > fdsReserved+fdsPerSession {
+		sessions = int64((soft - fdsReserved) / fdsPerSession)
+	}
+	if sessions > 1<<30 {
+		sessions = 1 << 30
+	}
+	atomic.StoreInt32(&r.fdSessions, int32(sessions))
+	return int32(sessions)
+}
+
+// fdExhausted is called by accept loops that ran out of file descriptors; they keep
+// retrying, so this only counts and logs it (at most once a minute).
+func (r *Relay) fdExhausted(err error) {
+	n := atomic.AddInt64(&r.metrics.fdExhausted, 1)
+	now := time.Now().Unix()
+	if last := atomic.LoadInt64(&r.metrics.fdLogged); now-last >= 60 && atomic.CompareAndSwapInt64(&r.metrics.fdLogged, last, now) {
+		open, _ := openFileCount()
+		log.Printf("relay: accept: %v (%d open of limit %d, %d times so far); retrying", err, open, atomic.LoadInt64(&r.fdLimit), n)
+	}
+}
+
+// checkFDBudget returns an error if n sessions do not fit the open file limit.
+func (r *Relay) checkFDBudget(n int) error {
+	if budget := atomic.LoadInt32(&r.fdSessions); budget > 0 && int32(n) > budget {
+		return fmt.Errorf("max sessions %d exceeds the %d the open file limit %d allows", n, budget, atomic.LoadInt64(&r.fdLimit))
+	}
+	return nil
+}
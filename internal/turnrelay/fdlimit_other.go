@@ -0,0 +1,12 @@
+//go:build !unix
+
+package turnrelay
+
+// openFileLimit reports no limit on platforms without RLIMIT_NOFILE.
+func openFileLimit() (soft, hard uint64, ok bool) {
+	return 0, 0, false
+}
+
+func raiseOpenFileLimit(want uint64) error { return nil }
+
+func openFileCount() (int, bool) { return 0, false }
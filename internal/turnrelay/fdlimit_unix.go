@@ -0,0 +1,43 @@
+//go:build unix
+
+package turnrelay
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFileLimit returns the process's RLIMIT_NOFILE soft and hard limits.
+func openFileLimit() (soft, hard uint64, ok bool) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, 0, false
+	}
+	return uint64(lim.Cur), uint64(lim.Max), true
+}
+
+// raiseOpenFileLimit raises the RLIMIT_NOFILE soft limit to want, capped at the hard limit.
+func raiseOpenFileLimit(want uint64) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return err
+	}
+	if uint64(lim.Cur) >= want {
+		return nil
+	}
+	lim.Cur = lim.Max
+	if uint64(lim.Max) > want {
+		lim.Cur = want
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+}
+
+// openFileCount returns the number of file descriptors the process has open.
+func openFileCount() (int, bool) {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			return len(entries), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,50 @@
+package turnrelay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// checkFileSize validates a registration's size option against MaxFileSize. Forward
+// sessions carry a stream each way, not a file, so they cannot declare one.
+func (r *Relay) checkFileSize(kind string, reg Registration) error {
+	switch {
+	case reg.Size == 0:
+		return nil
+	case reg.Size < 0:
+		return errors.New("bad size: must be a positive byte count")
+	case kind == "forward":
+		return errors.New("bad size: forward sessions have none")
+	case r.config.MaxFileSize > 0 && reg.Size > r.config.MaxFileSize:
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrFileTooLarge, reg.Size, r.config.MaxFileSize)
+	}
+	return nil
+}
+
+// fileSizeLimit is how many bytes of its file sess may carry: the declared size, else
+// MaxFileSize (0 = no limit).
+func (r *Relay) fileSizeLimit(sess *Session) int64 {
+	if sess.size > 0 {
+		return sess.size
+	}
+	return r.config.MaxFileSize
+}
+
+// withinFileSize reports whether sess may move n more bytes without passing its file size
+// limit. Positions count from the start of the file, so a resumed download is limited to
+// the rest of it. If not, the session is marked CloseTooLarge; the caller tears it down.
+func (r *Relay) withinFileSize(sess *Session, n int) bool {
+	limit := r.fileSizeLimit(sess)
+	if limit <= 0 || atomic.LoadInt64(&sess.resumedAt)+sess.Bytes()+int64(n) <= limit {
+		return true
+	}
+	if sess.size > 0 {
+		log.Printf("relay: %s: cut past its declared size of %d bytes", sess, limit)
+	} else {
+		log.Printf("relay: %s: cut at max file size %d", sess, limit)
+	}
+	sess.setCloseReason(CloseTooLarge)
+	return false
+}
@@ -0,0 +1,134 @@
+package turnrelay
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/bridge"
+)
+
+// A "forward" session bridges the user's DCC connection to an arbitrary bot-side stream in
+// both directions: user bytes go to the bot as MsgData (as in an upload) and the bot's
+// MsgData goes to the user (as in a download). Each direction ends with MsgEOF / the user
+// closing its write side; the session is removed once both have ended.
+
+// relayForwardBot is the bot side of a forward session; see relayDownloadToUser for detach.
+func (r *Relay) relayForwardBot(botConn *tls.Conn, username string, sess *Session, detach <-chan struct{}) {
+	sessionID := sess.ID
+	defer r.recoverPanic("forward session "+sessionID, func() { r.removeSession(sessionID) })
+	// Bot -> user. This goroutine is the only sender on BotStream and its only closer.
+	go func() {
+		defer r.recoverPanic("forward session "+sessionID, func() { r.removeSession(sessionID) })
+		eof := false
+		for {
+			msgType, payload, err := r.readBotFrame(botConn, sess)
+			if sess.detached(detach) {
+				return
+			}
+			if err != nil {
+				r.closeOnFrameError(sess, err)
+				// After MsgEOF the bot may hang up; what it sent is still delivered.
+				if !eof {
+					sess.Close()
+				}
+				return
+			}
+			switch {
+			case msgType == MsgData && !eof:
+				if !r.pace(sess, len(payload)) {
+					return
+				}
+				if !r.withinCap(sess, len(payload)) {
+					sess.Close()
+					return
+				}
+				select {
+				case sess.BotStream <- payload:
+					sess.addBytes(len(payload))
+				case <-sess.Done:
+					return
+				}
+			case msgType == MsgEOF && !eof:
+				eof = true
+				sess.CloseBotStream()
+			case msgType == MsgRenew:
+				if r.handleRenew(username, sess, payload) != nil {
+					sess.setCloseReason(CloseBotError)
+					sess.Close()
+					return
+				}
+			default: // MsgCancel, data after EOF or an unknown type
+				if msgType != MsgCancel {
+					r.metrics.malformed()
+					sess.setCloseReason(CloseBotError)
+				} else {
+					sess.setCloseReason(CloseCanceled)
+				}
+				sess.Close()
+				return
+			}
+		}
+	}()
+	// User -> bot.
+	for {
+		select {
+		case data, ok := <-sess.UserConn:
+			if !ok {
+				if err := sess.writeBot(MsgEOF, nil); err != nil {
+					sess.setCloseReason(CloseBotError)
+					r.removeSession(sessionID)
+					return
+				}
+				// Wait for the other direction to be delivered to the user.
+				select {
+				case <-sess.userDrained:
+					sess.completed.Store(true)
+				case <-sess.Done:
+				case <-detach:
+					return
+				}
+				r.removeSession(sessionID)
+				return
+			}
+			if !r.withinCap(sess, len(data)) {
+				r.removeSession(sessionID)
+				return
+			}
+			if err := sess.writeBot(MsgData, data); err != nil {
+				sess.setCloseReason(CloseBotError)
+				r.removeSession(sessionID)
+				return
+			}
+			sess.addBytes(len(data))
+		case <-sess.Done:
+			r.removeSession(sessionID)
+			return
+		case <-detach:
+			return
+		}
+	}
+}
+
+// forwardUser is the user side of a forward session: BotStream is copied to conn while
+// conn is read into UserConn. It returns once both directions have ended.
+func (r *Relay) forwardUser(conn net.Conn, sess *Session) {
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		defer r.recoverPanic("forward session "+sess.ID, func() { r.removeSession(sess.ID) })
+		cw := r.userWriter(conn, sess)
+		_, err := io.Copy(cw, &bridge.ChanReader{Ch: sess.BotStream, Done: sess.Done})
+		if err != nil {
+			sess.setCloseReason(CloseUserError)
+			sess.Close()
+			return
+		}
+		if hc, ok := conn.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite()
+		}
+		close(sess.userDrained)
+	}()
+	r.readUserInto(conn, sess)
+	<-copied
+}
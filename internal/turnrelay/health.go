@@ -0,0 +1,133 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watchdogInterval is how often the watchdog checks registered goroutines.
+const watchdogInterval = 10 * time.Second
+
+// healthRegistry tracks long-lived goroutines (accept loops, reapers, schedulers). Each one
+// registers, heartbeats while it makes progress and reports when it exits; the watchdog
+// turns silent exits and stalls into log diagnostics and a not-ready status.
+type healthRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*healthEntry
+	failed  chan error // the first exit, for RunContext
+	// onProblem, if set, is called (with mu held) for each problem the watchdog logs.
+	onProblem func(name, problem string)
+}
+
+// healthEntry is one registered goroutine. maxSilence 0 means no heartbeat is expected
+// (e.g. a loop blocked in Accept); only its exit is watched.
+type healthEntry struct {
+	reg        *healthRegistry
+	name       string
+	maxSilence time.Duration
+	lastBeat   time.Time
+	exited     bool
+	exitErr    error
+	reported   bool
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{entries: make(map[string]*healthEntry), failed: make(chan error, 1)}
+}
+
+// register adds (or replaces) the entry for name.
+func (h *healthRegistry) register(name string, maxSilence time.Duration) *healthEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := &healthEntry{reg: h, name: name, maxSilence: maxSilence, lastBeat: time.Now()}
+	h.entries[name] = e
+	return e
+}
+
+// unregister removes name; used by goroutines that stop on purpose (e.g. shutdown).
+func (h *healthRegistry) unregister(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.entries, name)
+}
+
+// beat records progress.
+func (e *healthEntry) beat() {
+	e.reg.mu.Lock()
+	e.lastBeat = time.Now()
+	e.reported = false
+	e.reg.mu.Unlock()
+}
+
+// stop removes the entry of a goroutine that returns on purpose (relay shutting down).
+func (e *healthEntry) stop() { e.reg.unregister(e.name) }
+
+// exit records that the goroutine returned; err is the reason, if any.
+func (e *healthEntry) exit(err error) {
+	e.reg.mu.Lock()
+	e.exited = true
+	e.exitErr = err
+	e.reg.mu.Unlock()
+	select {
+	case e.reg.failed <- fmt.Errorf("%s exited: %v", e.name, err):
+	default:
+	}
+}
+
+// problems returns one line per dead or stalled goroutine, sorted by name. Entries not yet
+// reported are logged and marked reported, so each failure is logged once.
+func (h *healthRegistry) problems(now time.Time, logNew bool) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []string
+	for _, e := range h.entries {
+		var p string
+		switch {
+		case e.exited:
+			p = fmt.Sprintf("%s: exited (%v)", e.name, e.exitErr)
+		case e.maxSilence > 0 && now.Sub(e.lastBeat) > e.maxSilence:
+			p = fmt.Sprintf("%s: no heartbeat for %s", e.name, now.Sub(e.lastBeat).Round(time.Second))
+		default:
+			continue
+		}
+		out = append(out, p)
+		if logNew && !e.reported {
+			e.reported = true
+			log.Printf("relay: watchdog: %s", p)
+			if h.onProblem != nil {
+				h.onProblem(e.name, p)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// HealthStatus reports whether every registered long-lived goroutine is alive.
+type HealthStatus struct {
+	Ready    bool
+	Problems []string
+}
+
+// Health returns the current readiness of the relay.
+func (r *Relay) Health() HealthStatus {
+	p := r.health.problems(time.Now(), false)
+	return HealthStatus{Ready: len(p) == 0, Problems: p}
+}
+
+// watchdog periodically checks the health registry and logs newly detected problems.
+func (r *Relay) watchdog() {
+	t := time.NewTicker(watchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case now := <-t.C:
+			r.health.problems(now, true)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+)
+
+// testUser and testSecret are the bot credential of relays made by startTestRelay.
+const (
+	testUser   = "bot"
+	testSecret = "secret"
+)
+
+// writeTestCert writes a self-signed certificate and key for localhost and 127.0.0.1 to
+// dir, named <name>.crt and <name>.key, and returns their paths and the certificate.
+func writeTestCert(t testing.TB, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	return certFile, keyFile, cert
+}
+
+// freePortRange returns the first of n consecutive TCP ports that are free right now. They
+// are below the usual ephemeral range (Linux: 32768 and up), so the tests' own outgoing
+// connections do not take them.
+func freePortRange(t testing.TB, n int) int {
+	t.Helper()
+	for try := 0; try < 100; try++ {
+		base := 20000 + mrand.Intn(12000-n)
+		free := true
+		for p := base; p < base+n && free; p++ {
+			ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p))
+			if err != nil {
+				free = false
+				continue
+			}
+			ln.Close()
+		}
+		if free {
+			return base
+		}
+	}
+	t.Fatalf("no %d free consecutive ports", n)
+	return 0
+}
+
+// newTestConfig returns a config for a relay on loopback with a fresh certificate, one bot
+// user (testUser) and a DCC range of ports free ports.
+func newTestConfig(t testing.TB, ports int) *RelayConfig {
+	t.Helper()
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir(), "relay")
+	base := freePortRange(t, ports)
+	return &RelayConfig{
+		TURNListen:  "127.0.0.1:0",
+		RelayHost:   "127.0.0.1",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+		TurnUsers:   []TurnUserCred{{Username: testUser, Secret: testSecret}},
+		DCCPortMin:  base,
+		DCCPortMax:  base + ports - 1,
+	}
+}
+
+// startTestRelay runs a relay with config c and returns it with its bot address. The relay
+// is shut down when the test ends.
+func startTestRelay(t testing.TB, c *RelayConfig) (*Relay, string) {
+	t.Helper()
+	r, err := NewRelay(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		r.Shutdown(ctx)
+	})
+	return r, fmt.Sprintf("127.0.0.1:%d", r.singlePort)
+}
+
+// dialTestBot connects to the relay at addr and authenticates as testUser.
+func dialTestBot(t testing.TB, addr string) *tls.Conn {
+	t.Helper()
+	conn, _ := dialTestBotNonce(t, addr)
+	return conn
+}
+
+// dialTestBotNonce is dialTestBot that also returns the connection's MsgAuthOk nonce.
+func dialTestBotNonce(t testing.TB, addr string) (*tls.Conn, []byte) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNFrames}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := WriteFrame(conn, MsgAuth, auth.MarshalRequest(testUser, testSecret)); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := readChainReply(conn, MsgAuthOk)
+	if err != nil {
+		t.Fatalf("auth: %v", err)
+	}
+	ok, err := ParseAuthOk(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, ok.Nonce
+}
+
+// registerTestSession registers a session of kind on the authenticated bot connection and
+// returns the DCC port it was given.
+func registerTestSession(t testing.TB, conn net.Conn, kind, sessionID string) int {
+	t.Helper()
+	msgType := map[string]byte{"download": MsgRegisterDownload, "upload": MsgRegisterUpload, "forward": MsgRegisterForward}[kind]
+	if err := WriteFrame(conn, msgType, Registration{SessionID: sessionID, Filename: "file.bin"}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := readChainReply(conn, MsgPortAlloc)
+	if err != nil {
+		t.Fatalf("register %s: %v", sessionID, err)
+	}
+	alloc, err := ParsePortAlloc(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alloc.Port
+}
+
+// dialTestUser connects to a session's DCC port as its user.
+func dialTestUser(t testing.TB, port int) *tls.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testSessionID returns a 36-byte session ID made from n.
+func testSessionID(n int) string { return fmt.Sprintf("00000000-0000-0000-0000-%012d", n) }
+
+// sessionCount returns how many sessions r has registered.
+func sessionCount(r *Relay) int {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+	return len(r.sessions)
+}
+
+// waitFor polls cond until it holds or d passes.
+func waitFor(t testing.TB, d time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
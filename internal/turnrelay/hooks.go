@@ -0,0 +1,176 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostHook is run after a transfer completes normally, e.g. to scan, archive or announce
+// it. A Command gets the transfer as JSON on stdin and in HUZAA_* environment variables;
+// a URL gets the same JSON POSTed to it. Results are recorded in the audit log as
+// "post_hook" events.
+type PostHook struct {
+	Name       string   // label in the audit log; defaults to the command or URL
+	Command    []string // program and arguments
+	URL        string   // HTTP(S) endpoint to POST to; a non-2xx status is a failure
+	Kinds      []string // session kinds to run for; empty = "upload"
+	TimeoutSec int      // per attempt; default 30
+	Retries    int      // extra attempts after a failure, with exponential backoff
+}
+
+// hookTransfer is the JSON a post-transfer hook receives.
+type hookTransfer struct {
+	Session  string `json:"session"`
+	Kind     string `json:"kind"`
+	Filename string `json:"filename,omitempty"`
+	User     string `json:"user"`
+	Bytes    int64  `json:"bytes"`
+	Peer     string `json:"peer,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+func (h *PostHook) label() string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case len(h.Command) > 0:
+		return h.Command[0]
+	default:
+		return h.URL
+	}
+}
+
+func (h *PostHook) matches(kind string) bool {
+	if len(h.Kinds) == 0 {
+		return kind == "upload"
+	}
+	for _, k := range h.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// runPostHooks starts the configured hooks for a finished session in the background.
+func (r *Relay) runPostHooks(sess *Session) {
+	if len(r.config.PostHooks) == 0 || !sess.completed.Load() {
+		return
+	}
+	t := hookTransfer{
+		Session:  sess.ID,
+		Kind:     sess.Kind,
+		Filename: sess.Filename,
+		User:     sess.owner,
+		Bytes:    sess.Bytes(),
+		Peer:     peerText(sess.Peer()),
+		Duration: r.sessionStats(sess).Duration.Milliseconds(),
+	}
+	for i := range r.config.PostHooks {
+		h := &r.config.PostHooks[i]
+		if h.matches(sess.Kind) {
+			go r.runPostHook(h, t)
+		}
+	}
+}
+
+// runPostHook runs one hook with retries and records the outcome.
+func (r *Relay) runPostHook(h *PostHook, t hookTransfer) {
+	defer r.recoverPanic("post hook "+h.label()+" for "+t.Session, nil)
+	body, err := json.Marshal(t)
+	if err != nil {
+		return
+	}
+	timeout := 30 * time.Second
+	if h.TimeoutSec > 0 {
+		timeout = time.Duration(h.TimeoutSec) * time.Second
+	}
+	backoff := time.Second
+	attempts := 0
+	for {
+		attempts++
+		ctx, cancel := context.WithTimeout(r.ctx, timeout)
+		if len(h.Command) > 0 {
+			err = runHookCommand(ctx, h.Command, t, body)
+		} else {
+			err = postHook(ctx, h.URL, body)
+		}
+		cancel()
+		if err == nil || attempts > h.Retries || r.ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+	ev := AuditEvent{
+		Event:    "post_hook",
+		Session:  t.Session,
+		Kind:     t.Kind,
+		Filename: t.Filename,
+		Bytes:    t.Bytes,
+		Action:   h.label(),
+		Attempts: attempts,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+		log.Printf("relay: post hook %s for session %s (user %s) failed after %d attempt(s): %v", h.label(), t.Session, t.User, attempts, err)
+	}
+	r.audit.record(ev)
+}
+
+func runHookCommand(ctx context.Context, argv []string, t hookTransfer, body []byte) error {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"HUZAA_SESSION="+t.Session,
+		"HUZAA_KIND="+t.Kind,
+		"HUZAA_FILENAME="+t.Filename,
+		"HUZAA_USER="+t.User,
+		"HUZAA_BYTES="+strconv.FormatInt(t.Bytes, 10),
+		"HUZAA_PEER="+t.Peer,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			if len(msg) > 200 {
+				msg = msg[:200]
+			}
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func postHook(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
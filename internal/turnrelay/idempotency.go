@@ -0,0 +1,45 @@
+package turnrelay
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers registration idempotency keys (scoped per bot user) for a
+// window, mapping each to the session it created.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]idempotencyEntry
+}
+
+type idempotencyEntry struct {
+	sessionID string
+	expires   time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{window: window, entries: make(map[string]idempotencyEntry)}
+}
+
+func (c *idempotencyCache) lookup(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.sessionID, true
+}
+
+func (c *idempotencyCache) store(key, sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = idempotencyEntry{sessionID: sessionID, expires: now.Add(c.window)}
+}
@@ -0,0 +1,33 @@
+package turnrelay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// sessionKeyLabel separates session MAC keys from any other use of the bot secret.
+const sessionKeyLabel = "huzaa-relay session mac v1"
+
+// DeriveSessionKey derives the per-session MAC key from the bot secret, the nonce the relay
+// sent in MsgAuthOk, and the session ID. Bot and relay compute the same key independently,
+// so the key itself never crosses the wire.
+func DeriveSessionKey(secret, nonce []byte, sessionID string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionKeyLabel))
+	mac.Write(nonce)
+	mac.Write([]byte(sessionID))
+	return mac.Sum(nil)
+}
+
+// SignChecksum authenticates a transfer digest with a session key so a tampered path
+// between relay and bot cannot forge a "transfer OK".
+func SignChecksum(key, digest []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(digest)
+	return mac.Sum(nil)
+}
+
+// VerifyChecksum reports whether tag is a valid SignChecksum of digest under key.
+func VerifyChecksum(key, digest, tag []byte) bool {
+	return hmac.Equal(SignChecksum(key, digest), tag)
+}
@@ -0,0 +1,119 @@
+package turnrelay
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// Reasons in InterruptedSession.Reason.
+const (
+	InterruptedUnclaimed    = "unclaimed"     // no user had connected when the relay stopped accepting
+	InterruptedDrainTimeout = "drain_timeout" // still transferring when the shutdown grace ran out
+)
+
+// InterruptedSession is a session Shutdown ended before it finished, as written to
+// InterruptedFile.
+type InterruptedSession struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size,omitempty"` // declared file size; 0 = not declared
+	Owner     string    `json:"owner"`          // bot user that registered the session
+	Offset    int64     `json:"offset"`         // how far it got: bytes the user received (downloads, from the start of the file) or the bot received
+	Bytes     int64     `json:"bytes"`          // bytes relayed on the bot leg
+	State     string    `json:"state"`          // lifecycle state when it was ended
+	Reason    string    `json:"reason"`         // InterruptedUnclaimed or InterruptedDrainTimeout
+	Resumable bool      `json:"resumable"`      // a download the bot can continue with MsgResume after a restart
+	Created   time.Time `json:"created"`
+	Ended     time.Time `json:"ended"`
+}
+
+// interruptedSnapshot is the content of InterruptedFile.
+type interruptedSnapshot struct {
+	Written  time.Time            `json:"written"`
+	Sessions []InterruptedSession `json:"sessions"`
+}
+
+// interrupt records sess, which Shutdown is about to end, for the snapshot.
+func (r *Relay) interrupt(sess *Session, reason string) {
+	rec := InterruptedSession{
+		ID:        sess.ID,
+		Kind:      sess.Kind,
+		Filename:  sess.Filename,
+		Size:      sess.size,
+		Owner:     sess.owner,
+		Offset:    sess.Bytes(),
+		Bytes:     sess.Bytes(),
+		State:     sess.State().String(),
+		Reason:    reason,
+		Resumable: r.resumable(sess),
+		Created:   sess.CreatedAt,
+		Ended:     time.Now(),
+	}
+	if sess.Kind == "download" {
+		rec.Offset = sess.delivered()
+	}
+	r.interruptedMu.Lock()
+	r.interrupted = append(r.interrupted, rec)
+	r.interruptedMu.Unlock()
+}
+
+// writeInterrupted replaces InterruptedFile with the sessions Shutdown ended, none included.
+func (r *Relay) writeInterrupted() error {
+	if r.config.InterruptedFile == "" {
+		return nil
+	}
+	r.interruptedMu.Lock()
+	snap := interruptedSnapshot{Written: time.Now(), Sessions: append([]InterruptedSession{}, r.interrupted...)}
+	r.interruptedMu.Unlock()
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.config.InterruptedFile, append(data, '\n'))
+}
+
+// ReadInterrupted reads the snapshot Shutdown wrote to path (InterruptedFile) and returns
+// when it was written and its sessions. A missing file is not an error: nothing was
+// interrupted yet.
+func ReadInterrupted(path string) (written time.Time, sessions []InterruptedSession, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return time.Time{}, nil, nil
+	}
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	var snap interruptedSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return time.Time{}, nil, err
+	}
+	return snap.Written, snap.Sessions, nil
+}
+
+// loadInterrupted makes the downloads of the last snapshot resumable again, so bots can
+// continue them with MsgResume after the restart.
+func (r *Relay) loadInterrupted() {
+	if r.config.InterruptedFile == "" || r.resumes == nil {
+		return
+	}
+	_, sessions, err := ReadInterrupted(r.config.InterruptedFile)
+	if err != nil {
+		log.Printf("relay: interrupted sessions: %v", err)
+		return
+	}
+	n := 0
+	for _, s := range sessions {
+		if s.Resumable {
+			r.resumes.remember(s.Owner+"\x00"+s.ID, s.Filename, s.Size, s.Offset)
+			n++
+		}
+	}
+	if len(sessions) > 0 {
+		log.Printf("relay: %d sessions were interrupted by the last shutdown, %d of them resumable; see relay sessions interrupted", len(sessions), n)
+	}
+}
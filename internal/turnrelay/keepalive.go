@@ -0,0 +1,92 @@
+package turnrelay
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// keepAliveMisses is how many BotKeepAliveSec intervals the relay waits on a read from a bot
+// before it counts the bot as gone.
+const keepAliveMisses = 3
+
+// botLiveness tracks reads from a bot connection that has a keepalive pinger (see
+// keepBotAlive). The methods do nothing on a nil *botLiveness.
+type botLiveness struct {
+	waiting atomic.Int64 // Unix nanoseconds when the pending read started; 0 = none pending
+}
+
+// reading marks the start of a read from the bot.
+func (l *botLiveness) reading() {
+	if l != nil {
+		l.waiting.Store(time.Now().UnixNano())
+	}
+}
+
+// idle marks that the read returned: a frame arrived or the connection failed.
+func (l *botLiveness) idle() {
+	if l != nil {
+		l.waiting.Store(0)
+	}
+}
+
+// silentFor returns how long the pending read has waited without a frame (0 if none is pending).
+func (l *botLiveness) silentFor(now time.Time) time.Duration {
+	since := l.waiting.Load()
+	if since == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, since))
+}
+
+// liveness returns the read tracker of conn, or nil if it has no keepalive pinger.
+func (r *Relay) liveness(conn net.Conn) *botLiveness {
+	if l, ok := r.keepalives.Load(conn); ok {
+		return l.(*botLiveness)
+	}
+	return nil
+}
+
+// keepBotAlive pings the bot on conn, which serves sess, every BotKeepAliveSec with MsgPing
+// until stop is called. The pings go out through write, which serializes them with the
+// other frames written to conn. Any frame the bot sends counts as a sign of life, its MsgPong too.
+// Only a read the relay is waiting on can go stale: while the relay holds back reading
+// (the user is slower than the bot) the bot cannot be judged. If a read waits
+// keepAliveMisses intervals, the session ends with CloseTimeout and the connection's
+// deadline is expired, which unblocks its reads and writes so the handler cleans up and
+// the DCC port is released. With BotKeepAliveSec 0 it does nothing.
+func (r *Relay) keepBotAlive(conn net.Conn, sess *Session, write func(msgType byte, payload []byte) error) (stop func()) {
+	if r.config.BotKeepAliveSec <= 0 {
+		return func() {}
+	}
+	interval := time.Duration(r.config.BotKeepAliveSec) * time.Second
+	l := &botLiveness{}
+	r.keepalives.Store(conn, l)
+	quit := make(chan struct{})
+	go func() {
+		defer r.keepalives.Delete(conn)
+		defer r.recoverPanic("keepalive of "+sess.ID, func() { r.removeSession(sess.ID) })
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-r.ctx.Done():
+				return
+			case now := <-t.C:
+				if silent := l.silentFor(now); silent >= keepAliveMisses*interval {
+					log.Printf("relay: %s: bot %s sent nothing for %s, closing its connection", sess, r.peerString(conn.RemoteAddr()), silent.Round(time.Second))
+					sess.setCloseReason(CloseTimeout)
+					conn.SetDeadline(time.Unix(1, 0))
+					return
+				}
+				if err := write(MsgPing, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(quit) }
+}
@@ -0,0 +1,112 @@
+package turnrelay
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestKeepaliveDuringUpload pings the bot of an upload while the relay sends it the user's
+// data, and has the bot ping the relay all the while: every MsgPing and MsgPong must arrive
+// as a frame of its own, never inside a MsgData. The bot goes quiet before the user ends
+// the upload, since the relay closes the connection after MsgEOF and unread pings would
+// reset it.
+func TestKeepaliveDuringUpload(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.BotKeepAliveSec = 1
+	_, addr := startTestRelay(t, c)
+	bot := dialTestBot(t, addr)
+	user := dialTestUser(t, registerTestSession(t, bot, "upload", testSessionID(1)))
+	const pattern = "0123456789abcdef"
+	data := bytes.Repeat([]byte(pattern), 4<<10)
+
+	done := make(chan struct{})
+	defer close(done)
+	stopPing := make(chan struct{}) // closed when the upload has run long enough
+	lastPong := make(chan struct{}) // closed when the relay answered the bot's last MsgPing
+	go func() {
+		// Keep the upload going for a few keepalive intervals.
+		deadline := time.Now().Add(1500 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if _, err := user.Write(data); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		close(stopPing)
+		select {
+		case <-lastPong:
+			user.CloseWrite()
+		case <-done:
+		}
+	}()
+	var botWMu sync.Mutex
+	writeBot := func(msgType byte, payload []byte) error {
+		botWMu.Lock()
+		defer botWMu.Unlock()
+		return WriteFrame(bot, msgType, payload)
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-stopPing:
+				writeBot(MsgPing, []byte("last"))
+				return
+			default:
+			}
+			if writeBot(MsgPing, []byte("bot")) != nil {
+				return
+			}
+		}
+	}()
+
+	var got, pings, pongs int
+	quiet := false // the bot has stopped writing
+	for {
+		msgType, payload, err := ReadFrame(bot)
+		if err != nil {
+			t.Fatalf("bot read after %d bytes: %v", got, err)
+		}
+		if msgType == MsgEOF {
+			break
+		}
+		switch msgType {
+		case MsgPing:
+			pings++
+			if quiet {
+				break
+			}
+			if err := writeBot(MsgPong, payload); err != nil {
+				t.Fatal(err)
+			}
+		case MsgPong:
+			switch string(payload) {
+			case "bot":
+				pongs++
+			case "last":
+				quiet = true
+				close(lastPong)
+			default:
+				t.Fatalf("MsgPong payload %q, want the MsgPing's", payload)
+			}
+		case MsgData:
+			for i, b := range payload {
+				if b != pattern[(got+i)%len(pattern)] {
+					t.Fatalf("MsgData byte %d is %q, not what the user sent", got+i, b)
+				}
+			}
+			got += len(payload)
+		default:
+			t.Fatalf("bot got %s", MsgTypeName(msgType))
+		}
+	}
+	if pings == 0 || pongs == 0 {
+		t.Errorf("%d MsgPing and %d MsgPong during the upload", pings, pongs)
+	}
+	if got == 0 || got%len(data) != 0 {
+		t.Errorf("bot got %d bytes, not a whole number of %d-byte writes", got, len(data))
+	}
+}
@@ -0,0 +1,121 @@
+package turnrelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+)
+
+// defaultMaxLease caps the total lifetime of an unclaimed allocation (from allocation, across
+// renewals) when neither the user nor the relay config sets one.
+const defaultMaxLease = time.Hour
+
+// An allocated DCC port that no user has connected to is leased: with DCCLeaseSec > 0 it
+// expires at Session.leaseUntil unless the bot renews it with MsgRenew. Once the user
+// connects the session is claimed and the lease no longer applies.
+
+// startLease sets the initial lease of a new session and starts its expiry watcher. It is
+// called once the bot is attached (and a chained session is registered upstream), so an
+// expiry always has a bot to tell. An idempotent retry attaching again keeps the lease.
+func (r *Relay) startLease(sess *Session) {
+	if r.config.DCCLeaseSec <= 0 {
+		return
+	}
+	sess.mu.Lock()
+	started := !sess.leaseUntil.IsZero()
+	if !started {
+		sess.leaseUntil = time.Now().Add(time.Duration(r.config.DCCLeaseSec) * time.Second)
+	}
+	sess.mu.Unlock()
+	if !started {
+		go r.watchLease(sess)
+	}
+}
+
+func (r *Relay) watchLease(sess *Session) {
+	defer r.recoverPanic("lease of "+sess.ID, func() { r.removeSession(sess.ID) })
+	for {
+		sess.mu.Lock()
+		until := sess.leaseUntil
+		sess.mu.Unlock()
+		t := time.NewTimer(time.Until(until))
+		select {
+		case <-sess.Done:
+			t.Stop()
+			return
+		case <-sess.claimed:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		sess.mu.Lock()
+		expired := !time.Now().Before(sess.leaseUntil)
+		sess.mu.Unlock()
+		if expired {
+			log.Printf("relay: %s: allocation lease expired, no user connected to port %d", sess, sess.Port)
+			r.audit.record(sessionEvent("lease_expired", sess))
+			sess.setCloseReason(CloseTimeout)
+			// The bot may be idle or blocked on a full buffer, so it is told now rather than
+			// on its next frame; MsgStats follows once its handler sees the session end.
+			_ = sess.writeBot(MsgError, []byte(ErrLeaseExpired.Error()))
+			r.removeSession(sess.ID)
+			return
+		}
+	}
+}
+
+// errLeaseClaimed is returned when renewing a session a user already connected to.
+var errLeaseClaimed = errors.New("renew: session already connected")
+
+// renewLease extends an unclaimed session's lease by extend from now, bounded by the
+// user's max lease measured from allocation. It returns the new expiry (zero when leases
+// are disabled and the allocation never expires).
+func (r *Relay) renewLease(username string, sess *Session, extend time.Duration) (time.Time, error) {
+	if r.config.DCCLeaseSec <= 0 {
+		return time.Time{}, nil
+	}
+	select {
+	case <-sess.claimed:
+		return time.Time{}, errLeaseClaimed
+	default:
+	}
+	maxLease := defaultMaxLease
+	if r.config.MaxLeaseSec > 0 {
+		maxLease = time.Duration(r.config.MaxLeaseSec) * time.Second
+	}
+	if p := r.policy(username); p.MaxLeaseSec > 0 {
+		maxLease = time.Duration(p.MaxLeaseSec) * time.Second
+	}
+	until := time.Now().Add(extend)
+	if limit := sess.CreatedAt.Add(maxLease); until.After(limit) {
+		until = limit
+	}
+	sess.mu.Lock()
+	if until.After(sess.leaseUntil) {
+		sess.leaseUntil = until
+	}
+	until = sess.leaseUntil
+	sess.mu.Unlock()
+	r.audit.record(sessionEvent("lease_renewed", sess))
+	return until, nil
+}
+
+// handleRenew answers a MsgRenew (payload: 4-byte seconds to extend by) with MsgRenewOk
+// (8-byte Unix expiry, 0 = never expires) or MsgError.
+func (r *Relay) handleRenew(username string, sess *Session, payload []byte) error {
+	if len(payload) < 4 {
+		r.metrics.malformed()
+		return sess.writeBot(MsgError, []byte("bad Renew"))
+	}
+	extend := time.Duration(binary.BigEndian.Uint32(payload[:4])) * time.Second
+	until, err := r.renewLease(username, sess, extend)
+	if err != nil {
+		return sess.writeBot(MsgError, []byte(err.Error()))
+	}
+	resp := make([]byte, 8)
+	if !until.IsZero() {
+		binary.BigEndian.PutUint64(resp, uint64(until.Unix()))
+	}
+	return sess.writeBot(MsgRenewOk, resp)
+}
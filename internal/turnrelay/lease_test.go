@@ -0,0 +1,53 @@
+package turnrelay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteBotWithoutBot(t *testing.T) {
+	sess := NewSession(testSessionID(1), "download", "file.bin", 0)
+	if err := sess.writeBot(MsgError, []byte("x")); !errors.Is(err, errNoBot) {
+		t.Fatalf("writeBot = %v, want errNoBot", err)
+	}
+}
+
+// A lease must not run before the bot is attached: chain() may take longer than
+// dcc_lease_sec, and an expiry then had no bot connection to write to.
+func TestLeaseStartsWhenBotAttached(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.DCCLeaseSec = 1
+	r, err := NewRelay(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := r.registerSession(context.Background(), testUser, "download", Registration{SessionID: testSessionID(1), Filename: "f", PeerBot: "peer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if _, err := r.lookupSession(sess.ID); err != nil {
+		t.Fatalf("session expired before a bot was attached: %v", err)
+	}
+	r.startLease(sess)
+	sess.mu.Lock()
+	first := sess.leaseUntil
+	sess.mu.Unlock()
+	if first.IsZero() {
+		t.Fatal("startLease set no lease")
+	}
+	// An idempotent retry attaching again keeps the lease it has.
+	r.startLease(sess)
+	sess.mu.Lock()
+	again := sess.leaseUntil
+	sess.mu.Unlock()
+	if !again.Equal(first) {
+		t.Fatalf("lease moved from %v to %v", first, again)
+	}
+	waitFor(t, 3*time.Second, "lease expiry", func() bool {
+		_, err := r.lookupSession(sess.ID)
+		return err != nil
+	})
+}
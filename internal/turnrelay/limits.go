@@ -0,0 +1,165 @@
+package turnrelay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+)
+
+// SetMaxSessions changes the limit on concurrent bot connections (MaxSessions) at runtime.
+// New connections beyond it are refused with "relay full". With shed, sessions beyond the
+// new limit are closed right away, lowest priority first: sessions that have not moved
+// data yet, then the most recently registered. n may not exceed what the open file limit
+// supports (see fdBudget).
+func (r *Relay) SetMaxSessions(actor string, n int, shed bool) error {
+	params := map[string]string{"max_sessions": itoa(n), "shed": fmt.Sprint(shed)}
+	if n <= 0 {
+		err := fmt.Errorf("max sessions must be > 0, got %d", n)
+		r.recordAdminAction(actor, "set_max_sessions", params, err)
+		return err
+	}
+	if err := r.checkFDBudget(n); err != nil {
+		r.recordAdminAction(actor, "set_max_sessions", params, err)
+		return err
+	}
+	atomic.StoreInt32(&r.maxSessions, int32(n))
+	if shed {
+		shedded := r.shedSessions(n)
+		params["shed_count"] = itoa(shedded)
+	}
+	r.recordAdminAction(actor, "set_max_sessions", params, nil)
+	return nil
+}
+
+// Limits are the relay limits that can be changed at runtime.
+type Limits struct {
+	MaxSessions     int   `json:"max_sessions"`      // see SetMaxSessions
+	MaxBandwidthBps int64 `json:"max_bandwidth_bps"` // see SetMaxBandwidth; 0 = unlimited
+}
+
+// Limits returns the current runtime limits.
+func (r *Relay) Limits() Limits {
+	return Limits{
+		MaxSessions:     int(atomic.LoadInt32(&r.maxSessions)),
+		MaxBandwidthBps: r.bandwidth.currentRate(),
+	}
+}
+
+// shedSessions closes the lowest-priority sessions until at most keep remain and returns
+// how many it closed.
+func (r *Relay) shedSessions(keep int) int {
+	sessions := r.sessionList()
+	if len(sessions) <= keep {
+		return 0
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		si, sj := sessions[i].State() >= StateStreaming, sessions[j].State() >= StateStreaming
+		if si != sj {
+			return !si
+		}
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	victims := sessions[:len(sessions)-keep]
+	for _, sess := range victims {
+		log.Printf("relay: shedding %s, %s, to meet max sessions %d", sess, sess.State(), keep)
+		sess.setCloseReason(CloseAdminKill)
+		r.removeSession(sess.ID)
+	}
+	return len(victims)
+}
+
+// SetUserRate changes the max_rate_bps of bot user username at runtime (0 = unlimited).
+// It applies to the user's new sessions and to running ones without a BoostSession
+// override.
+func (r *Relay) SetUserRate(actor, username string, bps int64) error {
+	params := map[string]string{"user": username, "rate_bps": fmt.Sprint(bps)}
+	var err error
+	r.policiesMu.Lock()
+	p, ok := r.policies[username]
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown user %q", username)
+	case bps < 0:
+		err = fmt.Errorf("rate must be >= 0, got %d", bps)
+	default:
+		p.MaxRateBps = bps
+		r.policies[username] = p
+	}
+	r.policiesMu.Unlock()
+	if err == nil {
+		r.sessionsMu.RLock()
+		for _, sess := range r.sessions {
+			if sess.owner == username {
+				r.applyUserPolicy(username, sess)
+			}
+		}
+		r.sessionsMu.RUnlock()
+	}
+	r.recordAdminAction(actor, "set_user_rate", params, err)
+	return err
+}
+
+// SetMaxBandwidth changes the relay-wide transfer rate cap (MaxBandwidthBps) at runtime
+// (0 = unlimited). Running sessions are held to the new cap at once.
+func (r *Relay) SetMaxBandwidth(actor string, bps int64) error {
+	params := map[string]string{"rate_bps": fmt.Sprint(bps)}
+	var err error
+	if bps < 0 {
+		err = fmt.Errorf("rate must be >= 0, got %d", bps)
+	} else {
+		r.bandwidth.setRate(bps)
+	}
+	r.recordAdminAction(actor, "set_max_bandwidth", params, err)
+	return err
+}
+
+// SetPortRange changes the DCC port range at runtime. Sessions on ports outside the new
+// range keep them until they end; new sessions get ports from the new range, never one of
+// the relay's own listener ports.
+func (r *Relay) SetPortRange(actor string, minPort, maxPort int) error {
+	params := map[string]string{"min": itoa(minPort), "max": itoa(maxPort)}
+	var err error
+	if r.config.SinglePort {
+		err = errors.New("no DCC port range in single-port mode")
+	} else {
+		err = r.portPool.Resize(minPort, maxPort)
+	}
+	r.recordAdminAction(actor, "set_port_range", params, err)
+	return err
+}
+
+// PortPoolInfo is the state of the DCC port pool. It is empty in single-port mode.
+type PortPoolInfo struct {
+	Min     int       `json:"min"`
+	Max     int       `json:"max"`
+	Free    int       `json:"free"`    // ports that can be allocated now
+	Cooling int       `json:"cooling"` // released ports waiting out PortCooldownSec
+	InUse   []PortUse `json:"in_use"`  // ports held by sessions, ascending
+}
+
+// PortUse is a DCC port held by a session. The port may lie outside the pool's range after
+// SetPortRange.
+type PortUse struct {
+	Port    int    `json:"port"`
+	Session string `json:"session"`
+}
+
+// PortPool returns the state of the DCC port pool.
+func (r *Relay) PortPool() PortPoolInfo {
+	if r.config.SinglePort {
+		return PortPoolInfo{}
+	}
+	var info PortPoolInfo
+	info.Min, info.Max = r.portPool.Range()
+	info.Free, info.Cooling = r.portPool.Free(), r.portPool.Cooling()
+	info.InUse = []PortUse{}
+	for _, sess := range r.sessionList() {
+		if sess.Port > 0 {
+			info.InUse = append(info.InUse, PortUse{Port: sess.Port, Session: sess.ID})
+		}
+	}
+	sort.Slice(info.InUse, func(i, j int) bool { return info.InUse[i].Port < info.InUse[j].Port })
+	return info
+}
@@ -0,0 +1,103 @@
+// Package listener runs accept loops.
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options tunes Serve.
+type Options struct {
+	// MaxInFlight bounds the number of handlers running at once; 0 means no limit. When
+	// the limit is reached Serve stops accepting until a handler returns, so new
+	// connections wait in the kernel's accept queue instead of each costing a goroutine.
+	MaxInFlight int
+	// OnAccept, if set, is called after every accepted connection (e.g. as a liveness
+	// heartbeat).
+	OnAccept func()
+	// OnSaturated, if set, is called each time Serve has to wait for a free slot.
+	OnSaturated func()
+	// OnFDExhausted, if set, is called each time Accept fails because the process or
+	// system is out of file descriptors. Serve backs off and keeps accepting.
+	OnFDExhausted func(error)
+	// Handlers, if set, counts the running handlers, so the caller can wait for the ones
+	// still running after Serve returns.
+	Handlers *sync.WaitGroup
+}
+
+// maxFDBackoff caps the wait between accept attempts while out of file descriptors.
+const maxFDBackoff = time.Second
+
+// Serve accepts connections on ln and runs handle for each in its own goroutine until
+// Accept fails or ctx ends (ln is then closed and ctx.Err() returned). handle gets ctx.
+// Running out of file descriptors (EMFILE, ENFILE) is not fatal: Serve retries with
+// backoff until descriptors are freed.
+func Serve(ctx context.Context, ln net.Listener, handle func(context.Context, net.Conn), opts Options) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	// The AfterFunc may still be running when Serve returns; the port must be free by then.
+	defer ln.Close()
+	var slots chan struct{}
+	if opts.MaxInFlight > 0 {
+		slots = make(chan struct{}, opts.MaxInFlight)
+	}
+	var backoff time.Duration
+	for {
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+			default:
+				if opts.OnSaturated != nil {
+					opts.OnSaturated()
+				}
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				if slots != nil {
+					<-slots
+				}
+				if opts.OnFDExhausted != nil {
+					opts.OnFDExhausted(err)
+				}
+				backoff = min(max(2*backoff, 5*time.Millisecond), maxFDBackoff)
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		if opts.OnAccept != nil {
+			opts.OnAccept()
+		}
+		if opts.Handlers != nil {
+			opts.Handlers.Add(1)
+		}
+		go func() {
+			if opts.Handlers != nil {
+				defer opts.Handlers.Done()
+			}
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			handle(ctx, conn)
+		}()
+	}
+}
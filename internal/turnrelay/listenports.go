@@ -0,0 +1,68 @@
+package turnrelay
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultPortCooldown is how long a released DCC port rests before reuse (PortCooldownSec).
+const defaultPortCooldown = 10 * time.Second
+
+// portCooldown returns the configured DCC port cooldown: 0 = default, negative = none.
+func portCooldown(sec int) time.Duration {
+	switch {
+	case sec < 0:
+		return 0
+	case sec == 0:
+		return defaultPortCooldown
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// listenPort is a TCP port the relay listens on besides the DCC range.
+type listenPort struct {
+	name string // config option, for messages
+	port int
+}
+
+// listenPorts returns the fixed ports in c's listen addresses. Addresses without a port or
+// with port 0 are skipped; an unparsable one is an error.
+func listenPorts(c *RelayConfig) ([]listenPort, error) {
+	var out []listenPort
+	for _, l := range []struct{ name, addr string }{
+		{"turn_listen", c.TURNListen},
+		{"dcc_sni_listen", c.DCCSNIListen},
+		{"metrics_listen", c.MetricsListen},
+		{"status_listen", c.StatusListen},
+		{"admin_listen", c.AdminListen},
+	} {
+		if l.addr == "" {
+			continue
+		}
+		_, p, err := net.SplitHostPort(l.addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", l.name, l.addr, err)
+		}
+		port, err := net.LookupPort("tcp", p)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: %w", l.name, l.addr, err)
+		}
+		if port > 0 {
+			out = append(out, listenPort{l.name, port})
+		}
+	}
+	return out, nil
+}
+
+// checkPortRange fails if the DCC range minPort..maxPort includes one of the relay's own
+// listener ports, which would otherwise surface as bind failures once that port comes up
+// for a session.
+func checkPortRange(minPort, maxPort int, listeners []listenPort) error {
+	for _, l := range listeners {
+		if l.port >= minPort && l.port <= maxPort {
+			return fmt.Errorf("dcc port range %d-%d includes the %s port %d", minPort, maxPort, l.name, l.port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package turnrelay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// relayMetrics holds process-wide counters, updated with sync/atomic.
+type relayMetrics struct {
+	handlerPanics   int64
+	framesIn        [256]int64 // bot -> relay, by frame type
+	framesOut       [256]int64 // relay -> bot, by frame type
+	framesMalformed int64      // oversized, truncated or unexpected frames from bots
+	slowConsumers   int64      // sessions that lagged past the slow-consumer grace period
+	acceptSaturated int64      // times the bot accept loop waited for a free handler slot
+	framesOversized int64      // frames from bots over MaxPayload (also counted as malformed)
+	fdExhausted     int64      // accept failures for lack of file descriptors (EMFILE/ENFILE)
+	fdLogged        int64      // unix time of the last such log line
+	regThrottled    int64      // registrations refused with ErrSlowDown
+	integrityErrs   int64      // sessions whose sampled payload hashes differed between legs
+	checksumErrs    int64      // downloads whose bot checksum differed from what the relay received
+
+	closed [len(closeReasons)]int64 // sessions ended, by index in closeReasons
+}
+
+func (m *relayMetrics) frameIn(t byte)  { atomic.AddInt64(&m.framesIn[t], 1) }
+func (m *relayMetrics) frameOut(t byte) { atomic.AddInt64(&m.framesOut[t], 1) }
+func (m *relayMetrics) malformed()      { atomic.AddInt64(&m.framesMalformed, 1) }
+
+func (m *relayMetrics) sessionClosed(reason CloseReason) {
+	for i, r := range closeReasons {
+		if r == reason {
+			atomic.AddInt64(&m.closed[i], 1)
+			return
+		}
+	}
+}
+
+// Metrics is a point-in-time copy of the relay counters.
+type Metrics struct {
+	HandlerPanics   int64              // panics recovered in connection/session goroutines
+	FramesIn        map[string]int64   // frames received from bots, by MsgTypeName
+	FramesOut       map[string]int64   // frames sent to bots, by MsgTypeName
+	FramesMalformed int64              // malformed or unexpected frames received from bots
+	Sessions        int                // sessions currently registered
+	BotConns        int                // bot connections currently open
+	FreePorts       int                // DCC ports currently free
+	CoolingPorts    int                // DCC ports released but not yet reusable (PortCooldownSec)
+	SlowConsumers   int64              // sessions that lagged past the slow-consumer grace period
+	AcceptSaturated int64              // times the bot accept loop waited for a free handler slot
+	FramesOversized int64              // frames from bots over MaxPayload (also counted in FramesMalformed)
+	FDExhausted     int64              // accept failures for lack of file descriptors (EMFILE/ENFILE)
+	RegThrottled    int64              // registrations refused by the registration rate limits
+	IntegrityErrors int64              // session directions whose sampled payload hashes differed (IntegritySampleEvery)
+	ChecksumErrors  int64              // downloads whose bot MsgChecksum differed from what the relay received
+	OpenFDs         int                // file descriptors open in the process; -1 = unknown
+	FDLimit         int                // open file soft limit; -1 = unknown
+	FDSessions      int                // sessions the open file limit supports; 0 = unknown
+	Occupancy       map[string]float64 // buffer occupancy (0..1) by session ID
+	States          map[string]int     // session count by SessionState name
+	SessionsClosed  map[string]int64   // sessions ended since start, by CloseReason
+	SessionsByUser  map[string]int     // sessions currently registered, by owning bot user
+}
+
+// Metrics returns a snapshot of the relay counters.
+func (r *Relay) Metrics() Metrics {
+	m := Metrics{
+		HandlerPanics:   atomic.LoadInt64(&r.metrics.handlerPanics),
+		FramesIn:        make(map[string]int64),
+		FramesOut:       make(map[string]int64),
+		FramesMalformed: atomic.LoadInt64(&r.metrics.framesMalformed),
+		BotConns:        int(atomic.LoadInt32(&r.currentConns)),
+		FreePorts:       r.freePorts(),
+		CoolingPorts:    r.coolingPorts(),
+		SlowConsumers:   atomic.LoadInt64(&r.metrics.slowConsumers),
+		AcceptSaturated: atomic.LoadInt64(&r.metrics.acceptSaturated),
+		FramesOversized: atomic.LoadInt64(&r.metrics.framesOversized),
+		FDExhausted:     atomic.LoadInt64(&r.metrics.fdExhausted),
+		RegThrottled:    atomic.LoadInt64(&r.metrics.regThrottled),
+		IntegrityErrors: atomic.LoadInt64(&r.metrics.integrityErrs),
+		ChecksumErrors:  atomic.LoadInt64(&r.metrics.checksumErrs),
+		OpenFDs:         -1,
+		FDLimit:         -1,
+		FDSessions:      int(atomic.LoadInt32(&r.fdSessions)),
+		Occupancy:       make(map[string]float64),
+		States:          make(map[string]int),
+		SessionsClosed:  make(map[string]int64),
+		SessionsByUser:  make(map[string]int),
+	}
+	for i, reason := range closeReasons {
+		m.SessionsClosed[string(reason)] = atomic.LoadInt64(&r.metrics.closed[i])
+	}
+	if n, ok := openFileCount(); ok {
+		m.OpenFDs = n
+	}
+	if soft, _, ok := openFileLimit(); ok {
+		m.FDLimit = 1<<31 - 1
+		if soft < uint64(m.FDLimit) {
+			m.FDLimit = int(soft)
+		}
+	}
+	for t := 0; t < 256; t++ {
+		if n := atomic.LoadInt64(&r.metrics.framesIn[t]); n > 0 {
+			m.FramesIn[MsgTypeName(byte(t))] = n
+		}
+		if n := atomic.LoadInt64(&r.metrics.framesOut[t]); n > 0 {
+			m.FramesOut[MsgTypeName(byte(t))] = n
+		}
+	}
+	r.sessionsMu.RLock()
+	m.Sessions = len(r.sessions)
+	for id, s := range r.sessions {
+		m.Occupancy[id] = s.Occupancy()
+		m.States[s.State().String()]++
+		m.SessionsByUser[s.owner]++
+	}
+	r.sessionsMu.RUnlock()
+	return m
+}
+
+// readFrame reads one frame from a bot connection, counting it by type. An oversized or
+// truncated frame counts as malformed; an oversized one is also logged, since it points
+// at a bot bug. Keepalive frames are handled here and not returned: MsgPing is answered
+// with MsgPong, MsgPong is dropped.
+func (r *Relay) readFrame(conn net.Conn) (byte, []byte, error) {
+	return r.readFrameReplying(conn, func(t byte, p []byte) error { return r.writeFrame(conn, t, p) })
+}
+
+// readFrameReplying is readFrame for a connection that other goroutines write to as well:
+// its MsgPong goes out through reply, which serializes it with their frames.
+func (r *Relay) readFrameReplying(conn net.Conn, reply func(msgType byte, payload []byte) error) (byte, []byte, error) {
+	l := r.liveness(conn)
+	for {
+		l.reading()
+		msgType, payload, err := ReadFrame(conn)
+		l.idle()
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrFrameTooLarge):
+				atomic.AddInt64(&r.metrics.framesOversized, 1)
+				r.metrics.malformed()
+				log.Printf("relay: bot %s: %v; closing connection", r.peerString(conn.RemoteAddr()), err)
+			case err == io.ErrUnexpectedEOF:
+				r.metrics.malformed()
+			}
+			return msgType, payload, err
+		}
+		r.metrics.frameIn(msgType)
+		switch msgType {
+		case MsgPing:
+			// A failed write shows up on the next read.
+			_ = reply(MsgPong, payload)
+		case MsgPong:
+		default:
+			return msgType, payload, nil
+		}
+	}
+}
+
+// writeFrame writes one frame to a bot connection, counting it by type. It does not
+// serialize frames: once other goroutines write to the connection, frames go through the
+// attached session's writeBot or the peerConn's writeFrame.
+func (r *Relay) writeFrame(conn net.Conn, msgType byte, payload []byte) error {
+	err := WriteFrame(conn, msgType, payload)
+	if err == nil {
+		r.metrics.frameOut(msgType)
+	}
+	return err
+}
+
+// WritePrometheus writes the relay metrics in the Prometheus text exposition format.
+func (r *Relay) WritePrometheus(w io.Writer) {
+	m := r.Metrics()
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge := func(name, help string, v int) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	bi := serverInfo()
+	fmt.Fprintf(w, "# HELP huzaa_relay_build_info Build of the running relay; always 1.\n# TYPE huzaa_relay_build_info gauge\n")
+	fmt.Fprintf(w, "huzaa_relay_build_info{version=%q,commit=%q,date=%q,goversion=%q} 1\n", bi.Version, bi.Commit, bi.Date, bi.GoVersion)
+	counter("huzaa_relay_handler_panics_total", "Panics recovered in connection and session goroutines.", m.HandlerPanics)
+	fmt.Fprintf(w, "# HELP huzaa_relay_frames_total Protocol frames exchanged with bots.\n# TYPE huzaa_relay_frames_total counter\n")
+	for _, dir := range []struct {
+		name   string
+		counts map[string]int64
+	}{{"in", m.FramesIn}, {"out", m.FramesOut}} {
+		types := make([]string, 0, len(dir.counts))
+		for t := range dir.counts {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "huzaa_relay_frames_total{direction=%q,type=%q} %d\n", dir.name, t, dir.counts[t])
+		}
+	}
+	counter("huzaa_relay_frames_malformed_total", "Malformed or unexpected frames received from bots.", m.FramesMalformed)
+	counter("huzaa_relay_frames_oversized_total", "Frames received from bots over the maximum payload size.", m.FramesOversized)
+	gauge("huzaa_relay_sessions", "Sessions currently registered.", m.Sessions)
+	fmt.Fprintf(w, "# HELP huzaa_relay_sessions_by_state Sessions currently registered, by lifecycle state.\n# TYPE huzaa_relay_sessions_by_state gauge\n")
+	for _, st := range sessionStateNames {
+		fmt.Fprintf(w, "huzaa_relay_sessions_by_state{state=%q} %d\n", st, m.States[st])
+	}
+	fmt.Fprintf(w, "# HELP huzaa_relay_sessions_closed_total Sessions ended, by close reason.\n# TYPE huzaa_relay_sessions_closed_total counter\n")
+	for _, reason := range closeReasons {
+		fmt.Fprintf(w, "huzaa_relay_sessions_closed_total{reason=%q} %d\n", reason, m.SessionsClosed[string(reason)])
+	}
+	fmt.Fprintf(w, "# HELP huzaa_relay_sessions_by_user Sessions currently registered, by bot user.\n# TYPE huzaa_relay_sessions_by_user gauge\n")
+	users := make([]string, 0, len(m.SessionsByUser))
+	for u := range m.SessionsByUser {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		fmt.Fprintf(w, "huzaa_relay_sessions_by_user{user=%q} %d\n", u, m.SessionsByUser[u])
+	}
+	gauge("huzaa_relay_bot_connections", "Bot connections currently open.", m.BotConns)
+	gauge("huzaa_relay_free_ports", "DCC ports currently free.", m.FreePorts)
+	gauge("huzaa_relay_cooling_ports", "DCC ports released but still in their reuse cooldown.", m.CoolingPorts)
+	counter("huzaa_relay_slow_consumers_total", "Sessions that lagged past the slow-consumer grace period.", m.SlowConsumers)
+	counter("huzaa_relay_accept_saturated_total", "Times the bot accept loop waited for a free handler slot.", m.AcceptSaturated)
+	counter("huzaa_relay_registrations_throttled_total", "Registrations refused by the registration rate limits.", m.RegThrottled)
+	counter("huzaa_relay_integrity_mismatches_total", "Session directions whose sampled payload hashes differed between the bot and user legs.", m.IntegrityErrors)
+	counter("huzaa_relay_checksum_mismatches_total", "Downloads whose end-of-transfer checksum from the bot differed from what the relay received.", m.ChecksumErrors)
+	counter("huzaa_relay_accept_fd_exhausted_total", "Accept failures for lack of file descriptors (EMFILE/ENFILE); the loop retries.", m.FDExhausted)
+	if m.OpenFDs >= 0 {
+		gauge("huzaa_relay_open_fds", "File descriptors open in the relay process.", m.OpenFDs)
+	}
+	if m.FDLimit >= 0 {
+		gauge("huzaa_relay_fd_limit", "Open file soft limit (RLIMIT_NOFILE).", m.FDLimit)
+		gauge("huzaa_relay_fd_session_budget", "Sessions the open file limit supports.", m.FDSessions)
+	}
+	fmt.Fprintf(w, "# HELP huzaa_relay_session_buffer_occupancy Fill ratio of each session's relay buffer.\n# TYPE huzaa_relay_session_buffer_occupancy gauge\n")
+	ids := make([]string, 0, len(m.Occupancy))
+	for id := range m.Occupancy {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(w, "huzaa_relay_session_buffer_occupancy{session=%q} %g\n", id, m.Occupancy[id])
+	}
+}
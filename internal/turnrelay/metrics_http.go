@@ -0,0 +1,36 @@
+package turnrelay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// serveMetrics serves /metrics (Prometheus text format) on MetricsListen. It has no
+// authentication, so it carries nothing per user; the usage export is on the admin API.
+func (r *Relay) serveMetrics() error {
+	ln, err := net.Listen("tcp", r.config.MetricsListen)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+	context.AfterFunc(r.ctx, func() { ln.Close() })
+	r.spawn(func() {
+		h := r.health.register("metrics server", 0)
+		err := http.Serve(ln, mux)
+		if r.ctx.Err() != nil {
+			h.stop()
+			return
+		}
+		log.Printf("relay: metrics server: %v", err)
+		h.exit(err)
+	})
+	log.Printf("relay: metrics listening on %s", r.config.MetricsListen)
+	return nil
+}
@@ -0,0 +1,231 @@
+package turnrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Operator notification events (Notifier.Events).
+const (
+	NotifyStartupFailed  = "startup_failed"  // Run failed, e.g. a listener could not be bound
+	NotifyHealth         = "health"          // the watchdog found a listener or background loop dead or stalled
+	NotifyCertExpiry     = "cert_expiry"     // the TLS certificate expires within certExpiryWarn
+	NotifyPortsExhausted = "ports_exhausted" // no free DCC port for portsExhaustedAfter
+	NotifyDiskFull       = "disk_full"       // a state file could not be written for lack of space
+)
+
+// Notifier payload formats.
+const (
+	NotifyJSON = "json" // the notification object (default)
+	NotifyText = "text" // {"text": ...}, as Slack, Mattermost and Matrix hookshot webhooks take it
+)
+
+const (
+	notifyCheckInterval = 30 * time.Second
+	notifyRepeat        = time.Hour // the same event and subject is sent at most this often
+	certExpiryWarn      = 14 * 24 * time.Hour
+	portsExhaustedAfter = time.Minute
+)
+
+// Notifier is a webhook that pages the operator about critical events, for relays without
+// a monitoring stack: a chat webhook, or a bot that relays it to IRC.
+type Notifier struct {
+	Name       string   // label in logs; defaults to the URL
+	URL        string   // HTTP(S) endpoint to POST to; a non-2xx status is a failure
+	Format     string   // NotifyJSON (default) or NotifyText
+	Events     []string // events to send; empty = all
+	TimeoutSec int      // per attempt; default 10
+	Retries    int      // extra attempts after a failure, with exponential backoff
+}
+
+// notification is the JSON a NotifyJSON notifier receives.
+type notification struct {
+	Time    time.Time `json:"time"`
+	Relay   string    `json:"relay"`
+	Event   string    `json:"event"`
+	Subject string    `json:"subject,omitempty"`
+	Message string    `json:"message"`
+}
+
+func (n *Notifier) label() string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return n.URL
+}
+
+func (n *Notifier) wants(event string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) body(note notification) ([]byte, error) {
+	if n.Format == NotifyText {
+		return json.Marshal(map[string]string{"text": fmt.Sprintf("huzaa-relay %s: %s", note.Relay, note.Message)})
+	}
+	return json.Marshal(note)
+}
+
+// send posts note, retrying on failure.
+func (n *Notifier) send(ctx context.Context, note notification) error {
+	body, err := n.body(note)
+	if err != nil {
+		return err
+	}
+	timeout := 10 * time.Second
+	if n.TimeoutSec > 0 {
+		timeout = time.Duration(n.TimeoutSec) * time.Second
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = postHook(attemptCtx, n.URL, body)
+		cancel()
+		if err == nil || attempt >= n.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// notifyLimiter remembers when each event and subject was last sent.
+type notifyLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (l *notifyLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.last[key]; ok && now.Sub(t) < notifyRepeat {
+		return false
+	}
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	l.last[key] = now
+	return true
+}
+
+func (r *Relay) newNotification(event, subject, message string) notification {
+	relay := r.config.RelayHost
+	if relay == "" {
+		relay, _ = os.Hostname()
+	}
+	return notification{Time: time.Now().UTC(), Relay: relay, Event: event, Subject: subject, Message: message}
+}
+
+// notify sends event to the notifiers that want it, in the background. subject tells apart
+// occurrences of the same event (a listener name, a file); each is sent at most once per
+// notifyRepeat.
+func (r *Relay) notify(event, subject, message string) {
+	if len(r.config.Notifiers) == 0 || !r.notified.allow(event+"\x00"+subject, time.Now()) {
+		return
+	}
+	note := r.newNotification(event, subject, message)
+	for i := range r.config.Notifiers {
+		if n := &r.config.Notifiers[i]; n.wants(event) {
+			go func() {
+				if err := n.send(r.ctx, note); err != nil {
+					log.Printf("relay: notifier %s: %s: %v", n.label(), event, err)
+				}
+			}()
+		}
+	}
+}
+
+// notifyStartupFailed reports that Run failed. It waits for delivery (up to a bound),
+// since the process usually exits right after.
+func (r *Relay) notifyStartupFailed(err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	note := r.newNotification(NotifyStartupFailed, "", "relay failed to start: "+err.Error())
+	var wg sync.WaitGroup
+	for i := range r.config.Notifiers {
+		if n := &r.config.Notifiers[i]; n.wants(NotifyStartupFailed) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := n.send(ctx, note); err != nil {
+					log.Printf("relay: notifier %s: %s: %v", n.label(), NotifyStartupFailed, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// noteWriteError notifies the operator if writing the state file what failed because the
+// disk is full.
+func (r *Relay) noteWriteError(what string, err error) {
+	if errors.Is(err, syscall.ENOSPC) {
+		r.notify(NotifyDiskFull, what, fmt.Sprintf("%s: %v", what, err))
+	}
+}
+
+// watchOperatorEvents checks for conditions the operator is notified about that no
+// other loop notices: certificate expiry and a port pool exhausted for a while.
+func (r *Relay) watchOperatorEvents() {
+	h := r.health.register("notification checks", 3*notifyCheckInterval)
+	t := time.NewTicker(notifyCheckInterval)
+	defer t.Stop()
+	var exhaustedSince time.Time
+	reported := false
+	for {
+		select {
+		case <-r.ctx.Done():
+			h.stop()
+			return
+		case now := <-t.C:
+			r.checkCertExpiry(now)
+			switch {
+			case r.freePorts() > 0:
+				exhaustedSince, reported = time.Time{}, false
+			case exhaustedSince.IsZero():
+				exhaustedSince = now
+			case !reported && now.Sub(exhaustedSince) >= portsExhaustedAfter:
+				reported = true
+				msg := fmt.Sprintf("no free DCC port for %s (%d sessions open)", now.Sub(exhaustedSince).Round(time.Second), len(r.sessionList()))
+				log.Printf("relay: %s", msg)
+				r.notify(NotifyPortsExhausted, "", msg)
+			}
+			h.beat()
+		}
+	}
+}
+
+func (r *Relay) checkCertExpiry(now time.Time) {
+	cert, _ := r.certs.get(nil)
+	if cert == nil || cert.Leaf == nil {
+		return
+	}
+	left := cert.Leaf.NotAfter.Sub(now)
+	if left > certExpiryWarn {
+		return
+	}
+	msg := fmt.Sprintf("TLS certificate %s expires %s", r.config.TLSCertFile, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	if left <= 0 {
+		msg = fmt.Sprintf("TLS certificate %s expired %s", r.config.TLSCertFile, cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+	r.notify(NotifyCertExpiry, cert.Leaf.SerialNumber.String(), msg)
+}
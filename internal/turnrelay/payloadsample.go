@@ -0,0 +1,136 @@
+package turnrelay
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// integrityBlock is the unit of IntegritySampleEvery. Blocks are cut by stream offset, so
+// both legs sample the same bytes however frames and reads split them.
+const integrityBlock = 64 << 10
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sampleHash keeps a CRC of every nth integrityBlock of one leg's byte stream.
+type sampleHash struct {
+	mu    sync.Mutex
+	every int64 // 0 = this direction is not checked
+	off   int64
+	crc   uint32   // of the sampled block in progress
+	sums  []uint32 // of the sampled blocks completed so far
+}
+
+func (h *sampleHash) write(p []byte) {
+	if h.every == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(p) > 0 {
+		n := min(len(p), int(integrityBlock-h.off%integrityBlock))
+		if (h.off/integrityBlock)%h.every == 0 {
+			h.crc = crc32.Update(h.crc, castagnoli, p[:n])
+			if (h.off+int64(n))%integrityBlock == 0 {
+				h.sums = append(h.sums, h.crc)
+				h.crc = 0
+			}
+		}
+		h.off += int64(n)
+		p = p[n:]
+	}
+}
+
+// legs holds the samples of one direction on its bot leg and its user leg.
+type legs struct {
+	bot, user sampleHash
+}
+
+// compare returns the stream offset of the first sampled block that differs between the
+// legs, or -1. Blocks only one leg has seen (a transfer cut short) are not compared, except
+// that a final partial block is when both legs ended at the same offset.
+func (l *legs) compare() int64 {
+	l.bot.mu.Lock()
+	defer l.bot.mu.Unlock()
+	l.user.mu.Lock()
+	defer l.user.mu.Unlock()
+	b, u := &l.bot, &l.user
+	for i := 0; i < min(len(b.sums), len(u.sums)); i++ {
+		if b.sums[i] != u.sums[i] {
+			return int64(i) * b.every * integrityBlock
+		}
+	}
+	if b.off == u.off && b.crc != u.crc {
+		return b.off - b.off%integrityBlock
+	}
+	return -1
+}
+
+// integrityCheck samples a session's payload on both legs (IntegritySampleEvery).
+type integrityCheck struct {
+	toUser legs // bot MsgData in, bytes written to the user out
+	toBot  legs // bytes read from the user in, MsgData to the bot out
+}
+
+// newIntegrityCheck returns nil if sampling is off. With a StreamTransform the user leg of
+// a download legitimately differs from the bot leg, so that direction is not checked.
+func newIntegrityCheck(every int, transformed bool) *integrityCheck {
+	if every <= 0 {
+		return nil
+	}
+	c := &integrityCheck{}
+	if !transformed {
+		c.toUser.bot.every, c.toUser.user.every = int64(every), int64(every)
+	}
+	c.toBot.bot.every, c.toBot.user.every = int64(every), int64(every)
+	return c
+}
+
+func (c *integrityCheck) botIn(p []byte) {
+	if c != nil {
+		c.toUser.bot.write(p)
+	}
+}
+
+func (c *integrityCheck) botOut(p []byte) {
+	if c != nil {
+		c.toBot.bot.write(p)
+	}
+}
+
+func (c *integrityCheck) userIn(p []byte) {
+	if c != nil {
+		c.toBot.user.write(p)
+	}
+}
+
+func (c *integrityCheck) userOut(p []byte) {
+	if c != nil {
+		c.toUser.user.write(p)
+	}
+}
+
+// checkIntegrity compares the sampled hashes of a finished session, logging and auditing a
+// mismatch.
+func (r *Relay) checkIntegrity(sess *Session) {
+	c := sess.integrity
+	if c == nil {
+		return
+	}
+	for _, dir := range []struct {
+		name string
+		legs *legs
+	}{{"bot->user", &c.toUser}, {"user->bot", &c.toBot}} {
+		off := dir.legs.compare()
+		if off < 0 {
+			continue
+		}
+		atomic.AddInt64(&r.metrics.integrityErrs, 1)
+		log.Printf("relay: %s: payload mismatch %s in the %d KiB block at offset %d", sess, dir.name, integrityBlock>>10, off)
+		ev := sessionEvent("integrity_mismatch", sess)
+		ev.Reason = fmt.Sprintf("%s offset %d", dir.name, off)
+		r.audit.record(ev)
+	}
+}
@@ -0,0 +1,26 @@
+package turnrelay
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/awgh/huzaa-relay/internal/netutil"
+)
+
+// nat64Prefixes returns the NAT64 prefixes used to normalize peer addresses.
+func (r *Relay) nat64Prefixes() []netip.Prefix {
+	if r.config.NAT64Prefixes != nil {
+		return r.config.NAT64Prefixes
+	}
+	return []netip.Prefix{netutil.WellKnownNAT64}
+}
+
+// peerIP returns the normalized IP of a peer address, for policy and limits.
+func (r *Relay) peerIP(a net.Addr) netip.Addr {
+	return netutil.AddrIP(a, r.nat64Prefixes())
+}
+
+// peerString formats a peer address for logs, normalized like peerIP.
+func (r *Relay) peerString(a net.Addr) string {
+	return netutil.AddrString(a, r.nat64Prefixes())
+}
@@ -0,0 +1,42 @@
+package turnrelay
+
+// userPolicy holds per-bot-user limits taken from TurnUsers. Zero fields fall back to the
+// relay-wide defaults.
+type userPolicy struct {
+	MaxLeaseSec int
+	MaxRateBps  int64
+	Schedules   []ScheduleRule
+	ChainPeer   bool
+
+	MaxSessionsPerDay   int64
+	MaxBytesPerDay      int64
+	MaxSessionsPerMonth int64
+	MaxBytesPerMonth    int64
+}
+
+// policy returns the limits of bot user username (zero if none are set).
+func (r *Relay) policy(username string) userPolicy {
+	r.policiesMu.RLock()
+	defer r.policiesMu.RUnlock()
+	return r.policies[username]
+}
+
+// buildPolicies indexes the per-user limits of creds by username.
+func buildPolicies(creds []TurnUserCred) map[string]userPolicy {
+	policies := make(map[string]userPolicy)
+	for _, u := range creds {
+		if u.Username != "" {
+			policies[u.Username] = userPolicy{
+				MaxLeaseSec:         u.MaxLeaseSec,
+				MaxRateBps:          u.MaxRateBps,
+				Schedules:           u.Schedules,
+				ChainPeer:           u.ChainPeer,
+				MaxSessionsPerDay:   u.MaxSessionsPerDay,
+				MaxBytesPerDay:      u.MaxBytesPerDay,
+				MaxSessionsPerMonth: u.MaxSessionsPerMonth,
+				MaxBytesPerMonth:    u.MaxBytesPerMonth,
+			}
+		}
+	}
+	return policies
+}
@@ -0,0 +1,153 @@
+// Package pool hands out DCC ports from a fixed range.
+package pool
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned by Allocate when no port is free.
+var ErrExhausted = errors.New("no free port")
+
+// Ports is a set of DCC ports; allocation picks a random free one. It is safe for
+// concurrent use.
+type Ports struct {
+	min, max int
+	used     map[int]bool
+	reserved map[int]bool // never allocated; see Reserve
+	mu       sync.Mutex
+
+	cooldown time.Duration
+	cooling  map[int]time.Time // released ports that are not handed out again before then
+}
+
+// New returns a pool of the ports minPort..maxPort inclusive.
+func New(minPort, maxPort int) (*Ports, error) {
+	if minPort <= 0 || maxPort < minPort {
+		return nil, fmt.Errorf("invalid port range %d-%d", minPort, maxPort)
+	}
+	return &Ports{
+		min:      minPort,
+		max:      maxPort,
+		used:     make(map[int]bool),
+		reserved: make(map[int]bool),
+		cooling:  make(map[int]time.Time),
+	}, nil
+}
+
+// SetCooldown makes released ports wait d before they can be allocated again, so a
+// user's late or repeated connection to a finished session's port cannot reach the next
+// session given that port. 0 releases ports immediately.
+func (p *Ports) SetCooldown(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cooldown = d
+}
+
+// Cooling returns the number of released ports still waiting out the cooldown.
+func (p *Ports) Cooling() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	return len(p.cooling)
+}
+
+// sweep frees the ports whose cooldown has passed. p.mu must be held.
+func (p *Ports) sweep() {
+	now := time.Now()
+	for port, until := range p.cooling {
+		if !now.Before(until) {
+			delete(p.cooling, port)
+			delete(p.used, port)
+		}
+	}
+}
+
+// Reserve excludes ports from allocation, e.g. ones the process listens on itself, even if
+// a later Resize moves the range over them.
+func (p *Ports) Reserve(ports ...int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, port := range ports {
+		p.reserved[port] = true
+	}
+}
+
+// Allocate reserves a random free port.
+func (p *Ports) Allocate() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	b := make([]byte, 2)
+	for i := 0; i < 100; i++ {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		port := p.min + (int(binary.BigEndian.Uint16(b)) % (p.max - p.min + 1))
+		if !p.used[port] && !p.reserved[port] {
+			p.used[port] = true
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w in %d-%d", ErrExhausted, p.min, p.max)
+}
+
+// Free returns the number of ports that can be allocated now.
+func (p *Ports) Free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sweep()
+	free := p.max - p.min + 1
+	for port := range p.used {
+		if port >= p.min && port <= p.max {
+			free--
+		}
+	}
+	for port := range p.reserved {
+		if port >= p.min && port <= p.max && !p.used[port] {
+			free--
+		}
+	}
+	return free
+}
+
+// Size returns the number of ports in the range.
+func (p *Ports) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.max - p.min + 1
+}
+
+// Range returns the current range.
+func (p *Ports) Range() (minPort, maxPort int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.min, p.max
+}
+
+// Resize changes the range to minPort..maxPort. Allocated ports outside the new range stay
+// in use until released; new allocations come from the new range only.
+func (p *Ports) Resize(minPort, maxPort int) error {
+	if minPort <= 0 || maxPort < minPort {
+		return fmt.Errorf("invalid port range %d-%d", minPort, maxPort)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.min, p.max = minPort, maxPort
+	return nil
+}
+
+// Release returns port to the pool, after the cooldown if one is set.
+func (p *Ports) Release(port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cooldown > 0 && p.used[port] {
+		p.cooling[port] = time.Now().Add(p.cooldown)
+		return
+	}
+	delete(p.used, port)
+}
@@ -0,0 +1,100 @@
+package turnrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// fdsPerSession is the file descriptors one session can hold: the bot connection, the
+	// user connection and, until the user arrives, the session's DCC listener.
+	fdsPerSession = 3
+	// fdsReserved covers listeners, log and stats files and the admin/metrics server.
+	fdsReserved = 32
+	// preflightMaxPorts is how many DCC ports preflight tries to bind; larger ranges are
+	// sampled evenly.
+	preflightMaxPorts = 256
+)
+
+// preflight checks, before anything listens, that the DCC port range can be bound, that
+// RelayHost resolves and that the open file limit covers MaxSessions (raising it if
+// allowed). Problems are logged; with PreflightStrict they are returned as one error and
+// the relay does not start. Otherwise MaxSessions is lowered to what the file limit allows.
+func (r *Relay) preflight() error {
+	var problems []string
+	report := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		log.Printf("relay: preflight: %s", msg)
+		problems = append(problems, msg)
+	}
+	if !r.config.SinglePort {
+		lo, hi := r.config.DCCPortMin, r.config.DCCPortMax
+		var busy []int
+		ports := samplePorts(lo, hi, preflightMaxPorts)
+		for _, p := range ports {
+			ln, err := net.Listen("tcp", ":"+strconv.Itoa(p))
+			if err != nil {
+				busy = append(busy, p)
+				continue
+			}
+			ln.Close()
+		}
+		switch {
+		case len(busy) == len(ports):
+			report("no DCC port in %d-%d can be bound", lo, hi)
+		case len(busy) > 0:
+			report("%d of %d DCC ports checked in %d-%d cannot be bound (first: %d)", len(busy), len(ports), lo, hi, busy[0])
+		}
+	}
+	switch {
+	case r.host.isName():
+		ctx, cancel := context.WithTimeout(r.ctx, 10*time.Second)
+		_, err := net.DefaultResolver.LookupIPAddr(ctx, r.config.RelayHost)
+		cancel()
+		if err != nil {
+			report("relay_host %s does not resolve: %v", r.config.RelayHost, err)
+		}
+	case r.config.RelayHost == "" && r.config.PublicIPDetect == "":
+		report("relay_host is empty and public_ip_detect is off; users get no address to connect to")
+	}
+	budget := r.fdBudget()
+	if err := r.checkFDBudget(int(atomic.LoadInt32(&r.maxSessions))); err != nil {
+		report("%v", err)
+	}
+	if len(problems) > 0 && r.config.PreflightStrict {
+		return errors.New("preflight failed: " + strings.Join(problems, "; "))
+	}
+	if budget > 0 && atomic.LoadInt32(&r.maxSessions) > budget {
+		log.Printf("relay: limiting max sessions to %d to stay within the open file limit", budget)
+		atomic.StoreInt32(&r.maxSessions, budget)
+	}
+	return nil
+}
+
+// samplePorts returns all ports in lo..hi, or n evenly spaced ones including both ends if
+// the range is larger.
+func samplePorts(lo, hi, n int) []int {
+	total := hi - lo + 1
+	if total <= 0 {
+		return nil
+	}
+	if total <= n {
+		ports := make([]int, 0, total)
+		for p := lo; p <= hi; p++ {
+			ports = append(ports, p)
+		}
+		return ports
+	}
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = lo + i*(total-1)/(n-1)
+	}
+	return ports
+}
@@ -0,0 +1,121 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// PreHook asks an external service (ticketing, DLP, ...) to approve every
+// registration before a port is allocated. The relay POSTs a JSON preRegisterRequest to
+// URL and expects a preRegisterReply; the service can deny the registration, rename the
+// file or cap how many bytes the session may move.
+type PreHook struct {
+	URL        string
+	TimeoutSec int  // default 5
+	FailOpen   bool // approve registrations when the service fails or times out; default deny
+}
+
+// preRegisterRequest is what the pre-registration hook receives.
+type preRegisterRequest struct {
+	Session  string `json:"session"`
+	Kind     string `json:"kind"`
+	Filename string `json:"filename"`
+	User     string `json:"user"`
+}
+
+// preRegisterReply is the pre-registration hook's answer.
+type preRegisterReply struct {
+	Allow    bool   `json:"allow"`
+	Reason   string `json:"reason,omitempty"`    // sent to the bot when denied
+	Filename string `json:"filename,omitempty"`  // if set, replaces the registered filename
+	MaxBytes int64  `json:"max_bytes,omitempty"` // if > 0, the session is cut after this many bytes
+}
+
+// preRegister runs the configured pre-registration hook for reg and records the outcome
+// in the audit log as event "pre_register". It returns the reply to apply, or
+// ErrDenied.
+func (r *Relay) preRegister(ctx context.Context, username, kind string, reg Registration) (preRegisterReply, error) {
+	h := r.config.PreRegister
+	if h == nil || h.URL == "" {
+		return preRegisterReply{Allow: true}, nil
+	}
+	timeout := 5 * time.Second
+	if h.TimeoutSec > 0 {
+		timeout = time.Duration(h.TimeoutSec) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	reply, err := callPreRegister(ctx, h.URL, preRegisterRequest{Session: reg.SessionID, Kind: kind, Filename: reg.Filename, User: username})
+	cancel()
+	ev := AuditEvent{Event: "pre_register", Session: reg.SessionID, Kind: kind, Filename: reg.Filename, User: username}
+	switch {
+	case err != nil:
+		log.Printf("relay: pre-registration hook for session %s (user %s): %v", reg.SessionID, username, err)
+		ev.Error = err.Error()
+		if h.FailOpen {
+			reply = preRegisterReply{Allow: true}
+			ev.State = "allowed_on_error"
+		} else {
+			err = fmt.Errorf("%w: approval service unavailable", ErrDenied)
+			ev.State = "denied_on_error"
+		}
+	case !reply.Allow:
+		err = ErrDenied
+		if reply.Reason != "" {
+			err = fmt.Errorf("%w: %s", ErrDenied, reply.Reason)
+		}
+		ev.State, ev.Error = "denied", reply.Reason
+	default:
+		ev.State, ev.Bytes = "allowed", reply.MaxBytes
+		if reply.Filename != "" {
+			ev.Filename = reply.Filename
+		}
+	}
+	r.audit.record(ev)
+	return reply, err
+}
+
+func callPreRegister(ctx context.Context, url string, body preRegisterRequest) (preRegisterReply, error) {
+	var reply preRegisterReply
+	data, err := json.Marshal(body)
+	if err != nil {
+		return reply, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return reply, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return reply, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return reply, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&reply); err != nil {
+		return reply, fmt.Errorf("%s: bad reply: %w", url, err)
+	}
+	return reply, nil
+}
+
+// withinCap reports whether sess may move n more bytes under its file size limit (see
+// withinFileSize) and its byte cap. Past the cap the session is marked CloseQuota; either
+// way the caller tears it down.
+func (r *Relay) withinCap(sess *Session, n int) bool {
+	if !r.withinFileSize(sess, n) {
+		return false
+	}
+	if sess.maxBytes <= 0 || sess.Bytes()+int64(n) <= sess.maxBytes {
+		return true
+	}
+	log.Printf("relay: %s: cut at its %d byte cap", sess, sess.maxBytes)
+	sess.setCloseReason(CloseQuota)
+	return false
+}
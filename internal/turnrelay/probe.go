@@ -0,0 +1,28 @@
+package turnrelay
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// probe answers MsgProbe: whether a registration by bot user username for req would be
+// accepted right now. It consumes nothing.
+func (r *Relay) probe(username string, req ProbeRequest) ProbeResult {
+	res := ProbeResult{
+		FreePorts: r.freePorts(),
+		// The probing connection already holds one slot and would carry the session.
+		FreeSlots: int(atomic.LoadInt32(&r.maxSessions)-atomic.LoadInt32(&r.currentConns)) + 1,
+	}
+	if res.FreeSlots < 0 {
+		res.FreeSlots = 0
+	}
+	switch {
+	case r.config.MaxFileSize > 0 && req.Size > r.config.MaxFileSize:
+		res.Reason = fmt.Sprintf("%v: %d bytes (max %d)", ErrFileTooLarge, req.Size, r.config.MaxFileSize)
+	case res.FreePorts == 0:
+		res.Reason = "no free port"
+	default:
+		res.OK = true
+	}
+	return res
+}
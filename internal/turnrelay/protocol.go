@@ -2,7 +2,14 @@ package turnrelay
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
 )
 
 // Message types (bot <-> relay).
@@ -15,9 +22,432 @@ const (
 	MsgEOF              = 0x06
 	MsgAuth             = 0x07
 	MsgAuthOk           = 0x08
+	MsgCancel           = 0x09 // bot aborts its session; no payload
+	MsgProbe            = 0x0A // dry-run registration check; see ProbeRequest
+	MsgProbeResult      = 0x0B // reply to MsgProbe; see ProbeResult
+	MsgRenew            = 0x0C // extend an unclaimed allocation: 4-byte seconds
+	MsgRenewOk          = 0x0D // reply to MsgRenew: 8-byte Unix expiry (0 = never expires)
+	MsgRegisterForward  = 0x0E // like RegisterDownload, but data flows both ways (port forward)
+	MsgBanner           = 0x0F // operator notice (UTF-8 text) sent after MsgAuthOk when configured
+	MsgStats            = 0x10 // session summary sent to the bot when its session ends; see SessionStats
+	MsgServerInfo       = 0x11 // bot: empty request; relay: reply describing its build; see ServerInfo
+	MsgAttach           = 0x12 // bot: 36-byte session ID of a bot-to-bot session; relay: reply, see Attach
+	MsgPing             = 0x13 // keepalive, either direction; optional payload, echoed in the MsgPong
+	MsgPong             = 0x14 // reply to MsgPing
+	MsgResume           = 0x15 // like RegisterDownload, continuing an interrupted download; see Resume
+	MsgChecksum         = 0x16 // end-of-transfer digest of the session's data, after MsgEOF; see Checksum
 )
 
-// Frame: 1 byte type + 4 byte length (big-endian) + payload.
+// msgTypeNames names the frame types for logs and metric labels.
+var msgTypeNames = map[byte]string{
+	MsgRegisterDownload: "register_download",
+	MsgRegisterUpload:   "register_upload",
+	MsgPortAlloc:        "port_alloc",
+	MsgData:             "data",
+	MsgError:            "error",
+	MsgEOF:              "eof",
+	MsgAuth:             "auth",
+	MsgAuthOk:           "auth_ok",
+	MsgCancel:           "cancel",
+	MsgProbe:            "probe",
+	MsgProbeResult:      "probe_result",
+	MsgRenew:            "renew",
+	MsgRenewOk:          "renew_ok",
+	MsgRegisterForward:  "register_forward",
+	MsgBanner:           "banner",
+	MsgStats:            "stats",
+	MsgServerInfo:       "server_info",
+	MsgAttach:           "attach",
+	MsgPing:             "ping",
+	MsgPong:             "pong",
+	MsgResume:           "resume",
+	MsgChecksum:         "checksum",
+}
+
+// MsgTypeName returns a short name for a frame type ("unknown_0x.." if not defined).
+func MsgTypeName(t byte) string {
+	if n, ok := msgTypeNames[t]; ok {
+		return n
+	}
+	return fmt.Sprintf("unknown_0x%02x", t)
+}
+
+// Registration is a parsed MsgRegisterDownload / MsgRegisterUpload payload:
+//
+//	<session ID, 36 bytes><filename>[\x00<key>=<value>]...
+//
+// Options follow the filename, each introduced by a NUL byte. Filenames cannot contain NUL,
+// so bots that send only session ID + filename are unaffected; unknown keys are ignored.
+type Registration struct {
+	SessionID      string
+	Filename       string
+	IdempotencyKey string // option "idem": retries with the same key reuse the original allocation
+	PeerBot        string // option "peer": bot user that attaches with MsgAttach instead of a DCC user; no DCC port is allocated
+	Via            string // option "via": comma-separated chain relays (RelayConfig.ChainRelays names) the session passes through to its user
+	Hops           int    // option "hops": relay-to-relay links the registration already passed; only honoured from chain peers (TurnUserCred.ChainPeer)
+	Fanout         int    // option "fanout": DCC users the download is streamed to at once; 0 or 1 = one user
+	Checksum       string // option "checksum": algorithm of the MsgChecksum exchanged after MsgEOF (ChecksumSHA256); "" = none
+	Size           int64  // option "size": expected file size in bytes; the session is cut if it moves more; 0 = not declared
+}
+
+// ParseRegistration parses a registration payload.
+func ParseRegistration(payload []byte) (Registration, error) {
+	var reg Registration
+	if len(payload) < 4 {
+		return reg, errors.New("registration too short")
+	}
+	reg.SessionID = string(payload[:min(36, len(payload))])
+	if len(payload) <= 36 {
+		return reg, nil
+	}
+	fields := strings.Split(string(payload[36:]), "\x00")
+	reg.Filename = fields[0]
+	for _, f := range fields[1:] {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "idem":
+			reg.IdempotencyKey = value
+		case "peer":
+			reg.PeerBot = value
+		case "via":
+			reg.Via = value
+		case "hops":
+			var err error
+			if reg.Hops, err = strconv.Atoi(value); err != nil || reg.Hops < 0 {
+				return reg, fmt.Errorf("bad hops %q", value)
+			}
+		case "fanout":
+			reg.Fanout, _ = strconv.Atoi(value)
+		case "checksum":
+			reg.Checksum = value
+		case "size":
+			if reg.Size, _ = strconv.ParseInt(value, 10, 64); reg.Size <= 0 {
+				reg.Size = -1 // rejected by checkFileSize
+			}
+		}
+	}
+	return reg, nil
+}
+
+// Marshal encodes the registration as a MsgRegisterDownload / MsgRegisterUpload payload.
+func (reg Registration) Marshal() []byte {
+	b := append([]byte(reg.SessionID), reg.Filename...)
+	if reg.IdempotencyKey != "" {
+		b = append(append(b, "\x00idem="...), reg.IdempotencyKey...)
+	}
+	if reg.PeerBot != "" {
+		b = append(append(b, "\x00peer="...), reg.PeerBot...)
+	}
+	if reg.Via != "" {
+		b = append(append(b, "\x00via="...), reg.Via...)
+	}
+	if reg.Hops > 0 {
+		b = append(b, "\x00hops="+strconv.Itoa(reg.Hops)...)
+	}
+	if reg.Fanout > 1 {
+		b = append(b, "\x00fanout="+strconv.Itoa(reg.Fanout)...)
+	}
+	if reg.Checksum != "" {
+		b = append(append(b, "\x00checksum="...), reg.Checksum...)
+	}
+	if reg.Size > 0 {
+		b = append(b, "\x00size="+strconv.FormatInt(reg.Size, 10)...)
+	}
+	return b
+}
+
+// AuthOk is a MsgAuthOk payload: <nonce, auth.NonceLen bytes>[<quota, 16 bytes>]. The
+// quota is only sent to bot users with quotas, so other bots see the bare nonce.
+type AuthOk struct {
+	Nonce []byte
+	Quota *Quota
+}
+
+// Quota is what a bot user has left today: [8-byte sessions][8-byte bytes], big-endian,
+// -1 = unlimited.
+type Quota struct {
+	SessionsLeft int64
+	BytesLeft    int64
+}
+
+// ParseAuthOk parses a MsgAuthOk payload.
+func ParseAuthOk(payload []byte) (AuthOk, error) {
+	if len(payload) < auth.NonceLen {
+		return AuthOk{}, errors.New("auth ok too short")
+	}
+	a := AuthOk{Nonce: payload[:auth.NonceLen]}
+	if rest := payload[auth.NonceLen:]; len(rest) >= 16 {
+		a.Quota = &Quota{
+			SessionsLeft: int64(binary.BigEndian.Uint64(rest[:8])),
+			BytesLeft:    int64(binary.BigEndian.Uint64(rest[8:16])),
+		}
+	}
+	return a, nil
+}
+
+// Marshal encodes the reply as a MsgAuthOk payload.
+func (a AuthOk) Marshal() []byte {
+	b := append([]byte(nil), a.Nonce...)
+	if a.Quota != nil {
+		b = binary.BigEndian.AppendUint64(b, uint64(a.Quota.SessionsLeft))
+		b = binary.BigEndian.AppendUint64(b, uint64(a.Quota.BytesLeft))
+	}
+	return b
+}
+
+// PortAlloc is a MsgPortAlloc payload:
+//
+//	<4-byte port, big-endian>[<advertised addresses, comma-separated>][\x00<key>=<value>]...
+//
+// Addresses are in preference order. Options use the same NUL-separated form as
+// Registration; bots that only read the port are unaffected.
+type PortAlloc struct {
+	Port     int
+	Addrs    []string
+	SNIHost  string // option "sni": TLS server name that reaches this session on the relay's SNI DCC port
+	Filename string // option "name": filename the relay's pre-registration hook substituted; offer this one
+	MaxBytes int64  // option "max": bytes the session may move before the relay cuts it; 0 = no cap
+}
+
+// ParsePortAlloc parses a MsgPortAlloc payload.
+func ParsePortAlloc(payload []byte) (PortAlloc, error) {
+	var p PortAlloc
+	if len(payload) < 4 {
+		return p, errors.New("port alloc too short")
+	}
+	p.Port = int(binary.BigEndian.Uint32(payload[:4]))
+	fields := strings.Split(string(payload[4:]), "\x00")
+	if fields[0] != "" {
+		p.Addrs = strings.Split(fields[0], ",")
+	}
+	for _, f := range fields[1:] {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "sni":
+			p.SNIHost = value
+		case "name":
+			p.Filename = value
+		case "max":
+			p.MaxBytes, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return p, nil
+}
+
+// Marshal encodes the allocation as a MsgPortAlloc payload.
+func (p PortAlloc) Marshal() []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(p.Port))
+	b = append(b, strings.Join(p.Addrs, ",")...)
+	if p.SNIHost != "" {
+		b = append(append(b, "\x00sni="...), p.SNIHost...)
+	}
+	if p.Filename != "" {
+		b = append(append(b, "\x00name="...), p.Filename...)
+	}
+	if p.MaxBytes > 0 {
+		b = strconv.AppendInt(append(b, "\x00max="...), p.MaxBytes, 10)
+	}
+	return b
+}
+
+// SessionStats is a MsgStats payload:
+//
+//	<8-byte bytes><8-byte user bytes><8-byte duration ms><8-byte average B/s><peer>\x00<close reason>
+//
+// Numbers are big-endian. Peer is the user's IP (possibly redacted, "" if no user
+// connected); the close reason is one of the Close* constants.
+type SessionStats struct {
+	Bytes      int64 // bytes relayed on the bot leg
+	UserBytes  int64 // bytes written to the user of a download (after any StreamTransform)
+	Duration   time.Duration
+	AvgRateBps int64
+	Peer       string
+	Reason     string
+}
+
+// ParseSessionStats parses a MsgStats payload.
+func ParseSessionStats(payload []byte) (SessionStats, error) {
+	if len(payload) < 32 {
+		return SessionStats{}, errors.New("stats too short")
+	}
+	peer, reason, _ := strings.Cut(string(payload[32:]), "\x00")
+	return SessionStats{
+		Bytes:      int64(binary.BigEndian.Uint64(payload[0:8])),
+		UserBytes:  int64(binary.BigEndian.Uint64(payload[8:16])),
+		Duration:   time.Duration(binary.BigEndian.Uint64(payload[16:24])) * time.Millisecond,
+		AvgRateBps: int64(binary.BigEndian.Uint64(payload[24:32])),
+		Peer:       peer,
+		Reason:     reason,
+	}, nil
+}
+
+// Marshal encodes the stats as a MsgStats payload.
+func (s SessionStats) Marshal() []byte {
+	b := make([]byte, 0, 32+len(s.Peer)+1+len(s.Reason))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.Bytes))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.UserBytes))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.Duration.Milliseconds()))
+	b = binary.BigEndian.AppendUint64(b, uint64(s.AvgRateBps))
+	b = append(append(append(b, s.Peer...), 0), s.Reason...)
+	return b
+}
+
+// ProbeRequest is a MsgProbe payload: [8-byte size, big-endian][user]. Both parts are
+// optional; size 0 means unknown, user is the IRC user the transfer is for.
+type ProbeRequest struct {
+	Size int64
+	User string
+}
+
+// ParseProbeRequest parses a MsgProbe payload.
+func ParseProbeRequest(payload []byte) ProbeRequest {
+	var p ProbeRequest
+	if len(payload) >= 8 {
+		p.Size = int64(binary.BigEndian.Uint64(payload[:8]))
+		p.User = string(payload[8:])
+	}
+	return p
+}
+
+// Marshal encodes the probe as a MsgProbe payload.
+func (p ProbeRequest) Marshal() []byte {
+	b := make([]byte, 8, 8+len(p.User))
+	binary.BigEndian.PutUint64(b, uint64(p.Size))
+	return append(b, p.User...)
+}
+
+// ProbeResult is a MsgProbeResult payload:
+// [1 byte ok][4-byte free DCC ports][4-byte free session slots][reason text].
+type ProbeResult struct {
+	OK        bool
+	FreePorts int
+	FreeSlots int
+	Reason    string // why a registration would be refused; empty when OK
+}
+
+// ParseProbeResult parses a MsgProbeResult payload.
+func ParseProbeResult(payload []byte) (ProbeResult, error) {
+	if len(payload) < 9 {
+		return ProbeResult{}, errors.New("probe result too short")
+	}
+	return ProbeResult{
+		OK:        payload[0] == 1,
+		FreePorts: int(binary.BigEndian.Uint32(payload[1:5])),
+		FreeSlots: int(binary.BigEndian.Uint32(payload[5:9])),
+		Reason:    string(payload[9:]),
+	}, nil
+}
+
+// Marshal encodes the result as a MsgProbeResult payload.
+func (p ProbeResult) Marshal() []byte {
+	b := make([]byte, 9, 9+len(p.Reason))
+	if p.OK {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:5], uint32(p.FreePorts))
+	binary.BigEndian.PutUint32(b[5:9], uint32(p.FreeSlots))
+	return append(b, p.Reason...)
+}
+
+// ServerInfo is the relay's MsgServerInfo reply: NUL-separated <key>=<value> fields
+// version, commit, date and go. Unknown keys are ignored.
+type ServerInfo struct {
+	Version   string
+	Commit    string // "" = unknown
+	Date      string // build time, RFC 3339; "" = unknown
+	GoVersion string
+}
+
+// ParseServerInfo parses a MsgServerInfo reply.
+func ParseServerInfo(payload []byte) ServerInfo {
+	var s ServerInfo
+	for _, f := range strings.Split(string(payload), "\x00") {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "version":
+			s.Version = value
+		case "commit":
+			s.Commit = value
+		case "date":
+			s.Date = value
+		case "go":
+			s.GoVersion = value
+		}
+	}
+	return s
+}
+
+// Marshal encodes the info as a MsgServerInfo reply.
+func (s ServerInfo) Marshal() []byte {
+	return []byte("version=" + s.Version + "\x00commit=" + s.Commit + "\x00date=" + s.Date + "\x00go=" + s.GoVersion)
+}
+
+// Attach is the relay's MsgAttach reply: <kind>\x00<filename>. Kind is the session kind as
+// registered ("download", "upload" or "forward"); the attaching bot takes the user's side
+// of it, so for a download it receives the data.
+type Attach struct {
+	Kind     string
+	Filename string
+}
+
+// ParseAttach parses a MsgAttach reply.
+func ParseAttach(payload []byte) Attach {
+	kind, filename, _ := strings.Cut(string(payload), "\x00")
+	return Attach{Kind: kind, Filename: filename}
+}
+
+// Marshal encodes the reply as a MsgAttach payload.
+func (a Attach) Marshal() []byte {
+	return []byte(a.Kind + "\x00" + a.Filename)
+}
+
+// Resume is a MsgResume payload:
+//
+//	<session ID, 36 bytes><8-byte offset, big-endian>[\x00<key>=<value>]...
+//
+// It re-registers a download of the same bot user that ended before its user received
+// everything, under the same session ID and filename; the bot then streams the file from
+// Offset on, which must not be past what the relay delivered to the user. Options are
+// those of Registration; only "checksum" applies.
+type Resume struct {
+	SessionID string
+	Offset    int64
+	Checksum  string // option "checksum", see Registration.Checksum; covers the data from Offset on
+}
+
+// ParseResume parses a MsgResume payload.
+func ParseResume(payload []byte) (Resume, error) {
+	if len(payload) < 36+8 {
+		return Resume{}, errors.New("resume too short")
+	}
+	off := int64(binary.BigEndian.Uint64(payload[36:44]))
+	if off < 0 {
+		return Resume{}, errors.New("negative resume offset")
+	}
+	res := Resume{SessionID: string(payload[:36]), Offset: off}
+	for _, f := range strings.Split(string(payload[44:]), "\x00")[1:] {
+		if key, value, _ := strings.Cut(f, "="); key == "checksum" {
+			res.Checksum = value
+		}
+	}
+	return res, nil
+}
+
+// Marshal encodes the request as a MsgResume payload.
+func (r Resume) Marshal() []byte {
+	b := binary.BigEndian.AppendUint64([]byte(r.SessionID), uint64(r.Offset))
+	if r.Checksum != "" {
+		b = append(append(b, "\x00checksum="...), r.Checksum...)
+	}
+	return b
+}
+
+// MaxPayload is the largest frame payload ReadFrame accepts.
+const MaxPayload = 2 * 1024 * 1024
+
+// Frame: 1 byte type + 4 byte length (big-endian) + payload. A payload over MaxPayload
+// fails with ErrFrameTooLarge.
 func ReadFrame(r io.Reader) (msgType byte, payload []byte, err error) {
 	var h [5]byte
 	if _, err = io.ReadFull(r, h[:]); err != nil {
@@ -25,8 +455,9 @@ func ReadFrame(r io.Reader) (msgType byte, payload []byte, err error) {
 	}
 	msgType = h[0]
 	ln := binary.BigEndian.Uint32(h[1:5])
-	if ln > 2*1024*1024 { // 2MB max payload
-		return 0, nil, io.ErrShortBuffer
+	if ln > MaxPayload {
+		// The payload is left unread, so the stream cannot be resynchronized.
+		return msgType, nil, fmt.Errorf("%w: %s frame of %d bytes (max %d)", ErrFrameTooLarge, MsgTypeName(msgType), ln, MaxPayload)
 	}
 	payload = make([]byte, ln)
 	if ln > 0 {
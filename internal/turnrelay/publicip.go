@@ -0,0 +1,153 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultIPEchoURL returns the caller's address as plain text.
+const defaultIPEchoURL = "https://api.ipify.org"
+
+// lookupPublicIP asks an HTTPS echo endpoint for the address this host is seen as.
+func lookupPublicIP(ctx context.Context, echoURL string) (net.IP, error) {
+	if echoURL == "" {
+		echoURL = defaultIPEchoURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ip echo %s: %s", echoURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("ip echo %s: not an IP address: %q", echoURL, body)
+	}
+	return ip, nil
+}
+
+// defaultSTUNServer answers STUN binding requests.
+const defaultSTUNServer = "stun.l.google.com:19302"
+
+const (
+	stunMagicCookie      = 0x2112A442
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunMappedAddress    = 0x0001
+	stunXorMappedAddress = 0x0020
+)
+
+// stunPublicIP sends a STUN binding request (RFC 5389) and returns the mapped address.
+func stunPublicIP(ctx context.Context, server string) (net.IP, error) {
+	if server == "" {
+		server = defaultSTUNServer
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("stun %s: %w", server, err)
+		}
+		if n < 20 || binary.BigEndian.Uint16(buf) != stunBindingSuccess || !bytes.Equal(buf[8:20], req[8:20]) {
+			continue
+		}
+		return parseSTUNAddress(buf[20:n], req[4:20])
+	}
+}
+
+// parseSTUNAddress finds the (XOR-)MAPPED-ADDRESS attribute; xorKey is cookie || txid.
+func parseSTUNAddress(attrs, xorKey []byte) (net.IP, error) {
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		l := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+l {
+			break
+		}
+		v := attrs[4 : 4+l]
+		if (typ == stunXorMappedAddress || typ == stunMappedAddress) && l >= 8 {
+			var ip net.IP
+			switch {
+			case v[1] == 0x01 && l >= 8:
+				ip = append(net.IP{}, v[4:8]...)
+			case v[1] == 0x02 && l >= 20:
+				ip = append(net.IP{}, v[4:20]...)
+			}
+			if ip != nil && typ == stunXorMappedAddress {
+				for i := range ip {
+					ip[i] ^= xorKey[i]
+				}
+				return ip, nil
+			}
+			if ip != nil {
+				mapped = ip
+			}
+		}
+		next := 4 + (l+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, fmt.Errorf("stun: no mapped address in response")
+	}
+	return mapped, nil
+}
+
+// detectPublicIP determines this host's public IP with the configured method ("stun" or
+// "https").
+func (r *Relay) detectPublicIP() (net.IP, error) {
+	ctx, cancel := context.WithTimeout(r.ctx, 15*time.Second)
+	defer cancel()
+	return DetectPublicIP(ctx, r.config.PublicIPDetect, r.config.PublicIPSTUNServer, r.config.PublicIPEchoURL)
+}
+
+// DetectPublicIP returns the address this host is seen as from outside, asking stunServer
+// (method "stun") or echoURL (method "https"); empty servers use the defaults.
+func DetectPublicIP(ctx context.Context, method, stunServer, echoURL string) (net.IP, error) {
+	switch method {
+	case "stun":
+		return stunPublicIP(ctx, stunServer)
+	case "https":
+		return lookupPublicIP(ctx, echoURL)
+	default:
+		return nil, fmt.Errorf("unknown public_ip_detect %q (want stun or https)", method)
+	}
+}
@@ -0,0 +1,204 @@
+package turnrelay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// quotaSaveInterval is how often changed quota counters are written to QuotaFile.
+const quotaSaveInterval = 30 * time.Second
+
+// quotaUsage counts sessions and bytes per bot user for the current UTC day and month, for
+// the per-user quotas (max_sessions_per_day, max_bytes_per_month, ...). Day counters
+// restart at midnight UTC, month counters on the first of the month. Without QuotaFile
+// they also restart with the relay.
+type quotaUsage struct {
+	mu    sync.Mutex
+	path  string // QuotaFile; "" = in memory only
+	dirty bool   // changed since the last save
+	state quotaState
+}
+
+// quotaState is the content of QuotaFile.
+type quotaState struct {
+	Day           string           `json:"day"`   // UTC day the day counters are for, 2006-01-02
+	Month         string           `json:"month"` // UTC month the month counters are for, 2006-01
+	DaySessions   map[string]int64 `json:"day_sessions"`
+	DayBytes      map[string]int64 `json:"day_bytes"`
+	MonthSessions map[string]int64 `json:"month_sessions"`
+	MonthBytes    map[string]int64 `json:"month_bytes"`
+}
+
+// quotaCounts is what one bot user used in the current day and month.
+type quotaCounts struct {
+	daySessions, dayBytes, monthSessions, monthBytes int64
+}
+
+// openQuotaUsage loads the counters saved at path, or starts empty ones if path is "" or
+// does not exist yet.
+func openQuotaUsage(path string) (*quotaUsage, error) {
+	u := &quotaUsage{path: path}
+	if path == "" {
+		return u, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &u.state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return u, nil
+}
+
+// rollover resets the counters of a day or month that is over. Callers hold mu.
+func (u *quotaUsage) rollover() {
+	now := time.Now().UTC()
+	s := &u.state
+	if day := now.Format("2006-01-02"); day != s.Day || s.DaySessions == nil || s.DayBytes == nil {
+		s.Day, s.DaySessions, s.DayBytes = day, make(map[string]int64), make(map[string]int64)
+		u.dirty = true
+	}
+	if month := now.Format("2006-01"); month != s.Month || s.MonthSessions == nil || s.MonthBytes == nil {
+		s.Month, s.MonthSessions, s.MonthBytes = month, make(map[string]int64), make(map[string]int64)
+		u.dirty = true
+	}
+}
+
+func (u *quotaUsage) addSession(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.state.DaySessions[user]++
+	u.state.MonthSessions[user]++
+	u.dirty = true
+}
+
+func (u *quotaUsage) addBytes(user string, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.state.DayBytes[user] += n
+	u.state.MonthBytes[user] += n
+	u.dirty = true
+}
+
+func (u *quotaUsage) get(user string) quotaCounts {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	s := &u.state
+	return quotaCounts{s.DaySessions[user], s.DayBytes[user], s.MonthSessions[user], s.MonthBytes[user]}
+}
+
+// save writes the counters to QuotaFile if they changed. The file is replaced atomically.
+func (u *quotaUsage) save() error {
+	u.mu.Lock()
+	if u.path == "" || !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(u.state, "", "  ")
+	u.dirty = false
+	u.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(u.path, append(data, '\n'))
+	}
+	if err != nil {
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+	}
+	return err
+}
+
+// saveQuotaUsage writes the quota counters periodically; Shutdown writes them once more.
+func (r *Relay) saveQuotaUsage() {
+	h := r.health.register("quota writer", 3*quotaSaveInterval)
+	t := time.NewTicker(quotaSaveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			h.stop()
+			return
+		case <-t.C:
+		}
+		if err := r.usage.save(); err != nil {
+			log.Printf("relay: quota file: %v", err)
+			r.noteWriteError("quota_file", err)
+			continue
+		}
+		h.beat()
+	}
+}
+
+// quota returns what username has left today (the tighter of its day and month limits),
+// and false if the user has no quotas.
+func (r *Relay) quota(username string) (Quota, bool) {
+	p := r.policy(username)
+	if p.MaxSessionsPerDay <= 0 && p.MaxBytesPerDay <= 0 && p.MaxSessionsPerMonth <= 0 && p.MaxBytesPerMonth <= 0 {
+		return Quota{}, false
+	}
+	c := r.usage.get(username)
+	return Quota{
+		SessionsLeft: quotaLeft(quotaLeft(-1, p.MaxSessionsPerDay, c.daySessions), p.MaxSessionsPerMonth, c.monthSessions),
+		BytesLeft:    quotaLeft(quotaLeft(-1, p.MaxBytesPerDay, c.dayBytes), p.MaxBytesPerMonth, c.monthBytes),
+	}, true
+}
+
+// quotaLeft lowers left (-1 = unlimited) to what limit (0 = none) leaves after used.
+func quotaLeft(left, limit, used int64) int64 {
+	if limit <= 0 {
+		return left
+	}
+	if rest := max(limit-used, 0); left < 0 || rest < left {
+		return rest
+	}
+	return left
+}
+
+// checkQuota returns ErrQuotaExceeded if username has used up a day or month limit.
+func (r *Relay) checkQuota(username string) error {
+	p := r.policy(username)
+	c := r.usage.get(username)
+	switch {
+	case p.MaxSessionsPerDay > 0 && c.daySessions >= p.MaxSessionsPerDay:
+		return fmt.Errorf("%w: %d sessions per day", ErrQuotaExceeded, p.MaxSessionsPerDay)
+	case p.MaxBytesPerDay > 0 && c.dayBytes >= p.MaxBytesPerDay:
+		return fmt.Errorf("%w: %d bytes per day", ErrQuotaExceeded, p.MaxBytesPerDay)
+	case p.MaxSessionsPerMonth > 0 && c.monthSessions >= p.MaxSessionsPerMonth:
+		return fmt.Errorf("%w: %d sessions per month", ErrQuotaExceeded, p.MaxSessionsPerMonth)
+	case p.MaxBytesPerMonth > 0 && c.monthBytes >= p.MaxBytesPerMonth:
+		return fmt.Errorf("%w: %d bytes per month", ErrQuotaExceeded, p.MaxBytesPerMonth)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data via a temporary file and rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
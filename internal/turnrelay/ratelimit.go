@@ -0,0 +1,98 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket over bytes. A rate of 0 means unlimited. The bucket holds
+// at most one second of tokens, so a session that idled cannot burst far above its rate.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    int64 // bytes per second; 0 = unlimited
+	boosted bool  // rate was set by an operator and overrides the user policy
+	tokens  float64
+	last    time.Time
+}
+
+func (l *rateLimiter) setRate(bps int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = bps
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// currentRate returns the rate and whether it is an operator override.
+func (l *rateLimiter) currentRate() (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, l.boosted
+}
+
+// wait blocks until n bytes may pass. It returns false if done is closed first.
+func (l *rateLimiter) wait(n int, done <-chan struct{}) bool {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return true
+		}
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		l.last = now
+		burst := float64(max(l.rate, int64(n)))
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return true
+		}
+		delay := time.Duration((float64(n) - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		if delay > 100*time.Millisecond {
+			delay = 100 * time.Millisecond // re-check: the rate may be boosted meanwhile
+		}
+		select {
+		case <-done:
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// applyUserPolicy sets the session's rate limit from the bot user's policy and the active
+// schedules unless an operator has already overridden it.
+func (r *Relay) applyUserPolicy(username string, sess *Session) {
+	rate, boosted := sess.limiter.currentRate()
+	if boosted {
+		return
+	}
+	if want := r.scheduledRate(username); want != rate {
+		sess.limiter.setRate(want)
+	}
+}
+
+// BoostSession overrides the rate limit of one session at runtime, e.g. to let an urgent
+// transfer through faster than its user's max_rate_bps. bps 0 removes the limit for that
+// session; the override lasts until the session ends.
+func (r *Relay) BoostSession(actor, sessionID string, bps int64) error {
+	params := map[string]string{"session": sessionID, "rate_bps": fmt.Sprint(bps)}
+	sess, err := r.lookupSession(sessionID)
+	if err == nil && bps < 0 {
+		err = fmt.Errorf("rate must be >= 0, got %d", bps)
+	}
+	if err == nil {
+		sess.limiter.mu.Lock()
+		sess.limiter.boosted = true
+		sess.limiter.mu.Unlock()
+		sess.limiter.setRate(bps)
+		log.Printf("relay: %s rate limit set to %d B/s by %s", sess, bps, actor)
+	}
+	r.recordAdminAction(actor, "boost_session", params, err)
+	return err
+}
@@ -0,0 +1,28 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+)
+
+// checkReadOnly refuses every session kind but downloads while the relay is read-only.
+// Forward sessions carry data from users too, so they are refused along with uploads.
+func (r *Relay) checkReadOnly(kind string) error {
+	if kind != "download" && r.readOnly.Load() {
+		return fmt.Errorf("%w: %s sessions are refused", ErrReadOnly, kind)
+	}
+	return nil
+}
+
+// ReadOnly reports whether the relay accepts downloads only (see SetReadOnly).
+func (r *Relay) ReadOnly() bool { return r.readOnly.Load() }
+
+// SetReadOnly turns read-only mode on or off at runtime, e.g. to stop uploads while content
+// abuse is investigated without taking the relay down. Sessions already registered are
+// left alone; use KillSession to end them.
+func (r *Relay) SetReadOnly(actor string, enabled bool) {
+	if r.readOnly.Swap(enabled) != enabled {
+		log.Printf("relay: read-only mode set to %v by %s", enabled, actor)
+	}
+	r.recordAdminAction(actor, "set_read_only", map[string]string{"enabled": fmt.Sprint(enabled)}, nil)
+}
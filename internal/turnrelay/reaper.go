@@ -0,0 +1,57 @@
+package turnrelay
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// reapInterval is how often the reaper checks sessions against the idle and duration limits.
+const reapInterval = time.Second
+
+// reapSessions ends sessions that moved no data for SessionIdleTimeoutSec after their user
+// connected (unclaimed sessions are left to leases), and sessions older than
+// SessionMaxDurationSec, whatever they are doing. Either ends with CloseTimeout and an
+// audit event (session_idle_timeout, session_max_duration); the port is released as the
+// session is removed.
+func (r *Relay) reapSessions() {
+	h := r.health.register("session reaper", 10*reapInterval)
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+	idle := time.Duration(r.config.SessionIdleTimeoutSec) * time.Second
+	maxAge := time.Duration(r.config.SessionMaxDurationSec) * time.Second
+	for {
+		var now time.Time
+		select {
+		case <-r.ctx.Done():
+			h.stop()
+			return
+		case now = <-t.C:
+		}
+		h.beat()
+		for _, s := range r.sessionList() {
+			switch {
+			case maxAge > 0 && now.Sub(s.CreatedAt) >= maxAge:
+				log.Printf("relay: %s: open for %s, over session_max_duration_sec; closing", s, now.Sub(s.CreatedAt).Round(time.Second))
+				r.reap(s, "session_max_duration")
+			case idle > 0 && s.isClaimed():
+				moved := atomic.LoadInt64(&s.bytes) + atomic.LoadInt64(&s.userBytes)
+				if moved != s.idleMark || s.idleSince.IsZero() {
+					s.idleMark, s.idleSince = moved, now
+					continue
+				}
+				if now.Sub(s.idleSince) >= idle {
+					log.Printf("relay: %s: no data moved for %s; closing", s, now.Sub(s.idleSince).Round(time.Second))
+					r.reap(s, "session_idle_timeout")
+				}
+			}
+		}
+	}
+}
+
+// reap ends sess with CloseTimeout, recording event in the audit log.
+func (r *Relay) reap(sess *Session, event string) {
+	r.audit.record(sessionEvent(event, sess))
+	sess.setCloseReason(CloseTimeout)
+	r.removeSession(sess.ID)
+}
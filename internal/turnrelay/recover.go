@@ -0,0 +1,48 @@
+package turnrelay
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// recoverPanic must be deferred directly by a handler goroutine. It turns a panic into a
+// logged stack trace, bumps the panic counter, runs cleanup (e.g. removing the session)
+// and, if CrashDumpDir is set, writes a crash dump file. The process keeps running.
+func (r *Relay) recoverPanic(name string, cleanup func()) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	atomic.AddInt64(&r.metrics.handlerPanics, 1)
+	log.Printf("relay: panic in %s: %v\n%s", name, v, stack)
+	if r.config.CrashDumpDir != "" {
+		if path, err := r.writeCrashDump(name, v, stack); err != nil {
+			log.Printf("relay: write crash dump: %v", err)
+		} else {
+			log.Printf("relay: crash dump written to %s", path)
+		}
+	}
+	if cleanup != nil {
+		cleanup()
+	}
+}
+
+var crashNameRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (r *Relay) writeCrashDump(name string, v interface{}, stack []byte) (string, error) {
+	if err := os.MkdirAll(r.config.CrashDumpDir, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	file := fmt.Sprintf("crash-%s-%s.txt", now.Format("20060102T150405.000000000"), crashNameRe.ReplaceAllString(name, "_"))
+	path := filepath.Join(r.config.CrashDumpDir, file)
+	body := fmt.Sprintf("time: %s\ngoroutine: %s\npanic: %v\n\n%s", now.Format(time.RFC3339Nano), name, v, stack)
+	return path, os.WriteFile(path, []byte(body), 0o600)
+}
@@ -0,0 +1,99 @@
+package turnrelay
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRegBurst is how many registrations may arrive back to back before
+// RegRatePerConn / RegRatePerUser apply.
+const defaultRegBurst = 10
+
+// regBucket is a token bucket over registrations.
+type regBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take consumes one token at rate tokens/s with the given burst. If none is available it
+// returns how long until one will be.
+func (b *regBucket) take(rate float64, burst int, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// regLimits holds the per-user registration buckets.
+type regLimits struct {
+	mu    sync.Mutex
+	users map[string]*regBucket
+}
+
+func (l *regLimits) user(username string) *regBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.users == nil {
+		l.users = make(map[string]*regBucket)
+	}
+	b, ok := l.users[username]
+	if !ok {
+		b = &regBucket{}
+		l.users[username] = b
+	}
+	return b
+}
+
+// rateLimitExempt reports whether peer is in one of the RateLimitExempt networks.
+func (r *Relay) rateLimitExempt(peer net.Addr) bool {
+	ip := r.peerIP(peer)
+	for _, p := range r.config.RateLimitExempt {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRegRate charges one registration to the bot connection's bucket and to the bot
+// user's, and returns ErrSlowDown with a retry-after hint if either is empty. Registrations
+// from a RateLimitExempt network are not charged at all, so they cannot drain the user's
+// bucket for that user's other connections either.
+func (r *Relay) checkRegRate(conn *regBucket, username string, peer net.Addr) error {
+	if r.rateLimitExempt(peer) {
+		return nil
+	}
+	burst := r.config.RegBurst
+	if burst <= 0 {
+		burst = defaultRegBurst
+	}
+	now := time.Now()
+	ok, wait := true, time.Duration(0)
+	if rate := r.config.RegRatePerConn; rate > 0 {
+		ok, wait = conn.take(rate, burst, now)
+	}
+	if rate := r.config.RegRatePerUser; ok && rate > 0 {
+		ok, wait = r.regLimits.user(username).take(rate, burst, now)
+	}
+	if ok {
+		return nil
+	}
+	atomic.AddInt64(&r.metrics.regThrottled, 1)
+	return fmt.Errorf("%w: retry after %dms", ErrSlowDown, max(wait.Milliseconds(), 1))
+}
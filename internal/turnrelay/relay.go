@@ -1,62 +1,194 @@
 package turnrelay
 
 import (
-	"crypto/rand"
-	"crypto/subtle"
+	"context"
+	"crypto"
 	"crypto/tls"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/stats"
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+	"github.com/awgh/huzaa-relay/internal/turnrelay/bridge"
+	"github.com/awgh/huzaa-relay/internal/turnrelay/listener"
+	"github.com/awgh/huzaa-relay/internal/turnrelay/pool"
 )
 
 // Relay runs the TURN relay: DCC front-end and bot-facing TLS.
 type Relay struct {
 	config       *RelayConfig
-	users        userSecrets // username -> secret, built from TurnUsers; nil or empty = no auth
+	users        auth.Credentials // username -> secret, built from TurnUsers; nil or empty = no auth
+	policies     map[string]userPolicy
+	policiesMu   sync.RWMutex
 	sessions     map[string]*Session
 	sessionsMu   sync.RWMutex
-	portPool     *portPool
+	portPool     *pool.Ports
 	currentConns int32
-	maxSessions  int
+	maxSessions  int32 // atomic; see SetMaxSessions
+	fdSessions   int32 // atomic; sessions the open file limit supports, 0 = unknown (see fdBudget)
+	fdLimit      int64 // atomic; RLIMIT_NOFILE soft limit after fdBudget
+	metrics      relayMetrics
+	idempotency  *idempotencyCache
+	resumes      *resumePoints // interrupted downloads (MsgResume); nil = resume is off
+	health       *healthRegistry
+	debug        *debugLog
+	audit        *auditLog
+	adminHistory adminHistory
+	host         *hostResolver
+	stats        *stats.Store
+	singlePort   int // single-port mode: the TURNListen port, advertised for every session
+	reach        reachability
+	banner       *banner
+	certs        *certCache
+	usage        *quotaUsage     // per-user day and month quota counters, saved to QuotaFile
+	dccTLS       *tls.Config     // per-session DCC listener config, built once in Run
+	regLimits    regLimits       // per-user registration buckets (RegRatePerUser)
+	bandwidth    bandwidthShaper // relay-wide transfer rate cap (MaxBandwidthBps)
+	notified     notifyLimiter   // when each operator notification was last sent
+	readOnly     atomic.Bool     // refuse all but downloads; see SetReadOnly
+	traces       traceStore      // session traces started by TraceSession
+	keepalives   sync.Map        // net.Conn -> *botLiveness of bot connections pinged by keepBotAlive
+
+	interruptedMu sync.Mutex
+	interrupted   []InterruptedSession // sessions Shutdown ended, for InterruptedFile
+
+	// ctx is canceled when the relay stops; every handler and background loop watches it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// accepting is canceled when Shutdown starts; the listeners for new connections watch it.
+	accepting     context.Context
+	stopAccepting context.CancelFunc
+	stopped       chan struct{}  // closed when Shutdown returns
+	stopOnce      sync.Once      // Shutdown runs once; later and concurrent calls wait for it
+	stopErr       error          // what Shutdown returned
+	running       sync.WaitGroup // accept loops, connection handlers and background loops (spawn)
 }
 
 // TurnUserCred is one allowed bot credential for auth.
 type TurnUserCred struct {
-	Username string
-	Secret   string
+	Username    string
+	Secret      string
+	MaxLeaseSec int            // cap on an unclaimed allocation's lifetime including renewals; 0 = relay default
+	MaxRateBps  int64          // per-session transfer rate limit in bytes/s; 0 = unlimited (see BoostSession)
+	Schedules   []ScheduleRule // time windows with extra limits for this user, on top of RelayConfig.Schedules
+	ChainPeer   bool           // another relay chaining sessions here logs in as this user; only its registrations' hop counts are trusted
+
+	MaxSessionsPerDay   int64 // sessions this user may register per UTC day; 0 = unlimited
+	MaxBytesPerDay      int64 // bytes this user's finished sessions may move per UTC day; 0 = unlimited
+	MaxSessionsPerMonth int64 // sessions this user may register per UTC calendar month; 0 = unlimited
+	MaxBytesPerMonth    int64 // bytes this user's finished sessions may move per UTC calendar month; 0 = unlimited
 }
 
 // RelayConfig is the relay configuration used by turnrelay.
 type RelayConfig struct {
-	TURNListen  string
-	TURNSecret  string
-	TurnUsers   []TurnUserCred // allowed username -> secret (lookup built in NewRelay)
-	DCCPortMin  int
-	DCCPortMax  int
-	RelayHost   string
-	TLSCertFile string
-	TLSKeyFile  string
-	MaxSessions int
-}
+	TURNListen            string
+	TURNSecret            string
+	TurnUsers             []TurnUserCred // allowed username -> secret (lookup built in NewRelay)
+	DCCPortMin            int
+	DCCPortMax            int
+	RelayHost             string
+	TLSCertFile           string        // PEM certificate chain, or a PKCS#12 bundle with the key (TLSKeyFile is then unused)
+	TLSKeyFile            string        // PEM key, optionally encrypted
+	TLSKeyPassphrase      []byte        // decrypts an encrypted TLSKeyFile or PKCS#12 TLSCertFile
+	TLSSigner             crypto.Signer // private key held outside the process (PKCS#11 token); TLSCertFile is then a PEM chain and TLSKeyFile is unused
+	MaxSessions           int
+	MaxBandwidthBps       int64           // relay-wide transfer rate cap in bytes/s, shared fairly by active sessions; 0 = unlimited
+	MaxFileSize           int64           // largest file a session may carry, declared (Registration.Size) or not; 0 = unlimited
+	ReadOnly              bool            // start in read-only mode: refuse upload and forward registrations; see SetReadOnly
+	CrashDumpDir          string          // if set, recovered panics are also written here as crash-*.txt
+	Debug                 bool            // debug logging at startup (also enabled by RELAY_DEBUG); see SetDebug
+	DebugEvery            int             // log every Nth per-frame/progress debug event per session (<= 1 = all)
+	DebugPerSec           int             // at most N per-frame/progress debug lines per second per session (0 = unlimited)
+	AuditLog              io.Writer       // if set, session lifecycle events are written here as JSON lines
+	IdempotencyWindowSec  int             // how long registration idempotency keys are remembered; default 300
+	ResumeWindowSec       int             // how long an interrupted download can be resumed (MsgResume); default 600, negative = off
+	InterruptedFile       string          // if set, Shutdown writes the sessions it ended here (see ReadInterrupted); read back at startup for MsgResume
+	DCCLeaseSec           int             // unclaimed allocations expire after this long unless renewed; 0 = never
+	MaxLeaseSec           int             // default cap on an allocation's lifetime including renewals; default 3600
+	MetricsListen         string          // if set, Prometheus metrics are served at http://<addr>/metrics
+	StatusListen          string          // if set, an unauthenticated status page (PublicStatus) is served at http://<addr>/
+	AdminListen           string          // if set, the admin API is served at https://<addr>/ (see serveAdmin); needs AdminUsers
+	AdminUsers            []AdminUser     // basic-auth credentials for the admin API
+	SlowConsumerPolicy    string          // "warn", "throttle" or "abort"; empty = no slow-consumer detection
+	SlowConsumerThreshold int             // buffer occupancy percent that counts as lagging; default 90
+	SlowConsumerGraceSec  int             // how long a session may lag before the policy applies; default 30
+	SessionIdleTimeoutSec int             // end a connected session that moves no data this long; 0 = never
+	SessionMaxDurationSec int             // end any session this long after registration; 0 = never
+	MaxFanout             int             // DCC users one download may be streamed to at once (Registration.Fanout); 0 = no fan-out
+	FanoutWaitSec         int             // how long a fan-out session waits for more users after the first; default 10
+	RelayHostTTLSec       int             // re-resolve a DNS RelayHost this often; default 300
+	DDNS                  *DDNSConfig     // if set, keep a DNS record pointed at the detected public IP
+	PublicIPDetect        string          // "stun" or "https": if RelayHost is empty, detect the public IP at startup and advertise it
+	PublicIPSTUNServer    string          // STUN server host:port for PublicIPDetect "stun"; default stun.l.google.com:19302
+	PublicIPEchoURL       string          // HTTPS echo endpoint for PublicIPDetect "https"; default api.ipify.org
+	Transform             StreamTransform // optional rewrite of download streams on the user leg (embedders only)
+	BotAcceptLimit        int             // max bot connection handlers running at once; beyond it connections wait in the accept queue (0 = no limit)
+	StatsFile             string          // if set, per-user daily transfer statistics are kept in this JSON file
+	StatsRetentionDays    int             // how long daily statistics are kept; default 400
+	QuotaFile             string          // if set, the per-user quota counters are saved here and survive restarts
+	DCCSNIListen          string          // if set, one TLS port where users reach any session by SNI <token>.<DCCSNIDomain>
+	DCCSNIDomain          string          // parent domain of the SNI session names (needs a wildcard certificate)
+	SinglePort            bool            // users also connect to TURNListen, routed by SNI like DCCSNIListen; no DCC port range is used
+	Banner                string          // operator notice sent to bots as MsgBanner after auth; see SetBanner
+	BannerFile            string          // if set, the banner is read from this file and re-read when it changes (overrides Banner)
+	Schedules             []ScheduleRule  // time windows with limits for all users (see TurnUserCred.Schedules)
+	ScheduleLocation      *time.Location  // time zone of schedule windows; nil = local time
+	NAT64Prefixes         []netip.Prefix  // /96 NAT64 prefixes mapped back to IPv4 for logs and policy; nil = 64:ff9b::/96
+	StatsRedactPeer       bool            // report only the /24 (IPv4) or /48 (IPv6) of the user's address in MsgStats
+	PostHooks             []PostHook      // commands or URLs run after a transfer completes (see PostHook)
+	PreRegister           *PreHook        // asks an external service to approve, rename or cap each registration before a port is allocated
+	Notifiers             []Notifier      // webhooks paged about critical events (see Notifier)
+	PreflightStrict       bool            // refuse to start when a startup check fails (DCC ports not bindable, relay_host unresolvable, open file limit too low)
+	UserKeepAliveSec      int             // TCP keepalive period on user connections; default 15, negative = off
+	UserTCPTimeoutSec     int             // Linux TCP_USER_TIMEOUT on user connections (unacknowledged data); default 45, negative = off
+	UserWriteTimeoutSec   int             // a write to a user stalled this long fails the session; default 60, negative = off
+	BotKeepAliveSec       int             // MsgPing bots with a session this often; silent for 3 intervals = gone; 0 = off
+	RegRatePerConn        float64         // registrations per second one bot connection may make; 0 = unlimited
+	RegRatePerUser        float64         // registrations per second one bot user may make across connections; 0 = unlimited
+	RegBurst              int             // registrations allowed back to back before the rates apply; default 10
+	RateLimitExempt       []netip.Prefix  // bot networks (monitoring, co-located bots) exempt from the registration rate limits
+	IntegritySampleEvery  int             // CRC every Nth 64 KiB block of a session on both legs and compare them at close; 0 = off
+	PortCooldownSec       int             // a released DCC port is not reused for this long; default 10, negative = off
+	ChainRelays           []ChainRelay    // relays that sessions can be chained through (Registration.Via)
+	MaxChainHops          int             // relay-to-relay links a chained session may pass through; default 2
 
-// userSecrets maps username -> secret for constant-time lookup (built from TurnUsers).
-type userSecrets map[string]string
+	// Protocols adds ALPN protocols served on TURNListen besides ALPNFrames (embedders only).
+	Protocols map[string]ProtocolHandler
+}
 
 func NewRelay(c *RelayConfig) (*Relay, error) {
-	pool, err := newPortPool(c.DCCPortMin, c.DCCPortMax)
-	if err != nil {
-		return nil, err
+	var ports *pool.Ports
+	if !c.SinglePort {
+		var err error
+		if ports, err = pool.New(c.DCCPortMin, c.DCCPortMax); err != nil {
+			return nil, err
+		}
+		listeners, err := listenPorts(c)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPortRange(c.DCCPortMin, c.DCCPortMax, listeners); err != nil {
+			return nil, err
+		}
+		// SetPortRange may still move the range over them; allocation skips them then.
+		for _, l := range listeners {
+			ports.Reserve(l.port)
+		}
+		ports.SetCooldown(portCooldown(c.PortCooldownSec))
 	}
 	maxSessions := c.MaxSessions
 	if maxSessions <= 0 {
 		maxSessions = 100
 	}
-	users := make(userSecrets)
+	users := make(auth.Credentials)
 	for _, u := range c.TurnUsers {
 		if u.Username != "" {
 			users[u.Username] = u.Secret
@@ -65,158 +197,362 @@ func NewRelay(c *RelayConfig) (*Relay, error) {
 	if len(users) == 0 {
 		log.Printf("relay: warning: no turn_users defined, all auth will fail")
 	}
-	return &Relay{
-		config:      c,
-		users:       users,
-		sessions:    make(map[string]*Session),
-		portPool:    pool,
-		maxSessions: maxSessions,
-	}, nil
+	idempotencyWindow := 5 * time.Minute
+	if c.IdempotencyWindowSec > 0 {
+		idempotencyWindow = time.Duration(c.IdempotencyWindowSec) * time.Second
+	}
+	var resumes *resumePoints
+	if c.ResumeWindowSec >= 0 {
+		resumeWindow := defaultResumeWindow
+		if c.ResumeWindowSec > 0 {
+			resumeWindow = time.Duration(c.ResumeWindowSec) * time.Second
+		}
+		resumes = newResumePoints(resumeWindow)
+	}
+	st, err := openStats(c)
+	if err != nil {
+		return nil, fmt.Errorf("open stats: %w", err)
+	}
+	usage, err := openQuotaUsage(c.QuotaFile)
+	if err != nil {
+		return nil, fmt.Errorf("open quota file: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	accepting, stopAccepting := context.WithCancel(ctx)
+	r := &Relay{
+		stats:         st,
+		usage:         usage,
+		ctx:           ctx,
+		cancel:        cancel,
+		accepting:     accepting,
+		stopAccepting: stopAccepting,
+		stopped:       make(chan struct{}),
+		config:        c,
+		users:         users,
+		policies:      buildPolicies(c.TurnUsers),
+		sessions:      make(map[string]*Session),
+		portPool:      ports,
+		maxSessions:   int32(maxSessions),
+		health:        newHealthRegistry(),
+		debug:         newDebugLog(c.Debug || os.Getenv("RELAY_DEBUG") != "", c.DebugEvery, c.DebugPerSec),
+		audit:         &auditLog{w: c.AuditLog},
+		idempotency:   newIdempotencyCache(idempotencyWindow),
+		resumes:       resumes,
+		banner:        &banner{text: c.Banner, path: c.BannerFile},
+		bandwidth:     bandwidthShaper{rate: c.MaxBandwidthBps},
+		certs:         &certCache{certFile: c.TLSCertFile, keyFile: c.TLSKeyFile, passphrase: c.TLSKeyPassphrase, signer: c.TLSSigner},
+		host:          newHostResolver(c.RelayHost, time.Duration(c.RelayHostTTLSec)*time.Second),
+	}
+	r.readOnly.Store(c.ReadOnly)
+	return r, nil
 }
 
-func (r *Relay) Run() error {
+// Run starts the listeners and background loops and returns; they run until Shutdown. If
+// it fails, whatever it started is stopped again. See RunContext for a blocking variant
+// that also reports listeners failing later.
+func (r *Relay) Run() (err error) {
+	defer func() {
+		if err != nil {
+			r.cancel()
+			if len(r.config.Notifiers) > 0 {
+				r.notifyStartupFailed(err)
+			}
+		}
+	}()
 	tlsConfig, err := r.tlsConfig()
 	if err != nil {
 		return err
 	}
-	turnLn, err := tls.Listen("tcp", r.config.TURNListen, tlsConfig)
+	r.dccTLS = tlsConfig
+	if err := r.preflight(); err != nil {
+		return err
+	}
+	botTLS := tlsConfig.Clone()
+	botTLS.NextProtos = r.botNextProtos()
+	if r.config.SinglePort {
+		if r.config.DCCSNIDomain == "" {
+			return errors.New("single_port needs dcc_sni_domain")
+		}
+		botTLS.GetConfigForClient = r.checkSNI(false)
+	}
+	turnLn, err := tls.Listen("tcp", r.config.TURNListen, botTLS)
 	if err != nil {
 		return fmt.Errorf("turns listen: %w", err)
 	}
-	go r.acceptBotConnections(turnLn)
-	go r.acceptDCCConnections(tlsConfig)
+	r.singlePort = turnLn.Addr().(*net.TCPAddr).Port
+	if r.config.RelayHost == "" && r.config.PublicIPDetect != "" {
+		ip, err := r.detectPublicIP()
+		if err != nil {
+			turnLn.Close()
+			return fmt.Errorf("detect public IP: %w", err)
+		}
+		log.Printf("relay: relay_host not set, advertising detected public IP %s", ip)
+		r.config.RelayHost = ip.String()
+		r.host = newHostResolver(ip.String(), r.host.ttl)
+	}
+	r.loadInterrupted()
+	r.spawn(func() { r.acceptBotConnections(turnLn) })
+	if r.config.DCCSNIListen != "" {
+		if err := r.listenSNI(tlsConfig); err != nil {
+			return err
+		}
+	}
+	r.health.onProblem = func(name, problem string) { r.notify(NotifyHealth, name, "watchdog: "+problem) }
+	r.spawn(r.watchdog)
+	if len(r.config.Notifiers) > 0 {
+		r.spawn(r.watchOperatorEvents)
+	}
+	if r.host.isName() {
+		r.host.resolve(r.ctx)
+		h := r.health.register("relay_host resolver", 3*r.host.ttl)
+		r.spawn(func() { r.host.refreshLoop(r.ctx, h) })
+	}
+	if r.config.SlowConsumerPolicy != "" {
+		r.spawn(r.monitorSlowConsumers)
+	}
+	if r.config.SessionIdleTimeoutSec > 0 || r.config.SessionMaxDurationSec > 0 {
+		r.spawn(r.reapSessions)
+	}
+	if r.stats != nil {
+		r.spawn(r.flushStats)
+	}
+	if r.config.QuotaFile != "" {
+		r.spawn(r.saveQuotaUsage)
+	}
+	if r.hasSchedules() {
+		r.spawn(r.enforceSchedules)
+	}
+	if d := r.config.DDNS; d != nil {
+		if d.Hostname == "" {
+			d.Hostname = r.config.RelayHost
+		}
+		p, err := newDDNSProvider(d)
+		if err != nil {
+			return err
+		}
+		r.spawn(func() { r.runDDNS(d, p) })
+	}
+	if r.config.MetricsListen != "" {
+		if err := r.serveMetrics(); err != nil {
+			return err
+		}
+	}
+	if r.config.StatusListen != "" {
+		if err := r.serveStatus(); err != nil {
+			return err
+		}
+	}
+	if r.config.AdminListen != "" {
+		if err := r.serveAdmin(); err != nil {
+			return err
+		}
+	}
 	log.Printf("relay: TURN listening on %s", r.config.TURNListen)
 	return nil
 }
 
+// tlsConfig loads the certificate and builds the TLS configuration shared by all listeners.
+// It is built once in Run; the certificate itself is reloaded by certs when it changes.
 func (r *Relay) tlsConfig() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(r.config.TLSCertFile, r.config.TLSKeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("load TLS: %w", err)
+	if err := r.certs.load(); err != nil {
+		return nil, err
 	}
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+		GetCertificate: r.certs.get,
+		MinVersion:     tls.VersionTLS12,
 	}, nil
 }
 
 func (r *Relay) acceptBotConnections(ln net.Listener) {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Printf("relay: accept bot: %v", err)
-			return
-		}
-		go r.handleBotConnection(conn.(*tls.Conn))
+	h := r.health.register("bot accept loop", 0)
+	// Connections already accepted outlive the listener until the relay stops (Shutdown).
+	err := listener.Serve(r.accepting, ln, func(_ context.Context, conn net.Conn) {
+		r.dispatchBotConnection(r.ctx, conn.(*tls.Conn))
+	}, listener.Options{
+		MaxInFlight:   r.config.BotAcceptLimit,
+		OnAccept:      h.beat,
+		OnSaturated:   func() { atomic.AddInt64(&r.metrics.acceptSaturated, 1) },
+		OnFDExhausted: r.fdExhausted,
+		Handlers:      &r.running,
+	})
+	if r.draining() {
+		h.stop()
+		return
 	}
+	log.Printf("relay: accept bot: %v", err)
+	h.exit(err)
 }
 
-func (r *Relay) acceptDCCConnections(tlsConfig *tls.Config) {
-	_ = tlsConfig
-	select {}
-}
-
-func (r *Relay) handleBotConnection(conn *tls.Conn) {
+func (r *Relay) handleBotConnection(ctx context.Context, conn *tls.Conn) {
 	defer conn.Close()
-	if n := atomic.AddInt32(&r.currentConns, 1); n > int32(r.maxSessions) {
+	// An expired deadline fails every pending and future read/write on conn, so all the
+	// loops below return once ctx ends.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	defer r.recoverPanic("bot connection "+r.peerString(conn.RemoteAddr()), nil)
+	if n := atomic.AddInt32(&r.currentConns, 1); n > atomic.LoadInt32(&r.maxSessions) {
 		atomic.AddInt32(&r.currentConns, -1)
+		_ = r.writeFrame(conn, MsgError, []byte(ErrRelayFull.Error()))
 		return
 	}
 	defer atomic.AddInt32(&r.currentConns, -1)
 
-	// First frame must be MsgAuth.
-	msgType, payload, err := ReadFrame(conn)
+	username, secret, nonce, err := r.authenticate(conn)
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("relay: bot frame read: %v", err)
+			r.debug.printf("relay: bot %s: %v", r.peerString(conn.RemoteAddr()), err)
 		}
 		return
 	}
-	if msgType != MsgAuth {
-		_ = WriteFrame(conn, MsgError, []byte("auth required"))
-		return
-	}
-	// Payload: 4-byte username length (big-endian), then username, then secret.
-	if len(payload) < 4 {
-		_ = WriteFrame(conn, MsgError, []byte("auth failed"))
-		return
-	}
-	unLen := binary.BigEndian.Uint32(payload[:4])
-	if unLen == 0 || uint32(len(payload)) < 4+unLen || unLen > 256 {
-		_ = WriteFrame(conn, MsgError, []byte("auth failed"))
-		return
-	}
-	username := string(payload[4 : 4+unLen])
-	secret := payload[4+unLen:]
-	expectedSecret, ok := r.users[username]
-	if !ok || subtle.ConstantTimeCompare([]byte(expectedSecret), secret) != 1 {
-		_ = WriteFrame(conn, MsgError, []byte("auth failed"))
-		return
-	}
-	if err := WriteFrame(conn, MsgAuthOk, nil); err != nil {
+	if err := r.sendBanner(conn); err != nil {
 		return
 	}
 
+	var connRegs regBucket
 	for {
-		msgType, payload, err := ReadFrame(conn)
+		msgType, payload, err := r.readFrame(conn)
 		if err != nil {
+			replyFrameError(err, func(t byte, p []byte) error { return r.writeFrame(conn, t, p) })
 			if err != io.EOF {
 				log.Printf("relay: bot frame read: %v", err)
 			}
 			return
 		}
 		switch msgType {
-		case MsgRegisterDownload:
-			if len(payload) < 4 {
-				_ = WriteFrame(conn, MsgError, []byte("bad RegisterDownload"))
+		case MsgRegisterDownload, MsgRegisterUpload, MsgRegisterForward:
+			kind, msgName := "download", "RegisterDownload"
+			switch msgType {
+			case MsgRegisterUpload:
+				kind, msgName = "upload", "RegisterUpload"
+			case MsgRegisterForward:
+				kind, msgName = "forward", "RegisterForward"
+			}
+			reg, err := ParseRegistration(payload)
+			if err != nil {
+				r.metrics.malformed()
+				_ = r.writeFrame(conn, MsgError, []byte("bad "+msgName))
 				continue
 			}
-			sessionID := string(payload[:min(36, len(payload))])
-			filename := ""
-			if len(payload) > 36 {
-				filename = string(payload[36:])
+			if err := r.checkRegRate(&connRegs, username, conn.RemoteAddr()); err != nil {
+				_ = r.writeFrame(conn, MsgError, []byte(err.Error()))
+				continue
 			}
-			port, err := r.allocateDCCPort(sessionID, "download", filename)
+			sess, err := r.registerSession(ctx, username, kind, reg)
 			if err != nil {
-				_ = WriteFrame(conn, MsgError, []byte(err.Error()))
+				_ = r.writeFrame(conn, MsgError, []byte(err.Error()))
 				continue
 			}
-			resp := make([]byte, 4)
-			binary.BigEndian.PutUint32(resp, uint32(port))
-			if err := WriteFrame(conn, MsgPortAlloc, resp); err != nil {
-				return
-			}
-			r.relayDownloadToUser(conn, sessionID)
+			r.serveBotSession(ctx, conn, username, sess, DeriveSessionKey(secret, nonce, reg.SessionID))
 			return
-		case MsgRegisterUpload:
-			if len(payload) < 4 {
-				_ = WriteFrame(conn, MsgError, []byte("bad RegisterUpload"))
+		case MsgResume:
+			res, err := ParseResume(payload)
+			if err != nil {
+				r.metrics.malformed()
+				_ = r.writeFrame(conn, MsgError, []byte("bad Resume"))
 				continue
 			}
-			sessionID := string(payload[:min(36, len(payload))])
-			filename := ""
-			if len(payload) > 36 {
-				filename = string(payload[36:])
+			if err := r.checkRegRate(&connRegs, username, conn.RemoteAddr()); err != nil {
+				_ = r.writeFrame(conn, MsgError, []byte(err.Error()))
+				continue
 			}
-			port, err := r.allocateDCCPort(sessionID, "upload", filename)
+			sess, err := r.resumeSession(ctx, username, res)
 			if err != nil {
-				_ = WriteFrame(conn, MsgError, []byte(err.Error()))
+				_ = r.writeFrame(conn, MsgError, []byte(err.Error()))
 				continue
 			}
-			resp := make([]byte, 4)
-			binary.BigEndian.PutUint32(resp, uint32(port))
-			if err := WriteFrame(conn, MsgPortAlloc, resp); err != nil {
+			r.serveBotSession(ctx, conn, username, sess, DeriveSessionKey(secret, nonce, res.SessionID))
+			return
+		case MsgProbe:
+			res := r.probe(username, ParseProbeRequest(payload))
+			if err := r.writeFrame(conn, MsgProbeResult, res.Marshal()); err != nil {
+				return
+			}
+		case MsgServerInfo:
+			if err := r.writeFrame(conn, MsgServerInfo, serverInfo().Marshal()); err != nil {
 				return
 			}
-			r.relayUploadFromUser(conn, sessionID)
+		case MsgAttach:
+			sess, err := r.attachPeerBot(username, string(payload))
+			if err != nil {
+				_ = r.writeFrame(conn, MsgError, []byte(err.Error()))
+				continue
+			}
+			r.servePeerBot(ctx, conn, sess)
 			return
 		default:
-			_ = WriteFrame(conn, MsgError, []byte("unknown message type"))
+			r.metrics.malformed()
+			_ = r.writeFrame(conn, MsgError, []byte("unknown message type"))
 			return
 		}
 	}
 }
 
+// serveBotSession sends the allocation of the newly registered sess to the bot on conn,
+// relays the session's data and finally its MsgStats. macKey is the session key derived
+// from conn's auth nonce.
+func (r *Relay) serveBotSession(ctx context.Context, conn *tls.Conn, username string, sess *Session, macKey []byte) {
+	detach := sess.attachBot(conn, r.peerString(conn.RemoteAddr()), macKey)
+	r.startLease(sess)
+	defer r.keepBotAlive(conn, sess, func(t byte, p []byte) error { return sess.writeBotOn(conn, t, p) })()
+	if err := sess.writeBot(MsgPortAlloc, r.portAllocPayload(sess, conn.RemoteAddr())); err != nil {
+		if !sess.detached(detach) {
+			sess.setCloseReason(CloseBotError)
+			r.removeSession(sess.ID)
+		}
+		return
+	}
+	switch sess.Kind {
+	case "download":
+		r.relayDownloadToUser(conn, username, sess, detach)
+	case "forward":
+		r.relayForwardBot(conn, username, sess, detach)
+	default:
+		r.relayUploadFromUser(conn, username, sess, detach)
+	}
+	r.sendSessionStats(ctx, sess, detach)
+}
+
+// authenticate reads the first frame, which must be MsgAuth, checks the credential and
+// replies MsgAuthOk with a fresh nonce (bot and relay derive per-session MAC keys from it)
+// or MsgError. Credential failures wrap ErrAuthFailed.
+func (r *Relay) authenticate(conn net.Conn) (username string, secret, nonce []byte, err error) {
+	msgType, payload, err := r.readFrame(conn)
+	if err != nil {
+		replyFrameError(err, func(t byte, p []byte) error { return r.writeFrame(conn, t, p) })
+		if err != io.EOF {
+			log.Printf("relay: bot frame read: %v", err)
+		}
+		return "", nil, nil, err
+	}
+	if msgType != MsgAuth {
+		r.metrics.malformed()
+		_ = r.writeFrame(conn, MsgError, []byte("auth required"))
+		return "", nil, nil, fmt.Errorf("%w: first frame is %s, not auth", ErrAuthFailed, MsgTypeName(msgType))
+	}
+	username, secret, err = auth.ParseRequest(payload)
+	if err != nil {
+		r.metrics.malformed()
+		_ = r.writeFrame(conn, MsgError, []byte(ErrAuthFailed.Error()))
+		return "", nil, nil, fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	if !r.users.Verify(username, secret) {
+		_ = r.writeFrame(conn, MsgError, []byte(ErrAuthFailed.Error()))
+		return "", nil, nil, fmt.Errorf("%w: user %q", ErrAuthFailed, username)
+	}
+	if nonce, err = auth.NewNonce(); err != nil {
+		_ = r.writeFrame(conn, MsgError, []byte("internal error"))
+		return "", nil, nil, fmt.Errorf("auth nonce: %w", err)
+	}
+	reply := AuthOk{Nonce: nonce}
+	if q, ok := r.quota(username); ok {
+		reply.Quota = &q
+	}
+	if err := r.writeFrame(conn, MsgAuthOk, reply.Marshal()); err != nil {
+		return "", nil, nil, err
+	}
+	return username, secret, nonce, nil
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -224,158 +560,412 @@ func min(a, b int) int {
 	return b
 }
 
-func (r *Relay) allocateDCCPort(sessionID, kind, filename string) (int, error) {
-	port, err := r.portPool.allocate()
+// registerSession allocates a session for reg, or returns the existing one when reg repeats
+// an idempotency key seen from the same bot user within the window.
+func (r *Relay) registerSession(ctx context.Context, username, kind string, reg Registration) (*Session, error) {
+	if r.draining() {
+		return nil, ErrShuttingDown
+	}
+	if err := r.checkReadOnly(kind); err != nil {
+		return nil, err
+	}
+	if err := r.checkSchedule(username, kind); err != nil {
+		return nil, err
+	}
+	if !r.policy(username).ChainPeer {
+		reg.Hops = 0 // only a chain relay can say how far a registration has come
+	}
+	if err := r.checkHops(reg); err != nil {
+		return nil, err
+	}
+	if err := r.checkFanout(kind, reg); err != nil {
+		return nil, err
+	}
+	if err := checkChecksum(kind, reg); err != nil {
+		return nil, err
+	}
+	if err := r.checkFileSize(kind, reg); err != nil {
+		return nil, err
+	}
+	if err := r.checkQuota(username); err != nil {
+		return nil, err
+	}
+	if reg.IdempotencyKey == "" {
+		return r.newSession(ctx, username, kind, reg)
+	}
+	key := username + "\x00" + reg.IdempotencyKey
+	if sessionID, ok := r.idempotency.lookup(key); ok {
+		r.sessionsMu.RLock()
+		sess, ok := r.sessions[sessionID]
+		r.sessionsMu.RUnlock()
+		if ok && sess.Kind == kind {
+			// Only a session that has not moved data can be handed to the retrying
+			// connection; otherwise the retry would duplicate bytes already relayed.
+			if sess.State() >= StateStreaming {
+				return nil, fmt.Errorf("%w: session %s already in progress", ErrDuplicateSession, sessionID)
+			}
+			// The running checksum was set up for the first registration.
+			if sess.sum.algorithm() != reg.Checksum {
+				return nil, fmt.Errorf("%w: retry of session %s changes its checksum", ErrDuplicateSession, sessionID)
+			}
+			log.Printf("relay: idempotent retry for %s, reusing port %d", sess, sess.Port)
+			return sess, nil
+		}
+	}
+	sess, err := r.newSession(ctx, username, kind, reg)
+	if err != nil {
+		return nil, err
+	}
+	r.idempotency.store(key, sess.ID)
+	return sess, nil
+}
+
+// newSession runs the pre-registration hook, then allocates a port and applies the bot
+// user's policy to the new session.
+func (r *Relay) newSession(ctx context.Context, username, kind string, reg Registration) (*Session, error) {
+	// An idempotent retry never gets here (registerSession hands it the session), so this
+	// is another registration, possibly of another bot user, reusing a live ID. It is
+	// refused before the hook runs or a port is taken.
+	if _, err := r.lookupSession(reg.SessionID); err == nil {
+		return nil, fmt.Errorf("%w: session %s is already registered", ErrDuplicateSession, reg.SessionID)
+	}
+	approval, err := r.preRegister(ctx, username, kind, reg)
+	if err != nil {
+		return nil, err
+	}
+	if approval.Filename != "" {
+		reg.Filename = approval.Filename
+	}
+	sess, err := r.allocateDCCPort(ctx, username, kind, reg)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	sess.maxBytes, sess.renamed = approval.MaxBytes, approval.Filename
+	sess.size = reg.Size
+	r.applyUserPolicy(username, sess)
+	if reg.Via != "" {
+		if err := r.chain(ctx, sess, reg); err != nil {
+			sess.setCloseReason(CloseUserError)
+			r.removeSession(sess.ID)
+			return nil, err
+		}
 	}
-	sess := NewSession(sessionID, kind, filename, port)
+	return sess, nil
+}
+
+// allocateDCCPort registers a session for reg and opens its DCC port. Bot-to-bot and
+// chained sessions get neither a port nor an SNI token; a peer bot or chain relay takes
+// their user side.
+func (r *Relay) allocateDCCPort(ctx context.Context, username, kind string, reg Registration) (*Session, error) {
+	sessionID := reg.SessionID
+	noPort := reg.PeerBot != "" || reg.Via != ""
+	var token string
+	if r.sniRouting() && !noPort {
+		var err error
+		if token, err = newSessionToken(); err != nil {
+			return nil, fmt.Errorf("session token: %w", err)
+		}
+	}
+	port := r.singlePort
+	if noPort {
+		port = 0
+	} else if !r.config.SinglePort {
+		var err error
+		if port, err = r.portPool.Allocate(); err != nil {
+			return nil, err
+		}
+	}
+	sess := NewSession(sessionID, kind, reg.Filename, port)
+	sess.Token = token
+	sess.owner = username
+	sess.peerBot = reg.PeerBot
+	sess.metrics = &r.metrics
+	if reg.Fanout > 1 {
+		sess.fan = newFanout(reg.Fanout)
+	}
+	sess.sum = newStreamSum(reg.Checksum)
+	// The user leg of a transformed or fanned-out download cannot be compared with the bot's.
+	sess.integrity = newIntegrityCheck(r.config.IntegritySampleEvery, kind == "download" && (r.config.Transform != nil || sess.fan != nil))
+	// Done is tied to ctx, so every select on it also ends when the relay stops.
+	sess.stopCtx = context.AfterFunc(ctx, func() {
+		sess.setCloseReason(CloseAdminKill)
+		sess.Close()
+	})
 	r.sessionsMu.Lock()
+	if _, ok := r.sessions[sessionID]; ok {
+		// Another registration of the same new ID got in since newSession checked.
+		r.sessionsMu.Unlock()
+		sess.stopCtx()
+		if port > 0 && !r.config.SinglePort {
+			r.portPool.Release(port)
+		}
+		return nil, fmt.Errorf("%w: session %s is already registered", ErrDuplicateSession, sessionID)
+	}
 	r.sessions[sessionID] = sess
 	r.sessionsMu.Unlock()
-	tlsConfig, _ := r.tlsConfig()
-	ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), tlsConfig)
-	if err != nil {
-		r.portPool.release(port)
-		r.sessionsMu.Lock()
-		delete(r.sessions, sessionID)
-		r.sessionsMu.Unlock()
-		return 0, err
+	var ln net.Listener
+	if !r.config.SinglePort && port > 0 {
+		var err error
+		// On Unix, Go listeners set SO_REUSEADDR, so connections of the port's previous
+		// session still in TIME_WAIT do not block this bind. Windows has no safe
+		// equivalent; the pool's cooldown (PortCooldownSec) covers it there.
+		if ln, err = tls.Listen("tcp", fmt.Sprintf(":%d", port), r.dccTLS); err != nil {
+			sess.stopCtx()
+			r.portPool.Release(port)
+			r.sessionsMu.Lock()
+			delete(r.sessions, sessionID)
+			r.sessionsMu.Unlock()
+			return nil, fmt.Errorf("dcc listen on port %d: %w", port, err)
+		}
 	}
-	go r.listenDCCForSession(ln, sessionID)
-	return port, nil
+	sess.advance(StateAllocated)
+	r.usage.addSession(username)
+	r.audit.record(sessionEvent("session_open", sess))
+	if ln != nil {
+		r.spawn(func() { r.listenDCCForSession(ln, sessionID) })
+	}
+	return sess, nil
 }
 
 func (r *Relay) listenDCCForSession(ln net.Listener, sessionID string) {
 	defer ln.Close()
-	conn, err := ln.Accept()
+	defer r.recoverPanic("dcc session "+sessionID, func() { r.removeSession(sessionID) })
+	sess, err := r.lookupSession(sessionID)
 	if err != nil {
-		r.removeSession(sessionID)
+		r.debug.printf("relay: dcc listener: %v", err)
 		return
 	}
-	defer conn.Close()
-	r.sessionsMu.RLock()
-	sess, ok := r.sessions[sessionID]
-	r.sessionsMu.RUnlock()
-	if !ok {
+	if sess.fan != nil {
+		r.acceptFanout(ln, sess)
 		return
 	}
-	if sess.Kind == "download" {
-		dest := io.Writer(conn)
-		var cw *countWriter
-		if os.Getenv("RELAY_DEBUG") != "" {
-			cw = &countWriter{w: conn, sessionID: sessionID}
-			dest = cw
+	// Closing the session, or a user claiming it through DCCSNIListen, unblocks Accept.
+	go func() {
+		select {
+		case <-sess.Done:
+		case <-sess.claimed:
 		}
-		n, err := io.Copy(dest, &ChanReader{Ch: sess.BotStream})
-		if cw != nil {
-			log.Printf("[debug] relay download to user session=%s total_written=%d copy_n=%d copy_err=%v", sessionID, cw.n, n, err)
+		ln.Close()
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		if !sess.isClaimed() {
+			r.removeSession(sessionID)
 		}
-		sess.Close()
-	} else {
-		buf := make([]byte, 32*1024)
-		for {
-			n, err := conn.Read(buf)
-			if n > 0 {
-				select {
-				case sess.UserConn <- buf[:n:n]:
-				case <-sess.Done:
-					return
-				}
+		return
+	}
+	if !sess.claim() {
+		conn.Close()
+		return
+	}
+	r.serveDCCUser(conn, sess)
+}
+
+// serveDCCUser relays between sess and the user connection that claimed it, whichever
+// listener accepted it.
+func (r *Relay) serveDCCUser(conn net.Conn, sess *Session) {
+	sessionID := sess.ID
+	defer conn.Close()
+	r.reach.observe(conn.LocalAddr())
+	sess.setPeer(r.peerIP(conn.RemoteAddr()))
+	// Peer bots and chain relays confirm a finished download (peerConn.finish).
+	fin, _ := conn.(interface{ finish() error })
+	conn = r.wrapUserConn(conn, sess)
+	// Closing the session unblocks any pending user read/write.
+	go func() {
+		<-sess.Done
+		conn.Close()
+	}()
+	if sess.Kind == "download" {
+		// The user side is the last reader of BotStream, so it tears the session down.
+		defer r.removeSession(sessionID)
+		cw := r.userWriter(conn, sess)
+		var dst io.Writer = cw
+		var tw io.WriteCloser
+		if t := r.config.Transform; t != nil {
+			if tw = t.Wrap(TransformInfo{SessionID: sessionID, Filename: sess.Filename}, cw); tw != nil {
+				dst = tw
 			}
-			if err != nil {
-				close(sess.UserConn)
-				sess.Close()
-				return
+		}
+		n, err := io.Copy(dst, &bridge.ChanReader{Ch: sess.BotStream, Done: sess.Done})
+		if tw != nil && err == nil {
+			if err = tw.Close(); err != nil {
+				log.Printf("relay: transform %s: %v", sess, err)
 			}
 		}
+		if fin != nil && err == nil {
+			err = fin.finish()
+		}
+		if err == nil {
+			sess.completed.Store(true)
+		} else {
+			sess.setCloseReason(CloseUserError)
+		}
+		r.noteResumePoint(sess)
+		r.debug.sessionf(sess, "relay download to user session=%s user=%s total_written=%d copy_n=%d copy_err=%v", sessionID, sess.owner, cw.N, n, err)
+	} else if sess.Kind == "forward" {
+		r.forwardUser(conn, sess)
+	} else {
+		r.readUserInto(conn, sess)
 	}
 }
 
-// countWriter wraps an io.Writer and counts bytes; logs progress every 10KB when RELAY_DEBUG is set.
-type countWriter struct {
-	w         io.Writer
-	n         int64
-	sessionID string
+// readUserInto reads the user connection into UserConn until the user stops sending. This
+// goroutine is the only sender on UserConn and therefore its only closer; the bot side
+// drains it, sends MsgEOF and removes the session.
+func (r *Relay) readUserInto(conn net.Conn, sess *Session) {
+	// Whatever ends the read, Done stays open so the bot side drains UserConn and sends MsgEOF.
+	defer sess.CloseUserConn()
+	bridge.Pump(conn, sess.UserConn, sess.Done, 32*1024, func(n int) bool {
+		return r.pace(sess, n)
+	})
 }
 
-func (c *countWriter) Write(p []byte) (int, error) {
-	n, err := c.w.Write(p)
-	if n > 0 {
-		c.n += int64(n)
-		if os.Getenv("RELAY_DEBUG") != "" && c.n/10240 != (c.n-int64(n))/10240 {
-			log.Printf("[debug] relay download to user session=%s written=%d", c.sessionID, c.n)
-		}
-	}
+// userWriter counts bytes written to a user connection, adding them to the session's
+// UserBytes as they go, and logs sampled progress every 10KB when debug is on.
+func (r *Relay) userWriter(conn net.Conn, sess *Session) *bridge.CountWriter {
+	debug := r.debug.sampler(sess)
+	return &bridge.CountWriter{W: userBytesWriter{conn, sess}, ProgressEvery: 10240, OnProgress: func(total int64) {
+		debug.printf("relay download to user session=%s user=%s written=%d", sess.ID, sess.owner, total)
+	}}
+}
+
+// userBytesWriter writes to a user connection and adds what was written to UserBytes, so
+// the count is current while the transfer runs (for the reaper and shutdown snapshots).
+type userBytesWriter struct {
+	w    io.Writer
+	sess *Session
+}
+
+func (u userBytesWriter) Write(p []byte) (int, error) {
+	n, err := u.w.Write(p)
+	u.sess.addUserBytes(int64(n))
 	return n, err
 }
 
-func (r *Relay) relayDownloadToUser(botConn *tls.Conn, sessionID string) {
-	r.sessionsMu.RLock()
-	sess, ok := r.sessions[sessionID]
-	r.sessionsMu.RUnlock()
-	if !ok {
-		return
-	}
-	debugRelay := os.Getenv("RELAY_DEBUG") != ""
+// relayDownloadToUser feeds bot MsgData frames into the session. detach is closed if an
+// idempotent retry hands the session to another bot connection; this handler then returns
+// without tearing the session down.
+func (r *Relay) relayDownloadToUser(botConn *tls.Conn, username string, sess *Session, detach <-chan struct{}) {
+	sessionID := sess.ID
+	defer r.recoverPanic("download session "+sessionID, func() { r.removeSession(sessionID) })
+	frames := r.debug.sampler(sess)
 	for {
-		msgType, payload, err := ReadFrame(botConn)
+		msgType, payload, err := r.readBotFrame(botConn, sess)
 		if err != nil {
-			if debugRelay {
-				log.Printf("[debug] relay download frame session=%s read_err=%v", sessionID, err)
+			if sess.detached(detach) {
+				return
 			}
-			sess.Close()
+			r.debug.sessionf(sess, "relay download frame session=%s user=%s read_err=%v", sessionID, username, err)
+			r.closeOnFrameError(sess, err)
+			r.removeSession(sessionID)
 			return
 		}
-		if debugRelay {
-			log.Printf("[debug] relay download frame type=%d payload_len=%d session=%s", msgType, len(payload), sessionID)
-		}
+		frames.printf("relay download frame type=%d payload_len=%d session=%s user=%s", msgType, len(payload), sessionID, username)
 		switch msgType {
 		case MsgData:
+			if !r.pace(sess, len(payload)) {
+				r.removeSession(sessionID)
+				return
+			}
+			if !r.withinCap(sess, len(payload)) {
+				r.removeSession(sessionID)
+				return
+			}
 			select {
 			case sess.BotStream <- payload:
+				sess.addBytes(len(payload))
 			case <-sess.Done:
+				r.removeSession(sessionID)
 				return
 			}
 		case MsgEOF:
-			if debugRelay {
-				log.Printf("[debug] relay download session=%s received MsgEOF", sessionID)
+			r.debug.sessionf(sess, "relay download session=%s user=%s received MsgEOF", sessionID, username)
+			// The user side drains what is buffered, then removes the session.
+			sess.CloseBotStream()
+			if sess.sum != nil {
+				r.verifyChecksum(botConn, sess)
 			}
-			close(sess.BotStream)
-			sess.Close()
 			return
-		default:
-			if debugRelay {
-				log.Printf("[debug] relay download session=%s unknown msgType=%d", sessionID, msgType)
+		case MsgCancel:
+			r.debug.sessionf(sess, "relay download session=%s user=%s canceled by bot", sessionID, username)
+			sess.setCloseReason(CloseCanceled)
+			r.removeSession(sessionID)
+			return
+		case MsgRenew:
+			if err := r.handleRenew(username, sess, payload); err != nil {
+				sess.setCloseReason(CloseBotError)
+				r.removeSession(sessionID)
+				return
 			}
-			sess.Close()
+		default:
+			r.debug.sessionf(sess, "relay download session=%s user=%s unknown msgType=%d", sessionID, username, msgType)
+			r.metrics.malformed()
+			sess.setCloseReason(CloseBotError)
+			r.removeSession(sessionID)
 			return
 		}
 	}
 }
 
-func (r *Relay) relayUploadFromUser(botConn *tls.Conn, sessionID string) {
-	r.sessionsMu.RLock()
-	sess, ok := r.sessions[sessionID]
-	r.sessionsMu.RUnlock()
-	if !ok {
-		return
-	}
+// relayUploadFromUser forwards user data to the bot as MsgData frames; see
+// relayDownloadToUser for detach.
+func (r *Relay) relayUploadFromUser(botConn *tls.Conn, username string, sess *Session, detach <-chan struct{}) {
+	sessionID := sess.ID
+	defer r.recoverPanic("upload session "+sessionID, func() { r.removeSession(sessionID) })
+	// On an upload session the bot only sends MsgRenew, MsgCancel or disconnects.
+	go func() {
+		defer r.recoverPanic("upload session "+sessionID, func() { r.removeSession(sessionID) })
+		for {
+			msgType, payload, err := r.readBotFrame(botConn, sess)
+			if sess.detached(detach) {
+				return
+			}
+			if err == nil && msgType == MsgRenew {
+				if r.handleRenew(username, sess, payload) == nil {
+					continue
+				}
+			}
+			if err != nil || msgType == MsgCancel || msgType == MsgRenew {
+				r.closeOnFrameError(sess, err)
+				if err == nil && msgType == MsgCancel {
+					sess.setCloseReason(CloseCanceled)
+				} else {
+					sess.setCloseReason(CloseBotError)
+				}
+				sess.Close()
+				return
+			}
+		}
+	}()
 	for {
 		select {
 		case data, ok := <-sess.UserConn:
 			if !ok {
-				_ = WriteFrame(botConn, MsgEOF, nil)
+				if sess.writeBot(MsgEOF, nil) == nil {
+					sess.completed.Store(true)
+					if sess.sum != nil {
+						_ = sess.writeBot(MsgChecksum, relayChecksum(sess))
+					}
+				}
 				r.removeSession(sessionID)
 				return
 			}
-			if err := WriteFrame(botConn, MsgData, data); err != nil {
+			if !r.withinCap(sess, len(data)) {
 				r.removeSession(sessionID)
 				return
 			}
+			if err := sess.writeBot(MsgData, data); err != nil {
+				sess.setCloseReason(CloseBotError)
+				r.removeSession(sessionID)
+				return
+			}
+			sess.addBytes(len(data))
 		case <-sess.Done:
 			r.removeSession(sessionID)
 			return
+		case <-detach:
+			return
 		}
 	}
 }
@@ -387,48 +977,25 @@ func (r *Relay) removeSession(sessionID string) {
 	r.sessionsMu.Unlock()
 	if ok {
 		sess.Close()
-		if sess.Port > 0 {
-			r.portPool.release(sess.Port)
+		sess.stopCtx()
+		if sess.Port > 0 && !r.config.SinglePort {
+			r.portPool.Release(sess.Port)
 		}
-	}
-}
-
-type portPool struct {
-	min, max int
-	used     map[int]bool
-	mu       sync.Mutex
-}
-
-func newPortPool(minPort, maxPort int) (*portPool, error) {
-	if minPort <= 0 || maxPort < minPort {
-		return nil, fmt.Errorf("invalid port range %d-%d", minPort, maxPort)
-	}
-	return &portPool{
-		min:  minPort,
-		max:  maxPort,
-		used: make(map[int]bool),
-	}, nil
-}
-
-func (p *portPool) allocate() (int, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	b := make([]byte, 2)
-	for i := 0; i < 100; i++ {
-		if _, err := rand.Read(b); err != nil {
-			return 0, err
+		reason := sess.CloseReason()
+		sess.traceEvent(traceRelay, traceRelay, "removed: "+string(reason), 0)
+		r.metrics.sessionClosed(reason)
+		ev := sessionEvent("session_close", sess)
+		ev.Reason = string(reason)
+		r.audit.record(ev)
+		r.checkIntegrity(sess)
+		r.recordStats(sess)
+		r.usage.addBytes(sess.owner, sess.Bytes())
+		if peer := sess.chargedPeer(); peer != "" {
+			r.usage.addBytes(peer, sess.Bytes())
 		}
-		port := p.min + (int(binary.BigEndian.Uint16(b)) % (p.max - p.min + 1))
-		if !p.used[port] {
-			p.used[port] = true
-			return port, nil
+		r.runPostHooks(sess)
+		if !sess.isClaimed() {
+			r.noteResumePoint(sess)
 		}
 	}
-	return 0, fmt.Errorf("no free port in %d-%d", p.min, p.max)
-}
-
-func (p *portPool) release(port int) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	delete(p.used, port)
 }
@@ -0,0 +1,113 @@
+package turnrelay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A registration reusing a live session ID must not replace that session, whoever sends it,
+// and is refused before it takes a port: none is allocated, released or left cooling.
+func TestDuplicateSessionID(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.PortCooldownSec = 60
+	r, addr := startTestRelay(t, c)
+	id := testSessionID(1)
+	registerTestSession(t, dialTestBot(t, addr), "download", id)
+	first, err := r.lookupSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, cooling := r.portPool.Free(), r.portPool.Cooling()
+
+	bot := dialTestBot(t, addr)
+	if err := WriteFrame(bot, MsgRegisterUpload, Registration{SessionID: id, Filename: "other"}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readChainReply(bot, MsgPortAlloc)
+	if err == nil || !strings.HasPrefix(err.Error(), ErrDuplicateSession.Error()) {
+		t.Fatalf("second registration: %v, want %v", err, ErrDuplicateSession)
+	}
+	if sess, _ := r.lookupSession(id); sess != first {
+		t.Fatal("the first session was replaced")
+	}
+	if got := r.portPool.Free(); got != free {
+		t.Errorf("free ports %d, want %d", got, free)
+	}
+	if got := r.portPool.Cooling(); got != cooling {
+		t.Errorf("cooling ports %d, want %d: the refused registration took a port", got, cooling)
+	}
+}
+
+// An idempotent retry takes the session over on a new connection with its own auth nonce:
+// the relay's final checksum must be signed with the key derived from that nonce, and a
+// retry that asks for another checksum than the first registration is refused.
+func TestIdempotentRetryChecksumKey(t *testing.T) {
+	_, addr := startTestRelay(t, newTestConfig(t, 4))
+	id := testSessionID(1)
+	reg := Registration{SessionID: id, Filename: "file.bin", IdempotencyKey: "retry", Checksum: ChecksumSHA256}
+	register := func(bot net.Conn, reg Registration) (PortAlloc, error) {
+		if err := WriteFrame(bot, MsgRegisterDownload, reg.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readChainReply(bot, MsgPortAlloc)
+		if err != nil {
+			return PortAlloc{}, err
+		}
+		return ParsePortAlloc(payload)
+	}
+
+	first, _ := dialTestBotNonce(t, addr)
+	alloc, err := register(first, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot, nonce := dialTestBotNonce(t, addr)
+	retry, err := register(bot, reg)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if retry.Port != alloc.Port {
+		t.Fatalf("retry got port %d, want %d", retry.Port, alloc.Port)
+	}
+	first.Close()
+
+	noSum := reg
+	noSum.Checksum = ""
+	if _, err := register(dialTestBot(t, addr), noSum); err == nil || !strings.HasPrefix(err.Error(), ErrDuplicateSession.Error()) {
+		t.Fatalf("retry without checksum: %v, want %v", err, ErrDuplicateSession)
+	}
+
+	data := []byte("retried download")
+	if err := WriteFrame(bot, MsgData, data); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(dialTestUser(t, alloc.Port), got); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("user got %q, %v", got, err)
+	}
+	digest := sha256.Sum256(data)
+	if err := WriteFrame(bot, MsgEOF, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFrame(bot, MsgChecksum, Checksum{Algorithm: ChecksumSHA256, Digest: digest[:]}.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := readChainReply(bot, MsgChecksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := ParseChecksum(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum.Digest, digest[:]) {
+		t.Errorf("relay digest %x, want %x", sum.Digest, digest)
+	}
+	if !VerifyChecksum(DeriveSessionKey([]byte(testSecret), nonce, id), sum.Digest, sum.Tag) {
+		t.Error("relay checksum is not signed with the retrying connection's session key")
+	}
+}
@@ -0,0 +1,126 @@
+package turnrelay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultResumeWindow is how long an interrupted download can be resumed when
+// ResumeWindowSec is not set.
+const defaultResumeWindow = 10 * time.Minute
+
+// resumePoints remembers interrupted downloads (scoped per bot user) for a window, with
+// how far their users got, so MsgResume can continue them.
+type resumePoints struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]resumePoint
+}
+
+type resumePoint struct {
+	filename  string
+	size      int64 // declared file size (Registration.Size); 0 = not declared
+	delivered int64 // bytes of the stream the user received, counted from offset 0
+	expires   time.Time
+}
+
+func newResumePoints(window time.Duration) *resumePoints {
+	return &resumePoints{window: window, entries: make(map[string]resumePoint)}
+}
+
+func (c *resumePoints) remember(key, filename string, size, delivered int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = resumePoint{filename: filename, size: size, delivered: delivered, expires: now.Add(c.window)}
+}
+
+// take removes and returns the entry for key, so a download is resumed at most once at a
+// time; put it back with restore if the resumed session cannot be set up.
+func (c *resumePoints) take(key string) (resumePoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	delete(c.entries, key)
+	if !ok || time.Now().After(e.expires) {
+		return resumePoint{}, false
+	}
+	return e, true
+}
+
+func (c *resumePoints) restore(key string, e resumePoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+func (c *resumePoints) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// resumable reports whether sess can be continued with MsgResume: a download to a single
+// DCC user whose stream reaches the user unchanged, so offsets on both legs agree.
+func (r *Relay) resumable(sess *Session) bool {
+	return r.resumes != nil && sess.Kind == "download" && sess.Port > 0 && sess.fan == nil && r.config.Transform == nil
+}
+
+// noteResumePoint records how far the user of an ended download got, or forgets the
+// download once a user received all of it. It runs when the user side finished (or, for a
+// session no user claimed, when it was removed), so the count is final.
+func (r *Relay) noteResumePoint(sess *Session) {
+	if !r.resumable(sess) {
+		return
+	}
+	key := sess.owner + "\x00" + sess.ID
+	if sess.completed.Load() {
+		r.resumes.forget(key)
+		return
+	}
+	r.resumes.remember(key, sess.Filename, sess.size, sess.delivered())
+}
+
+// resumeSession registers a download continuing the interrupted session res names from
+// res.Offset, which must not be past what that session's user received. Errors wrap
+// ErrResumeRejected, or are whatever a registration would fail with.
+func (r *Relay) resumeSession(ctx context.Context, username string, res Resume) (*Session, error) {
+	if r.resumes == nil {
+		return nil, fmt.Errorf("%w: resume is off", ErrResumeRejected)
+	}
+	r.sessionsMu.RLock()
+	_, open := r.sessions[res.SessionID]
+	r.sessionsMu.RUnlock()
+	if open {
+		return nil, fmt.Errorf("%w: session %s is still open", ErrResumeRejected, res.SessionID)
+	}
+	key := username + "\x00" + res.SessionID
+	point, ok := r.resumes.take(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: no interrupted download %s", ErrResumeRejected, res.SessionID)
+	}
+	if res.Offset > point.delivered {
+		r.resumes.restore(key, point)
+		return nil, fmt.Errorf("%w: offset %d is past the %d bytes delivered", ErrResumeRejected, res.Offset, point.delivered)
+	}
+	sess, err := r.registerSession(ctx, username, "download", Registration{SessionID: res.SessionID, Filename: point.filename, Checksum: res.Checksum, Size: point.size})
+	if err != nil {
+		r.resumes.restore(key, point)
+		return nil, err
+	}
+	atomic.StoreInt64(&sess.resumedAt, res.Offset)
+	log.Printf("relay: %s: resumed at offset %d of %d delivered", sess, res.Offset, point.delivered)
+	ev := sessionEvent("session_resume", sess)
+	ev.Reason = fmt.Sprintf("offset %d", res.Offset)
+	r.audit.record(ev)
+	return sess, nil
+}
@@ -0,0 +1,170 @@
+package turnrelay
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// scheduleCheckInterval is how often running sessions are re-limited as schedule windows
+// open and close.
+const scheduleCheckInterval = 30 * time.Second
+
+// ScheduleRule is a recurring time window with limits that apply during it, e.g. a rate
+// cap during business hours or no uploads while backups run.
+type ScheduleRule struct {
+	Days       []time.Weekday // days the window starts on; empty = every day
+	Start, End time.Duration  // offsets from midnight; End <= Start means the window crosses midnight
+	MaxRateBps int64          // per-session rate cap during the window; 0 = no cap
+	Deny       []string       // session kinds ("download", "upload", "forward") refused during the window
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseScheduleRule builds a rule from config strings: days as "mon".."sun", start and end
+// as "HH:MM".
+func ParseScheduleRule(days []string, start, end string, maxRateBps int64, deny []string) (ScheduleRule, error) {
+	rule := ScheduleRule{MaxRateBps: maxRateBps, Deny: deny}
+	for _, d := range days {
+		wd, ok := weekdays[strings.ToLower(d)[:min(3, len(d))]]
+		if !ok {
+			return rule, fmt.Errorf("schedule: bad day %q", d)
+		}
+		rule.Days = append(rule.Days, wd)
+	}
+	var err error
+	if rule.Start, err = parseClock(start); err != nil {
+		return rule, err
+	}
+	if rule.End, err = parseClock(end); err != nil {
+		return rule, err
+	}
+	for _, k := range deny {
+		if k != "download" && k != "upload" && k != "forward" {
+			return rule, fmt.Errorf("schedule: bad kind %q in deny", k)
+		}
+	}
+	return rule, nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("schedule: bad time %q (want HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether now falls inside the window.
+func (s ScheduleRule) active(now time.Time) bool {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	off := now.Sub(midnight)
+	day := now.Weekday()
+	switch {
+	case s.Start < s.End:
+		if off < s.Start || off >= s.End {
+			return false
+		}
+	case off >= s.Start:
+	case off < s.End:
+		day = (day + 6) % 7 // the part after midnight belongs to the window that started yesterday
+	default:
+		return false
+	}
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// activeRules returns the global and username's schedule rules in effect now.
+func (r *Relay) activeRules(username string) []ScheduleRule {
+	loc := r.config.ScheduleLocation
+	if loc == nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	var out []ScheduleRule
+	for _, rules := range [][]ScheduleRule{r.config.Schedules, r.policy(username).Schedules} {
+		for _, s := range rules {
+			if s.active(now) {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// checkSchedule returns ErrScheduleDenied if a schedule window refuses kind for username now.
+func (r *Relay) checkSchedule(username, kind string) error {
+	for _, s := range r.activeRules(username) {
+		for _, k := range s.Deny {
+			if k == kind {
+				return fmt.Errorf("%w: %s until %02d:%02d", ErrScheduleDenied, kind, int(s.End.Hours()), int(s.End.Minutes())%60)
+			}
+		}
+	}
+	return nil
+}
+
+// scheduledRate returns the rate limit for username now: the user's max_rate_bps, lowered
+// by any active schedule cap (0 = unlimited).
+func (r *Relay) scheduledRate(username string) int64 {
+	rate := r.policy(username).MaxRateBps
+	for _, s := range r.activeRules(username) {
+		if s.MaxRateBps > 0 && (rate == 0 || s.MaxRateBps < rate) {
+			rate = s.MaxRateBps
+		}
+	}
+	return rate
+}
+
+// hasSchedules reports whether any schedule rule is configured.
+func (r *Relay) hasSchedules() bool {
+	if len(r.config.Schedules) > 0 {
+		return true
+	}
+	r.policiesMu.RLock()
+	defer r.policiesMu.RUnlock()
+	for _, p := range r.policies {
+		if len(p.Schedules) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceSchedules re-applies rate limits to running sessions as schedule windows open
+// and close.
+func (r *Relay) enforceSchedules() {
+	h := r.health.register("schedule enforcer", 3*scheduleCheckInterval)
+	defer h.stop()
+	t := time.NewTicker(scheduleCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-t.C:
+		}
+		r.sessionsMu.RLock()
+		sessions := make([]*Session, 0, len(r.sessions))
+		for _, sess := range r.sessions {
+			sessions = append(sessions, sess)
+		}
+		r.sessionsMu.RUnlock()
+		for _, sess := range sessions {
+			r.applyUserPolicy(sess.owner, sess)
+		}
+		h.beat()
+	}
+}
@@ -0,0 +1,9 @@
+package turnrelay
+
+import "github.com/awgh/huzaa-relay/internal/buildinfo"
+
+// serverInfo describes the running build, for MsgServerInfo and the build_info metric.
+func serverInfo() ServerInfo {
+	bi := buildinfo.Get()
+	return ServerInfo{Version: bi.Version, Commit: bi.Commit, Date: bi.Date, GoVersion: bi.GoVersion}
+}
@@ -1,12 +1,32 @@
 package turnrelay
 
 import (
-	"io"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/bridge"
 )
 
-// Session represents a single download or upload session.
+// Session represents a single download, upload or forward session.
+//
+// Channel ownership (each channel has exactly one closer):
+//   - BotStream (downloads) is sent on and closed only by the bot-side goroutine
+//     (relayDownloadToUser), via CloseBotStream after MsgEOF. The user side only reads it.
+//   - UserConn (uploads) is sent on and closed only by the user-side goroutine
+//     (listenDCCForSession), via CloseUserConn when the user connection ends. The bot
+//     side only reads it.
+//   - A forward session uses both: BotStream towards the user, UserConn towards the bot.
+//     userDrained is closed by the user side once BotStream has been written out.
+//   - Done is closed by Close, which any goroutine may call any number of times. It means
+//     "stop": every blocking send or receive on the data channels also selects on Done.
+//
+// A closed data channel means "no more data, finish normally"; a closed Done means "abort".
 type Session struct {
 	ID        string
 	Kind      string
@@ -16,47 +36,234 @@ type Session struct {
 	BotStream chan []byte
 	Done      chan struct{}
 	Port      int
+	Token     string // random DNS label; with SNI routing the user presents <Token>.<DCCSNIDomain>
+	MACKey    []byte // per-session key from DeriveSessionKey (set by attachBot, guarded by mu); authenticates the final checksum
 	mu        sync.Mutex
+
+	botStreamOnce sync.Once
+	userConnOnce  sync.Once
+
+	bytes     int64 // atomic; bytes relayed on the bot leg
+	userBytes int64 // atomic; bytes written to the user (after any StreamTransform)
+	resumedAt int64 // atomic; stream offset a resumed download (MsgResume) started at
+	botConn   net.Conn
+	botDetach chan struct{}
+	botWMu    sync.Mutex // serializes frames written to botConn
+	metrics   *relayMetrics
+
+	lagSince    time.Time // slow-consumer monitor only: when the buffer went above threshold
+	lagReported bool      // slow-consumer monitor only
+	idleMark    int64     // reaper only: bytes moved (both legs) when last seen changing
+	idleSince   time.Time // reaper only: when idleMark was taken
+
+	leaseUntil time.Time     // unclaimed allocation expiry; guarded by mu
+	claimed    chan struct{} // closed once a user connects
+	claimOnce  sync.Once
+
+	userDrained chan struct{} // forward sessions: bot-to-user direction fully delivered
+
+	fsm       sessionFSM
+	limiter   rateLimiter // transfer rate limit (user policy or BoostSession)
+	owner     string      // bot user that registered the session
+	completed atomic.Bool // the transfer finished normally (for statistics)
+	stopCtx   func() bool // detaches Done from the relay context; set on allocation
+	peer      netip.Addr  // user's normalized IP once connected; guarded by mu
+	botAddr   string      // see BotAddr; guarded by mu
+	maxBytes  int64       // bytes the session may move (pre-registration hook); 0 = no cap
+	size      int64       // declared file size (Registration.Size); 0 = not declared
+	renamed   string      // filename substituted by the pre-registration hook; "" = unchanged
+	peerBot   string      // bot user that attaches as the user side (Registration.PeerBot); "" = DCC user
+	fan       *fanout     // download streamed to several DCC users (Registration.Fanout); nil = one user
+	sum       *streamSum  // hash of the MsgData on the bot connection (Registration.Checksum); nil = none
+
+	chainAlloc *PortAlloc                   // chained sessions: the next relay's allocation, passed to the bot
+	upstream   atomic.Pointer[SessionStats] // chained sessions: the next relay's MsgStats once it ended there
+
+	trace     atomic.Pointer[sessionTrace] // set while TraceSession is on
+	integrity *integrityCheck              // sampled payload hashes (IntegritySampleEvery); nil = off
+	debug     atomic.Bool                  // debug logging for this session only (SetSessionDebug)
+
+	connectedAt time.Time   // when the user connected; guarded by mu
+	closeReason CloseReason // first explicit reason the session was ended; guarded by mu
 }
 
 // NewSession creates a session.
 func NewSession(id, kind, filename string, port int) *Session {
 	return &Session{
-		ID:        id,
-		Kind:      kind,
-		Filename:  filename,
-		CreatedAt: time.Now(),
-		Port:      port,
-		UserConn:  make(chan []byte, 256),
-		BotStream: make(chan []byte, 512),
-		Done:      make(chan struct{}),
+		ID:          id,
+		Kind:        kind,
+		Filename:    filename,
+		CreatedAt:   time.Now(),
+		Port:        port,
+		UserConn:    make(chan []byte, 256),
+		BotStream:   make(chan []byte, 512),
+		Done:        make(chan struct{}),
+		claimed:     make(chan struct{}),
+		userDrained: make(chan struct{}),
+	}
+}
+
+// ChanReader reads a session channel as an io.Reader; see bridge.ChanReader.
+type ChanReader = bridge.ChanReader
+
+// CloseBotStream closes BotStream. Only the bot-side sender may call it; repeat calls are no-ops.
+func (s *Session) CloseBotStream() {
+	s.botStreamOnce.Do(func() { close(s.BotStream) })
+}
+
+// CloseUserConn closes UserConn. Only the user-side sender may call it; repeat calls are no-ops.
+func (s *Session) CloseUserConn() {
+	s.userConnOnce.Do(func() { close(s.UserConn) })
+}
+
+// Bytes returns the number of bytes relayed on the bot leg so far.
+func (s *Session) Bytes() int64 { return atomic.LoadInt64(&s.bytes) }
+
+func (s *Session) addBytes(n int) {
+	if atomic.AddInt64(&s.bytes, int64(n)) == int64(n) {
+		s.advance(StateStreaming)
+	}
+}
+
+// State returns the session's lifecycle state.
+func (s *Session) State() SessionState { return s.fsm.get() }
+
+// UserBytes returns the number of bytes written to the user of a download. It differs from
+// Bytes when a StreamTransform changed the stream.
+func (s *Session) UserBytes() int64 { return atomic.LoadInt64(&s.userBytes) }
+
+func (s *Session) addUserBytes(n int64) { atomic.AddInt64(&s.userBytes, n) }
+
+// delivered returns how much of the stream the user of a download received, counted from
+// offset 0 for a resumed one.
+func (s *Session) delivered() int64 {
+	return atomic.LoadInt64(&s.resumedAt) + atomic.LoadInt64(&s.userBytes)
+}
+
+// Owner returns the authenticated bot user that registered the session.
+func (s *Session) Owner() string { return s.owner }
+
+// BotAddr returns the (normalized) remote address of the bot connection serving the
+// session: the one that registered it, or the one that took it over by idempotent retry.
+func (s *Session) BotAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.botAddr
+}
+
+// String identifies the session in logs by ID, owning bot user and bot address.
+func (s *Session) String() string {
+	return fmt.Sprintf("session %s (user %s from %s)", s.ID, s.owner, s.BotAddr())
+}
+
+// attachBot makes conn the session's bot connection. A previously attached connection (an
+// idempotent retry replacing it) is detached and closed. addr is conn's remote address as
+// logged and macKey the session key derived from conn's auth nonce, which the bot on conn
+// expects the relay's checksum to be signed with. The returned channel is closed when conn
+// is detached.
+func (s *Session) attachBot(conn net.Conn, addr string, macKey []byte) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.botDetach != nil {
+		close(s.botDetach)
+		s.botConn.Close()
+	}
+	s.botConn = conn
+	s.botAddr = addr
+	s.MACKey = macKey
+	s.botDetach = make(chan struct{})
+	return s.botDetach
+}
+
+// errNoBot is returned by writeBot before a bot connection is attached.
+var errNoBot = errors.New("no bot connection attached")
+
+// writeBot writes one frame to the session's bot connection. Handlers that may write
+// concurrently (e.g. a MsgRenew reply during an upload, or a keepalive) go through here.
+func (s *Session) writeBot(msgType byte, payload []byte) error {
+	return s.writeBotOn(nil, msgType, payload)
+}
+
+// writeBotOn is writeBot for a frame that belongs to bot connection conn, such as the
+// keepalives of conn: once an idempotent retry replaced conn, it fails rather than go to the
+// new bot. A nil conn means whichever connection is attached.
+func (s *Session) writeBotOn(want net.Conn, msgType byte, payload []byte) error {
+	s.mu.Lock()
+	conn := s.botConn
+	s.mu.Unlock()
+	if conn == nil {
+		return errNoBot
 	}
+	if want != nil && conn != want {
+		return net.ErrClosed
+	}
+	s.botWMu.Lock()
+	defer s.botWMu.Unlock()
+	err := WriteFrame(conn, msgType, payload)
+	if err == nil && s.metrics != nil {
+		s.metrics.frameOut(msgType)
+	}
+	if err == nil && msgType == MsgData {
+		s.integrity.botOut(payload)
+		s.sum.write(payload)
+	}
+	if err != nil {
+		s.traceEvent(traceRelay, traceBot, MsgTypeName(msgType)+" failed: "+err.Error(), len(payload))
+	} else {
+		s.traceEvent(traceRelay, traceBot, MsgTypeName(msgType), len(payload))
+	}
+	return err
+}
+
+// Peer returns the normalized IP address of the user connection (zero until a user connects).
+func (s *Session) Peer() netip.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer
 }
 
-// ChanReader implements io.Reader by reading from a channel of byte slices.
-type ChanReader struct {
-	Ch   <-chan []byte
-	cur  []byte
-	done bool
+func (s *Session) setPeer(ip netip.Addr) {
+	s.mu.Lock()
+	s.peer = ip
+	s.mu.Unlock()
+}
+
+// claim marks that a user connected; the allocation lease no longer applies. It reports
+// whether this call claimed the session: only the first user connection gets it.
+func (s *Session) claim() bool {
+	claimed := false
+	s.claimOnce.Do(func() {
+		s.mu.Lock()
+		s.connectedAt = time.Now()
+		s.mu.Unlock()
+		close(s.claimed)
+		s.advance(StateConnected)
+		claimed = true
+	})
+	return claimed
 }
 
-func (c *ChanReader) Read(p []byte) (n int, err error) {
-	for len(c.cur) == 0 && !c.done {
-		data, ok := <-c.Ch
-		if !ok {
-			c.done = true
-			return 0, io.EOF
-		}
-		c.cur = data
+// isClaimed reports whether a user has connected.
+func (s *Session) isClaimed() bool {
+	select {
+	case <-s.claimed:
+		return true
+	default:
+		return false
 	}
-	if len(c.cur) == 0 {
-		return 0, io.EOF
+}
+
+// detached reports whether the bot connection that received detach was replaced.
+func (s *Session) detached(detach <-chan struct{}) bool {
+	select {
+	case <-detach:
+		return true
+	default:
+		return false
 	}
-	n = copy(p, c.cur)
-	c.cur = c.cur[n:]
-	return n, nil
 }
 
+// Close aborts the session by closing Done. It is safe to call from any goroutine, repeatedly.
 func (s *Session) Close() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -64,5 +271,54 @@ func (s *Session) Close() {
 	case <-s.Done:
 	default:
 		close(s.Done)
+		s.advance(StateClosed)
+	}
+}
+
+// SessionInfo describes a registered session for operators.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Filename  string    `json:"filename"`
+	Owner     string    `json:"owner"`          // bot user that registered the session
+	BotAddr   string    `json:"bot_addr"`       // remote address of the bot connection serving it
+	Peer      string    `json:"peer,omitempty"` // DCC user's IP once connected
+	State     string    `json:"state"`
+	Port      int       `json:"port,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Sessions returns a snapshot of the registered sessions, oldest first.
+func (r *Relay) Sessions() []SessionInfo {
+	r.sessionsMu.RLock()
+	out := make([]SessionInfo, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		out = append(out, SessionInfo{
+			ID:        s.ID,
+			Kind:      s.Kind,
+			Filename:  s.Filename,
+			Owner:     s.owner,
+			BotAddr:   s.BotAddr(),
+			Peer:      peerText(s.Peer()),
+			State:     s.State().String(),
+			Port:      s.Port,
+			Bytes:     s.Bytes(),
+			CreatedAt: s.CreatedAt,
+		})
+	}
+	r.sessionsMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// KillSession ends the session sessionID with close reason admin_kill.
+func (r *Relay) KillSession(actor, sessionID string) error {
+	sess, err := r.lookupSession(sessionID)
+	if err == nil {
+		sess.setCloseReason(CloseAdminKill)
+		r.removeSession(sessionID)
 	}
+	r.recordAdminAction(actor, "kill_session", map[string]string{"session": sessionID}, err)
+	return err
 }
@@ -0,0 +1,206 @@
+package turnrelay
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionCloseRepeated closes a session's channels and Done from many goroutines at
+// once; every call after the first must be a no-op rather than a double close.
+func TestSessionCloseRepeated(t *testing.T) {
+	sess := NewSession(testSessionID(1), "forward", "file.bin", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(3)
+		go func() { defer wg.Done(); sess.Close() }()
+		go func() { defer wg.Done(); sess.CloseBotStream() }()
+		go func() { defer wg.Done(); sess.CloseUserConn() }()
+	}
+	wg.Wait()
+	select {
+	case <-sess.Done:
+	default:
+		t.Error("Done is still open")
+	}
+	if _, ok := <-sess.BotStream; ok {
+		t.Error("BotStream is still open")
+	}
+	if _, ok := <-sess.UserConn; ok {
+		t.Error("UserConn is still open")
+	}
+	if got := sess.State(); got != StateClosed {
+		t.Errorf("state = %v, want %v", got, StateClosed)
+	}
+}
+
+// TestUserDisconnectRacesBotEOF has users hang up while their bots finish sending and send
+// MsgEOF. Whichever side ends first, every session must be removed and its port returned.
+func TestUserDisconnectRacesBotEOF(t *testing.T) {
+	const n = 40
+	c := newTestConfig(t, 8*n)
+	c.PortCooldownSec = -1
+	r, addr := startTestRelay(t, c)
+	data := bytes.Repeat([]byte("x"), 64<<10)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bot, port, err := stressBot(addr, "download", testSessionID(i))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer bot.Close()
+			go func() {
+				for off := 0; off < len(data); off += stressChunk {
+					if WriteFrame(bot, MsgData, data[off:off+stressChunk]) != nil {
+						return
+					}
+				}
+				WriteFrame(bot, MsgEOF, nil)
+			}()
+			user, err := stressUser(port)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Read a varying amount, then hang up: some users leave before MsgEOF, some after.
+			io.CopyN(io.Discard, user, int64(i*len(data)/n))
+			user.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "sessions to be removed", func() bool { return sessionCount(r) == 0 })
+	if free, size := r.portPool.Free(), r.portPool.Size(); free != size {
+		t.Errorf("ports: %d free of %d", free, size)
+	}
+	if m := r.Metrics(); m.HandlerPanics != 0 {
+		t.Errorf("%d handler panics", m.HandlerPanics)
+	}
+}
+
+// TestSendAfterKill keeps a bot sending MsgData after its session was killed. The relay must
+// drop the data without panicking and go on serving new sessions.
+func TestSendAfterKill(t *testing.T) {
+	r, addr := startTestRelay(t, newTestConfig(t, 4))
+	bot, port, err := stressBot(addr, "download", testSessionID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	chunk := make([]byte, stressChunk)
+	if err := WriteFrame(bot, MsgData, chunk); err != nil {
+		t.Fatal(err)
+	}
+	user, err := stressUser(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	waitFor(t, 5*time.Second, "the user to connect", func() bool {
+		sess, err := r.lookupSession(testSessionID(1))
+		return err == nil && sess.isClaimed()
+	})
+	if err := r.KillSession("test", testSessionID(1)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		if WriteFrame(bot, MsgData, chunk) != nil {
+			break
+		}
+	}
+	WriteFrame(bot, MsgEOF, nil)
+	waitFor(t, 5*time.Second, "the session to be removed", func() bool { return sessionCount(r) == 0 })
+	if m := r.Metrics(); m.HandlerPanics != 0 {
+		t.Errorf("%d handler panics", m.HandlerPanics)
+	}
+	if err := stressDownload(addr, testSessionID(2), chunk); err != nil {
+		t.Errorf("download after kill: %v", err)
+	}
+}
+
+// TestForwardClosesBothDirections ends a forward session from both sides at once: the bot
+// sends MsgEOF while the user closes its write side. Each must receive the other's data in
+// full and the session must then be removed.
+func TestForwardClosesBothDirections(t *testing.T) {
+	r, addr := startTestRelay(t, newTestConfig(t, 4))
+	bot, port, err := stressBot(addr, "forward", testSessionID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	user, err := stressUser(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer user.Close()
+	toUser := bytes.Repeat([]byte("d"), 40<<10)
+	toBot := bytes.Repeat([]byte("u"), 24<<10)
+
+	botErr := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(toUser); off += stressChunk {
+			if err := WriteFrame(bot, MsgData, toUser[off:off+stressChunk]); err != nil {
+				botErr <- err
+				return
+			}
+		}
+		botErr <- WriteFrame(bot, MsgEOF, nil)
+	}()
+	userErr := make(chan error, 1)
+	go func() {
+		_, err := user.Write(toBot)
+		if err == nil {
+			err = user.CloseWrite()
+		}
+		userErr <- err
+	}()
+
+	var got []byte
+	for {
+		msgType, payload, err := ReadFrame(bot)
+		if err != nil {
+			t.Fatalf("bot read: %v", err)
+		}
+		if msgType == MsgEOF {
+			break
+		}
+		if msgType != MsgData {
+			t.Fatalf("bot got message type %d", msgType)
+		}
+		got = append(got, payload...)
+	}
+	if !bytes.Equal(got, toBot) {
+		t.Errorf("bot got %d bytes, want %d", len(got), len(toBot))
+	}
+	gotUser, err := io.ReadAll(user)
+	if err != nil {
+		t.Fatalf("user read: %v", err)
+	}
+	if !bytes.Equal(gotUser, toUser) {
+		t.Errorf("user got %d bytes, want %d", len(gotUser), len(toUser))
+	}
+	for name, ch := range map[string]chan error{"bot": botErr, "user": userErr} {
+		if err := <-ch; err != nil {
+			t.Errorf("%s write: %v", name, err)
+		}
+	}
+	if _, err := readChainReply(bot, MsgStats); err != nil {
+		t.Errorf("stats: %v", err)
+	}
+	waitFor(t, 5*time.Second, "the session to be removed", func() bool { return sessionCount(r) == 0 })
+	if m := r.Metrics(); m.HandlerPanics != 0 {
+		t.Errorf("%d handler panics", m.HandlerPanics)
+	}
+}
@@ -0,0 +1,69 @@
+package turnrelay
+
+import "sync/atomic"
+
+// SessionState is where a session is in its lifecycle:
+//
+//	registered -> allocated -> connected -> streaming -> closed
+//
+// A download may start streaming (the bot sends data into the relay buffer) before the
+// user connects, so allocated -> streaming is allowed too; any state may go to closed.
+// States only move forward.
+type SessionState int32
+
+const (
+	StateRegistered SessionState = iota // registration accepted, no port yet
+	StateAllocated                      // DCC port listening, waiting for the user
+	StateConnected                      // user connected, no data yet
+	StateStreaming                      // data has moved on the bot leg
+	StateClosed                         // torn down
+)
+
+var sessionStateNames = [...]string{"registered", "allocated", "connected", "streaming", "closed"}
+
+func (s SessionState) String() string {
+	if s >= 0 && int(s) < len(sessionStateNames) {
+		return sessionStateNames[s]
+	}
+	return "unknown"
+}
+
+// sessionTransitions lists the valid next states of each state.
+var sessionTransitions = map[SessionState][]SessionState{
+	StateRegistered: {StateAllocated, StateClosed},
+	StateAllocated:  {StateConnected, StateStreaming, StateClosed},
+	StateConnected:  {StateStreaming, StateClosed},
+	StateStreaming:  {StateClosed},
+}
+
+// validTransition reports whether a session may move from one state to another.
+func validTransition(from, to SessionState) bool {
+	for _, s := range sessionTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFSM holds a session's state; it is safe for concurrent use.
+type sessionFSM struct {
+	state int32 // atomic SessionState
+}
+
+func (f *sessionFSM) get() SessionState { return SessionState(atomic.LoadInt32(&f.state)) }
+
+// advance moves to next if that is a valid transition from the current state and reports
+// whether it did. Events that arrive late (a user connecting to a session that is already
+// streaming) are simply not transitions and leave the state unchanged.
+func (f *sessionFSM) advance(next SessionState) bool {
+	for {
+		cur := f.get()
+		if !validTransition(cur, next) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&f.state, int32(cur), int32(next)) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package turnrelay
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSessionFSMAdvance(t *testing.T) {
+	tests := []struct {
+		from, to SessionState
+		ok       bool
+	}{
+		{StateRegistered, StateAllocated, true},
+		{StateRegistered, StateClosed, true},
+		{StateRegistered, StateConnected, false},
+		{StateRegistered, StateStreaming, false},
+		{StateRegistered, StateRegistered, false},
+		{StateAllocated, StateConnected, true},
+		{StateAllocated, StateStreaming, true}, // download data before the user connects
+		{StateAllocated, StateClosed, true},
+		{StateAllocated, StateRegistered, false},
+		{StateAllocated, StateAllocated, false},
+		{StateConnected, StateStreaming, true},
+		{StateConnected, StateClosed, true},
+		{StateConnected, StateAllocated, false},
+		{StateConnected, StateRegistered, false},
+		{StateConnected, StateConnected, false},
+		{StateStreaming, StateClosed, true},
+		{StateStreaming, StateConnected, false}, // late user connect
+		{StateStreaming, StateAllocated, false},
+		{StateStreaming, StateStreaming, false},
+		{StateClosed, StateRegistered, false},
+		{StateClosed, StateAllocated, false},
+		{StateClosed, StateConnected, false},
+		{StateClosed, StateStreaming, false},
+		{StateClosed, StateClosed, false},
+		{StateRegistered, SessionState(99), false},
+		{SessionState(-1), StateClosed, false},
+	}
+	for _, tt := range tests {
+		f := sessionFSM{state: int32(tt.from)}
+		if got := f.advance(tt.to); got != tt.ok {
+			t.Errorf("%v -> %v: advance = %v, want %v", tt.from, tt.to, got, tt.ok)
+		}
+		want := tt.from
+		if tt.ok {
+			want = tt.to
+		}
+		if got := f.get(); got != want {
+			t.Errorf("%v -> %v: state = %v, want %v", tt.from, tt.to, got, want)
+		}
+	}
+}
+
+func TestSessionFSMLifecycle(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []SessionState
+		want  SessionState
+	}{
+		{"download", []SessionState{StateAllocated, StateConnected, StateStreaming, StateClosed}, StateClosed},
+		{"streaming before connect", []SessionState{StateAllocated, StateStreaming, StateConnected}, StateStreaming},
+		{"never connected", []SessionState{StateAllocated, StateClosed, StateConnected}, StateClosed},
+		{"closed stays closed", []SessionState{StateClosed, StateAllocated, StateConnected, StateStreaming}, StateClosed},
+		{"skip allocation", []SessionState{StateConnected, StateStreaming}, StateRegistered},
+	}
+	for _, tt := range tests {
+		var f sessionFSM
+		for _, s := range tt.steps {
+			f.advance(s)
+		}
+		if got := f.get(); got != tt.want {
+			t.Errorf("%s: state = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSessionFSMConcurrent races every transition from allocated; exactly one goroutine
+// may win each state change and the state must end up closed.
+func TestSessionFSMConcurrent(t *testing.T) {
+	f := sessionFSM{state: int32(StateAllocated)}
+	var won [StateClosed + 1]int32
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		for _, s := range []SessionState{StateConnected, StateStreaming, StateClosed} {
+			s := s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if f.advance(s) {
+					atomic.AddInt32(&won[s], 1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	for _, s := range []SessionState{StateConnected, StateStreaming, StateClosed} {
+		if won[s] > 1 {
+			t.Errorf("%v entered %d times", s, won[s])
+		}
+	}
+	if f.get() != StateClosed || won[StateClosed] != 1 {
+		t.Errorf("state = %v after %d wins of closed, want closed once", f.get(), won[StateClosed])
+	}
+}
+
+func TestSessionStateString(t *testing.T) {
+	tests := map[SessionState]string{
+		StateRegistered:  "registered",
+		StateAllocated:   "allocated",
+		StateConnected:   "connected",
+		StateStreaming:   "streaming",
+		StateClosed:      "closed",
+		SessionState(-1): "unknown",
+		SessionState(5):  "unknown",
+	}
+	for s, want := range tests {
+		if got := s.String(); got != want {
+			t.Errorf("SessionState(%d).String() = %q, want %q", int32(s), got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package turnrelay
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// CloseReason says why a session ended. The same values are used in the audit log
+// (session_close "reason"), the sessions-closed metric and MsgStats.
+type CloseReason string
+
+// Session close reasons.
+const (
+	CloseCompleted CloseReason = "completed"  // the transfer finished normally
+	CloseBotError  CloseReason = "bot_error"  // the bot disconnected, sent a bad or unexpected frame, or could not be written to
+	CloseUserError CloseReason = "user_error" // the user disconnected or its connection failed before the transfer completed
+	CloseTimeout   CloseReason = "timeout"    // no user came before the lease ran out, the user or bot stopped responding, or an idle or duration limit
+	CloseCanceled  CloseReason = "canceled"   // the bot sent MsgCancel
+	CloseAdminKill CloseReason = "admin_kill" // killed by KillSession, shed by SetMaxSessions, or the relay shut down
+	CloseQuota     CloseReason = "quota"      // a per-user limit ended the session
+	CloseStall     CloseReason = "stall"      // the slow-consumer policy aborted a lagging session
+	CloseTooLarge  CloseReason = "too_large"  // the session moved more than its declared size or MaxFileSize
+)
+
+// closeReasons lists every CloseReason, in the order metrics report them.
+var closeReasons = [...]CloseReason{CloseCompleted, CloseBotError, CloseUserError, CloseTimeout, CloseCanceled, CloseAdminKill, CloseQuota, CloseStall, CloseTooLarge}
+
+// setCloseReason records why the session is ending. The first reason wins, so the cause is
+// kept rather than the teardown it triggered.
+func (s *Session) setCloseReason(reason CloseReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+}
+
+// CloseReason returns why the session ended: an explicit reason if one was recorded,
+// otherwise CloseCompleted, or CloseBotError since the bot's handler ended it.
+func (s *Session) CloseReason() CloseReason {
+	s.mu.Lock()
+	reason := s.closeReason
+	s.mu.Unlock()
+	switch {
+	case reason != "":
+		return reason
+	case s.completed.Load():
+		return CloseCompleted
+	default:
+		return CloseBotError
+	}
+}
+
+// sessionStats summarizes sess for MsgStats. The duration runs from the user connecting (or
+// from registration if no user came) until now.
+func (r *Relay) sessionStats(sess *Session) SessionStats {
+	sess.mu.Lock()
+	start, peer := sess.connectedAt, sess.peer
+	sess.mu.Unlock()
+	if start.IsZero() {
+		start = sess.CreatedAt
+	}
+	st := SessionStats{
+		Bytes:     sess.Bytes(),
+		UserBytes: sess.UserBytes(),
+		Duration:  time.Since(start),
+		Reason:    string(sess.CloseReason()),
+	}
+	if secs := st.Duration.Seconds(); secs > 0 {
+		st.AvgRateBps = int64(float64(st.Bytes) / secs)
+	}
+	if peer.IsValid() {
+		if r.config.StatsRedactPeer {
+			peer = redactIP(peer)
+		}
+		st.Peer = peer.String()
+	}
+	// A chained session's user is at the end of the chain; the last relay knows about it.
+	if up := sess.upstream.Load(); up != nil {
+		st.UserBytes, st.Peer = up.UserBytes, up.Peer
+	}
+	return st
+}
+
+// redactIP keeps the network part of ip: the /24 of an IPv4 address, the /48 of IPv6.
+func redactIP(ip netip.Addr) netip.Addr {
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p.Addr()
+}
+
+// sendSessionStats waits for sess to end and sends the bot MsgStats on its connection,
+// unless the session was handed to another connection or the relay is stopping.
+func (r *Relay) sendSessionStats(ctx context.Context, sess *Session, detach <-chan struct{}) {
+	select {
+	case <-sess.Done:
+	case <-detach:
+		return
+	case <-ctx.Done():
+		return
+	}
+	if sess.detached(detach) {
+		return
+	}
+	_ = sess.writeBot(MsgStats, r.sessionStats(sess).Marshal())
+}
+
+// closeOnFrameError records CloseBotError when a session's frame read failed, and tells the
+// bot if it was an oversized frame. The caller still tears the session down.
+func (r *Relay) closeOnFrameError(sess *Session, err error) {
+	if err == nil {
+		return
+	}
+	sess.setCloseReason(CloseBotError)
+	if errors.Is(err, ErrFrameTooLarge) {
+		replyFrameError(err, sess.writeBot)
+	}
+}
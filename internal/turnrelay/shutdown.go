@@ -0,0 +1,138 @@
+package turnrelay
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// drainPollInterval is how often Shutdown checks whether the remaining sessions finished.
+const drainPollInterval = 100 * time.Millisecond
+
+// Shutdown stops the relay. It first stops accepting: the bot and SNI listeners are closed,
+// registrations on open bot connections are refused with ErrShuttingDown, and sessions no
+// user has claimed yet are ended, which closes their DCC listeners. Sessions that are
+// transferring are left to finish until ctx ends. Then everything else stops: the remaining
+// sessions are ended (CloseAdminKill), bot connections and the metrics and status listeners
+// are closed, background loops return, statistics and quota counters are written and every
+// DCC port is back in the pool. The sessions it ended are written to InterruptedFile if set.
+// When it returns, every listener is closed and every accept loop, connection handler and
+// background loop has returned, so the ports can be bound again.
+// Shutdown returns ctx.Err() if sessions had to be cut off, nil otherwise. It runs once:
+// further calls, concurrent ones included, wait for the first and return its result. The
+// relay cannot be run again afterwards.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() {
+		r.stopErr = r.shutdown(ctx)
+		close(r.stopped)
+	})
+	return r.stopErr
+}
+
+func (r *Relay) shutdown(ctx context.Context) error {
+	r.stopAccepting()
+	log.Printf("relay: shutting down, draining %d sessions", r.drainUnclaimed())
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	var err error
+	for err == nil && r.drainUnclaimed() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-t.C:
+		}
+	}
+	r.cancel()
+	if n := r.endSessions(); n > 0 {
+		log.Printf("relay: shutdown: ended %d sessions still in progress", n)
+	}
+	// Handlers still finishing may record interrupted sessions and statistics.
+	r.running.Wait()
+	if err := r.writeInterrupted(); err != nil {
+		log.Printf("relay: interrupted sessions: %v", err)
+	}
+	if r.stats != nil {
+		if err := r.stats.Flush(); err != nil {
+			log.Printf("relay: stats: %v", err)
+		}
+	}
+	if err := r.usage.save(); err != nil {
+		log.Printf("relay: quota file: %v", err)
+	}
+	log.Printf("relay: stopped")
+	return err
+}
+
+// spawn runs f in a goroutine that Shutdown waits for. Listeners, connection handlers and
+// background loops go through here; f must return once r.ctx ends. Only goroutines that are
+// themselves spawned, or Run, may call it, so none is added after Shutdown stopped waiting.
+func (r *Relay) spawn(f func()) {
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		f()
+	}()
+}
+
+// RunContext starts the relay like Run and blocks until it has stopped. If a listener or
+// accept loop fails while running, the relay is stopped and that error returned. When ctx
+// ends the relay is stopped without draining and nil returned; for a graceful stop, call
+// Shutdown instead, after which RunContext returns nil.
+func (r *Relay) RunContext(ctx context.Context) error {
+	if err := r.Run(); err != nil {
+		return err
+	}
+	var err error
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+	case err = <-r.health.failed:
+	}
+	now, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.Shutdown(now)
+	return err
+}
+
+// drainUnclaimed ends the sessions no user has claimed and returns how many are left. It
+// runs until the drain is over, so sessions whose registration was already past the
+// ErrShuttingDown check go too.
+func (r *Relay) drainUnclaimed() int {
+	var left int
+	for _, sess := range r.sessionList() {
+		if sess.isClaimed() {
+			left++
+			continue
+		}
+		r.interrupt(sess, InterruptedUnclaimed)
+		sess.setCloseReason(CloseAdminKill)
+		r.removeSession(sess.ID)
+	}
+	return left
+}
+
+// endSessions ends every remaining session and returns how many there were.
+func (r *Relay) endSessions() int {
+	sessions := r.sessionList()
+	for _, sess := range sessions {
+		r.interrupt(sess, InterruptedDrainTimeout)
+		sess.setCloseReason(CloseAdminKill)
+		r.removeSession(sess.ID)
+	}
+	return len(sessions)
+}
+
+// sessionList returns the registered sessions.
+func (r *Relay) sessionList() []*Session {
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// draining reports whether Shutdown has been called.
+func (r *Relay) draining() bool { return r.accepting.Err() != nil }
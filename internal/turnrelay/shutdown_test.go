@@ -0,0 +1,65 @@
+package turnrelay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// When Shutdown returns, the relay's ports can be bound again right away, and concurrent
+// calls (POST /drain racing SIGTERM) run the sequence once and agree on the result.
+func TestShutdownWaitsAndRunsOnce(t *testing.T) {
+	c := newTestConfig(t, 4)
+	c.InterruptedFile = filepath.Join(t.TempDir(), "interrupted.json")
+	r, addr, _ := startAdminRelay(t, c)
+
+	idle := dialTestBot(t, addr) // a handler blocked reading the next frame
+	defer idle.Close()
+	port := registerTestSession(t, dialTestBot(t, addr), "upload", testSessionID(1))
+	dialTestUser(t, port) // claimed, so Shutdown has to cut it off
+	sess, err := r.lookupSession(testSessionID(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 2*time.Second, "the user to claim the session", sess.isClaimed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != context.DeadlineExceeded {
+			t.Errorf("Shutdown call %d: %v, want %v", i, err, context.DeadlineExceeded)
+		}
+	}
+
+	for _, a := range []string{addr, c.AdminListen, fmt.Sprintf("127.0.0.1:%d", port)} {
+		ln, err := net.Listen("tcp", a)
+		if err != nil {
+			t.Errorf("%s still bound after Shutdown: %v", a, err)
+			continue
+		}
+		ln.Close()
+	}
+
+	_, sessions, err := ReadInterrupted(c.InterruptedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != testSessionID(1) {
+		t.Fatalf("interrupted sessions %+v, want just %s", sessions, testSessionID(1))
+	}
+}
@@ -0,0 +1,124 @@
+package turnrelay
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Slow-consumer policies (SlowConsumerPolicy).
+const (
+	SlowConsumerWarn     = "warn"     // log once per episode
+	SlowConsumerThrottle = "throttle" // log, and hold the fast side until the buffer drains below the threshold
+	SlowConsumerAbort    = "abort"    // log and close the session
+)
+
+// slowConsumerCheckInterval is how often session buffers are sampled.
+const slowConsumerCheckInterval = time.Second
+
+// Occupancy returns how full the session's relay buffer is, 0..1: BotStream for downloads
+// (a full buffer means the user reads slower than the bot sends), UserConn for uploads (the
+// bot reads slower than the user sends), the fuller of the two for forwards.
+func (s *Session) Occupancy() float64 {
+	down := float64(len(s.BotStream)) / float64(cap(s.BotStream))
+	up := float64(len(s.UserConn)) / float64(cap(s.UserConn))
+	switch s.Kind {
+	case "download":
+		return down
+	case "forward":
+		return max(down, up)
+	default:
+		return up
+	}
+}
+
+// slowSide names the side that is falling behind when the buffer fills.
+func (s *Session) slowSide() string {
+	switch {
+	case s.Kind == "download":
+		return "user"
+	case s.Kind == "forward" && len(s.BotStream)*cap(s.UserConn) >= len(s.UserConn)*cap(s.BotStream):
+		return "user"
+	default:
+		return "bot"
+	}
+}
+
+func (r *Relay) slowConsumerThreshold() float64 {
+	if r.config.SlowConsumerThreshold > 0 && r.config.SlowConsumerThreshold <= 100 {
+		return float64(r.config.SlowConsumerThreshold) / 100
+	}
+	return 0.9
+}
+
+func (r *Relay) slowConsumerGrace() time.Duration {
+	if r.config.SlowConsumerGraceSec > 0 {
+		return time.Duration(r.config.SlowConsumerGraceSec) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// monitorSlowConsumers samples every session's buffer occupancy and applies the policy to
+// sessions that stay above the threshold for longer than the grace period.
+func (r *Relay) monitorSlowConsumers() {
+	h := r.health.register("slow consumer monitor", 10*slowConsumerCheckInterval)
+	t := time.NewTicker(slowConsumerCheckInterval)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-r.ctx.Done():
+			h.stop()
+			return
+		case now = <-t.C:
+		}
+		h.beat()
+		threshold, grace := r.slowConsumerThreshold(), r.slowConsumerGrace()
+		r.sessionsMu.RLock()
+		sessions := make([]*Session, 0, len(r.sessions))
+		for _, s := range r.sessions {
+			sessions = append(sessions, s)
+		}
+		r.sessionsMu.RUnlock()
+		for _, s := range sessions {
+			occ := s.Occupancy()
+			if occ < threshold {
+				s.lagSince = time.Time{}
+				s.lagReported = false
+				continue
+			}
+			if s.lagSince.IsZero() {
+				s.lagSince = now
+			}
+			if s.lagReported || now.Sub(s.lagSince) < grace {
+				continue
+			}
+			s.lagReported = true
+			atomic.AddInt64(&r.metrics.slowConsumers, 1)
+			log.Printf("relay: %s: slow %s, buffer %.0f%% full for %s (policy %s)",
+				s, s.slowSide(), occ*100, now.Sub(s.lagSince).Round(time.Second), r.config.SlowConsumerPolicy)
+			if r.config.SlowConsumerPolicy == SlowConsumerAbort {
+				r.audit.record(sessionEvent("slow_consumer_abort", s))
+				s.setCloseReason(CloseStall)
+				r.removeSession(s.ID)
+			}
+		}
+	}
+}
+
+// throttleFastSide blocks the sending side of sess while the throttle policy is active and
+// the buffer is above the threshold. It returns false if the session closed meanwhile.
+func (r *Relay) throttleFastSide(sess *Session) bool {
+	if r.config.SlowConsumerPolicy != SlowConsumerThrottle {
+		return true
+	}
+	threshold := r.slowConsumerThreshold()
+	for sess.Occupancy() >= threshold {
+		select {
+		case <-sess.Done:
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package turnrelay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/listener"
+)
+
+// errUnknownSNI fails the handshake of a user whose server name names no waiting session.
+var errUnknownSNI = errors.New("unknown session server name")
+
+// newSessionToken returns a random 32-character hex label, usable as a DNS label and
+// unguessable enough to authorize the connection that presents it.
+func newSessionToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sniRouting reports whether users can reach sessions by server name: on DCCSNIListen or,
+// in single-port mode, on TURNListen.
+func (r *Relay) sniRouting() bool {
+	return r.config.DCCSNIListen != "" || r.config.SinglePort
+}
+
+// freePorts returns the number of DCC ports left to allocate. In single-port mode every
+// session shares TURNListen, so it is the number of session slots left.
+func (r *Relay) freePorts() int {
+	if !r.config.SinglePort {
+		return r.portPool.Free()
+	}
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+	return max(int(atomic.LoadInt32(&r.maxSessions))-len(r.sessions), 0)
+}
+
+// coolingPorts returns the DCC ports waiting out their cooldown (0 in single-port mode).
+func (r *Relay) coolingPorts() int {
+	if r.config.SinglePort {
+		return 0
+	}
+	return r.portPool.Cooling()
+}
+
+// sniHost returns the server name that reaches sess by SNI routing, or "" if it is off.
+func (r *Relay) sniHost(sess *Session) string {
+	if !r.sniRouting() || sess.Token == "" {
+		return ""
+	}
+	return sess.Token + "." + r.config.DCCSNIDomain
+}
+
+// sniToken returns the session token in server name name, if name is under DCCSNIDomain.
+func (r *Relay) sniToken(name string) (string, bool) {
+	return strings.CutSuffix(strings.ToLower(name), "."+strings.ToLower(r.config.DCCSNIDomain))
+}
+
+// sessionBySNI returns the unclaimed session whose token is the first label of name, or nil.
+func (r *Relay) sessionBySNI(name string) *Session {
+	token, ok := r.sniToken(name)
+	if !ok || token == "" || strings.Contains(token, ".") {
+		return nil
+	}
+	r.sessionsMu.RLock()
+	defer r.sessionsMu.RUnlock()
+	for _, sess := range r.sessions {
+		if sess.Token != "" && subtle.ConstantTimeCompare([]byte(sess.Token), []byte(token)) == 1 && (!sess.isClaimed() || sess.fan != nil && sess.fan.joinable()) {
+			return sess
+		}
+	}
+	return nil
+}
+
+// listenSNI opens DCCSNIListen, the single DCC port where users name their session in the
+// TLS server name. Unknown names are refused during the handshake. Per-session ports stay
+// open as well; whichever connection arrives first claims the session.
+func (r *Relay) listenSNI(tlsConfig *tls.Config) error {
+	if r.config.DCCSNIDomain == "" {
+		return errors.New("dcc_sni_listen needs dcc_sni_domain")
+	}
+	cfg := tlsConfig.Clone()
+	cfg.GetConfigForClient = r.checkSNI(true)
+	ln, err := tls.Listen("tcp", r.config.DCCSNIListen, cfg)
+	if err != nil {
+		return fmt.Errorf("dcc sni listen: %w", err)
+	}
+	r.spawn(func() {
+		h := r.health.register("dcc sni accept loop", 0)
+		err := listener.Serve(r.accepting, ln, func(_ context.Context, conn net.Conn) {
+			r.handleSNIConnection(r.ctx, conn.(*tls.Conn))
+		}, listener.Options{OnAccept: h.beat, OnFDExhausted: r.fdExhausted, Handlers: &r.running})
+		if r.draining() {
+			h.stop()
+			return
+		}
+		log.Printf("relay: accept dcc sni: %v", err)
+		h.exit(err)
+	})
+	log.Printf("relay: DCC SNI listening on %s (*.%s)", r.config.DCCSNIListen, r.config.DCCSNIDomain)
+	return nil
+}
+
+// checkSNI returns a GetConfigForClient hook that fails the handshake of a server name under
+// DCCSNIDomain naming no waiting session. With strict, every other name fails too; without
+// (single-port mode), other names are bot connections and pass.
+func (r *Relay) checkSNI(strict bool) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if _, under := r.sniToken(hello.ServerName); !under && !strict {
+			return nil, nil
+		}
+		if r.sessionBySNI(hello.ServerName) == nil {
+			return nil, errUnknownSNI
+		}
+		return nil, nil
+	}
+}
+
+// handleSNIConnection completes the handshake and serves the user like a per-session DCC
+// port would.
+func (r *Relay) handleSNIConnection(ctx context.Context, conn *tls.Conn) {
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	err := conn.HandshakeContext(hctx)
+	cancel()
+	if err != nil {
+		r.debug.printf("relay: dcc sni %s: handshake: %v", r.peerString(conn.RemoteAddr()), err)
+		conn.Close()
+		return
+	}
+	r.serveSNIUser(conn)
+}
+
+// serveSNIUser claims the session named by the server name of the handshaken conn and
+// serves the user on it.
+func (r *Relay) serveSNIUser(conn *tls.Conn) {
+	sess := r.sessionBySNI(conn.ConnectionState().ServerName)
+	if sess != nil && sess.fan != nil {
+		r.serveFanoutUser(conn, sess)
+		return
+	}
+	if sess == nil || !sess.claim() {
+		conn.Close()
+		return
+	}
+	defer r.recoverPanic("dcc session "+sess.ID, func() { r.removeSession(sess.ID) })
+	r.serveDCCUser(conn, sess)
+}
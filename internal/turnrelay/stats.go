@@ -0,0 +1,70 @@
+package turnrelay
+
+import (
+	"log"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/stats"
+)
+
+// statsFlushInterval is how often changed statistics are written to StatsFile.
+const statsFlushInterval = 30 * time.Second
+
+// defaultStatsRetentionDays is how long daily rollups are kept when StatsRetentionDays is 0.
+const defaultStatsRetentionDays = 400
+
+func openStats(c *RelayConfig) (*stats.Store, error) {
+	if c.StatsFile == "" {
+		return nil, nil
+	}
+	days := c.StatsRetentionDays
+	if days <= 0 {
+		days = defaultStatsRetentionDays
+	}
+	return stats.Open(c.StatsFile, time.Duration(days)*24*time.Hour)
+}
+
+// recordStats adds a finished session to the persistent statistics.
+func (r *Relay) recordStats(sess *Session) {
+	if r.stats == nil {
+		return
+	}
+	r.stats.Record(sess.owner, time.Now(), sess.Bytes(), sess.completed.Load())
+	if peer := sess.chargedPeer(); peer != "" {
+		r.stats.Record(peer, time.Now(), sess.Bytes(), sess.completed.Load())
+	}
+}
+
+// flushStats writes the statistics periodically and once more when the relay stops.
+func (r *Relay) flushStats() {
+	h := r.health.register("stats writer", 3*statsFlushInterval)
+	t := time.NewTicker(statsFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			if err := r.stats.Flush(); err != nil {
+				log.Printf("relay: stats: %v", err)
+			}
+			h.stop()
+			return
+		case <-t.C:
+		}
+		if err := r.stats.Flush(); err != nil {
+			log.Printf("relay: stats: %v", err)
+			r.noteWriteError("stats_file", err)
+			continue
+		}
+		h.beat()
+	}
+}
+
+// Stats returns per-bot-user totals (sessions, bytes, failures) for the UTC days from
+// since through until, followed by the overall total (User ""). It returns nil if
+// StatsFile is not configured.
+func (r *Relay) Stats(since, until time.Time) []stats.Row {
+	if r.stats == nil {
+		return nil
+	}
+	return r.stats.Query(since, until)
+}
@@ -0,0 +1,91 @@
+package turnrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// PublicStatus is what the unauthenticated status page (StatusListen) shows: aggregate
+// availability only, nothing about users, sessions or peers.
+type PublicStatus struct {
+	Up        bool     `json:"up"`           // the relay is running and all its background loops are healthy
+	Capacity  int      `json:"capacity_pct"` // share of bot connection slots and DCC ports still free, the lower of the two
+	Protocols []string `json:"protocols"`    // ALPN protocol IDs served to bots on the bot port
+}
+
+// PublicStatus returns the relay's aggregate availability.
+func (r *Relay) PublicStatus() PublicStatus {
+	slots := atomic.LoadInt32(&r.maxSessions)
+	capacity := 100
+	if slots > 0 {
+		capacity = min(capacity, int(100*max(slots-atomic.LoadInt32(&r.currentConns), 0)/slots))
+	}
+	if !r.config.SinglePort {
+		if size := r.portPool.Size(); size > 0 {
+			capacity = min(capacity, 100*r.portPool.Free()/size)
+		}
+	}
+	return PublicStatus{
+		Up:        !r.draining() && r.Health().Ready,
+		Capacity:  capacity,
+		Protocols: r.botNextProtos(),
+	}
+}
+
+// serveStatus serves the public status page on StatusListen: HTML at / and JSON at
+// /status.json. Either answers 503 while the relay is not up, for simple uptime probes.
+func (r *Relay) serveStatus() error {
+	ln, err := net.Listen("tcp", r.config.StatusListen)
+	if err != nil {
+		return fmt.Errorf("status listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status.json", func(w http.ResponseWriter, req *http.Request) {
+		st := r.PublicStatus()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !st.Up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(st)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		st := r.PublicStatus()
+		state := "up"
+		if !st.Up {
+			state = "down"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if !st.Up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><title>huzaa relay status</title></head><body>\n"+
+			"<h1>huzaa relay: %s</h1>\n<p>Free capacity: %d%%</p>\n<p>Bot protocols: %s</p>\n</body></html>\n",
+			state, st.Capacity, html.EscapeString(strings.Join(st.Protocols, ", ")))
+	})
+	context.AfterFunc(r.ctx, func() { ln.Close() })
+	r.spawn(func() {
+		h := r.health.register("status server", 0)
+		err := http.Serve(ln, mux)
+		if r.ctx.Err() != nil {
+			h.stop()
+			return
+		}
+		log.Printf("relay: status server: %v", err)
+		h.exit(err)
+	})
+	log.Printf("relay: status page listening on %s", r.config.StatusListen)
+	return nil
+}
@@ -0,0 +1,252 @@
+package turnrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay/auth"
+)
+
+// stressSessions is how many downloads, and as many uploads, TestStress runs at once
+// (-short: stressSessionsShort).
+const (
+	stressSessions      = 150
+	stressSessionsShort = 20
+	stressBytes         = 48 << 10
+	stressChunk         = 8 << 10
+)
+
+// TestStress runs hundreds of concurrent downloads and uploads through an in-process relay,
+// checks every byte, and then that no session, DCC port or goroutine is left over. Run it
+// with -race.
+func TestStress(t *testing.T) {
+	n := stressSessions
+	if testing.Short() {
+		n = stressSessionsShort
+	}
+	// The pool picks ports at random, so leave it plenty of headroom and no cooldown.
+	c := newTestConfig(t, 8*n)
+	c.PortCooldownSec = -1
+	c.MaxSessions = 4 * n
+	r, addr := startTestRelay(t, c)
+	data := make([]byte, stressBytes)
+	rand.Read(data)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := stressDownload(addr, testSessionID(i), data); err != nil {
+				errs <- fmt.Errorf("download %d: %w", i, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := stressUpload(addr, testSessionID(n+i), data); err != nil {
+				errs <- fmt.Errorf("upload %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	waitFor(t, 10*time.Second, "sessions to be removed", func() bool { return sessionCount(r) == 0 })
+	if free, cooling, size := r.portPool.Free(), r.portPool.Cooling(), r.portPool.Size(); free+cooling != size {
+		t.Errorf("ports: %d free + %d cooling of %d; %d leaked", free, cooling, size, size-free-cooling)
+	}
+	if m := r.Metrics(); m.IntegrityErrors != 0 {
+		t.Errorf("%d integrity errors", m.IntegrityErrors)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	checkGoroutines(t)
+}
+
+// relayPackages marks the stack frames of the turnrelay package and its subpackages.
+const relayPackages = "github.com/awgh/huzaa-relay/internal/turnrelay"
+
+// checkGoroutines fails t, listing their stacks, if goroutines that run code of the relay or
+// were started by it are still running after a grace period. This is what goleak's
+// VerifyNone would check, without adding a dependency to go.mod.
+func checkGoroutines(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leaked := relayGoroutines()
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines of the relay left:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// relayGoroutines returns the stacks of all goroutines but the caller's that have a frame in
+// relayPackages, including the "created by" line.
+func relayGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var leaked []string
+	// Goroutine stacks are separated by blank lines; the caller's comes first.
+	for _, g := range strings.Split(string(buf), "\n\n")[1:] {
+		if strings.Contains(g, relayPackages) {
+			leaked = append(leaked, g)
+		}
+	}
+	return leaked
+}
+
+// stressBot connects to the relay at addr as testUser and registers a session of kind,
+// returning the connection and the DCC port. It does not use testing.T, so goroutines can
+// call it.
+func stressBot(addr, kind, sessionID string) (*tls.Conn, int, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{ALPNFrames}})
+	if err != nil {
+		return nil, 0, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	if err := WriteFrame(conn, MsgAuth, auth.MarshalRequest(testUser, testSecret)); err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	if _, err := readChainReply(conn, MsgAuthOk); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("auth: %w", err)
+	}
+	msgType := map[string]byte{"download": MsgRegisterDownload, "upload": MsgRegisterUpload, "forward": MsgRegisterForward}[kind]
+	alloc, err := registerChained(conn, msgType, Registration{SessionID: sessionID, Filename: "stress.bin"})
+	if err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("register: %w", err)
+	}
+	return conn, alloc.Port, nil
+}
+
+// stressUser connects to a session's DCC port.
+func stressUser(port int) (*tls.Conn, error) {
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	return conn, nil
+}
+
+// stressDownload sends data from a bot to a DCC user and waits for the bot's MsgStats.
+func stressDownload(addr, sessionID string, data []byte) error {
+	bot, port, err := stressBot(addr, "download", sessionID)
+	if err != nil {
+		return err
+	}
+	defer bot.Close()
+	sent := make(chan error, 1)
+	go func() {
+		for off := 0; off < len(data); off += stressChunk {
+			if err := WriteFrame(bot, MsgData, data[off:min(off+stressChunk, len(data))]); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- WriteFrame(bot, MsgEOF, nil)
+	}()
+	user, err := stressUser(port)
+	if err != nil {
+		return err
+	}
+	defer user.Close()
+	got, err := io.ReadAll(user)
+	if err != nil {
+		return fmt.Errorf("user read: %w", err)
+	}
+	if err := <-sent; err != nil {
+		return fmt.Errorf("bot write: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("user got %d bytes, not the %d sent", len(got), len(data))
+	}
+	if _, err := readChainReply(bot, MsgStats); err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	return nil
+}
+
+// stressUpload sends data from a DCC user to a bot and waits for the bot's MsgStats.
+func stressUpload(addr, sessionID string, data []byte) error {
+	bot, port, err := stressBot(addr, "upload", sessionID)
+	if err != nil {
+		return err
+	}
+	defer bot.Close()
+	user, err := stressUser(port)
+	if err != nil {
+		return err
+	}
+	defer user.Close()
+	sent := make(chan error, 1)
+	go func() {
+		_, err := user.Write(data)
+		if err == nil {
+			err = user.CloseWrite()
+		}
+		sent <- err
+	}()
+	var got []byte
+	for {
+		msgType, payload, err := ReadFrame(bot)
+		if err != nil {
+			return fmt.Errorf("bot read: %w", err)
+		}
+		if msgType == MsgData {
+			got = append(got, payload...)
+			continue
+		}
+		if msgType == MsgEOF {
+			break
+		}
+		if msgType == MsgError {
+			return errors.New(string(payload))
+		}
+	}
+	if err := <-sent; err != nil {
+		return fmt.Errorf("user write: %w", err)
+	}
+	if !bytes.Equal(got, data) {
+		return fmt.Errorf("bot got %d bytes, not the %d sent", len(got), len(data))
+	}
+	if _, err := readChainReply(bot, MsgStats); err != nil {
+		return fmt.Errorf("stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package turnrelay
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceCapacity = 4096 // events kept per traced session; older ones are dropped
+	traceKeep     = 32   // traces kept for SessionTrace, including those of ended sessions
+)
+
+// Trace parties.
+const (
+	traceBot   = "bot"
+	traceRelay = "relay"
+	traceUser  = "user"
+)
+
+// traceEvent is one frame, user read/write or state change of a traced session. A state
+// change has from == to == traceRelay.
+type traceEvent struct {
+	at       time.Time
+	from, to string
+	what     string
+	n        int // payload bytes
+}
+
+// sessionTrace records a session's events in a ring of traceCapacity.
+type sessionTrace struct {
+	header  string // session description at the start of tracing
+	started time.Time
+
+	mu      sync.Mutex
+	events  []traceEvent
+	next    int // ring position once events is full
+	dropped int
+	stopped bool
+}
+
+func (t *sessionTrace) add(from, to, what string, n int) {
+	ev := traceEvent{at: time.Now(), from: from, to: to, what: what, n: n}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if len(t.events) < traceCapacity {
+		t.events = append(t.events, ev)
+		return
+	}
+	t.events[t.next] = ev
+	t.next = (t.next + 1) % traceCapacity
+	t.dropped++
+}
+
+// snapshot returns the recorded events in order and how many were dropped before them.
+func (t *sessionTrace) snapshot() ([]traceEvent, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]traceEvent, 0, len(t.events))
+	out = append(out, t.events[t.next:]...)
+	out = append(out, t.events[:t.next]...)
+	return out, t.dropped
+}
+
+// traceStore holds the traces the relay keeps, oldest first.
+type traceStore struct {
+	mu     sync.Mutex
+	order  []string
+	traces map[string]*sessionTrace
+}
+
+func (s *traceStore) get(sessionID string) *sessionTrace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.traces[sessionID]
+}
+
+func (s *traceStore) put(sessionID string, t *sessionTrace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.traces == nil {
+		s.traces = make(map[string]*sessionTrace)
+	}
+	if _, ok := s.traces[sessionID]; !ok {
+		s.order = append(s.order, sessionID)
+	}
+	s.traces[sessionID] = t
+	for len(s.order) > traceKeep {
+		delete(s.traces, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// traceEvent records an event if the session is being traced.
+func (s *Session) traceEvent(from, to, what string, n int) {
+	if t := s.trace.Load(); t != nil {
+		t.add(from, to, what, n)
+	}
+}
+
+// advance moves the session's state machine and traces the transition.
+func (s *Session) advance(next SessionState) {
+	if s.fsm.advance(next) {
+		s.traceEvent(traceRelay, traceRelay, next.String(), 0)
+	}
+}
+
+// ioTraceText describes a user read or write for the trace.
+func ioTraceText(op string, err error) string {
+	switch {
+	case err == io.EOF:
+		return op + " EOF"
+	case err != nil:
+		return op + " error: " + err.Error()
+	}
+	return op
+}
+
+// readBotFrame reads a frame of sess from its bot connection and traces it.
+func (r *Relay) readBotFrame(conn net.Conn, sess *Session) (byte, []byte, error) {
+	msgType, payload, err := r.readFrameReplying(conn, func(t byte, p []byte) error { return sess.writeBotOn(conn, t, p) })
+	if err != nil {
+		sess.traceEvent(traceBot, traceRelay, "read error: "+err.Error(), 0)
+	} else {
+		sess.traceEvent(traceBot, traceRelay, MsgTypeName(msgType), len(payload))
+		if msgType == MsgData {
+			sess.integrity.botIn(payload)
+			sess.sum.write(payload)
+		}
+	}
+	return msgType, payload, err
+}
+
+// TraceSession starts (on) or stops recording every bot frame, user read and write and
+// state change of a session, for SessionTrace. Starting again discards the previous trace.
+func (r *Relay) TraceSession(actor, sessionID string, on bool) error {
+	params := map[string]string{"session": sessionID, "on": fmt.Sprint(on)}
+	sess, err := r.lookupSession(sessionID)
+	if err == nil {
+		if on {
+			t := &sessionTrace{
+				header:  fmt.Sprintf("%s, %s %q, state %s, %d bytes so far", sess, sess.Kind, sess.Filename, sess.State(), sess.Bytes()),
+				started: time.Now(),
+			}
+			r.traces.put(sessionID, t)
+			sess.trace.Store(t)
+			log.Printf("relay: %s: tracing started by %s", sess, actor)
+		} else if t := sess.trace.Swap(nil); t != nil {
+			t.mu.Lock()
+			t.stopped = true
+			t.mu.Unlock()
+			log.Printf("relay: %s: tracing stopped by %s", sess, actor)
+		}
+	}
+	r.recordAdminAction(actor, "trace_session", params, err)
+	return err
+}
+
+// SessionTrace renders the trace of a session as "text" (one line per event) or
+// "mermaid" (a sequenceDiagram). Runs of identical events, such as a stream of data
+// frames, are folded into one line. Traces of ended sessions stay available for the last
+// traceKeep traced sessions.
+func (r *Relay) SessionTrace(sessionID, format string) (string, error) {
+	t := r.traces.get(sessionID)
+	if t == nil {
+		return "", fmt.Errorf("%w: no trace for %s", ErrSessionNotFound, sessionID)
+	}
+	events, dropped := t.snapshot()
+	runs := foldTrace(events)
+	var b strings.Builder
+	switch format {
+	case "", "text":
+		fmt.Fprintf(&b, "trace of %s\n", t.header)
+		if dropped > 0 {
+			fmt.Fprintf(&b, "(%d earlier events dropped)\n", dropped)
+		}
+		for _, run := range runs {
+			party := run.from + " -> " + run.to
+			if run.from == run.to {
+				party = run.from
+			}
+			fmt.Fprintf(&b, "%-18s %-14s %s\n", run.offset(t.started), party, run.label())
+		}
+	case "mermaid":
+		fmt.Fprintf(&b, "sequenceDiagram\n    title %s\n", mermaidText(t.header))
+		fmt.Fprintf(&b, "    participant %s\n    participant %s\n    participant %s\n", traceBot, traceRelay, traceUser)
+		if dropped > 0 {
+			fmt.Fprintf(&b, "    Note over %s,%s: %d earlier events dropped\n", traceBot, traceUser, dropped)
+		}
+		for _, run := range runs {
+			if run.from == run.to {
+				fmt.Fprintf(&b, "    Note over %s: %s %s\n", run.from, mermaidText(run.label()), run.offset(t.started))
+			} else {
+				fmt.Fprintf(&b, "    %s->>%s: %s %s\n", run.from, run.to, mermaidText(run.label()), run.offset(t.started))
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown trace format %q (text or mermaid)", format)
+	}
+	return b.String(), nil
+}
+
+// traceRun is a run of consecutive events with the same parties and description.
+type traceRun struct {
+	traceEvent
+	last  time.Time
+	count int
+	bytes int64
+}
+
+func foldTrace(events []traceEvent) []traceRun {
+	var runs []traceRun
+	for _, ev := range events {
+		if n := len(runs); n > 0 && runs[n-1].from == ev.from && runs[n-1].to == ev.to && runs[n-1].what == ev.what {
+			runs[n-1].last = ev.at
+			runs[n-1].count++
+			runs[n-1].bytes += int64(ev.n)
+			continue
+		}
+		runs = append(runs, traceRun{traceEvent: ev, last: ev.at, count: 1, bytes: int64(ev.n)})
+	}
+	return runs
+}
+
+func (run traceRun) offset(start time.Time) string {
+	first := fmt.Sprintf("+%.3fs", run.at.Sub(start).Seconds())
+	if run.count == 1 {
+		return first
+	}
+	return fmt.Sprintf("%s..+%.3fs", first, run.last.Sub(start).Seconds())
+}
+
+func (run traceRun) label() string {
+	switch {
+	case run.count > 1:
+		return fmt.Sprintf("%s x%d (%d bytes)", run.what, run.count, run.bytes)
+	case run.bytes > 0:
+		return fmt.Sprintf("%s (%d bytes)", run.what, run.bytes)
+	}
+	return run.what
+}
+
+// mermaidText makes s safe inside a mermaid message or note, using mermaid's entity codes.
+func mermaidText(s string) string {
+	return strings.NewReplacer("#", "#35;", ";", "#59;", ":", "#58;", "\n", " ").Replace(s)
+}
@@ -0,0 +1,18 @@
+package turnrelay
+
+import "io"
+
+// TransformInfo describes the session a StreamTransform is applied to.
+type TransformInfo struct {
+	SessionID string
+	Filename  string
+}
+
+// StreamTransform rewrites a download on the user-facing leg, e.g. to prepend a banner or
+// append a manifest. It is off unless RelayConfig.Transform is set.
+type StreamTransform interface {
+	// Wrap returns a writer that receives the bot's bytes and writes the transformed stream
+	// to w, or nil to leave this session untouched. Close is called once the bot's data has
+	// ended cleanly, so trailers can be written there; it is not called on aborted sessions.
+	Wrap(info TransformInfo, w io.Writer) io.WriteCloser
+}
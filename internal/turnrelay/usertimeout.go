@@ -0,0 +1,112 @@
+package turnrelay
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultUserKeepAlive    = 15 * time.Second
+	defaultUserTCPTimeout   = 45 * time.Second
+	defaultUserWriteTimeout = 60 * time.Second
+)
+
+// userTimeouts returns the configured keepalive, TCP user timeout and write timeout for
+// user connections; a zero setting means the default, a negative one disables it (0).
+func (r *Relay) userTimeouts() (keepAlive, tcpTimeout, writeTimeout time.Duration) {
+	pick := func(sec int, def time.Duration) time.Duration {
+		switch {
+		case sec < 0:
+			return 0
+		case sec == 0:
+			return def
+		default:
+			return time.Duration(sec) * time.Second
+		}
+	}
+	return pick(r.config.UserKeepAliveSec, defaultUserKeepAlive),
+		pick(r.config.UserTCPTimeoutSec, defaultUserTCPTimeout),
+		pick(r.config.UserWriteTimeoutSec, defaultUserWriteTimeout)
+}
+
+// wrapUserConn tunes a user connection for prompt half-open detection (keepalive and, on
+// Linux, TCP_USER_TIMEOUT) and returns it wrapped so that every write has a deadline. A
+// write that times out, or a read that fails because the peer stopped answering, ends the
+// session with CloseTimeout; for a fan-out session it only fails that user's writes.
+func (r *Relay) wrapUserConn(conn net.Conn, sess *Session) net.Conn {
+	keepAlive, tcpTimeout, writeTimeout := r.userTimeouts()
+	raw := conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		raw = tc.NetConn()
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		if keepAlive > 0 {
+			tcp.SetKeepAlive(true)
+			tcp.SetKeepAlivePeriod(keepAlive)
+		}
+		if tcpTimeout > 0 {
+			if err := setTCPUserTimeout(tcp, tcpTimeout); err != nil {
+				r.debug.sessionf(sess, "relay: %s: TCP_USER_TIMEOUT: %v", sess, err)
+			}
+		}
+	}
+	onTimeout := func(err error) {
+		sess.setCloseReason(CloseTimeout)
+		log.Printf("relay: %s: DCC user %s stopped responding: %v", sess, peerText(sess.Peer()), err)
+		r.removeSession(sess.ID)
+	}
+	if sess.fan != nil {
+		onTimeout = func(error) {}
+	}
+	return &userConn{Conn: conn, sess: sess, writeTimeout: writeTimeout, onTimeout: onTimeout}
+}
+
+// userConn is a user connection with a per-write deadline and timeout reporting.
+type userConn struct {
+	net.Conn
+	sess         *Session
+	writeTimeout time.Duration
+	onTimeout    func(error)
+}
+
+func (c *userConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	n, err := c.Conn.Write(p)
+	c.sess.traceEvent(traceRelay, traceUser, ioTraceText("write", err), n)
+	c.sess.integrity.userOut(p[:n])
+	if err != nil && isPeerTimeout(err) {
+		c.onTimeout(err)
+	}
+	return n, err
+}
+
+func (c *userConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.sess.traceEvent(traceUser, traceRelay, ioTraceText("read", err), n)
+	c.sess.integrity.userIn(p[:n])
+	if err != nil && isPeerTimeout(err) {
+		c.onTimeout(err)
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection if it supports it (forward sessions).
+func (c *userConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+// isPeerTimeout reports whether err means the peer stopped acknowledging: a write deadline,
+// or the kernel giving up on keepalives or unacknowledged data.
+func isPeerTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT)
+}
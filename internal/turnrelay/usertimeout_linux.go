@@ -0,0 +1,27 @@
+package turnrelay
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT from linux/tcp.h (not defined by syscall on every arch).
+const tcpUserTimeout = 0x12
+
+// setTCPUserTimeout limits how long data may stay unacknowledged before the kernel drops the
+// connection.
+func setTCPUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(d.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package turnrelay
+
+import (
+	"net"
+	"time"
+)
+
+// setTCPUserTimeout is a no-op outside Linux; keepalive and write deadlines still apply.
+func setTCPUserTimeout(conn *net.TCPConn, d time.Duration) error { return nil }
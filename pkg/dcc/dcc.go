@@ -0,0 +1,133 @@
+// Package dcc formats and parses the pieces of IRC DCC SEND offers that are easy to get
+// subtly wrong: the decimal "long IP" address form and filename quoting.
+//
+// A bot using the relay offers a transfer to an IRC user with a CTCP message such as
+//
+//	\x01DCC SEND "my file.txt" 3232235777 50042 1048576\x01
+//
+// where the address and port are the relay's (see relayclient.Conn.RelayAddrs) rather
+// than the bot's own.
+package dcc
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// LongIP returns the DCC form of ip: the decimal value of an IPv4 address (IPv4-mapped
+// IPv6 addresses included), or the textual form of an IPv6 address, which is what IPv6
+// capable clients expect in that position.
+func LongIP(ip netip.Addr) (string, error) {
+	if !ip.IsValid() {
+		return "", errors.New("dcc: invalid IP address")
+	}
+	ip = ip.Unmap()
+	if ip.Is4() {
+		b := ip.As4()
+		return strconv.FormatUint(uint64(b[0])<<24|uint64(b[1])<<16|uint64(b[2])<<8|uint64(b[3]), 10), nil
+	}
+	return ip.WithZone("").String(), nil
+}
+
+// ParseLongIP parses the address field of a DCC offer: a decimal long IP, or a dotted-quad
+// or IPv6 literal as some clients send.
+func ParseLongIP(s string) (netip.Addr, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("dcc: bad address %q", s)
+	}
+	return ip.Unmap(), nil
+}
+
+// SafeFilename reduces name to something every DCC client accepts: the last path element,
+// with double quotes, control characters and path separators replaced by '_'.
+func SafeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// QuoteFilename returns name as it goes in a DCC SEND line: made safe with SafeFilename and
+// wrapped in double quotes if it contains a space.
+func QuoteFilename(name string) string {
+	name = SafeFilename(name)
+	if strings.ContainsRune(name, ' ') {
+		return `"` + name + `"`
+	}
+	return name
+}
+
+// Offer is a DCC SEND offer.
+type Offer struct {
+	Filename string
+	IP       netip.Addr
+	Port     int
+	Size     int64 // -1 = unknown (omitted from the line)
+}
+
+// String formats the offer as a CTCP DCC SEND message, including the \x01 delimiters.
+func (o Offer) String() string {
+	ip, err := LongIP(o.IP)
+	if err != nil {
+		ip = "0"
+	}
+	line := fmt.Sprintf("DCC SEND %s %s %d", QuoteFilename(o.Filename), ip, o.Port)
+	if o.Size >= 0 {
+		line += " " + strconv.FormatInt(o.Size, 10)
+	}
+	return "\x01" + line + "\x01"
+}
+
+// ParseOffer parses a CTCP DCC SEND message, with or without the \x01 delimiters. Quoted
+// filenames may contain spaces; a missing size is returned as -1.
+func ParseOffer(msg string) (Offer, error) {
+	msg = strings.Trim(msg, "\x01")
+	rest, ok := strings.CutPrefix(msg, "DCC SEND ")
+	if !ok {
+		return Offer{}, errors.New("dcc: not a DCC SEND")
+	}
+	var o Offer
+	if strings.HasPrefix(rest, `"`) {
+		end := strings.IndexByte(rest[1:], '"')
+		if end < 0 {
+			return Offer{}, errors.New("dcc: unterminated filename quote")
+		}
+		o.Filename, rest = rest[1:1+end], strings.TrimLeft(rest[2+end:], " ")
+	} else {
+		o.Filename, rest, _ = strings.Cut(rest, " ")
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return Offer{}, errors.New("dcc: missing address or port")
+	}
+	var err error
+	if o.IP, err = ParseLongIP(fields[0]); err != nil {
+		return Offer{}, err
+	}
+	if o.Port, err = strconv.Atoi(fields[1]); err != nil || o.Port < 0 || o.Port > 65535 {
+		return Offer{}, fmt.Errorf("dcc: bad port %q", fields[1])
+	}
+	o.Size = -1
+	if len(fields) > 2 {
+		if o.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+			return Offer{}, fmt.Errorf("dcc: bad size %q", fields[2])
+		}
+	}
+	return o, nil
+}
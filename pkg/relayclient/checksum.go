@@ -0,0 +1,54 @@
+package relayclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// sessionSum hashes the data of a session registered with a checksum
+// (Registration.Checksum) and checks the relay's MsgChecksum against it.
+type sessionSum struct {
+	alg string
+	key []byte // session MAC key, see turnrelay.DeriveSessionKey
+	h   hash.Hash
+}
+
+// newSessionSum returns nil if alg is "" (no checksum).
+func (c *Conn) newSessionSum(sessionID, alg string) *sessionSum {
+	if alg == "" {
+		return nil
+	}
+	return &sessionSum{alg: alg, key: turnrelay.DeriveSessionKey([]byte(c.secret), c.nonce, sessionID), h: sha256.New()}
+}
+
+// write adds p to the hash; it does nothing on a nil *sessionSum.
+func (s *sessionSum) write(p []byte) {
+	if s != nil {
+		s.h.Write(p)
+	}
+}
+
+// message is the bot's MsgChecksum payload for the data hashed so far.
+func (s *sessionSum) message() []byte {
+	return turnrelay.Checksum{Algorithm: s.alg, Digest: s.h.Sum(nil)}.Marshal()
+}
+
+// verify checks the relay's MsgChecksum payload: it must be signed with the session key and
+// match the data hashed here.
+func (s *sessionSum) verify(payload []byte) error {
+	sum, err := turnrelay.ParseChecksum(payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	if sum.Algorithm != s.alg || !turnrelay.VerifyChecksum(s.key, sum.Digest, sum.Tag) {
+		return fmt.Errorf("%w: relay checksum is not signed for this session", ErrChecksumMismatch)
+	}
+	if own := s.h.Sum(nil); !bytes.Equal(sum.Digest, own) {
+		return fmt.Errorf("%w: relay %x, bot %x", ErrChecksumMismatch, sum.Digest, own)
+	}
+	return nil
+}
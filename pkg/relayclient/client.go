@@ -0,0 +1,401 @@
+// Package relayclient is the bot side of the huzaa relay protocol: it authenticates to a
+// relay, registers download/upload sessions and streams file data as MsgData frames.
+package relayclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// Config describes how to reach and authenticate to a relay.
+type Config struct {
+	Addr        string      // relay host:port (turn_listen)
+	Username    string      // turn_users username
+	Secret      string      // turn_users secret
+	TLSConfig   *tls.Config // nil = system roots, ServerName from Addr
+	DialTimeout time.Duration
+}
+
+// Conn is one authenticated bot connection. A connection carries a single session: after
+// RegisterDownload/RegisterUpload the stream belongs to that transfer.
+type Conn struct {
+	conn   net.Conn
+	nonce  []byte      // from MsgAuthOk; input to turnrelay.DeriveSessionKey
+	secret string      // turn_users secret; input to turnrelay.DeriveSessionKey
+	sum    *sessionSum // checksum of the registered session; nil = none
+	addrs  []string
+	sni    string
+	name   string // PortAlloc.Filename
+	max    int64  // PortAlloc.MaxBytes
+	motd   string
+	quota  *Quota
+	wmu    sync.Mutex
+}
+
+// Dial connects to the relay and authenticates.
+func Dial(ctx context.Context, cfg Config) (*Conn, error) {
+	tlsCfg := cfg.TLSConfig
+	if tlsCfg == nil {
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+	if len(tlsCfg.NextProtos) == 0 {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.NextProtos = []string{turnrelay.ALPNFrames}
+	}
+	d := &tls.Dialer{NetDialer: &net.Dialer{Timeout: cfg.DialTimeout}, Config: tlsCfg}
+	nc, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: nc}
+	if err := c.auth(ctx, cfg.Username, cfg.Secret); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) auth(ctx context.Context, username, secret string) error {
+	stop := c.closeOnDone(ctx)
+	defer stop()
+	payload := make([]byte, 4, 4+len(username)+len(secret))
+	binary.BigEndian.PutUint32(payload, uint32(len(username)))
+	payload = append(append(payload, username...), secret...)
+	if err := c.writeFrame(turnrelay.MsgAuth, payload); err != nil {
+		return ctxErr(ctx, err)
+	}
+	msgType, reply, err := c.readFrame()
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	switch msgType {
+	case turnrelay.MsgAuthOk:
+		ok, err := turnrelay.ParseAuthOk(reply)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrProtocol, err)
+		}
+		c.nonce, c.quota, c.secret = ok.Nonce, ok.Quota, secret
+		return nil
+	case turnrelay.MsgError:
+		return newRelayError(reply)
+	default:
+		return fmt.Errorf("%w: type %d during auth", ErrProtocol, msgType)
+	}
+}
+
+// Nonce returns the MsgAuthOk nonce used to derive per-session MAC keys.
+func (c *Conn) Nonce() []byte { return c.nonce }
+
+// RelayAddrs returns the addresses the relay advertised in its last PortAlloc, in preference
+// order (empty if the relay did not send any). Users should connect to one of these.
+func (c *Conn) RelayAddrs() []string { return c.addrs }
+
+// Quota is what a bot user has left today: sessions and bytes, -1 = unlimited.
+type Quota = turnrelay.Quota
+
+// Quota returns what this bot user has left today as reported at auth (-1 = unlimited), or
+// nil if the relay sets no quotas for it. Bots can use it to hold back transfers
+// instead of hitting ErrQuotaExceeded.
+func (c *Conn) Quota() *Quota { return c.quota }
+
+// Banner returns the operator notice the relay sent after auth (MsgBanner), or "" if none
+// has been received yet. It is read along with the first reply after Dial.
+func (c *Conn) Banner() string { return c.motd }
+
+// readFrame reads the next frame, answering the relay's keepalive MsgPing and skipping
+// MsgPong.
+func (c *Conn) readFrame() (byte, []byte, error) {
+	for {
+		t, payload, err := turnrelay.ReadFrame(c.conn)
+		switch {
+		case err != nil:
+			return t, payload, err
+		case t == turnrelay.MsgPing:
+			if err := c.writeFrame(turnrelay.MsgPong, payload); err != nil {
+				return 0, nil, err
+			}
+		case t != turnrelay.MsgPong:
+			return t, payload, nil
+		}
+	}
+}
+
+// readReply reads the next frame, recording and skipping MsgBanner.
+func (c *Conn) readReply() (byte, []byte, error) {
+	for {
+		t, payload, err := c.readFrame()
+		if err != nil || t != turnrelay.MsgBanner {
+			return t, payload, err
+		}
+		c.motd = string(payload)
+	}
+}
+
+// SNIHost returns the TLS server name from the last PortAlloc, or "" if the relay does not
+// route DCC connections by SNI. A user presenting it on the relay's SNI port reaches the
+// session without the per-session port.
+func (c *Conn) SNIHost() string { return c.sni }
+
+// Filename returns the filename the relay's approval hook substituted in the last
+// PortAlloc, or "" if the registered name stands. Offer this name to the user.
+func (c *Conn) Filename() string { return c.name }
+
+// MaxBytes returns how many bytes the last registered session may move before the relay
+// cuts it (0 = no cap).
+func (c *Conn) MaxBytes() int64 { return c.max }
+
+// Close closes the connection.
+func (c *Conn) Close() error { return c.conn.Close() }
+
+// Registration is a session registration: session ID, filename and options such as the
+// idempotency key.
+type Registration = turnrelay.Registration
+
+// RegisterDownload registers a bot-to-user session and returns the DCC port.
+func (c *Conn) RegisterDownload(ctx context.Context, sessionID, filename string) (int, error) {
+	return c.Register(ctx, true, Registration{SessionID: sessionID, Filename: filename})
+}
+
+// RegisterUpload registers a user-to-bot session and returns the DCC port.
+func (c *Conn) RegisterUpload(ctx context.Context, sessionID, filename string) (int, error) {
+	return c.Register(ctx, false, Registration{SessionID: sessionID, Filename: filename})
+}
+
+// Register registers a download (bot to user) or upload session with full registration
+// options and returns the DCC port.
+func (c *Conn) Register(ctx context.Context, download bool, reg Registration) (int, error) {
+	msgType := byte(turnrelay.MsgRegisterUpload)
+	if download {
+		msgType = turnrelay.MsgRegisterDownload
+	}
+	return c.register(ctx, msgType, reg)
+}
+
+// RegisterForward registers a forward session (data in both directions between the user's
+// DCC connection and the bot) and returns the DCC port. See Forward.
+func (c *Conn) RegisterForward(ctx context.Context, reg Registration) (int, error) {
+	return c.register(ctx, turnrelay.MsgRegisterForward, reg)
+}
+
+// Resume is a request to continue an interrupted download: session ID, offset and options.
+type Resume = turnrelay.Resume
+
+// Resume continues the download res.SessionID that ended before its user received
+// everything: the relay allocates a new session with the same ID and filename and returns
+// its DCC port, and the bot then sends the file from res.Offset on. The relay refuses with
+// ErrResumeRejected if it does not remember the download or its user received less than
+// res.Offset bytes.
+func (c *Conn) Resume(ctx context.Context, res Resume) (int, error) {
+	if len(res.SessionID) != 36 {
+		return 0, fmt.Errorf("session ID must be 36 bytes, got %d", len(res.SessionID))
+	}
+	port, err := c.allocate(ctx, turnrelay.MsgResume, res.Marshal())
+	if err == nil {
+		c.sum = c.newSessionSum(res.SessionID, res.Checksum)
+	}
+	return port, err
+}
+
+func (c *Conn) register(ctx context.Context, msgType byte, reg Registration) (int, error) {
+	if len(reg.SessionID) != 36 {
+		return 0, fmt.Errorf("session ID must be 36 bytes, got %d", len(reg.SessionID))
+	}
+	port, err := c.allocate(ctx, msgType, reg.Marshal())
+	if err == nil {
+		c.sum = c.newSessionSum(reg.SessionID, reg.Checksum)
+	}
+	return port, err
+}
+
+// allocate sends a registration frame and reads the relay's PortAlloc.
+func (c *Conn) allocate(ctx context.Context, msgType byte, payload []byte) (int, error) {
+	stop := c.closeOnDone(ctx)
+	defer stop()
+	if err := c.writeFrame(msgType, payload); err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	t, reply, err := c.readReply()
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	switch {
+	case t == turnrelay.MsgPortAlloc && len(reply) >= 4:
+		alloc, err := turnrelay.ParsePortAlloc(reply)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrProtocol, err)
+		}
+		c.addrs, c.sni = alloc.Addrs, alloc.SNIHost
+		c.name, c.max = alloc.Filename, alloc.MaxBytes
+		return alloc.Port, nil
+	case t == turnrelay.MsgError:
+		return 0, newRelayError(reply)
+	default:
+		return 0, fmt.Errorf("%w: type %d in reply to register", ErrProtocol, t)
+	}
+}
+
+// ProbeResult is the relay's answer to Probe.
+type ProbeResult = turnrelay.ProbeResult
+
+// Probe asks the relay whether a registration for size bytes (0 = unknown) for IRC user
+// user would succeed right now, without allocating anything. The connection stays usable
+// for a registration afterwards.
+func (c *Conn) Probe(ctx context.Context, size int64, user string) (ProbeResult, error) {
+	stop := c.closeOnDone(ctx)
+	defer stop()
+	if err := c.writeFrame(turnrelay.MsgProbe, turnrelay.ProbeRequest{Size: size, User: user}.Marshal()); err != nil {
+		return ProbeResult{}, ctxErr(ctx, err)
+	}
+	t, reply, err := c.readReply()
+	if err != nil {
+		return ProbeResult{}, ctxErr(ctx, err)
+	}
+	switch t {
+	case turnrelay.MsgProbeResult:
+		return turnrelay.ParseProbeResult(reply)
+	case turnrelay.MsgError:
+		return ProbeResult{}, newRelayError(reply)
+	default:
+		return ProbeResult{}, fmt.Errorf("%w: type %d in reply to probe", ErrProtocol, t)
+	}
+}
+
+// ServerInfo is the relay's build: version, commit, build date and Go version.
+type ServerInfo = turnrelay.ServerInfo
+
+// ServerInfo asks the relay which build it runs. Relays older than MsgServerInfo reply
+// with an error and close the connection.
+func (c *Conn) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	stop := c.closeOnDone(ctx)
+	defer stop()
+	if err := c.writeFrame(turnrelay.MsgServerInfo, nil); err != nil {
+		return ServerInfo{}, ctxErr(ctx, err)
+	}
+	t, reply, err := c.readReply()
+	if err != nil {
+		return ServerInfo{}, ctxErr(ctx, err)
+	}
+	switch t {
+	case turnrelay.MsgServerInfo:
+		return turnrelay.ParseServerInfo(reply), nil
+	case turnrelay.MsgError:
+		return ServerInfo{}, newRelayError(reply)
+	default:
+		return ServerInfo{}, fmt.Errorf("%w: type %d in reply to server info", ErrProtocol, t)
+	}
+}
+
+// Attach is the relay's reply to Conn.Attach: the kind and filename of the session.
+type Attach = turnrelay.Attach
+
+// Attach takes the user's side of the bot-to-bot session sessionID, which another bot
+// registered with Registration.PeerBot set to this connection's user, and returns the
+// session's kind and filename. The connection then carries that session.
+func (c *Conn) Attach(ctx context.Context, sessionID string) (Attach, error) {
+	if len(sessionID) != 36 {
+		return Attach{}, fmt.Errorf("session ID must be 36 bytes, got %d", len(sessionID))
+	}
+	stop := c.closeOnDone(ctx)
+	defer stop()
+	if err := c.writeFrame(turnrelay.MsgAttach, []byte(sessionID)); err != nil {
+		return Attach{}, ctxErr(ctx, err)
+	}
+	t, reply, err := c.readReply()
+	if err != nil {
+		return Attach{}, ctxErr(ctx, err)
+	}
+	switch t {
+	case turnrelay.MsgAttach:
+		return turnrelay.ParseAttach(reply), nil
+	case turnrelay.MsgError:
+		return Attach{}, newRelayError(reply)
+	default:
+		return Attach{}, fmt.Errorf("%w: type %d in reply to attach", ErrProtocol, t)
+	}
+}
+
+func (c *Conn) writeFrame(msgType byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return turnrelay.WriteFrame(c.conn, msgType, payload)
+}
+
+// closeOnDone closes the connection if ctx ends before stop is called.
+func (c *Conn) closeOnDone(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-quit:
+		}
+	}()
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// cancelOnDone sends MsgCancel and closes the connection if ctx ends before stop is called,
+// so the relay tears the session down instead of waiting for more data.
+func (c *Conn) cancelOnDone(ctx context.Context) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-ctx.Done():
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_ = c.writeFrame(turnrelay.MsgCancel, nil)
+			c.conn.Close()
+		case <-quit:
+		}
+	}()
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// ctxErr prefers the context's error when the context ended; closing the connection on
+// cancellation otherwise surfaces as a confusing "use of closed connection".
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// NewSessionID returns a random RFC 4122 version 4 UUID string (36 bytes), the session ID
+// format the relay expects.
+func NewSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,47 @@
+package relayclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRVService and SRVProto name the DNS SRV records relays are published under:
+// _huzaa-relay._tcp.<domain>.
+const (
+	SRVService = "huzaa-relay"
+	SRVProto   = "tcp"
+)
+
+// Discover looks up the relays published for domain via DNS SRV and returns their
+// host:port addresses in preference order (by priority, randomized by weight within a
+// priority as RFC 2782 asks).
+func Discover(ctx context.Context, domain string) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, SRVService, SRVProto, domain)
+	if err != nil {
+		return nil, fmt.Errorf("relayclient: discover %s: %w", domain, err)
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, s := range srvs {
+		if s.Target == "." {
+			continue // "service not available here"
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("relayclient: discover %s: no relays published", domain)
+	}
+	return addrs, nil
+}
+
+// DiscoverFailover returns a Failover over the relays Discover finds for domain. cfg.Addr
+// is ignored.
+func DiscoverFailover(ctx context.Context, cfg Config, domain string) (*Failover, error) {
+	addrs, err := Discover(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	return NewFailover(cfg, addrs...), nil
+}
@@ -0,0 +1,79 @@
+package relayclient
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Typed errors for relay MsgError replies. Use errors.Is on errors returned by this package.
+var (
+	ErrAuthFailed       = errors.New("relay auth failed")
+	ErrPortsExhausted   = errors.New("relay has no free DCC port")
+	ErrRelayFull        = errors.New("relay has too many bot connections")
+	ErrNotAllowedNow    = errors.New("relay schedule refuses this transfer now")
+	ErrQuotaExceeded    = errors.New("relay quota used up")
+	ErrFileTooLarge     = errors.New("relay refuses files this large")
+	ErrReadOnly         = errors.New("relay accepts downloads only")
+	ErrSlowDown         = errors.New("relay registration rate limit hit")
+	ErrDenied           = errors.New("relay approval hook denied the registration")
+	ErrShuttingDown     = errors.New("relay is shutting down")
+	ErrLeaseExpired     = errors.New("relay allocation expired before a user connected")
+	ErrResumeRejected   = errors.New("relay cannot resume the download")
+	ErrChecksumMismatch = errors.New("relay checksum does not match the data")
+	ErrBadRequest       = errors.New("relay rejected malformed request")
+	ErrProtocol         = errors.New("unexpected relay frame")
+)
+
+// RelayError is a MsgError reply from the relay. Msg is the relay's text; Unwrap returns the
+// matching typed error (nil if the message is not recognized).
+type RelayError struct {
+	Msg        string
+	RetryAfter time.Duration // how long to wait before registering again (ErrSlowDown); 0 if not given
+	kind       error
+}
+
+func (e *RelayError) Error() string { return "relay error: " + e.Msg }
+
+func (e *RelayError) Unwrap() error { return e.kind }
+
+// relayErrorKinds maps MsgError text prefixes sent by the relay to typed errors.
+var relayErrorKinds = []struct {
+	prefix string
+	kind   error
+}{
+	{"auth ", ErrAuthFailed},
+	{"no free port", ErrPortsExhausted},
+	{"relay full", ErrRelayFull},
+	{"not allowed now", ErrNotAllowedNow},
+	{"quota exceeded", ErrQuotaExceeded},
+	{"file too large", ErrFileTooLarge},
+	{"read only", ErrReadOnly},
+	{"slow down", ErrSlowDown},
+	{"registration denied", ErrDenied},
+	{"shutting down", ErrShuttingDown},
+	{"lease expired", ErrLeaseExpired},
+	{"resume rejected", ErrResumeRejected},
+	{"bad ", ErrBadRequest},
+	{"frame too large", ErrBadRequest},
+	{"unknown message type", ErrBadRequest},
+}
+
+// newRelayError wraps a MsgError payload in a RelayError.
+func newRelayError(payload []byte) error {
+	msg := string(payload)
+	e := &RelayError{Msg: msg}
+	for _, k := range relayErrorKinds {
+		if strings.HasPrefix(msg, k.prefix) {
+			e.kind = k.kind
+			break
+		}
+	}
+	if _, after, ok := strings.Cut(msg, "retry after "); ok {
+		if ms, err := strconv.Atoi(strings.TrimSuffix(after, "ms")); err == nil {
+			e.RetryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return e
+}
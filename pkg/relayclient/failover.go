@@ -0,0 +1,263 @@
+package relayclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff is a jittered exponential backoff policy.
+type Backoff struct {
+	Initial time.Duration // first delay; 500ms if 0
+	Max     time.Duration // delay cap; 30s if 0
+	Jitter  float64       // fraction of each delay randomized, 0..1; 0.5 if 0
+}
+
+// delay returns the wait before retry attempt (0-based).
+func (b Backoff) delay(attempt int) time.Duration {
+	initial, max, jitter := b.Initial, b.Max, b.Jitter
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if jitter <= 0 || jitter > 1 {
+		jitter = 0.5
+	}
+	d := initial
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// Spread retries from many bots after a relay restart.
+	return time.Duration(float64(d) * (1 - jitter*rand.Float64()))
+}
+
+// endpoint is one relay address and its observed health.
+type endpoint struct {
+	addr      string
+	failures  int
+	downUntil time.Time
+	lastErr   error
+}
+
+// Failover spreads registrations over several relays. Endpoints that fail a dial or auth
+// are marked down for a backoff period and the next one is tried; registrations that fail
+// on a connection error are retried with jittered backoff until MaxAttempts or ctx ends.
+type Failover struct {
+	Config      Config // Addr is ignored; each endpoint's address is used instead
+	Backoff     Backoff
+	MaxAttempts int // total registration attempts; 5 if 0
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+}
+
+// NewFailover returns a Failover over addrs, tried in the given order of preference.
+func NewFailover(cfg Config, addrs ...string) *Failover {
+	f := &Failover{Config: cfg}
+	for _, a := range addrs {
+		f.endpoints = append(f.endpoints, &endpoint{addr: a})
+	}
+	return f
+}
+
+// EndpointStatus is the health of one endpoint as seen by a Failover.
+type EndpointStatus struct {
+	Addr      string
+	Up        bool
+	Failures  int
+	DownUntil time.Time
+	LastError error
+}
+
+// Status reports the health of every endpoint.
+func (f *Failover) Status() []EndpointStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	out := make([]EndpointStatus, 0, len(f.endpoints))
+	for _, e := range f.endpoints {
+		out = append(out, EndpointStatus{
+			Addr:      e.addr,
+			Up:        !now.Before(e.downUntil),
+			Failures:  e.failures,
+			DownUntil: e.downUntil,
+			LastError: e.lastErr,
+		})
+	}
+	return out
+}
+
+// order returns endpoints that are up (in preference order) followed by those still marked
+// down, soonest-recovering first.
+func (f *Failover) order() []*endpoint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var up, down []*endpoint
+	for _, e := range f.endpoints {
+		if now.Before(e.downUntil) {
+			down = append(down, e)
+		} else {
+			up = append(up, e)
+		}
+	}
+	for i := 1; i < len(down); i++ {
+		for j := i; j > 0 && down[j].downUntil.Before(down[j-1].downUntil); j-- {
+			down[j], down[j-1] = down[j-1], down[j]
+		}
+	}
+	return append(up, down...)
+}
+
+func (f *Failover) markUp(e *endpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e.failures = 0
+	e.downUntil = time.Time{}
+	e.lastErr = nil
+}
+
+func (f *Failover) markDown(e *endpoint, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e.lastErr = err
+	e.downUntil = time.Now().Add(f.Backoff.delay(e.failures))
+	e.failures++
+}
+
+// Dial connects and authenticates to the first endpoint that answers.
+func (f *Failover) Dial(ctx context.Context) (*Conn, error) {
+	if len(f.endpoints) == 0 {
+		return nil, errors.New("relayclient: no relay endpoints")
+	}
+	var lastErr error
+	for _, e := range f.order() {
+		cfg := f.Config
+		cfg.Addr = e.addr
+		c, err := Dial(ctx, cfg)
+		if err == nil {
+			f.markUp(e)
+			return c, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		f.markDown(e, err)
+		lastErr = fmt.Errorf("%s: %w", e.addr, err)
+		if errors.Is(err, ErrAuthFailed) {
+			// Credentials are shared across endpoints; trying the rest will not help.
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// CheckHealth dials and authenticates to every endpoint, updating their status.
+func (f *Failover) CheckHealth(ctx context.Context) {
+	for _, e := range f.order() {
+		cfg := f.Config
+		cfg.Addr = e.addr
+		c, err := Dial(ctx, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			f.markDown(e, err)
+			continue
+		}
+		c.Close()
+		f.markUp(e)
+	}
+}
+
+// RunHealthChecks calls CheckHealth every interval until ctx ends.
+func (f *Failover) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.CheckHealth(ctx)
+		}
+	}
+}
+
+// RegisterDownload registers a bot-to-user session, failing over between endpoints and
+// retrying connection failures with backoff. The returned Conn carries the session.
+// Retries carry the session ID as idempotency key, so a registration the relay already
+// saw reuses its port instead of allocating another.
+func (f *Failover) RegisterDownload(ctx context.Context, sessionID, filename string) (*Conn, int, error) {
+	reg := Registration{SessionID: sessionID, Filename: filename, IdempotencyKey: sessionID}
+	return f.register(ctx, func(c *Conn) (int, error) { return c.Register(ctx, true, reg) })
+}
+
+// RegisterUpload registers a user-to-bot session; see RegisterDownload.
+func (f *Failover) RegisterUpload(ctx context.Context, sessionID, filename string) (*Conn, int, error) {
+	reg := Registration{SessionID: sessionID, Filename: filename, IdempotencyKey: sessionID}
+	return f.register(ctx, func(c *Conn) (int, error) { return c.Register(ctx, false, reg) })
+}
+
+func (f *Failover) register(ctx context.Context, reg func(*Conn) (int, error)) (*Conn, int, error) {
+	attempts := f.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := f.Backoff.delay(attempt - 1)
+			var re *RelayError
+			if errors.As(lastErr, &re) && re.RetryAfter > wait {
+				wait = re.RetryAfter
+			}
+			select {
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		c, err := f.Dial(ctx)
+		if err != nil {
+			if !retryable(ctx, err) {
+				return nil, 0, err
+			}
+			lastErr = err
+			continue
+		}
+		port, err := reg(c)
+		if err == nil {
+			return c, port, nil
+		}
+		c.Close()
+		if !retryable(ctx, err) {
+			return nil, 0, err
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("relayclient: giving up after %d attempts: %w", attempts, lastErr)
+}
+
+// retryable reports whether a registration error may succeed on another attempt: network
+// failures, a full port pool, a full or shutting down relay and a registration rate limit
+// (retried no sooner than its retry-after hint) are, auth and request errors are not.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var re *RelayError
+	if errors.As(err, &re) {
+		return errors.Is(err, ErrPortsExhausted) || errors.Is(err, ErrRelayFull) || errors.Is(err, ErrShuttingDown) ||
+			errors.Is(err, ErrSlowDown)
+	}
+	return !errors.Is(err, ErrProtocol)
+}
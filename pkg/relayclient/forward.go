@@ -0,0 +1,82 @@
+package relayclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// Forward registers a forward session and bridges the user's DCC connection to local (for
+// example a connection to a local TCP service) until both directions have ended: bytes read
+// from local go to the user, bytes from the user are written to local. When the user stops
+// sending, local is half-closed if it has a CloseWrite method. Forward uses opts.Config;
+// Failover and Client are not supported. If ctx is canceled the relay is sent MsgCancel and
+// ctx.Err() is returned.
+func Forward(ctx context.Context, local io.ReadWriter, opts Options) error {
+	sessionID, err := opts.sessionID()
+	if err != nil {
+		return err
+	}
+	c, err := Dial(ctx, opts.Config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	port, err := c.RegisterForward(ctx, Registration{SessionID: sessionID, Filename: opts.Filename})
+	if err != nil {
+		return err
+	}
+	if opts.OnPort != nil {
+		opts.OnPort(port)
+	}
+	stop := c.cancelOnDone(ctx)
+	defer stop()
+
+	// Local -> user.
+	sent := make(chan error, 1)
+	go func() {
+		buf := make([]byte, opts.chunkSize())
+		for {
+			n, rerr := local.Read(buf)
+			if n > 0 {
+				if err := c.writeFrame(turnrelay.MsgData, buf[:n]); err != nil {
+					sent <- err
+					return
+				}
+			}
+			if rerr == io.EOF {
+				sent <- c.writeFrame(turnrelay.MsgEOF, nil)
+				return
+			}
+			if rerr != nil {
+				sent <- rerr
+				return
+			}
+		}
+	}()
+
+	// User -> local.
+	for {
+		msgType, payload, err := c.readFrame()
+		if err != nil {
+			return ctxErr(ctx, err)
+		}
+		switch msgType {
+		case turnrelay.MsgData:
+			if _, err := local.Write(payload); err != nil {
+				return err
+			}
+		case turnrelay.MsgEOF:
+			if hc, ok := local.(interface{ CloseWrite() error }); ok {
+				hc.CloseWrite()
+			}
+			return ctxErr(ctx, <-sent)
+		case turnrelay.MsgError:
+			return newRelayError(payload)
+		default:
+			return fmt.Errorf("%w: type %d during forward", ErrProtocol, msgType)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package relayclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrQueueFull is returned when a registration would wait for a connection while the
+// relay is unreachable and ClientOptions.QueueLimit registrations are already waiting.
+var ErrQueueFull = errors.New("relayclient: registration queue full while disconnected")
+
+// ErrClientClosed is returned by a Client after Close.
+var ErrClientClosed = errors.New("relayclient: client closed")
+
+// ClientOptions configures a managed Client.
+type ClientOptions struct {
+	Config                   // single relay; ignored if Failover is set
+	Failover   *Failover     // optional multi-relay dialing
+	PoolSize   int           // authenticated idle connections kept ready; 1 if 0
+	MaxIdle    time.Duration // idle connections older than this are replaced; 60s if 0
+	QueueLimit int           // registrations allowed to wait while disconnected; 16 if 0
+	Backoff    Backoff       // reconnect backoff
+}
+
+// pooledConn is an authenticated connection waiting to carry a session.
+type pooledConn struct {
+	c       *Conn
+	created time.Time
+}
+
+// Client keeps authenticated connections to the relay ready so registrations skip the
+// TLS and auth round trips, re-dials and re-authenticates in the background after the
+// relay goes away, and queues registrations issued while disconnected (up to QueueLimit)
+// until a connection is back.
+type Client struct {
+	opts    ClientOptions
+	warm    chan pooledConn
+	refill  chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	up      int32 // atomic; 1 while the last dial succeeded
+	waiting int32 // atomic; registrations blocked waiting for a connection
+}
+
+// NewClient starts a managed client; call Close to stop it.
+func NewClient(opts ClientOptions) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 1
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 60 * time.Second
+	}
+	if opts.QueueLimit <= 0 {
+		opts.QueueLimit = 16
+	}
+	c := &Client{
+		opts:   opts,
+		warm:   make(chan pooledConn, opts.PoolSize),
+		refill: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.maintain()
+	return c
+}
+
+// Connected reports whether the client currently reaches the relay.
+func (c *Client) Connected() bool { return atomic.LoadInt32(&c.up) == 1 }
+
+// Close stops background dialing and closes idle connections. Sessions already handed out
+// are not affected.
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.wg.Wait()
+		for {
+			select {
+			case pc := <-c.warm:
+				pc.c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (c *Client) dial(ctx context.Context) (*Conn, error) {
+	if c.opts.Failover != nil {
+		return c.opts.Failover.Dial(ctx)
+	}
+	return Dial(ctx, c.opts.Config)
+}
+
+// maintain keeps the warm pool full, reconnecting with backoff while the relay is down.
+func (c *Client) maintain() {
+	defer c.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.closed
+		cancel()
+	}()
+	attempt := 0
+	tick := time.NewTicker(c.opts.MaxIdle / 2)
+	defer tick.Stop()
+	for {
+		if len(c.warm) < cap(c.warm) {
+			conn, err := c.dial(ctx)
+			if err != nil {
+				atomic.StoreInt32(&c.up, 0)
+				select {
+				case <-c.closed:
+					return
+				case <-time.After(c.opts.Backoff.delay(attempt)):
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			atomic.StoreInt32(&c.up, 1)
+			select {
+			case c.warm <- pooledConn{c: conn, created: time.Now()}:
+			default:
+				conn.Close()
+			}
+			continue
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-c.refill:
+		case <-tick.C:
+			c.recycleStale()
+		}
+	}
+}
+
+// recycleStale closes idle connections older than MaxIdle so the pool is refilled with
+// fresh ones before NATs or the relay drop them.
+func (c *Client) recycleStale() {
+	for i := len(c.warm); i > 0; i-- {
+		select {
+		case pc := <-c.warm:
+			if time.Since(pc.created) > c.opts.MaxIdle {
+				pc.c.Close()
+				continue
+			}
+			select {
+			case c.warm <- pc:
+			default:
+				pc.c.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// get takes an authenticated connection, waiting (queued) while disconnected.
+func (c *Client) get(ctx context.Context) (*Conn, error) {
+	defer c.wake()
+	for {
+		select {
+		case pc := <-c.warm:
+			if time.Since(pc.created) > c.opts.MaxIdle {
+				pc.c.Close()
+				c.wake()
+				continue
+			}
+			return pc.c, nil
+		default:
+		}
+		if !c.Connected() && atomic.LoadInt32(&c.waiting) >= int32(c.opts.QueueLimit) {
+			return nil, ErrQueueFull
+		}
+		atomic.AddInt32(&c.waiting, 1)
+		select {
+		case pc := <-c.warm:
+			atomic.AddInt32(&c.waiting, -1)
+			if time.Since(pc.created) > c.opts.MaxIdle {
+				pc.c.Close()
+				c.wake()
+				continue
+			}
+			return pc.c, nil
+		case <-ctx.Done():
+			atomic.AddInt32(&c.waiting, -1)
+			return nil, ctx.Err()
+		case <-c.closed:
+			atomic.AddInt32(&c.waiting, -1)
+			return nil, ErrClientClosed
+		}
+	}
+}
+
+func (c *Client) wake() {
+	select {
+	case c.refill <- struct{}{}:
+	default:
+	}
+}
+
+// RegisterDownload registers a bot-to-user session on a ready connection and returns it
+// with the allocated DCC port. The Conn belongs to the session; close it when done. The
+// session ID is sent as idempotency key so the internal retry cannot allocate twice.
+func (c *Client) RegisterDownload(ctx context.Context, sessionID, filename string) (*Conn, int, error) {
+	reg := Registration{SessionID: sessionID, Filename: filename, IdempotencyKey: sessionID}
+	return c.register(ctx, func(conn *Conn) (int, error) { return conn.Register(ctx, true, reg) })
+}
+
+// RegisterUpload registers a user-to-bot session; see RegisterDownload.
+func (c *Client) RegisterUpload(ctx context.Context, sessionID, filename string) (*Conn, int, error) {
+	reg := Registration{SessionID: sessionID, Filename: filename, IdempotencyKey: sessionID}
+	return c.register(ctx, func(conn *Conn) (int, error) { return conn.Register(ctx, false, reg) })
+}
+
+func (c *Client) register(ctx context.Context, reg func(*Conn) (int, error)) (*Conn, int, error) {
+	// An idle connection may have died since it was pooled; one retry on a fresh
+	// connection covers that without hiding real relay errors.
+	var lastErr error
+	for try := 0; try < 2; try++ {
+		conn, err := c.get(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		port, err := reg(conn)
+		if err == nil {
+			return conn, port, nil
+		}
+		conn.Close()
+		if !retryable(ctx, err) {
+			return nil, 0, err
+		}
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
@@ -0,0 +1,54 @@
+package relayclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ReceiveFromBot attaches to the bot-to-bot download session opts.SessionID, which another
+// bot registered with Send and Options.PeerBot naming this bot user, and copies the data it
+// sends into w until MsgEOF. It uses opts.Config; Failover and Client are not supported.
+// If ctx is canceled the relay is sent MsgCancel and ctx.Err() is returned.
+func ReceiveFromBot(ctx context.Context, w io.Writer, opts Options) (int64, error) {
+	c, err := opts.attach(ctx, "download")
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return c.receive(ctx, w, opts, "download")
+}
+
+// SendToBot attaches to the bot-to-bot upload session opts.SessionID, which another bot
+// registered with ReceiveFile and Options.PeerBot naming this bot user, and streams r to
+// it; size is the total for progress (-1 if unknown). See ReceiveFromBot.
+func SendToBot(ctx context.Context, r io.Reader, size int64, opts Options) error {
+	c, err := opts.attach(ctx, "upload")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.send(ctx, r, size, opts)
+}
+
+// attach dials and attaches to opts.SessionID, which must be a session of the given kind.
+func (o *Options) attach(ctx context.Context, kind string) (*Conn, error) {
+	if o.SessionID == "" {
+		return nil, errors.New("attaching needs the session ID the other bot registered")
+	}
+	c, err := Dial(ctx, o.Config)
+	if err != nil {
+		return nil, err
+	}
+	a, err := c.Attach(ctx, o.SessionID)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if a.Kind != kind {
+		c.Close()
+		return nil, fmt.Errorf("session %s is a %s session, not %s", o.SessionID, a.Kind, kind)
+	}
+	return c, nil
+}
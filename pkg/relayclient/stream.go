@@ -0,0 +1,352 @@
+package relayclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/awgh/huzaa-relay/internal/turnrelay"
+)
+
+// DefaultChunkSize is the MsgData payload size used when Options.ChunkSize is 0.
+const DefaultChunkSize = 32 * 1024
+
+// Options configures SendFile and ReceiveFile.
+type Options struct {
+	Config
+	// Failover, if set, is used instead of Config to pick a relay and register, retrying
+	// connection failures across its endpoints.
+	Failover *Failover
+	// Client, if set, takes precedence over Failover and Config: registrations use its
+	// ready connections and queue while it reconnects.
+	Client    *Client
+	SessionID string // 36-byte session ID; generated if empty
+	Filename  string // advertised filename; SendFile defaults to the base name of path
+	ChunkSize int    // MsgData payload size; DefaultChunkSize if 0
+	// OnPort is called with the allocated DCC port once the session is registered, before
+	// any data moves; the bot uses it to send the DCC offer to the IRC user.
+	OnPort func(port int)
+	// Progress, if set, is called after every chunk with bytes moved so far and the total
+	// (-1 when unknown).
+	Progress func(done, total int64)
+	// OnStats, if set, makes Send and ReceiveFile wait for the relay's summary of the
+	// session (MsgStats) after the transfer and pass it on. For Send that means waiting
+	// until the user has received everything. It is not called if the summary never comes.
+	OnStats func(SessionStats)
+	// PeerBot, if set, makes Send and ReceiveFile register a bot-to-bot session: instead of
+	// a DCC user, bot user PeerBot attaches to it with ReceiveFromBot or SendToBot. No DCC
+	// port is allocated, so OnPort gets 0; share SessionID with the other bot instead.
+	PeerBot string
+	// Fanout, if above 1, makes Send stream to up to that many DCC users who connect to
+	// the same port (or server name) within the relay's fan-out wait, reading the source
+	// once. The relay must allow it (max_fanout).
+	Fanout int
+	// ResumeFrom, if above 0, makes Send continue the interrupted download SessionID from
+	// that offset (MsgResume) instead of registering a new session. SendFile starts reading
+	// the file there; Send expects r to be positioned there. See Conn.Resume.
+	ResumeFrom int64
+	// Checksum, if set, makes Send and ReceiveFile exchange a SHA-256 checksum of the data
+	// with the relay after MsgEOF (MsgChecksum). If the relay received or sent different
+	// data, they return ErrChecksumMismatch.
+	Checksum bool
+	// Size, if above 0, is the file size declared to the relay (option "size"). The relay
+	// refuses files over its max_file_size with ErrFileTooLarge and cuts the session if more
+	// is sent. Send declares the size it is given; for ReceiveFile take it from the user's
+	// DCC offer.
+	Size int64
+}
+
+// SessionStats is the relay's summary of a finished session.
+type SessionStats = turnrelay.SessionStats
+
+func (o *Options) chunkSize() int {
+	if o.ChunkSize > 0 {
+		return o.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+func (o *Options) sessionID() (string, error) {
+	if o.SessionID != "" {
+		return o.SessionID, nil
+	}
+	return NewSessionID()
+}
+
+// register dials and registers a download (bot to user) or upload session, or resumes a
+// download (ResumeFrom).
+func (o *Options) register(ctx context.Context, download bool, sessionID string) (*Conn, int, error) {
+	reg := Registration{SessionID: sessionID, Filename: o.Filename, PeerBot: o.PeerBot, Size: o.Size}
+	if download {
+		reg.Fanout = o.Fanout
+	}
+	if o.Checksum {
+		reg.Checksum = turnrelay.ChecksumSHA256
+	}
+	if o.Client != nil || o.Failover != nil {
+		// As in Client.RegisterDownload, retries carry the session ID as idempotency key.
+		reg.IdempotencyKey = sessionID
+	}
+	do := func(c *Conn) (int, error) { return c.Register(ctx, download, reg) }
+	if download && o.ResumeFrom > 0 {
+		do = func(c *Conn) (int, error) {
+			return c.Resume(ctx, Resume{SessionID: sessionID, Offset: o.ResumeFrom, Checksum: reg.Checksum})
+		}
+	}
+	if o.Client != nil {
+		return o.Client.register(ctx, do)
+	}
+	if o.Failover != nil {
+		return o.Failover.register(ctx, do)
+	}
+	c, err := Dial(ctx, o.Config)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := do(c)
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+	return c, port, nil
+}
+
+// SendFile registers a download session (bot to user) and streams the file at path to the
+// relay. If ctx is canceled the relay is sent MsgCancel and ctx.Err() is returned.
+func SendFile(ctx context.Context, path string, opts Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if opts.Filename == "" {
+		opts.Filename = filepath.Base(path)
+	}
+	if _, err := f.Seek(opts.ResumeFrom, io.SeekStart); err != nil {
+		return err
+	}
+	return Send(ctx, f, st.Size()-opts.ResumeFrom, opts)
+}
+
+// Send is SendFile for an arbitrary reader; size is the total for progress (-1 if unknown).
+func Send(ctx context.Context, r io.Reader, size int64, opts Options) error {
+	sessionID, err := opts.sessionID()
+	if err != nil {
+		return err
+	}
+	if opts.Size == 0 && size > 0 {
+		opts.Size = opts.ResumeFrom + size
+	}
+	c, port, err := opts.register(ctx, true, sessionID)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if opts.OnPort != nil {
+		opts.OnPort(port)
+	}
+	return c.send(ctx, r, size, opts)
+}
+
+// send streams r as MsgData frames followed by MsgEOF on a registered or attached session.
+// Meanwhile the relay's frames are read by watchRelay, so keepalives are answered even
+// while r is slow. If a write fails after the relay sent MsgError (e.g. the lease expired
+// before a user connected), that error is returned.
+func (c *Conn) send(ctx context.Context, r io.Reader, size int64, opts Options) error {
+	stop := c.cancelOnDone(ctx)
+	defer stop()
+	w := c.watchRelay()
+	buf := make([]byte, opts.chunkSize())
+	var done int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if err := c.writeFrame(turnrelay.MsgData, buf[:n]); err != nil {
+				return w.writeFailed(ctx, err)
+			}
+			c.sum.write(buf[:n])
+			done += int64(n)
+			if opts.Progress != nil {
+				opts.Progress(done, size)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if err := c.writeFrame(turnrelay.MsgEOF, nil); err != nil {
+		return w.writeFailed(ctx, err)
+	}
+	if c.sum != nil {
+		if err := c.writeFrame(turnrelay.MsgChecksum, c.sum.message()); err != nil {
+			return w.writeFailed(ctx, err)
+		}
+		select {
+		case <-w.checksum:
+		case <-w.done:
+			if w.err != nil {
+				return w.err
+			}
+			return fmt.Errorf("%w: no checksum from the relay", ErrProtocol)
+		}
+		if err := c.sum.verify(w.sum); err != nil {
+			return err
+		}
+	}
+	if opts.OnStats != nil {
+		// The data is sent, so a connection error only means no summary; a MsgError means
+		// the session failed after all.
+		<-w.done
+		if w.stats != nil {
+			if st, err := turnrelay.ParseSessionStats(w.stats); err == nil {
+				opts.OnStats(st)
+			}
+		}
+		return w.err
+	}
+	return nil
+}
+
+// relayWatch reads the relay's frames in the background while send only writes, which
+// answers MsgPing (see readFrame). It stops when MsgStats arrives or the connection fails.
+type relayWatch struct {
+	done     chan struct{} // closed when reading stopped
+	checksum chan struct{} // closed when the relay's MsgChecksum arrived
+	sum      []byte        // MsgChecksum payload; read after checksum is closed
+	stats    []byte        // MsgStats payload, if it arrived; read after done
+	err      error         // the relay's MsgError, if it sent one; read after done
+}
+
+func (c *Conn) watchRelay() *relayWatch {
+	w := &relayWatch{done: make(chan struct{}), checksum: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			msgType, payload, err := c.readFrame()
+			switch {
+			case err != nil:
+				return
+			case msgType == turnrelay.MsgStats:
+				w.stats = payload
+				return
+			case msgType == turnrelay.MsgChecksum && w.sum == nil:
+				w.sum = payload
+				close(w.checksum)
+			case msgType == turnrelay.MsgError && w.err == nil:
+				w.err = newRelayError(payload)
+			}
+		}
+	}()
+	return w
+}
+
+// writeFailed returns the error for a failed write: the relay's MsgError if it explained
+// why the session ended, else ctxErr. The connection is dead, so reading stops soon.
+func (w *relayWatch) writeFailed(ctx context.Context, err error) error {
+	<-w.done
+	if w.err != nil && ctx.Err() == nil {
+		return w.err
+	}
+	return ctxErr(ctx, err)
+}
+
+// awaitChecksum reads the relay's MsgChecksum that follows MsgEOF and verifies it.
+func (c *Conn) awaitChecksum() error {
+	msgType, payload, err := c.readFrame()
+	switch {
+	case err != nil:
+		return err
+	case msgType == turnrelay.MsgChecksum:
+		return c.sum.verify(payload)
+	case msgType == turnrelay.MsgError:
+		return newRelayError(payload)
+	default:
+		return fmt.Errorf("%w: type %d instead of checksum", ErrProtocol, msgType)
+	}
+}
+
+// awaitStats reads until the relay's MsgStats and passes it to fn (if fn is non-nil). The
+// transfer is already complete, so a connection error only means no summary.
+func (c *Conn) awaitStats(fn func(SessionStats)) {
+	if fn == nil {
+		return
+	}
+	for {
+		msgType, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		if msgType == turnrelay.MsgStats {
+			if st, err := turnrelay.ParseSessionStats(payload); err == nil {
+				fn(st)
+			}
+			return
+		}
+	}
+}
+
+// ReceiveFile registers an upload session (user to bot) and copies the data the user sends
+// into w until the relay sends MsgEOF. If ctx is canceled the relay is sent MsgCancel and
+// ctx.Err() is returned.
+func ReceiveFile(ctx context.Context, w io.Writer, opts Options) (int64, error) {
+	sessionID, err := opts.sessionID()
+	if err != nil {
+		return 0, err
+	}
+	c, port, err := opts.register(ctx, false, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if opts.OnPort != nil {
+		opts.OnPort(port)
+	}
+	return c.receive(ctx, w, opts, "upload")
+}
+
+// receive copies MsgData frames into w until MsgEOF on a registered or attached session;
+// what names the session kind in protocol errors.
+func (c *Conn) receive(ctx context.Context, w io.Writer, opts Options, what string) (int64, error) {
+	stop := c.cancelOnDone(ctx)
+	defer stop()
+	var done int64
+	for {
+		msgType, payload, err := c.readFrame()
+		if err != nil {
+			return done, ctxErr(ctx, err)
+		}
+		switch msgType {
+		case turnrelay.MsgData:
+			n, err := w.Write(payload)
+			c.sum.write(payload[:n])
+			done += int64(n)
+			if err != nil {
+				return done, err
+			}
+			if opts.Progress != nil {
+				opts.Progress(done, -1)
+			}
+		case turnrelay.MsgEOF:
+			if c.sum != nil {
+				if err := c.awaitChecksum(); err != nil {
+					return done, ctxErr(ctx, err)
+				}
+			}
+			c.awaitStats(opts.OnStats)
+			return done, nil
+		case turnrelay.MsgError:
+			return done, newRelayError(payload)
+		default:
+			return done, fmt.Errorf("%w: type %d during %s", ErrProtocol, msgType, what)
+		}
+	}
+}